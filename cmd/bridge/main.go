@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"shadow/pkg/bridge"
+	"shadow/pkg/bridge/webhook"
+	"shadow/pkg/shadow"
+)
+
+func main() {
+	name := flag.String("name", "bridge", "Identity name")
+	relayAddrStr := flag.String("relay", "", "Comma-separated multiaddrs of relays")
+	listen := flag.String("listen", "127.0.0.1:8088", "Address to accept webhook messages on")
+	url := flag.String("webhook", "http://127.0.0.1:8089/", "URL to post outgoing messages to")
+	secret := flag.String("secret", "", "Shared secret for both webhook directions")
+	rooms := flag.String("rooms", "", "Comma-separated channel=room mappings; a bare name maps to a room of the same name")
+	flag.Parse()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	var opts []bridge.Option
+	for _, m := range strings.Split(*rooms, ",") {
+		if m == "" {
+			continue
+		}
+		channel, room, ok := strings.Cut(m, "=")
+		if !ok {
+			room = channel
+		}
+		opts = append(opts, bridge.WithRoom(channel, room))
+	}
+
+	cfg := shadow.Config{Name: *name, DataDir: "data/" + *name}
+	if *relayAddrStr != "" {
+		cfg.Relays = strings.Split(*relayAddrStr, ",")
+	}
+	client, err := shadow.Start(ctx, cfg)
+	if err != nil {
+		panic(err)
+	}
+	defer client.Close()
+	fmt.Printf("Bridge running as %s@%s (%s), webhooks in on %s, out to %s\n",
+		client.Name(), client.Zbase32(), client.ID(), *listen, *url)
+
+	adapter := webhook.New(webhook.Config{Listen: *listen, URL: *url, Secret: *secret})
+	if err := bridge.New(client, adapter, opts...).Run(ctx); err != nil && ctx.Err() == nil {
+		fmt.Println("Bridge stopped:", err)
+	}
+}
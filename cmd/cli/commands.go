@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"shadow/internal/chat"
+	"shadow/internal/daemon"
+	"shadow/internal/logging"
+)
+
+// Exit codes of the subcommands.
+const (
+	exitOK          = 0
+	exitError       = 1 // the operation failed
+	exitUsage       = 2 // bad flags or arguments
+	exitUnavailable = 3 // no daemon and no node could be started, or the daemon went away
+	exitNotFound    = 4 // the peer could not be resolved
+	exitTimeout     = 5
+)
+
+// readyTimeout bounds how long a command waits for a node it started itself
+// to get connected before going ahead anyway.
+const readyTimeout = 20 * time.Second
+
+// command runs a subcommand against a daemon and returns the exit code.
+type command struct {
+	usage string
+	run   func(ctx context.Context, c *daemon.Client, args []string) int
+	// needsNetwork commands wait for a node started by the command to connect.
+	needsNetwork bool
+}
+
+var commands map[string]command
+
+func init() {
+	// Set here: the commands print their own usage from this table
+	commands = map[string]command{
+		"send":   {usage: "send (--to <peer> | --room <room>) [--json] [text...]", run: cmdSend, needsNetwork: true},
+		"listen": {usage: "listen [--json] [--room <room>,...] [--count n] [--timeout d]", run: cmdListen},
+		"whois":  {usage: "whois [--json] <peer>", run: cmdWhois, needsNetwork: true},
+		"peers":  {usage: "peers [--json] [--discover]", run: cmdPeers, needsNetwork: true},
+		"status": {usage: "status [--json]", run: cmdStatus},
+	}
+}
+
+// stdout is the real standard output. Commands print their results there
+// and everything else goes to stderr, so output can be piped.
+var stdout io.Writer = os.Stdout
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] [command [command flags] [args]]\n\n", os.Args[0])
+	fmt.Fprintln(out, "Without a command it starts the interactive prompt. Commands:")
+	for _, name := range []string{"send", "listen", "whois", "peers", "status"} {
+		fmt.Fprintln(out, "  "+commands[name].usage)
+	}
+	fmt.Fprintln(out, "\n<peer> is a peer ID, z:<zbase32> or @contact. With no text, send reads stdin.")
+	fmt.Fprintln(out, "Commands use a running daemon for the identity if there is one, otherwise they start a node.")
+	fmt.Fprintln(out, "Exit codes: 0 ok, 1 failed, 2 usage, 3 daemon unavailable, 4 peer not found, 5 timeout.")
+	fmt.Fprintln(out, "\nFlags:")
+	flag.PrintDefaults()
+}
+
+// runCommand runs the subcommand in args and returns the exit code.
+func runCommand(cfg daemonConfig, connect string, args []string) int {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "Unknown command:", args[0])
+		flag.Usage()
+		return exitUsage
+	}
+	// Keep the output of a node started for the command out of its results
+	logging.SetOutput(os.Stderr)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	client, wait, err := dialDaemon(ctx, cfg, connect)
+	if wait != nil {
+		// Runs after cancel below, once the command is done
+		defer wait()
+	}
+	defer cancel()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Daemon unavailable:", err)
+		return exitUnavailable
+	}
+	defer client.Close()
+	if wait != nil && cmd.needsNetwork {
+		waitReady(ctx, client)
+	}
+	return cmd.run(ctx, client, args[1:])
+}
+
+// waitReady waits until a freshly started node has peers or a relay reservation.
+func waitReady(ctx context.Context, c *daemon.Client) {
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+	for {
+		st, err := c.Status(ctx)
+		if err != nil {
+			return
+		}
+		if st.Reserved > 0 || st.Peers > 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
+
+// exitCode maps an error from the daemon to an exit code.
+func exitCode(err error) int {
+	var rpcErr *daemon.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return exitTimeout
+	case errors.As(err, &rpcErr) && rpcErr.Code == daemon.CodeNotFound:
+		return exitNotFound
+	case errors.As(err, &rpcErr) && rpcErr.Code == daemon.CodeInvalidParams:
+		return exitUsage
+	}
+	return exitError
+}
+
+func fail(what string, err error) int {
+	fmt.Fprintln(os.Stderr, what+":", err)
+	return exitCode(err)
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:", commands[name].usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func printJSON(v any) {
+	json.NewEncoder(stdout).Encode(v)
+}
+
+func cmdSend(ctx context.Context, c *daemon.Client, args []string) int {
+	fs := newFlagSet("send")
+	to := fs.String("to", "", "Peer to message: peer ID, z:<zbase32> or @contact")
+	room := fs.String("room", "", "Room to post to (joined if needed)")
+	asJSON := fs.Bool("json", false, "Print the sent message as JSON")
+	if fs.Parse(args) != nil {
+		return exitUsage
+	}
+	if (*to == "") == (*room == "") {
+		fmt.Fprintln(os.Stderr, "Exactly one of --to and --room is required")
+		return exitUsage
+	}
+	text := strings.Join(fs.Args(), " ")
+	if fs.NArg() == 0 {
+		data, err := io.ReadAll(io.LimitReader(os.Stdin, chat.MaxMessageSize+1))
+		if err != nil {
+			return fail("Failed to read stdin", err)
+		}
+		text = strings.TrimRight(string(data), "\n")
+	}
+	if text == "" {
+		fmt.Fprintln(os.Stderr, "Nothing to send")
+		return exitUsage
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, callTimeout)
+	defer cancel()
+	var m chat.Message
+	var err error
+	if *room != "" {
+		if err := c.Join(ctx, *room); err != nil {
+			return fail("Failed to join room", err)
+		}
+		m, err = c.SendRoom(ctx, *room, text)
+	} else {
+		m, err = c.Send(ctx, *to, text)
+	}
+	if err != nil {
+		return fail("Failed to send message", err)
+	}
+	if *asJSON {
+		printJSON(m)
+	}
+	return exitOK
+}
+
+func cmdListen(ctx context.Context, c *daemon.Client, args []string) int {
+	fs := newFlagSet("listen")
+	asJSON := fs.Bool("json", false, "Print one JSON message per line")
+	rooms := fs.String("room", "", "Comma-separated rooms to join and listen to")
+	count := fs.Int("count", 0, "Exit after this many messages (0: no limit)")
+	timeout := fs.Duration("timeout", 0, "Exit after this long (0: no limit)")
+	if fs.Parse(args) != nil || fs.NArg() > 0 {
+		return exitUsage
+	}
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	for _, room := range strings.Split(*rooms, ",") {
+		if room == "" {
+			continue
+		}
+		if err := c.Join(ctx, room); err != nil {
+			return fail("Failed to join room", err)
+		}
+	}
+	if err := c.Subscribe(ctx); err != nil {
+		return fail("Failed to subscribe", err)
+	}
+
+	seen := 0
+	for {
+		select {
+		case <-ctx.Done():
+			// Interrupted or --timeout: a normal end of listening
+			return exitOK
+		case note, ok := <-c.Notifications():
+			if !ok {
+				fmt.Fprintln(os.Stderr, "Lost connection to daemon")
+				return exitUnavailable
+			}
+			if note.Method != daemon.NotifyMessage {
+				continue
+			}
+			var m chat.Message
+			if json.Unmarshal(note.Params, &m) != nil {
+				continue
+			}
+			if *asJSON {
+				printJSON(m)
+			} else if m.Room != "" {
+				fmt.Fprintf(stdout, "[#%s] %s: %s\n", m.Room, m.Sender(), m.Text)
+			} else {
+				fmt.Fprintf(stdout, "[from %s] %s\n", m.Sender(), m.Text)
+			}
+			seen++
+			if *count > 0 && seen >= *count {
+				return exitOK
+			}
+		}
+	}
+}
+
+func cmdWhois(ctx context.Context, c *daemon.Client, args []string) int {
+	fs := newFlagSet("whois")
+	asJSON := fs.Bool("json", false, "Print as JSON")
+	if fs.Parse(args) != nil || fs.NArg() != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+	ctx, cancel := context.WithTimeout(ctx, callTimeout)
+	defer cancel()
+	p, err := c.Whois(ctx, fs.Arg(0))
+	if err != nil {
+		return fail("Failed to look up peer", err)
+	}
+	if *asJSON {
+		printJSON(p)
+		return exitOK
+	}
+	name := p.Name
+	if name == "" {
+		name = "(unknown)"
+	}
+	fmt.Fprintln(stdout, "Name:      ", name)
+	fmt.Fprintln(stdout, "Peer ID:   ", p.ID)
+	fmt.Fprintln(stdout, "Zbase32:   ", p.Zbase32)
+	fmt.Fprintln(stdout, "Connection:", p.ConnType)
+	fmt.Fprintln(stdout, "Contact:   ", p.Contact)
+	for _, a := range p.Addrs {
+		fmt.Fprintln(stdout, "Address:   ", a)
+	}
+	return exitOK
+}
+
+func cmdPeers(ctx context.Context, c *daemon.Client, args []string) int {
+	fs := newFlagSet("peers")
+	asJSON := fs.Bool("json", false, "Print as JSON")
+	discover := fs.Bool("discover", false, "List peers at the rendezvous point instead of connected peers")
+	if fs.Parse(args) != nil || fs.NArg() > 0 {
+		return exitUsage
+	}
+	ctx, cancel := context.WithTimeout(ctx, callTimeout)
+	defer cancel()
+	var peers []daemon.Peer
+	var err error
+	if *discover {
+		peers, err = c.Discover(ctx)
+	} else {
+		peers, err = c.Peers(ctx)
+	}
+	if err != nil {
+		return fail("Failed to list peers", err)
+	}
+	if *asJSON {
+		printJSON(peers)
+		return exitOK
+	}
+	for _, p := range peers {
+		fmt.Fprintf(stdout, "%s\t%s\t%s\t%s\n", p.ID, p.Zbase32, p.ConnType, p.Name)
+	}
+	return exitOK
+}
+
+func cmdStatus(ctx context.Context, c *daemon.Client, args []string) int {
+	fs := newFlagSet("status")
+	asJSON := fs.Bool("json", false, "Print as JSON")
+	if fs.Parse(args) != nil || fs.NArg() > 0 {
+		return exitUsage
+	}
+	ctx, cancel := context.WithTimeout(ctx, callTimeout)
+	defer cancel()
+	st, err := c.Status(ctx)
+	if err != nil {
+		return fail("Failed to get status", err)
+	}
+	if *asJSON {
+		printJSON(st)
+	} else {
+		fmt.Fprintln(stdout, st)
+	}
+	return exitOK
+}
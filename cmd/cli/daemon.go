@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+
+	"shadow/internal/chat"
+	"shadow/internal/daemon"
+	"shadow/internal/identity"
+	"shadow/internal/logging"
+	"shadow/internal/node"
+	"shadow/internal/onion"
+	"shadow/internal/relay"
+	"shadow/internal/utils"
+)
+
+type daemonConfig struct {
+	name       string
+	dataDir    string
+	relays     string
+	relayCount int
+	invite     string
+	connsLow   int
+	connsHigh  int
+	ws         string
+	sealed     bool
+	onionDir   string
+	cover      chat.Cover
+}
+
+// dialDaemon connects to the daemon at addr, or at the identity's socket if
+// addr is empty. If no daemon runs on the identity's socket, it starts one in
+// this process and returns a function that waits for it to shut down once
+// ctx is done; wait is nil when a running daemon is used.
+func dialDaemon(ctx context.Context, cfg daemonConfig, addr string) (client *daemon.Client, wait func(), err error) {
+	explicit := addr != ""
+	if !explicit {
+		addr = daemon.SocketPath(cfg.dataDir)
+	}
+	token, _ := daemon.LoadToken(cfg.dataDir)
+	client, err = daemon.Dial(ctx, addr, token)
+	noDaemon := errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED)
+	if !noDaemon || explicit {
+		return client, nil, err
+	}
+	wait, err = startDaemon(ctx, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	token, _ = daemon.LoadToken(cfg.dataDir)
+	client, err = daemon.Dial(ctx, addr, token)
+	return client, wait, err
+}
+
+// startDaemon starts the node, messaging and the API on the identity's
+// socket (and WebSocket, if configured). Everything stops when ctx is done;
+// the returned function waits for the node to shut down.
+func startDaemon(ctx context.Context, cfg daemonConfig) (func(), error) {
+	if cfg.ws != "" {
+		if err := daemon.CheckLoopback(cfg.ws); err != nil {
+			return nil, fmt.Errorf("invalid WebSocket address: %w", err)
+		}
+	}
+	id, err := identity.LoadOrCreate(cfg.dataDir, cfg.name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Generate identicon for self
+	pubBytes, _ := id.PublicKey().Raw()
+	iconPath := fmt.Sprintf("data/%s_identicon.png", cfg.name)
+	if err := utils.GenerateIdenticon(pubBytes, iconPath); err == nil {
+		logging.Println("Generated identicon at:", iconPath)
+	} else {
+		logging.Println("Failed to generate identicon:", err)
+	}
+
+	// If relay addresses are not provided, try to load them from relay.addr file
+	var relayAddrs []string
+	if cfg.relays != "" {
+		relayAddrs = strings.Split(cfg.relays, ",")
+	} else if addrs, err := relay.ReadAddrs("data"); err == nil && len(addrs) > 0 {
+		relayAddrs = addrs
+		logging.Println("Loaded relay addresses from data/relay.addr:", strings.Join(relayAddrs, ", "))
+	}
+
+	nodeOpts := []node.Option{
+		node.WithRelayCount(cfg.relayCount),
+		node.WithConnLimits(cfg.connsLow, cfg.connsHigh),
+	}
+	if cfg.invite != "" {
+		nodeOpts = append(nodeOpts, node.WithRelayInvite(cfg.invite))
+	}
+	n, err := node.NewNode(ctx, id, relayAddrs, nodeOpts...)
+	if err != nil {
+		return nil, err
+	}
+	n.PrintInfo()
+	logging.Println("Your PeerID (zbase32):", identity.PeerIDToZbase32(n.Host.ID()))
+
+	svc, err := chat.New(ctx, n)
+	if err != nil {
+		n.Shutdown(ctx)
+		return nil, err
+	}
+	svc.SetSealedSender(cfg.sealed)
+	if err := svc.SetCover(cfg.cover); err != nil {
+		n.Shutdown(ctx)
+		return nil, err
+	}
+	if cfg.onionDir != "" {
+		dir, err := onion.LoadDirectory(cfg.onionDir)
+		if err != nil {
+			n.Shutdown(ctx)
+			return nil, err
+		}
+		svc.OnionDirectory().Add(dir.Relays()...)
+	}
+	token, err := daemon.LoadOrCreateToken(cfg.dataDir)
+	if err != nil {
+		n.Shutdown(ctx)
+		return nil, err
+	}
+	srv := daemon.NewServer(ctx, svc, token)
+
+	socket := daemon.SocketPath(cfg.dataDir)
+	l, err := daemon.ListenUnix(socket)
+	if err != nil {
+		n.Shutdown(ctx)
+		return nil, err
+	}
+	go func() {
+		if err := srv.Serve(ctx, l); err != nil {
+			logging.Println("API server stopped:", err)
+		}
+	}()
+	logging.Println("API listening on", socket)
+	if cfg.ws != "" {
+		go func() {
+			if err := srv.ServeWebSocket(ctx, cfg.ws); err != nil {
+				logging.Println("WebSocket API stopped:", err)
+			}
+		}()
+		logging.Println("WebSocket API listening on ws://" + cfg.ws)
+	}
+
+	return func() {
+		<-ctx.Done()
+		svc.Close()
+		n.Shutdown(context.Background())
+	}, nil
+}
@@ -2,24 +2,26 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/c-bata/go-prompt"
-	"github.com/libp2p/go-libp2p/core/network"
-	"github.com/libp2p/go-libp2p/core/peer"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
 
-	"shadow/internal/identity"
+	"shadow/internal/chat"
+	"shadow/internal/daemon"
 	"shadow/internal/node"
-	"shadow/internal/utils"
 )
 
-const privateMsgProtocol = "/chat/1.0.0"
+const callTimeout = time.Minute
 
 func main() {
 	ctx, cancel := context.WithCancel(context.Background())
@@ -27,35 +29,58 @@ func main() {
 
 	var once sync.Once
 
-	relayAddrStr := flag.String("relay", "", "Multiaddr of static relay")
+	relayAddrStr := flag.String("relay", "", "Comma-separated multiaddrs of relays")
+	relayCount := flag.Int("relays", 2, "Number of relays to keep reservations on")
 	name := flag.String("name", "anon", "Identity name")
-	// peerAddrStr := flag.String("peer", "", "Multiaddr of another peer to connect to")
-	// peerIDStr := flag.String("peerid", "", "Connect to peer by ID using DHT")
+	invite := flag.String("invite", "", "Relay invite token")
+	connsLow := flag.Int("conns-low", 100, "Connection manager low watermark")
+	connsHigh := flag.Int("conns-high", 200, "Connection manager high watermark")
+	headless := flag.Bool("daemon", false, "Run the node headless, serving the API only")
+	wsAddr := flag.String("ws", "", "Also serve the API as a WebSocket on this loopback address (e.g. 127.0.0.1:7700)")
+	sealed := flag.Bool("sealed-sender", false, "Send direct messages through the recipient's relay mailbox, hiding the sender from relays")
+	onionDir := flag.String("onion-dir", "", "File of relay multiaddrs, one per line, to pick onion paths from besides -relay")
+	coverMode := flag.String("cover", "off", "Cover traffic mode: off, poisson or constant")
+	coverInterval := flag.Duration("cover-interval", 0, "Time between cover packets (0: the mode's default)")
+	coverBudget := flag.Int64("cover-budget", 0, "Daily cover traffic budget in MiB (0: the mode's default)")
+	fullScreen := flag.Bool("tui", false, "Use the full-screen terminal UI instead of the prompt")
+	connect := flag.String("connect", "", "Daemon to use: socket path or ws:// URL (default: the identity's socket)")
+	flag.Usage = usage
 	flag.Parse()
 
-	fmt.Println("Name:", *name)
-	// Load or generate identity
-	id, err := identity.LoadOrCreate("data/"+*name, *name)
+	dataDir := "data/" + *name
+	cfg := daemonConfig{
+		name:       *name,
+		dataDir:    dataDir,
+		relays:     *relayAddrStr,
+		relayCount: *relayCount,
+		invite:     *invite,
+		connsLow:   *connsLow,
+		connsHigh:  *connsHigh,
+		ws:         *wsAddr,
+		sealed:     *sealed,
+		onionDir:   *onionDir,
+	}
+	mode, err := chat.ParseCoverMode(*coverMode)
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
-
-	// Generate identicon for self
-	pubBytes, _ := id.PublicKey().Raw()
-	iconPath := fmt.Sprintf("data/%s_identicon.png", *name)
-	if err := utils.GenerateIdenticon(pubBytes, iconPath); err == nil {
-		fmt.Println("Generated identicon at:", iconPath)
-	} else {
-		fmt.Println("Failed to generate identicon:", err)
+	cfg.cover = chat.DefaultCover(mode)
+	if *coverInterval > 0 {
+		cfg.cover.Interval = *coverInterval
 	}
-
-	// If relay address is not provided, try to load from relay.addr file
-	if *relayAddrStr == "" {
-		if b, err := os.ReadFile("data/relay.addr"); err == nil {
-			*relayAddrStr = string(b)
-			fmt.Println("Loaded relay address from data/relay.addr:", *relayAddrStr)
-		}
+	if *coverBudget > 0 {
+		cfg.cover.Budget = *coverBudget << 20
 	}
+	if flag.NArg() > 0 {
+		cancel()
+		os.Exit(runCommand(cfg, *connect, flag.Args()))
+	}
+	if *fullScreen {
+		cancel()
+		os.Exit(runTUI(cfg, *connect))
+	}
+	fmt.Println("Name:", *name)
 
 	// Channel to signal REPL exit
 	done := make(chan struct{})
@@ -72,43 +97,63 @@ func main() {
 		})
 	}()
 
-	// Init node
-	n, err := node.NewNode(ctx, id, *relayAddrStr)
-	if err != nil {
-		panic(err)
+	if *headless {
+		wait, err := startDaemon(ctx, cfg)
+		if err != nil {
+			panic(err)
+		}
+		wait()
+		return
 	}
-	defer n.Shutdown(ctx)
-
-	n.PrintInfo()
-	fmt.Println("Your PeerID (zbase32):", identity.PeerIDToZbase32(n.Host.ID()))
 
-	// Channel for incoming private messages
-	privateMsgChan := make(chan string, 10)
+	client, wait, err := dialDaemon(ctx, cfg, *connect)
+	if wait != nil {
+		defer wait()
+	}
+	if err != nil {
+		fmt.Println("Failed to connect to daemon:", err)
+		os.Exit(1)
+	}
+	defer client.Close()
 
-	// Stream handler for private messages
-	n.Host.SetStreamHandler(privateMsgProtocol, func(s network.Stream) {
-		defer s.Close()
-		buf := make([]byte, 4096)
-		nr, err := s.Read(buf)
-		if err == nil && nr > 0 {
-			privateMsgChan <- string(buf[:nr])
-		}
-	})
+	info, err := client.Info(ctx)
+	if err != nil {
+		fmt.Println("Failed to query daemon:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Connected as %s@%s (%s)\n", info.Name, info.Zbase32, info.PeerID)
 
-	// TODO:
-	// Aliases map: @alias -> zbase32 peer ID
-	aliases := map[string]string{
-		// Example: "bob": <zbase32 peer.ID value>
+	if err := client.Subscribe(ctx); err != nil {
+		fmt.Println("Failed to subscribe:", err)
 	}
 
-	// Populate aliases map with @name -> zbase32 peer ID
-	for _, p := range n.Host.Network().Peers() {
-		if p == n.Host.ID() {
-			continue
+	// Room plain text goes to, set by /join
+	var room string
+
+	// Peers and contacts for tab-completion, refreshed at most every few seconds
+	var completions []prompt.Suggest
+	var completionsAt time.Time
+	peerSuggestions := func() []prompt.Suggest {
+		if time.Since(completionsAt) < 3*time.Second {
+			return completions
+		}
+		completionsAt = time.Now()
+		completions = nil
+		cctx, ccancel := context.WithTimeout(ctx, time.Second)
+		defer ccancel()
+		if contacts, err := client.Contacts(cctx); err == nil {
+			for _, c := range contacts {
+				if c.Name != "" {
+					completions = append(completions, prompt.Suggest{Text: "@" + c.Name, Description: "Contact"})
+				}
+			}
 		}
-		peerIDStr := identity.PeerIDToZbase32(p)
-		//alias := strings.TrimPrefix(peerIDStr, "z:")
-		aliases[peerIDStr] = peerIDStr
+		if peers, err := client.Peers(cctx); err == nil {
+			for _, p := range peers {
+				completions = append(completions, prompt.Suggest{Text: p.Zbase32, Description: "PeerID"})
+			}
+		}
+		return completions
 	}
 
 	// Tab-completion function
@@ -119,17 +164,23 @@ func main() {
 			{Text: "/quit", Description: "Exit the chat"},
 			{Text: "/help", Description: "Show help"},
 			{Text: "/msg", Description: "Send a private message"},
+			{Text: "/join", Description: "Join a room"},
+			{Text: "/leave", Description: "Leave a room"},
+			{Text: "/rooms", Description: "List joined rooms"},
+			{Text: "/history", Description: "Show conversation history"},
+			{Text: "/contacts", Description: "List contacts"},
+			{Text: "/discover", Description: "List peers at the rendezvous point"},
+			{Text: "/relays", Description: "Show relay health"},
+			{Text: "/status", Description: "Show connectivity state"},
+			{Text: "/limits", Description: "Show connection and resource usage"},
+			{Text: "/padding", Description: "Show or set message padding"},
+			{Text: "/onion", Description: "Show or set onion routing"},
+			{Text: "/cover", Description: "Show or set cover traffic"},
+			{Text: "/verify", Description: "Mark a contact's key as checked"},
+			{Text: "/rotate", Description: "Replace your key"},
 		}
-		if strings.HasPrefix(text, "/msg ") {
-			// Suggest aliases and peer IDs
-			suggestions := []prompt.Suggest{}
-			for alias := range aliases {
-				suggestions = append(suggestions, prompt.Suggest{Text: "@" + alias, Description: "Alias"})
-			}
-			for _, p := range n.Host.Network().Peers() {
-				suggestions = append(suggestions, prompt.Suggest{Text: identity.PeerIDToZbase32(p), Description: "PeerID"})
-			}
-			return prompt.FilterHasPrefix(suggestions, d.GetWordBeforeCursor(), true)
+		if strings.HasPrefix(text, "/msg ") || strings.HasPrefix(text, "/history ") || strings.HasPrefix(text, "/padding ") || strings.HasPrefix(text, "/onion ") || strings.HasPrefix(text, "/verify ") {
+			return prompt.FilterHasPrefix(peerSuggestions(), d.GetWordBeforeCursor(), true)
 		}
 		return prompt.FilterHasPrefix(cmds, text, true)
 	}
@@ -140,6 +191,9 @@ func main() {
 		if msg == "" {
 			return
 		}
+		cctx, ccancel := context.WithTimeout(ctx, callTimeout)
+		defer ccancel()
+		fields := strings.Fields(msg)
 		switch {
 		case msg == "/quit":
 			fmt.Println("Exiting...")
@@ -149,82 +203,316 @@ func main() {
 			})
 			return
 		case msg == "/peers":
+			peers, err := client.Peers(cctx)
+			if err != nil {
+				fmt.Println("Failed to list peers:", err)
+				return
+			}
 			fmt.Println("Connected peers:")
-			for _, p := range n.Host.Network().Peers() {
-				addrs := n.Host.Peerstore().Addrs(p)
-				fmt.Printf("- %s", p.Loggable())
-				if len(addrs) > 0 {
-					fmt.Printf(" (")
-					for i, a := range addrs {
-						if i > 0 {
-							fmt.Print(", ")
-						}
-						fmt.Print(a.String())
-					}
-					fmt.Print(")")
+			printPeers(peers)
+		case msg == "/discover":
+			found, err := client.Discover(cctx)
+			if err != nil {
+				fmt.Println("Discovery failed:", err)
+				return
+			}
+			fmt.Println("Registered peers:")
+			for _, p := range found {
+				fmt.Printf("- %s (%s)\n", p.Zbase32, p.ID)
+			}
+		case msg == "/relays":
+			status, err := client.Relays(cctx)
+			if err != nil {
+				fmt.Println("Failed to get relays:", err)
+				return
+			}
+			if len(status) == 0 {
+				fmt.Println("No relays configured")
+				return
+			}
+			for _, st := range status {
+				state := "down"
+				if st.Healthy {
+					state = fmt.Sprintf("up, rtt %s", st.RTT.Round(time.Millisecond))
+				}
+				if st.Reserved {
+					state += ", reserved"
+				}
+				fmt.Printf("- %s (%s)", st.ID, state)
+				if st.LastErr != "" {
+					fmt.Printf(" last error: %s", st.LastErr)
 				}
 				fmt.Println()
 			}
-		case msg == "/help":
-			fmt.Println("Available commands:")
-			fmt.Println("  /peers   - List connected peers")
-			fmt.Println("  /quit    - Exit the chat")
-			fmt.Println("  /help    - Show this help message")
-			fmt.Println("  /msg <peerid|@alias> <message> - Send a private message")
-			fmt.Println("  <text>   - Send a message to the chat")
-		default:
-			if strings.HasPrefix(msg, "/msg ") {
-				parts := strings.SplitN(msg, " ", 3)
-				if len(parts) < 3 {
-					fmt.Println("Usage: /msg <peerid|@alias> <message>")
-					return
+		case msg == "/status":
+			st, err := client.Status(cctx)
+			if err != nil {
+				fmt.Println("Failed to get status:", err)
+				return
+			}
+			fmt.Println("Connectivity:", st)
+		case msg == "/limits":
+			r, err := client.Limits(cctx)
+			if err != nil {
+				fmt.Println("Failed to get limits:", err)
+				return
+			}
+			printLimits(r)
+		case fields[0] == "/join":
+			if len(fields) != 2 {
+				fmt.Println("Usage: /join <room>")
+				return
+			}
+			if err := client.Join(cctx, fields[1]); err != nil {
+				fmt.Println("Failed to join room:", err)
+				return
+			}
+			room = fields[1]
+			fmt.Println("Joined #" + room + ", plain text now goes to this room")
+		case fields[0] == "/leave":
+			leave := room
+			if len(fields) == 2 {
+				leave = strings.TrimPrefix(fields[1], "#")
+			}
+			if leave == "" {
+				fmt.Println("Usage: /leave <room>")
+				return
+			}
+			if err := client.Leave(cctx, leave); err != nil {
+				fmt.Println("Failed to leave room:", err)
+				return
+			}
+			if leave == room {
+				room = ""
+			}
+			fmt.Println("Left #" + leave)
+		case msg == "/rooms":
+			rooms, err := client.Rooms(cctx)
+			if err != nil {
+				fmt.Println("Failed to list rooms:", err)
+				return
+			}
+			for _, r := range rooms {
+				marker := " "
+				if r == room {
+					marker = "*"
 				}
-				peerIDStr := parts[1]
-				privateMsg := parts[2]
-				var pid peer.ID
-				var err error
-				if strings.HasPrefix(peerIDStr, "@") {
-					alias := peerIDStr[1:]
-					peerIDStrVal, ok := aliases[alias]
-					if !ok {
-						fmt.Println("Unknown alias:", alias)
-						return
-					}
-					pid, err = peer.Decode(peerIDStrVal)
-					if err != nil {
-						fmt.Println("Invalid peer ID for alias:", err)
-						return
-					}
-				} else if strings.HasPrefix(peerIDStr, "z:") {
-					pid, err = identity.Zbase32ToPeerID(peerIDStr[2:])
-				} else {
-					pid, err = peer.Decode(peerIDStr)
+				fmt.Printf("%s #%s\n", marker, r)
+			}
+		case msg == "/contacts":
+			contacts, err := client.Contacts(cctx)
+			if err != nil {
+				fmt.Println("Failed to list contacts:", err)
+				return
+			}
+			for _, c := range contacts {
+				verified := ""
+				if c.Verified {
+					verified = " [verified]"
 				}
+				fmt.Printf("- %s %s (%s)%s\n", c.Name, c.Zbase32, c.ID, verified)
+			}
+		case fields[0] == "/history":
+			if len(fields) < 2 {
+				fmt.Println("Usage: /history <peerid|@contact|#room> [count]")
+				return
+			}
+			limit := 20
+			if len(fields) > 2 {
+				n, err := strconv.Atoi(fields[2])
 				if err != nil {
-					fmt.Println("Invalid peer ID:", err)
+					fmt.Println("Invalid count:", fields[2])
 					return
 				}
-				s, err := n.Host.NewStream(ctx, pid, privateMsgProtocol)
-				if err != nil {
-					fmt.Println("Failed to open stream to peer:", err)
-					return
+				limit = n
+			}
+			msgs, err := client.History(cctx, fields[1], limit)
+			if err != nil {
+				fmt.Println("Failed to read history:", err)
+				return
+			}
+			for _, m := range msgs {
+				fmt.Printf("%s %s: %s\n", m.Time.Local().Format("2006-01-02 15:04"), m.Sender(), m.Text)
+			}
+		case fields[0] == "/padding":
+			if len(fields) < 2 {
+				fmt.Println("Usage: /padding <peerid|@contact|default> [none|padme|buckets] [files|nofiles]")
+				return
+			}
+			ref := fields[1]
+			if ref == "default" {
+				ref = ""
+			}
+			var policy string
+			var files *bool
+			for _, arg := range fields[2:] {
+				switch arg {
+				case "files", "nofiles":
+					on := arg == "files"
+					files = &on
+				default:
+					policy = arg
+				}
+			}
+			pad, err := client.SetPadding(cctx, ref, policy, files)
+			if err != nil {
+				fmt.Println("Failed to set padding:", err)
+				return
+			}
+			fmt.Printf("Padding for %s: %s", fields[1], pad.Policy)
+			if pad.Files {
+				fmt.Print(", files padded too")
+			}
+			fmt.Println()
+		case fields[0] == "/onion":
+			if len(fields) < 2 || len(fields) > 3 {
+				fmt.Println("Usage: /onion <peerid|@contact|default> [off|1|2|3]")
+				return
+			}
+			ref := fields[1]
+			if ref == "default" {
+				ref = ""
+			}
+			var hops *int
+			if len(fields) == 3 {
+				n, err := strconv.Atoi(fields[2])
+				if fields[2] == "off" {
+					n, err = 0, nil
 				}
-				_, err = s.Write([]byte(fmt.Sprintf("[from %s] %s", *name, privateMsg)))
 				if err != nil {
-					fmt.Println("Failed to send message:", err)
+					fmt.Println("Invalid number of relays:", fields[2])
+					return
 				}
-				s.Close()
+				hops = &n
+			}
+			n, err := client.SetOnionHops(cctx, ref, hops)
+			if err != nil {
+				fmt.Println("Failed to set onion routing:", err)
 				return
 			}
-			// Ignore all other input (no group chat)
+			if n == 0 {
+				fmt.Printf("Onion routing for %s: off\n", fields[1])
+			} else {
+				fmt.Printf("Onion routing for %s: %d relays\n", fields[1], n)
+			}
+		case fields[0] == "/cover":
+			var p daemon.CoverParams
+			if len(fields) > 1 {
+				p.Mode = fields[1]
+			}
+			if len(fields) > 2 {
+				p.Interval = fields[2]
+			}
+			st, err := client.Cover(cctx, p)
+			if err != nil {
+				fmt.Println("Failed to set cover traffic:", err)
+				return
+			}
+			if st.Mode == chat.CoverOff {
+				fmt.Println("Cover traffic: off")
+				return
+			}
+			fmt.Printf("Cover traffic: %s every %s through %d relays, %d real and %d dummy packets, %d KiB today\n",
+				st.Mode, st.Effective, st.Hops, st.Real, st.Dummies, st.Today>>10)
+		case fields[0] == "/verify":
+			if len(fields) < 2 || len(fields) > 3 || len(fields) == 3 && fields[2] != "off" {
+				fmt.Println("Usage: /verify <peerid|@contact> [off]")
+				return
+			}
+			verified := len(fields) == 2
+			if err := client.SetVerified(cctx, fields[1], verified); err != nil {
+				fmt.Println("Failed to verify contact:", err)
+				return
+			}
+			if verified {
+				fmt.Printf("Key of %s marked as verified\n", fields[1])
+			} else {
+				fmt.Printf("Key of %s no longer marked as verified\n", fields[1])
+			}
+		case msg == "/rotate":
+			rec, err := client.Rotate(cctx)
+			if err != nil {
+				fmt.Println("Failed to rotate key:", err)
+				return
+			}
+			fmt.Printf("New peer ID: %s\nContacts were told; restart the daemon to use the new key.\n", rec.New)
+		case msg == "/help":
+			fmt.Println("Available commands:")
+			fmt.Println("  /peers   - List connected peers")
+			fmt.Println("  /quit    - Exit the chat")
+			fmt.Println("  /help    - Show this help message")
+			fmt.Println("  /msg <peerid|@contact> <message> - Send a private message")
+			fmt.Println("  /join <room>  - Join a room; plain text goes to the last joined room")
+			fmt.Println("  /leave [room] - Leave a room")
+			fmt.Println("  /rooms   - List joined rooms")
+			fmt.Println("  /history <peerid|@contact|#room> [count] - Show conversation history")
+			fmt.Println("  /contacts - List contacts")
+			fmt.Println("  /discover - List peers at the rendezvous point")
+			fmt.Println("  /relays  - Show relay health")
+			fmt.Println("  /status  - Show connectivity state")
+			fmt.Println("  /limits  - Show connection and resource usage")
+			fmt.Println("  /padding <peerid|@contact|default> [none|padme|buckets] [files|nofiles] - Show or set message padding")
+			fmt.Println("  /onion <peerid|@contact|default> [off|1|2|3] - Show or set onion routing")
+			fmt.Println("  /cover [off|poisson|constant] [interval] - Show or set cover traffic")
+			fmt.Println("  /verify <peerid|@contact> [off] - Mark a contact's key as checked out of band")
+			fmt.Println("  /rotate  - Replace your key and move contacts over to it")
+			fmt.Println("  <text>   - Send a message to the current room")
+		case fields[0] == "/msg":
+			parts := strings.SplitN(msg, " ", 3)
+			if len(parts) < 3 {
+				fmt.Println("Usage: /msg <peerid|@contact> <message>")
+				return
+			}
+			if _, err := client.Send(cctx, parts[1], parts[2]); err != nil {
+				fmt.Println("Failed to send message:", err)
+			}
+		case strings.HasPrefix(msg, "/"):
+			fmt.Println("Unknown command, try /help")
+		default:
+			if room == "" {
+				fmt.Println("Not in a room, use /join <room> or /msg")
+				return
+			}
+			if _, err := client.SendRoom(cctx, room, msg); err != nil {
+				fmt.Println("Failed to send message:", err)
+			}
 		}
 	}
 
-	// Print incoming private messages in a goroutine
+	// Print incoming messages and connectivity changes pushed by the daemon
 	go func() {
-		for pm := range privateMsgChan {
-			fmt.Printf("\n[private msg] %s\n> ", pm)
+		for note := range client.Notifications() {
+			switch note.Method {
+			case daemon.NotifyMessage:
+				var m chat.Message
+				if json.Unmarshal(note.Params, &m) != nil {
+					continue
+				}
+				if kc := m.KeyChange; kc != nil {
+					fmt.Printf("\n[key change] %s moved from %s to %s\n", m.Sender(), kc.Old, kc.New)
+					if kc.Verified {
+						fmt.Println("[key change] WARNING: the old key was verified, verify the new one before trusting it")
+					}
+					fmt.Print("> ")
+				} else if m.Room != "" {
+					fmt.Printf("\n[#%s] %s: %s\n> ", m.Room, m.Sender(), m.Text)
+				} else {
+					fmt.Printf("\n[private msg] [from %s] %s\n> ", m.Sender(), m.Text)
+				}
+			case daemon.NotifyConnectivity:
+				var st daemon.Status
+				if json.Unmarshal(note.Params, &st) == nil {
+					fmt.Printf("\n[network] %s\n> ", st)
+				}
+			}
+		}
+		if ctx.Err() == nil {
+			fmt.Println("\nLost connection to daemon")
 		}
+		once.Do(func() {
+			cancel()
+			close(done)
+		})
 	}()
 
 	// Start the prompt REPL
@@ -232,12 +520,77 @@ func main() {
 		executor,
 		completer,
 		prompt.OptionPrefix("> "),
+		prompt.OptionSetExitCheckerOnInput(func(string, bool) bool {
+			select {
+			case <-done:
+				return true
+			default:
+				return false
+			}
+		}),
 	)
 	p.Run()
 
-	<-done // Block main until REPL signals exit
 	once.Do(func() {
 		cancel()
 		close(done)
 	})
+	<-done
+}
+
+func printPeers(peers []daemon.Peer) {
+	for _, p := range peers {
+		fmt.Printf("- %s [%s]", p.ID, p.ConnType)
+		if p.Name != "" {
+			fmt.Printf(" %s", p.Name)
+		}
+		if len(p.Addrs) > 0 {
+			fmt.Printf(" (%s)", strings.Join(p.Addrs, ", "))
+		}
+		fmt.Println()
+	}
+}
+
+// printLimits prints usage as used/limit for every resource manager scope.
+func printLimits(r node.LimitsReport) {
+	fmt.Printf("Connections: %d (low water %d, high water %d)\n", r.Conns, r.LowWater, r.HighWater)
+	for _, sc := range r.Scopes {
+		st, l := sc.Stat, sc.Limit
+		fmt.Printf("- %s: streams in %d/%s out %d/%s, conns in %d/%s out %d/%s, memory %s/%s\n",
+			sc.Scope,
+			st.NumStreamsInbound, limitString(int64(l.StreamsInbound)),
+			st.NumStreamsOutbound, limitString(int64(l.StreamsOutbound)),
+			st.NumConnsInbound, limitString(int64(l.ConnsInbound)),
+			st.NumConnsOutbound, limitString(int64(l.ConnsOutbound)),
+			byteString(st.Memory), limitBytes(int64(l.Memory)))
+	}
+}
+
+func limitString(v int64) string {
+	switch v {
+	case int64(rcmgr.Unlimited):
+		return "unlimited"
+	case int64(rcmgr.DefaultLimit):
+		return "default"
+	case int64(rcmgr.BlockAllLimit):
+		return "0"
+	}
+	return fmt.Sprint(v)
+}
+
+func limitBytes(v int64) string {
+	if v <= 0 {
+		return limitString(v)
+	}
+	return byteString(v)
+}
+
+func byteString(v int64) string {
+	switch {
+	case v >= 1<<20:
+		return fmt.Sprintf("%.1fMiB", float64(v)/(1<<20))
+	case v >= 1<<10:
+		return fmt.Sprintf("%.1fKiB", float64(v)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", v)
 }
@@ -0,0 +1,533 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+
+	"shadow/internal/chat"
+	"shadow/internal/daemon"
+	"shadow/internal/logging"
+)
+
+const (
+	// logConversation collects node output and errors.
+	logConversation = "*log*"
+	tuiHistory      = 200
+	statusRefresh   = 5 * time.Second
+	maxPaneLines    = 2000
+)
+
+// conversation is one entry of the conversation list: a room ("#room"),
+// a peer (its ID) or the log.
+type conversation struct {
+	key    string
+	title  string
+	lines  []string
+	unread int
+	loaded bool // history has been fetched
+}
+
+// tui is the full-screen interface: conversation list, scrollback pane,
+// input line and status bar, all fed by a daemon client.
+type tui struct {
+	ctx    context.Context
+	client *daemon.Client
+	self   daemon.Info
+
+	app    *tview.Application
+	list   *tview.List
+	pane   *tview.TextView
+	input  *tview.InputField
+	status *tview.TextView
+
+	// Only touched on the UI goroutine
+	convs   map[string]*conversation
+	order   []string // list order of conversation keys
+	current string
+	names   map[string]string // peer ID -> contact name
+	state   daemon.Status
+	relays  int
+}
+
+// runTUI runs the full-screen interface until the user quits and returns
+// the exit code.
+func runTUI(cfg daemonConfig, connect string) int {
+	// Node output would garble the screen; show it in the log conversation instead
+	stderr := os.Stderr
+	r, w, err := os.Pipe()
+	if err != nil {
+		fmt.Fprintln(stderr, "Failed to start:", err)
+		return exitError
+	}
+	logging.SetOutput(w)
+	// libp2p logs to stderr
+	os.Stderr = w
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, wait, err := dialDaemon(ctx, cfg, connect)
+	if wait != nil {
+		defer wait()
+	}
+	defer cancel()
+	if err != nil {
+		fmt.Fprintln(stderr, "Daemon unavailable:", err)
+		return exitUnavailable
+	}
+	defer client.Close()
+	info, err := client.Info(ctx)
+	if err != nil {
+		fmt.Fprintln(stderr, "Failed to query daemon:", err)
+		return exitUnavailable
+	}
+	if err := client.Subscribe(ctx); err != nil {
+		fmt.Fprintln(stderr, "Failed to subscribe:", err)
+		return exitUnavailable
+	}
+
+	t := newTUI(ctx, client, info)
+	go t.readLog(r)
+	go t.readNotifications()
+	go t.refreshStatus()
+	t.loadConversations()
+	if err := t.app.Run(); err != nil {
+		fmt.Fprintln(stderr, "Terminal UI failed:", err)
+		return exitError
+	}
+	return exitOK
+}
+
+func newTUI(ctx context.Context, client *daemon.Client, self daemon.Info) *tui {
+	t := &tui{
+		ctx:    ctx,
+		client: client,
+		self:   self,
+		app:    tview.NewApplication(),
+		list:   tview.NewList().ShowSecondaryText(false).SetHighlightFullLine(true),
+		pane:   tview.NewTextView().SetDynamicColors(true).SetScrollable(true).SetWrap(true),
+		input:  tview.NewInputField().SetLabel("> ").SetFieldBackgroundColor(tcell.ColorDefault),
+		status: tview.NewTextView().SetDynamicColors(true),
+		convs:  map[string]*conversation{},
+		names:  map[string]string{},
+	}
+	t.list.SetBorder(true).SetTitle(" Conversations ")
+	t.pane.SetBorder(true)
+	t.list.SetSelectedFunc(func(i int, _, _ string, _ rune) {
+		t.app.SetFocus(t.input)
+	})
+	t.list.SetChangedFunc(func(i int, _, _ string, _ rune) {
+		if i >= 0 && i < len(t.order) {
+			t.open(t.order[i])
+		}
+	})
+	t.input.SetDoneFunc(func(key tcell.Key) {
+		if key == tcell.KeyEnter {
+			text := t.input.GetText()
+			t.input.SetText("")
+			t.submit(text)
+		}
+	})
+
+	main := tview.NewFlex().
+		AddItem(t.list, 28, 0, false).
+		AddItem(t.pane, 0, 1, false)
+	root := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(t.status, 1, 0, false).
+		AddItem(main, 0, 1, false).
+		AddItem(t.input, 1, 0, true)
+	t.app.SetRoot(root, true).SetInputCapture(t.keys)
+
+	t.addConversation(logConversation, "log")
+	t.setStatus()
+	return t
+}
+
+// keys handles the global key bindings.
+func (t *tui) keys(ev *tcell.EventKey) *tcell.EventKey {
+	switch ev.Key() {
+	case tcell.KeyCtrlC:
+		t.app.Stop()
+		return nil
+	case tcell.KeyTab:
+		if t.app.GetFocus() == t.input {
+			t.app.SetFocus(t.list)
+		} else {
+			t.app.SetFocus(t.input)
+		}
+		return nil
+	case tcell.KeyCtrlN:
+		t.step(1)
+		return nil
+	case tcell.KeyCtrlP:
+		t.step(-1)
+		return nil
+	case tcell.KeyPgUp, tcell.KeyPgDn:
+		// Scroll the pane without leaving the input line
+		t.pane.InputHandler()(ev, nil)
+		return nil
+	case tcell.KeyEscape:
+		t.app.SetFocus(t.list)
+		return nil
+	}
+	return ev
+}
+
+// step selects the next (1) or previous (-1) conversation, preferring ones
+// with unread messages.
+func (t *tui) step(dir int) {
+	n := len(t.order)
+	if n == 0 {
+		return
+	}
+	cur := t.list.GetCurrentItem()
+	for i := 1; i < n; i++ {
+		j := ((cur+dir*i)%n + n) % n
+		if t.convs[t.order[j]].unread > 0 {
+			t.list.SetCurrentItem(j)
+			return
+		}
+	}
+	t.list.SetCurrentItem(((cur+dir)%n + n) % n)
+}
+
+// addConversation adds a conversation to the list if it is new.
+func (t *tui) addConversation(key, title string) *conversation {
+	if c, ok := t.convs[key]; ok {
+		return c
+	}
+	c := &conversation{key: key, title: title, loaded: key == logConversation}
+	t.convs[key] = c
+	t.order = append(t.order, key)
+	t.list.AddItem(title, "", 0, nil)
+	if t.current == "" {
+		t.open(key)
+	}
+	return c
+}
+
+// title is the list label of a conversation key.
+func (t *tui) title(key string) string {
+	if strings.HasPrefix(key, "#") || key == logConversation {
+		return key
+	}
+	if name := t.names[key]; name != "" {
+		return "@" + name
+	}
+	return key[len(key)-8:]
+}
+
+// loadConversations fills the list from the daemon's history, rooms and contacts.
+func (t *tui) loadConversations() {
+	ctx, cancel := context.WithTimeout(t.ctx, callTimeout)
+	defer cancel()
+	contacts, _ := t.client.Contacts(ctx)
+	convs, _ := t.client.Conversations(ctx)
+	rooms, _ := t.client.Rooms(ctx)
+	for _, c := range contacts {
+		t.names[c.ID.String()] = c.Name
+	}
+	for _, r := range rooms {
+		convs = append(convs, "#"+r)
+	}
+	sort.Strings(convs)
+	for _, key := range convs {
+		t.addConversation(key, t.title(key))
+	}
+	if len(convs) > 0 {
+		t.list.SetCurrentItem(1)
+	}
+}
+
+// open shows a conversation in the pane, fetching its history on first use.
+func (t *tui) open(key string) {
+	c := t.convs[key]
+	t.current = key
+	if !c.loaded {
+		c.loaded = true
+		ctx, cancel := context.WithTimeout(t.ctx, callTimeout)
+		msgs, err := t.client.History(ctx, key, tuiHistory)
+		cancel()
+		if err == nil {
+			// History already holds everything received so far
+			c.lines = c.lines[:0]
+			for _, m := range msgs {
+				c.lines = append(c.lines, t.format(m))
+			}
+		}
+	}
+	c.unread = 0
+	t.updateItem(key)
+	t.pane.SetTitle(" " + c.title + " ")
+	t.pane.SetText(strings.Join(c.lines, "\n"))
+	t.pane.ScrollToEnd()
+}
+
+func (t *tui) updateItem(key string) {
+	for i, k := range t.order {
+		if k != key {
+			continue
+		}
+		c := t.convs[key]
+		label := c.title
+		if c.unread > 0 {
+			label = fmt.Sprintf("%s [yellow](%d)[-]", c.title, c.unread)
+		}
+		t.list.SetItemText(i, label, "")
+		return
+	}
+}
+
+// append adds a line to a conversation and counts it as unread unless shown.
+func (t *tui) append(key, line string) {
+	c := t.addConversation(key, t.title(key))
+	c.lines = append(c.lines, line)
+	if len(c.lines) > maxPaneLines {
+		c.lines = c.lines[len(c.lines)-maxPaneLines:]
+	}
+	if key == t.current {
+		t.pane.SetText(strings.Join(c.lines, "\n"))
+		t.pane.ScrollToEnd()
+		return
+	}
+	if key != logConversation {
+		c.unread++
+		t.updateItem(key)
+	}
+}
+
+func (t *tui) format(m chat.Message) string {
+	if m.KeyChange != nil {
+		color := "yellow"
+		if m.KeyChange.Verified {
+			color = "red"
+		}
+		return fmt.Sprintf("[gray]%s[-] [%s]%s %s (was %s)[-]", m.Time.Local().Format("15:04"), color,
+			tview.Escape(m.Sender()), tview.Escape(m.Text), m.KeyChange.Old)
+	}
+	return fmt.Sprintf("[gray]%s[-] [::b]%s[::-]: %s",
+		m.Time.Local().Format("15:04"), tview.Escape(m.Sender()), tview.Escape(m.Text))
+}
+
+// logf adds a line to the log conversation; safe from any goroutine.
+func (t *tui) logf(format string, args ...any) {
+	line := tview.Escape(fmt.Sprintf(format, args...))
+	t.app.QueueUpdateDraw(func() {
+		t.append(logConversation, line)
+	})
+}
+
+// notify shows an error or notice in the current conversation.
+func (t *tui) notify(format string, args ...any) {
+	t.append(t.current, "[red]"+tview.Escape(fmt.Sprintf(format, args...))+"[-]")
+}
+
+func (t *tui) readLog(r *os.File) {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		t.logf("%s", sc.Text())
+	}
+}
+
+func (t *tui) readNotifications() {
+	for note := range t.client.Notifications() {
+		switch note.Method {
+		case daemon.NotifyMessage:
+			var m chat.Message
+			if json.Unmarshal(note.Params, &m) != nil {
+				continue
+			}
+			t.app.QueueUpdateDraw(func() {
+				key := m.Conversation(t.self.PeerID)
+				if m.Room == "" && m.Name != "" {
+					t.names[key] = m.Name
+				}
+				t.append(key, t.format(m))
+			})
+		case daemon.NotifyConnectivity:
+			var st daemon.Status
+			if json.Unmarshal(note.Params, &st) == nil {
+				t.app.QueueUpdateDraw(func() {
+					t.state = st
+					t.setStatus()
+				})
+			}
+		}
+	}
+	if t.ctx.Err() == nil {
+		t.logf("Lost connection to daemon")
+	}
+}
+
+// refreshStatus polls what connectivity notifications do not carry.
+func (t *tui) refreshStatus() {
+	tick := time.NewTicker(statusRefresh)
+	defer tick.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(t.ctx, statusRefresh)
+		st, err := t.client.Status(ctx)
+		relays, rerr := t.client.Relays(ctx)
+		cancel()
+		if err == nil {
+			healthy := 0
+			for _, r := range relays {
+				if r.Healthy {
+					healthy++
+				}
+			}
+			t.app.QueueUpdateDraw(func() {
+				t.state = st
+				if rerr == nil {
+					t.relays = healthy
+				}
+				t.setStatus()
+			})
+		}
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+func (t *tui) setStatus() {
+	color := "red"
+	switch t.state.State {
+	case "public":
+		color = "green"
+	case "relayed":
+		color = "yellow"
+	}
+	state := t.state.State
+	if state == "" {
+		state = "unknown"
+	}
+	t.status.SetText(fmt.Sprintf(" [::b]%s[::-]@%s  [%s]%s[-]  NAT: %s  relays: %d healthy, %d reserved  peers: %d  [gray]Tab focus  Ctrl-N/P switch  PgUp/PgDn scroll  Ctrl-C quit[-]",
+		tview.Escape(t.self.Name), t.self.Zbase32[len(t.self.Zbase32)-8:], color, state,
+		t.state.Reachability, t.relays, t.state.Reserved, t.state.Peers))
+}
+
+// submit handles a line typed into the input field. Daemon calls run in
+// the background so a slow peer lookup does not freeze the screen.
+func (t *tui) submit(text string) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return
+	}
+	if !strings.HasPrefix(text, "/") {
+		t.send(t.current, text)
+		return
+	}
+
+	fields := strings.Fields(text)
+	switch fields[0] {
+	case "/quit":
+		t.app.Stop()
+	case "/join":
+		if len(fields) != 2 {
+			t.notify("Usage: /join <room>")
+			return
+		}
+		room := strings.TrimPrefix(fields[1], "#")
+		t.background(func(ctx context.Context) func() {
+			if err := t.client.Join(ctx, room); err != nil {
+				return func() { t.notify("Failed to join room: %v", err) }
+			}
+			return func() {
+				t.addConversation("#"+room, "#"+room)
+				t.selectConversation("#" + room)
+			}
+		})
+	case "/leave":
+		key := t.current
+		if !strings.HasPrefix(key, "#") {
+			t.notify("Not in a room")
+			return
+		}
+		t.background(func(ctx context.Context) func() {
+			if err := t.client.Leave(ctx, key[1:]); err != nil {
+				return func() { t.notify("Failed to leave room: %v", err) }
+			}
+			return func() { t.append(key, "[gray]left the room[-]") }
+		})
+	case "/msg":
+		parts := strings.SplitN(text, " ", 3)
+		if len(parts) < 2 {
+			t.notify("Usage: /msg <peer> [text]")
+			return
+		}
+		t.background(func(ctx context.Context) func() {
+			p, err := t.client.Whois(ctx, parts[1])
+			if err != nil {
+				return func() { t.notify("Unknown peer: %v", err) }
+			}
+			return func() {
+				key := p.ID.String()
+				if p.Name != "" {
+					t.names[key] = p.Name
+				}
+				t.addConversation(key, t.title(key))
+				t.selectConversation(key)
+				if len(parts) == 3 {
+					t.send(key, parts[2])
+				}
+			}
+		})
+	case "/help":
+		t.notify("/join <room>, /leave, /msg <peer|@contact> [text], /quit. Plain text goes to the open conversation.")
+	default:
+		t.notify("Unknown command, try /help")
+	}
+}
+
+// background runs fn off the UI goroutine and then the UI update it returns.
+func (t *tui) background(fn func(ctx context.Context) func()) {
+	go func() {
+		ctx, cancel := context.WithTimeout(t.ctx, callTimeout)
+		defer cancel()
+		update := fn(ctx)
+		t.app.QueueUpdateDraw(update)
+	}()
+}
+
+func (t *tui) selectConversation(key string) {
+	for i, k := range t.order {
+		if k == key {
+			t.list.SetCurrentItem(i)
+			return
+		}
+	}
+}
+
+// send sends text to the conversation key.
+func (t *tui) send(key, text string) {
+	if key == logConversation {
+		t.notify("Open a conversation first, or use /msg or /join")
+		return
+	}
+	t.background(func(ctx context.Context) func() {
+		var m chat.Message
+		var err error
+		if strings.HasPrefix(key, "#") {
+			// Rooms from history may not be joined in this session
+			if err = t.client.Join(ctx, key[1:]); err == nil {
+				m, err = t.client.SendRoom(ctx, key[1:], text)
+			}
+		} else {
+			m, err = t.client.Send(ctx, key, text)
+		}
+		if err != nil {
+			return func() { t.append(key, "[red]"+tview.Escape("Failed to send: "+err.Error())+"[-]") }
+		}
+		return func() { t.append(key, t.format(m)) }
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"shadow/pkg/bot"
+	"shadow/pkg/shadow"
+)
+
+func main() {
+	name := flag.String("name", "echobot", "Identity name")
+	relayAddrStr := flag.String("relay", "", "Comma-separated multiaddrs of relays")
+	rooms := flag.String("rooms", "", "Comma-separated rooms to join")
+	flag.Parse()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	cfg := shadow.Config{Name: *name, DataDir: "data/" + *name}
+	if *relayAddrStr != "" {
+		cfg.Relays = strings.Split(*relayAddrStr, ",")
+	}
+	client, err := shadow.Start(ctx, cfg)
+	if err != nil {
+		panic(err)
+	}
+	defer client.Close()
+	fmt.Printf("Echo bot running as %s@%s (%s)\n", client.Name(), client.Zbase32(), client.ID())
+
+	for _, room := range strings.Split(*rooms, ",") {
+		if room == "" {
+			continue
+		}
+		if err := client.Join(ctx, room); err != nil {
+			fmt.Println("Failed to join room:", err)
+			continue
+		}
+		fmt.Println("Joined #" + room)
+	}
+
+	b := bot.New(client)
+	b.Handle("echo", "echo <text>: repeat text", func(ctx context.Context, m *bot.Context) error {
+		if len(m.Args) == 0 {
+			return m.Reply("usage: !echo <text>")
+		}
+		return m.Reply(m.Rest())
+	})
+	b.Handle("count", "count: how many plain messages I have seen here", func(ctx context.Context, m *bot.Context) error {
+		n, _ := m.State.Get("seen").(int)
+		return m.Replyf("%d messages so far", n)
+	})
+	b.Handle("whoami", "whoami: show your peer ID", func(ctx context.Context, m *bot.Context) error {
+		return m.ReplyDirect(fmt.Sprintf("you are %s (%s)", m.Name, m.From))
+	})
+	// Count plain messages without answering them: echoing every one would
+	// loop with any other bot that answers plain messages
+	b.HandleDefault(func(ctx context.Context, m *bot.Context) error {
+		m.State.Update("seen", func(old any) any {
+			n, _ := old.(int)
+			return n + 1
+		})
+		return nil
+	})
+
+	if err := b.Run(ctx); err != nil && ctx.Err() == nil {
+		fmt.Println("Bot stopped:", err)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"shadow/internal/irc"
+	"shadow/pkg/shadow"
+)
+
+func main() {
+	name := flag.String("name", "irc", "Identity name")
+	relayAddrStr := flag.String("relay", "", "Comma-separated multiaddrs of relays")
+	listen := flag.String("listen", "127.0.0.1:6667", "Address to accept IRC clients on")
+	password := flag.String("password", "", "Password IRC clients must send with PASS")
+	flag.Parse()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	cfg := shadow.Config{Name: *name, DataDir: "data/" + *name}
+	if *relayAddrStr != "" {
+		cfg.Relays = strings.Split(*relayAddrStr, ",")
+	}
+	client, err := shadow.Start(ctx, cfg)
+	if err != nil {
+		panic(err)
+	}
+	defer client.Close()
+	fmt.Printf("IRC gateway for %s@%s (%s) listening on %s\n", client.Name(), client.Zbase32(), client.ID(), *listen)
+	if *password == "" && !strings.HasPrefix(*listen, "127.") && !strings.HasPrefix(*listen, "localhost:") {
+		fmt.Println("Warning: no -password set; anyone who can reach", *listen, "can use this identity")
+	}
+
+	gw := irc.New(client, *password)
+	if err := gw.ListenAndServe(ctx, *listen); err != nil {
+		fmt.Println("IRC gateway stopped:", err)
+	}
+}
@@ -2,54 +2,146 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"syscall"
+	"time"
 
-	libp2p "github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/host"
-	ma "github.com/multiformats/go-multiaddr"
+	"github.com/libp2p/go-libp2p/core/peer"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+
+	"shadow/internal/mailbox"
+	"shadow/internal/onion"
+	"shadow/internal/relay"
+	"shadow/internal/rendezvous"
 )
 
 func main() {
-	_, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// Create a new libp2p Host with Relay HOP enabled
-	h, err := libp2p.New(
-		libp2p.ListenAddrStrings("/ip4/0.0.0.0/tcp/4001"),
-		libp2p.EnableNATService(),
-		libp2p.NATPortMap(),
-		libp2p.EnableRelay(),
-		libp2p.EnableRelayService(),
-	)
+	dataDir := flag.String("data", "data", "Directory holding relay.key and relay.addr")
+	tcpAddr := flag.String("tcp", "/ip4/0.0.0.0/tcp/4001", "TCP listen multiaddr (empty to disable)")
+	quicAddr := flag.String("quic", "/ip4/0.0.0.0/udp/4001/quic-v1", "QUIC listen multiaddr (empty to disable)")
+	wsAddr := flag.String("ws", "/ip4/0.0.0.0/tcp/4002/ws", "WebSocket listen multiaddr (empty to disable)")
+
+	res := relayv2.DefaultResources()
+	maxReservations := flag.Int("max-reservations", res.MaxReservations, "Maximum number of active relay reservations")
+	maxCircuits := flag.Int("max-circuits", res.MaxCircuits, "Maximum number of open circuits per peer")
+	reservationTTL := flag.Duration("reservation-ttl", res.ReservationTTL, "Lifetime of a reservation")
+	circuitDuration := flag.Duration("circuit-duration", res.Limit.Duration, "Maximum duration of a relayed connection (0 for unlimited)")
+	circuitData := flag.Int64("circuit-data", res.Limit.Data, "Maximum bytes relayed in each direction per connection (0 for unlimited)")
+	issueInvite := flag.Duration("issue-invite", 0, "Print a single-use invite token valid for this long and exit")
+	invitePeer := flag.String("invite-peer", "", "Bind the issued invite to this peer ID")
+	serveRendezvous := flag.Bool("rendezvous", true, "Serve the rendezvous protocol")
+	serveMailbox := flag.Bool("mailbox", true, "Keep sealed messages for offline peers")
+	serveOnion := flag.Bool("onion", true, "Forward onion-routed messages")
+	onionDir := flag.String("onion-dir", "", "File of the other relays' multiaddrs, one per line, to forward onion packets to")
+	adminAddr := flag.String("admin", "", "Serve the admin API (bearer token in the data directory) and /metrics on this address, e.g. 127.0.0.1:8081")
+	flag.Parse()
+
+	if *issueInvite > 0 {
+		printInvite(*dataDir, *invitePeer, *issueInvite)
+		return
+	}
+
+	cfg := relay.DefaultConfig(*dataDir)
+	cfg.ListenAddrs = nil
+	for _, a := range []string{*tcpAddr, *quicAddr, *wsAddr} {
+		if a != "" {
+			cfg.ListenAddrs = append(cfg.ListenAddrs, a)
+		}
+	}
+	if len(cfg.ListenAddrs) == 0 {
+		log.Fatal("At least one listen address is required")
+	}
+	cfg.Resources.MaxReservations = *maxReservations
+	cfg.Resources.MaxCircuits = *maxCircuits
+	cfg.Resources.ReservationTTL = *reservationTTL
+	if *circuitDuration == 0 && *circuitData == 0 {
+		cfg.Resources.Limit = nil
+	} else {
+		cfg.Resources.Limit = &relayv2.RelayLimit{Duration: *circuitDuration, Data: *circuitData}
+	}
+
+	acl, err := relay.NewACL(*dataDir)
+	if err != nil {
+		log.Fatalf("Failed to load relay policy: %v", err)
+	}
+	cfg.ACL = acl
+
+	h, err := relay.LoadOrCreateRelayHost(ctx, cfg)
 	if err != nil {
 		log.Fatalf("Failed to create host: %v", err)
 	}
 
-	// Always create and persist relay multiaddr to data/relay.addr
-	relayAddrPath := filepath.Join("data", "relay.addr")
-	if err := os.MkdirAll("data", 0700); err != nil {
-		log.Printf("Failed to create data dir: %v\n", err)
-	} else if len(h.Addrs()) > 0 {
-		fullAddr := h.Addrs()[0].Encapsulate(ma.StringCast("/p2p/" + h.ID().String()))
-		if err := os.WriteFile(relayAddrPath, []byte(fullAddr.String()), 0644); err != nil {
-			log.Printf("Failed to write relay address: %v\n", err)
-		} else {
-			fmt.Printf("Relay address persisted to %s: %s\n", relayAddrPath, fullAddr.String())
-		}
+	// Persist every relay multiaddr to data/relay.addr
+	if path, err := relay.WriteAddrs(h, *dataDir); err != nil {
+		log.Printf("Failed to persist relay addresses: %v\n", err)
 	} else {
-		log.Printf("No addresses found for host, cannot persist relay address.\n")
+		fmt.Printf("Relay addresses persisted to %s\n", path)
+	}
+
+	if *serveRendezvous {
+		rendezvous.NewService(h, acl.Allowed)
+	}
+	if *serveMailbox {
+		mailbox.NewService(h, acl.Allowed)
+	}
+	dir := onion.NewDirectory()
+	if *serveOnion {
+		if *onionDir != "" {
+			if dir, err = onion.LoadDirectory(*onionDir); err != nil {
+				log.Fatalf("Failed to load onion directory: %v", err)
+			}
+		}
+		if _, err := onion.NewService(h, dir); err != nil {
+			log.Fatalf("Failed to start onion forwarding: %v", err)
+		}
 	}
 
 	printHostInfo(h)
 
-	// Wait until Ctrl+C
+	if *adminAddr != "" {
+		token, err := relay.LoadOrCreateAdminToken(*dataDir)
+		if err != nil {
+			log.Fatalf("Failed to load admin token: %v", err)
+		}
+		admin := relay.NewAdmin(h, acl, token)
+		go func() {
+			if err := admin.ListenAndServe(ctx, *adminAddr); err != nil {
+				log.Printf("Admin API stopped: %v\n", err)
+			}
+		}()
+		fmt.Printf("\nAdmin API listening on http://%s\n", *adminAddr)
+		fmt.Printf("Requests need the bearer token in %s\n", relay.AdminTokenPath(*dataDir))
+	}
+
+	// Reload the access policy and onion directory on SIGHUP, wait until Ctrl+C
 	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, os.Interrupt)
-	<-ch
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range ch {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if err := acl.Reload(); err != nil {
+			log.Printf("Failed to reload relay policy: %v\n", err)
+		} else {
+			fmt.Println("Relay policy reloaded.")
+		}
+		if *serveOnion && *onionDir != "" {
+			if fresh, err := onion.LoadDirectory(*onionDir); err != nil {
+				log.Printf("Failed to reload onion directory: %v\n", err)
+			} else {
+				dir.Add(fresh.Relays()...)
+				fmt.Println("Onion directory reloaded.")
+			}
+		}
+	}
 
 	fmt.Println("\nShutting down...")
 	if err := h.Close(); err != nil {
@@ -62,15 +154,32 @@ func printHostInfo(h host.Host) {
 	fmt.Println("Peer ID:", h.ID().String())
 	fmt.Println("Addresses:")
 
-	for _, addr := range h.Addrs() {
-		fullAddr := addr.Encapsulate(ma.StringCast("/p2p/" + h.ID().String()))
-		fmt.Printf(" - %s\n", fullAddr)
+	addrs := relay.FullAddrs(h)
+	for _, addr := range addrs {
+		fmt.Printf(" - %s\n", addr)
 	}
 
 	fmt.Println("\nGive one of these to clients to use as a static relay address.")
 	fmt.Println("Example:")
-	if len(h.Addrs()) > 0 {
-		example := h.Addrs()[0].Encapsulate(ma.StringCast("/p2p/" + h.ID().String()))
-		fmt.Printf(`peer.AddrInfoFromString("%s")`, example.String())
+	if len(addrs) > 0 {
+		fmt.Printf(`peer.AddrInfoFromString("%s")`+"\n", addrs[0].String())
+	}
+}
+
+func printInvite(dataDir, bound string, ttl time.Duration) {
+	priv, err := relay.LoadOrCreateKey(dataDir)
+	if err != nil {
+		log.Fatalf("Failed to load relay key: %v", err)
+	}
+	var pid peer.ID
+	if bound != "" {
+		if pid, err = peer.Decode(bound); err != nil {
+			log.Fatalf("Invalid invite peer: %v", err)
+		}
+	}
+	token, err := relay.IssueInvite(priv, pid, ttl)
+	if err != nil {
+		log.Fatalf("Failed to issue invite: %v", err)
 	}
+	fmt.Println(token)
 }
@@ -0,0 +1,332 @@
+// Command simnet runs many in-memory shadow nodes on a mocknet through a
+// scripted scenario of joins, leaves and partitions, and records how room
+// gossip and peer lookups behave: propagation latency, delivery and duplicate
+// ratios and lookup success. Results are written as CSV or JSON so runs
+// before and after a protocol change can be compared.
+//
+//	go run ./cmd/simnet -nodes 500 -scenario churn -format json -out churn.json
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"shadow/internal/logging"
+	"shadow/internal/node"
+	"shadow/internal/testnet"
+)
+
+const room = "sim"
+
+func main() {
+	nodes := flag.Int("nodes", 500, "Number of nodes started before the scenario")
+	scenario := flag.String("scenario", "steady", "Built-in scenario (steady, churn, partition) or path to a scenario file")
+	latency := flag.Duration("latency", 20*time.Millisecond, "Latency of every link")
+	withRelay := flag.Bool("relay", false, "Run a relay with a rendezvous point; lookups then ask it before the DHT")
+	settle := flag.Duration("settle", 5*time.Second, "How long a publish step waits for messages to propagate")
+	lookupTimeout := flag.Duration("lookup-timeout", 10*time.Second, "Timeout of a single lookup")
+	format := flag.String("format", "csv", "Output format: csv or json")
+	out := flag.String("out", "", "Output file (default stdout)")
+	seed := flag.Int64("seed", 1, "Seed for the random choices of the scenario")
+	verbose := flag.Bool("v", false, "Show the nodes' own output")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags]\n\n%s\n\nFlags:\n", os.Args[0], scenarioHelp)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *format != "csv" && *format != "json" {
+		fmt.Fprintln(os.Stderr, "Unknown format:", *format)
+		os.Exit(2)
+	}
+	steps, err := loadScenario(*scenario)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to load scenario:", err)
+		os.Exit(2)
+	}
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to create output:", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		w = f
+	}
+	// The nodes print their progress; keep it out of the results
+	if *verbose {
+		logging.SetOutput(os.Stderr)
+	} else {
+		logging.SetOutput(io.Discard)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	s := &sim{
+		rng:           rand.New(rand.NewPCG(uint64(*seed), 0)),
+		col:           newCollector(),
+		dups:          &dupTracer{},
+		settle:        *settle,
+		lookupTimeout: *lookupTimeout,
+		initial:       *nodes,
+	}
+	opts := []testnet.Option{
+		testnet.WithLatency(*latency),
+		testnet.WithNodeOptions(node.WithPubSubOptions(pubsub.WithRawTracer(s.dups))),
+	}
+	if !*withRelay {
+		opts = append(opts, testnet.WithoutRelay())
+	}
+	fmt.Fprintln(os.Stderr, "Starting", *nodes, "nodes")
+	start := time.Now()
+	if s.net, err = testnet.New(ctx, 0, opts...); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to start network:", err)
+		os.Exit(1)
+	}
+	defer s.net.Close()
+	if err := s.join(ctx, *nodes); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to start nodes:", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Started %d nodes in %s\n", *nodes, time.Since(start).Round(time.Millisecond))
+
+	results := s.run(ctx, steps)
+
+	if *format == "json" {
+		err = writeJSON(w, Report{Scenario: *scenario, Nodes: *nodes, Latency: *latency, Relay: *withRelay, Seed: *seed, Steps: results})
+	} else {
+		err = writeCSV(w, results)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to write results:", err)
+		os.Exit(1)
+	}
+}
+
+// loadScenario returns a built-in scenario or reads one from a file.
+func loadScenario(name string) ([]step, error) {
+	if script, ok := scenarios[name]; ok {
+		return parseScenario(strings.NewReader(script))
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseScenario(f)
+}
+
+type sim struct {
+	net           *testnet.Network
+	rng           *rand.Rand
+	col           *collector
+	dups          *dupTracer
+	settle        time.Duration
+	lookupTimeout time.Duration
+	initial       int // nodes started before the scenario
+	started       int // nodes started so far, for naming
+}
+
+// run executes the steps and returns their results. An interrupted run
+// returns the steps completed so far.
+func (s *sim) run(ctx context.Context, steps []step) []Result {
+	var results []Result
+	start := time.Now()
+	for i, st := range steps {
+		if ctx.Err() != nil {
+			break
+		}
+		r := Result{Step: i + 1, Command: st.String()}
+		var err error
+		switch st.cmd {
+		case "wait":
+			select {
+			case <-ctx.Done():
+			case <-time.After(st.d):
+			}
+		case "publish":
+			err = s.publish(ctx, st.n, i+1, &r)
+		case "lookup":
+			s.lookup(ctx, st.n, &r)
+		case "join":
+			err = s.join(ctx, st.count(s.initial))
+		case "leave":
+			err = s.leave(st.count(s.initial))
+		case "churn":
+			// Replaces the nodes it stops, the network keeps its size
+			n := st.count(s.initial)
+			if err = s.leave(n); err == nil {
+				err = s.join(ctx, n)
+			}
+		case "partition":
+			err = s.partition(st.n)
+		case "heal":
+			err = s.net.Heal()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Step %d (%s) failed: %v\n", r.Step, r.Command, err)
+		}
+		r.Elapsed = time.Since(start).Seconds()
+		r.Nodes = len(s.net.Peers())
+		results = append(results, r)
+		fmt.Fprintf(os.Stderr, "%3d %-14s nodes=%d", r.Step, r.Command, r.Nodes)
+		if r.Messages > 0 {
+			fmt.Fprintf(os.Stderr, " delivered=%.3f p50=%.0fms p95=%.0fms dup=%.2f",
+				r.DeliveryRatio, r.LatencyP50, r.LatencyP95, r.DuplicateRatio)
+		}
+		if r.Lookups > 0 {
+			fmt.Fprintf(os.Stderr, " lookups=%.3f p50=%.0fms", r.LookupSuccess, r.LookupP50)
+		}
+		fmt.Fprintln(os.Stderr)
+	}
+	return results
+}
+
+// join starts n nodes, joins them to the room and records their arrivals.
+func (s *sim) join(ctx context.Context, n int) error {
+	for i := 0; i < n; i++ {
+		s.started++
+		p, err := s.net.AddPeer(ctx, fmt.Sprintf("node%d", s.started))
+		if err != nil {
+			return err
+		}
+		if err := p.Chat.JoinRoom(room); err != nil {
+			return err
+		}
+		msgs, _ := p.Chat.Subscribe()
+		go func() {
+			// Ends when the node leaves and its messaging service closes
+			for m := range msgs {
+				if m.Room == room {
+					s.col.arrived(m.Text, time.Since(m.Time))
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+// leave stops n random nodes.
+func (s *sim) leave(n int) error {
+	peers := s.net.Peers()
+	if n > len(peers) {
+		return fmt.Errorf("cannot stop %d nodes, %d are running", n, len(peers))
+	}
+	s.rng.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	for _, p := range peers[:n] {
+		if err := s.net.RemovePeer(p); err != nil {
+			return fmt.Errorf("failed to stop %s: %w", p.Name, err)
+		}
+	}
+	return nil
+}
+
+// partition deals the nodes out to n groups at random.
+func (s *sim) partition(n int) error {
+	peers := s.net.Peers()
+	s.rng.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	groups := make([][]peer.ID, n)
+	for i, p := range peers {
+		groups[i%n] = append(groups[i%n], p.ID())
+	}
+	return s.net.Partition(groups...)
+}
+
+// publish has n random nodes post to the room and measures the arrivals
+// within the settle time.
+func (s *sim) publish(ctx context.Context, n, stepNum int, r *Result) error {
+	peers := s.net.Peers()
+	if len(peers) < 2 {
+		return fmt.Errorf("not enough nodes")
+	}
+	s.rng.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	dups := s.dups.duplicates.Load()
+	for i, p := range peers[:min(n, len(peers))] {
+		text := fmt.Sprintf("step %d message %d", stepNum, i)
+		s.col.track(text)
+		if _, err := p.Chat.SendRoom(ctx, room, text); err != nil {
+			return fmt.Errorf("%s failed to publish: %w", p.Name, err)
+		}
+		r.Messages++
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(s.settle):
+	}
+	arrivals := s.col.reset()
+
+	r.Expected = r.Messages * (len(peers) - 1)
+	r.Delivered = len(arrivals)
+	r.DeliveryRatio = float64(r.Delivered) / float64(r.Expected)
+	r.LatencyP50 = percentile(arrivals, 50)
+	r.LatencyP95 = percentile(arrivals, 95)
+	r.LatencyMax = percentile(arrivals, 100)
+	r.Duplicates = s.dups.duplicates.Load() - dups
+	if r.Delivered > 0 {
+		r.DuplicateRatio = float64(r.Duplicates) / float64(r.Delivered)
+	}
+	return nil
+}
+
+// lookup has n random nodes look up the addresses of a random node they are
+// not connected to, all at once.
+func (s *sim) lookup(ctx context.Context, n int, r *Result) {
+	peers := s.net.Peers()
+	if len(peers) < 2 {
+		return
+	}
+	var mu sync.Mutex
+	var took []time.Duration
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		from := peers[s.rng.IntN(len(peers))]
+		var to *testnet.Peer
+		// A connected target would be answered locally; try a few for one that is not
+		for try := 0; try < 10; try++ {
+			to = peers[s.rng.IntN(len(peers))]
+			if to != from && from.Node.Host.Network().Connectedness(to.ID()) != network.Connected {
+				break
+			}
+		}
+		if to == from {
+			continue
+		}
+		r.Lookups++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lctx, cancel := context.WithTimeout(ctx, s.lookupTimeout)
+			defer cancel()
+			t := time.Now()
+			ai, err := from.Node.FindPeer(lctx, to.ID())
+			if err != nil || len(ai.Addrs) == 0 {
+				return
+			}
+			mu.Lock()
+			took = append(took, time.Since(t))
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	r.LookupsOK = len(took)
+	if r.Lookups > 0 {
+		r.LookupSuccess = float64(r.LookupsOK) / float64(r.Lookups)
+	}
+	r.LookupP50 = percentile(took, 50)
+	r.LookupP95 = percentile(took, 95)
+}
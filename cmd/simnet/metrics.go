@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// Result holds the measurements of one scenario step. Propagation fields are
+// set by publish steps and lookup fields by lookup steps.
+type Result struct {
+	Step    int     `json:"step"`
+	Command string  `json:"command"`
+	Elapsed float64 `json:"elapsed_s"` // since the scenario started
+	Nodes   int     `json:"nodes"`
+
+	Messages      int     `json:"messages"`
+	Expected      int     `json:"expected"`  // receptions if every live node got every message
+	Delivered     int     `json:"delivered"` // receptions within the settle time
+	DeliveryRatio float64 `json:"delivery_ratio"`
+	LatencyP50    float64 `json:"latency_p50_ms"`
+	LatencyP95    float64 `json:"latency_p95_ms"`
+	LatencyMax    float64 `json:"latency_max_ms"`
+	// Duplicates are copies gossipsub received and dropped as already seen
+	Duplicates     int64   `json:"duplicates"`
+	DuplicateRatio float64 `json:"duplicate_ratio"` // duplicates per delivered message
+
+	Lookups       int     `json:"lookups"`
+	LookupsOK     int     `json:"lookups_ok"`
+	LookupSuccess float64 `json:"lookup_success"`
+	LookupP50     float64 `json:"lookup_p50_ms"`
+	LookupP95     float64 `json:"lookup_p95_ms"`
+}
+
+// Report is the JSON output.
+type Report struct {
+	Scenario string        `json:"scenario"`
+	Nodes    int           `json:"nodes"`
+	Latency  time.Duration `json:"latency_ns"`
+	Relay    bool          `json:"relay"`
+	Seed     int64         `json:"seed"`
+	Steps    []Result      `json:"steps"`
+}
+
+func writeJSON(w io.Writer, r Report) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+func writeCSV(w io.Writer, results []Result) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"step", "command", "elapsed_s", "nodes",
+		"messages", "expected", "delivered", "delivery_ratio",
+		"latency_p50_ms", "latency_p95_ms", "latency_max_ms", "duplicates", "duplicate_ratio",
+		"lookups", "lookups_ok", "lookup_success", "lookup_p50_ms", "lookup_p95_ms"})
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+	for _, r := range results {
+		cw.Write([]string{strconv.Itoa(r.Step), r.Command, f(r.Elapsed), strconv.Itoa(r.Nodes),
+			strconv.Itoa(r.Messages), strconv.Itoa(r.Expected), strconv.Itoa(r.Delivered), f(r.DeliveryRatio),
+			f(r.LatencyP50), f(r.LatencyP95), f(r.LatencyMax), strconv.FormatInt(r.Duplicates, 10), f(r.DuplicateRatio),
+			strconv.Itoa(r.Lookups), strconv.Itoa(r.LookupsOK), f(r.LookupSuccess), f(r.LookupP50), f(r.LookupP95)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// collector records when room messages published by a publish step arrive.
+type collector struct {
+	mu       sync.Mutex
+	tracking map[string]bool
+	arrivals []time.Duration
+}
+
+func newCollector() *collector {
+	return &collector{tracking: map[string]bool{}}
+}
+
+// track starts counting arrivals of the message with text key.
+func (c *collector) track(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tracking[key] = true
+}
+
+func (c *collector) arrived(key string, latency time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tracking[key] {
+		c.arrivals = append(c.arrivals, latency)
+	}
+}
+
+// reset stops tracking and returns the arrival latencies recorded so far.
+func (c *collector) reset() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := c.arrivals
+	c.tracking = map[string]bool{}
+	c.arrivals = nil
+	return out
+}
+
+// percentile returns the p-th percentile of ds in milliseconds.
+func percentile(ds []time.Duration, p float64) float64 {
+	if len(ds) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), ds...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(p / 100 * float64(len(sorted)-1))
+	return float64(sorted[i]) / float64(time.Millisecond)
+}
+
+// dupTracer counts the duplicate messages gossipsub drops on every node.
+type dupTracer struct {
+	duplicates atomic.Int64
+}
+
+var _ pubsub.RawTracer = (*dupTracer)(nil)
+
+func (t *dupTracer) DuplicateMessage(*pubsub.Message) { t.duplicates.Add(1) }
+
+func (t *dupTracer) AddPeer(peer.ID, protocol.ID)          {}
+func (t *dupTracer) RemovePeer(peer.ID)                    {}
+func (t *dupTracer) Join(string)                           {}
+func (t *dupTracer) Leave(string)                          {}
+func (t *dupTracer) Graft(peer.ID, string)                 {}
+func (t *dupTracer) Prune(peer.ID, string)                 {}
+func (t *dupTracer) ValidateMessage(*pubsub.Message)       {}
+func (t *dupTracer) DeliverMessage(*pubsub.Message)        {}
+func (t *dupTracer) RejectMessage(*pubsub.Message, string) {}
+func (t *dupTracer) ThrottlePeer(peer.ID)                  {}
+func (t *dupTracer) RecvRPC(*pubsub.RPC)                   {}
+func (t *dupTracer) SendRPC(*pubsub.RPC, peer.ID)          {}
+func (t *dupTracer) DropRPC(*pubsub.RPC, peer.ID)          {}
+func (t *dupTracer) UndeliverableMessage(*pubsub.Message)  {}
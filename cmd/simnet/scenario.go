@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// step is one line of a scenario.
+type step struct {
+	cmd string
+	n   int
+	pct bool // n is a percentage of the initial nodes
+	d   time.Duration
+}
+
+func (s step) String() string {
+	switch s.cmd {
+	case "wait":
+		return "wait " + s.d.String()
+	case "heal":
+		return "heal"
+	}
+	if s.pct {
+		return s.cmd + " " + strconv.Itoa(s.n) + "%"
+	}
+	return s.cmd + " " + strconv.Itoa(s.n)
+}
+
+// count returns the number of nodes of the step, for a network started
+// with initial nodes.
+func (s step) count(initial int) int {
+	if !s.pct {
+		return s.n
+	}
+	return max(1, (s.n*initial+50)/100)
+}
+
+// scenarios are the built-in scenarios, run after the initial nodes are up.
+// Nodes join and leave in shares of the initial nodes, so the scenarios fit
+// any -nodes.
+var scenarios = map[string]string{
+	"steady": `
+wait 10s
+publish 10
+lookup 50
+publish 10
+lookup 50
+`,
+	"churn": `
+wait 10s
+publish 10
+lookup 50
+churn 10%
+wait 5s
+publish 10
+lookup 50
+churn 10%
+wait 5s
+publish 10
+lookup 50
+leave 20%
+wait 5s
+publish 10
+lookup 50
+join 20%
+wait 10s
+publish 10
+lookup 50
+`,
+	"partition": `
+wait 10s
+publish 10
+lookup 50
+partition 2
+wait 2s
+publish 10
+lookup 50
+heal
+wait 10s
+publish 10
+lookup 50
+`,
+}
+
+const scenarioHelp = `A scenario is one command per line, # starts a comment:
+  wait <duration>   let the network settle
+  publish <n>       n random nodes post to the room; measures propagation
+  lookup <n>        n random nodes look up a random other node; measures lookups
+  join <n>          start n new nodes
+  leave <n>         stop n random nodes, at most as many as are running
+  churn <n>         stop n random nodes and start n new ones
+  partition <n>     split the nodes into n groups that cannot reach each other
+  heal              undo the partition
+The n of join, leave and churn may be a percentage of -nodes, e.g. 10%.`
+
+// parseScenario reads a scenario script.
+func parseScenario(r io.Reader) ([]step, error) {
+	var steps []step
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		text, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		s := step{cmd: fields[0]}
+		var err error
+		switch {
+		case s.cmd == "heal" && len(fields) == 1:
+		case s.cmd == "wait" && len(fields) == 2:
+			s.d, err = time.ParseDuration(fields[1])
+		case len(fields) == 2 && isCountCommand(s.cmd):
+			count, pct := strings.CutSuffix(fields[1], "%")
+			if pct && !isNodeCommand(s.cmd) {
+				err = fmt.Errorf("%s takes no percentage", s.cmd)
+				break
+			}
+			s.pct = pct
+			s.n, err = strconv.Atoi(count)
+			if err == nil && s.n < 1 {
+				err = fmt.Errorf("count must be positive")
+			}
+		default:
+			return nil, fmt.Errorf("line %d: invalid command: %s", line, strings.TrimSpace(text))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		steps = append(steps, s)
+	}
+	return steps, sc.Err()
+}
+
+func isCountCommand(cmd string) bool {
+	switch cmd {
+	case "publish", "lookup", "join", "leave", "churn", "partition":
+		return true
+	}
+	return false
+}
+
+// isNodeCommand reports whether cmd starts or stops nodes.
+func isNodeCommand(cmd string) bool {
+	return cmd == "join" || cmd == "leave" || cmd == "churn"
+}
@@ -0,0 +1,71 @@
+// Command embed runs a shadow node inside a program: it joins a room, prints
+// everything it receives and acknowledges direct messages.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+
+	"shadow/pkg/shadow"
+)
+
+func main() {
+	name := flag.String("name", "embedded", "Identity name")
+	data := flag.String("data", "", "Data directory (default data/<name>)")
+	relays := flag.String("relay", "", "Comma-separated relay multiaddrs")
+	room := flag.String("room", "lobby", "Room to join")
+	flag.Parse()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	cfg := shadow.Config{Name: *name, DataDir: *data}
+	if cfg.DataDir == "" {
+		cfg.DataDir = "data/" + *name
+	}
+	if *relays != "" {
+		cfg.Relays = strings.Split(*relays, ",")
+	}
+	c, err := shadow.Start(ctx, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Close()
+	fmt.Printf("Running as %s (%s)\n", c.Name(), c.ID())
+
+	if err := c.Join(ctx, *room); err != nil {
+		log.Fatal(err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-c.Events():
+			if !ok {
+				return
+			}
+			switch ev := ev.(type) {
+			case shadow.ConnectivityEvent:
+				fmt.Printf("[network] %s, %d relays reserved, %d peers\n", ev.State, ev.Reserved, ev.Peers)
+			case shadow.MessageEvent:
+				switch {
+				case ev.Room != "":
+					fmt.Printf("[#%s] %s: %s\n", ev.Room, ev.Name, ev.Text)
+				case ev.File != nil:
+					fmt.Printf("[file] %s sent %s (%d bytes), saved to %s\n", ev.Name, ev.File.Name, ev.File.Size, ev.File.Path)
+				default:
+					fmt.Printf("[dm] %s: %s\n", ev.Name, ev.Text)
+					if _, err := c.Send(ctx, ev.From.String(), "received: "+ev.Text); err != nil {
+						fmt.Println("Reply failed:", err)
+					}
+				}
+			}
+		}
+	}
+}
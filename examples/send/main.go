@@ -0,0 +1,53 @@
+// Command send starts a shadow node, delivers one message or file and exits.
+//
+//	send -name ci -to @ops-bot -text "deploy finished"
+//	send -name ci -to z:<zbase32> -file build.log
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"shadow/pkg/shadow"
+)
+
+func main() {
+	name := flag.String("name", "sender", "Identity name")
+	relays := flag.String("relay", "", "Comma-separated relay multiaddrs")
+	to := flag.String("to", "", "Recipient: peer ID, z:<zbase32> or @contact")
+	text := flag.String("text", "", "Message text")
+	file := flag.String("file", "", "File to send instead of a message")
+	timeout := flag.Duration("timeout", time.Minute, "Give up after this long")
+	flag.Parse()
+	if *to == "" || (*text == "") == (*file == "") {
+		log.Fatal("need -to and exactly one of -text or -file")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	cfg := shadow.Config{Name: *name, DataDir: "data/" + *name}
+	if *relays != "" {
+		cfg.Relays = strings.Split(*relays, ",")
+	}
+	c, err := shadow.Start(ctx, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Close()
+
+	var m shadow.Message
+	if *file != "" {
+		m, err = c.SendFile(ctx, *to, *file)
+	} else {
+		m, err = c.Send(ctx, *to, *text)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Delivered", m.ID, "to", m.To)
+}
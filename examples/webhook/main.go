@@ -0,0 +1,86 @@
+// Command webhook stands in for a remote chat network when trying out
+// cmd/bridge: it prints what the bridge posts and posts what you type.
+//
+//	go run ./cmd/bridge -rooms general=lobby
+//	go run ./examples/webhook -user alice
+//
+// Type "#general hello" to talk in a channel or "@<peer> hello" to message a
+// shadow peer directly.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"shadow/pkg/bridge/webhook"
+)
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:8089", "Address to receive the bridge's messages on")
+	bridgeURL := flag.String("bridge", "http://127.0.0.1:8088"+webhook.MessagesPath, "Bridge URL to post messages to")
+	user := flag.String("user", "alice", "Remote user to post as")
+	secret := flag.String("secret", "", "Shared secret")
+	flag.Parse()
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		var m webhook.Outgoing
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		from := m.From.Name
+		if m.From.Puppet != "" {
+			from = m.From.Puppet + " (via " + from + ")"
+		}
+		if m.Channel != "" {
+			fmt.Printf("[#%s] %s: %s\n", m.Channel, from, m.Text)
+		} else {
+			fmt.Printf("[to %s] %s: %s\n", m.To, from, m.Text)
+		}
+	})
+	go func() {
+		if err := http.ListenAndServe(*listen, nil); err != nil {
+			fmt.Println("Failed to listen:", err)
+			os.Exit(1)
+		}
+	}()
+
+	sc := bufio.NewScanner(os.Stdin)
+	for sc.Scan() {
+		target, text, ok := strings.Cut(sc.Text(), " ")
+		if !ok || len(target) < 2 {
+			fmt.Println("Usage: #channel text | @peer text")
+			continue
+		}
+		m := webhook.Incoming{User: *user, Text: text}
+		switch target[0] {
+		case '#':
+			m.Channel = target[1:]
+		case '@':
+			m.To = target[1:]
+		default:
+			fmt.Println("Usage: #channel text | @peer text")
+			continue
+		}
+		body, _ := json.Marshal(m)
+		req, _ := http.NewRequest(http.MethodPost, *bridgeURL, bytes.NewReader(body))
+		if *secret != "" {
+			req.Header.Set(webhook.SecretHeader, *secret)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			fmt.Println("Failed to post:", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			fmt.Println("Bridge refused message:", resp.Status)
+		}
+	}
+}
@@ -0,0 +1,442 @@
+package chat
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	p2pcrypto "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"shadow/internal/crypto"
+	"shadow/internal/identity"
+	"shadow/internal/logging"
+	"shadow/internal/node"
+	"shadow/internal/onion"
+)
+
+const (
+	// MaxMessageSize bounds a single direct message on the wire.
+	MaxMessageSize = 64 << 10
+	sendTimeout    = 30 * time.Second
+	historyDir     = "history"
+)
+
+// Message is a direct or room message, sent or received.
+type Message struct {
+	ID   string      `json:"id"`
+	From peer.ID     `json:"from"`
+	Name string      `json:"name"`         // name the sender announced
+	To   peer.ID     `json:"to,omitempty"` // set on direct messages
+	Room string      `json:"room,omitempty"`
+	Text string      `json:"text"`
+	Time time.Time   `json:"time"`
+	File *Attachment `json:"file,omitempty"`
+	// Mailbox is set on direct messages left in the recipient's mailbox
+	// rather than handed over directly.
+	Mailbox bool `json:"mailbox,omitempty"`
+	// Onion is set on direct messages routed through a path of relays.
+	Onion bool `json:"onion,omitempty"`
+	// Puppet is the remote user a bridge sent the message for. From and
+	// Name are still the bridge's own identity.
+	Puppet string `json:"puppet,omitempty"`
+	// KeyChange is set on the notice that the sender rotated its key.
+	KeyChange *KeyChange `json:"key_change,omitempty"`
+}
+
+// Conversation returns the history key of m as seen by self: "#room" for
+// room messages, otherwise the ID of the other peer.
+func (m Message) Conversation(self peer.ID) string {
+	if m.Room != "" {
+		return "#" + m.Room
+	}
+	if m.From == self {
+		return m.To.String()
+	}
+	return m.From.String()
+}
+
+// Sender is the display name of the author: the announced name, or the
+// puppet and the bridge it came through.
+func (m Message) Sender() string {
+	if m.Puppet != "" {
+		return m.Puppet + " (via " + m.Name + ")"
+	}
+	return m.Name
+}
+
+// Contact is a peer we exchanged messages with.
+type Contact struct {
+	ID      peer.ID `json:"id"`
+	Zbase32 string  `json:"zbase32"`
+	Name    string  `json:"name"`
+	// Verified is set when the user checked the key out of band.
+	Verified bool `json:"verified,omitempty"`
+}
+
+// Service sends and receives direct and room messages over a node, keeps
+// history and fans incoming messages out to subscribers.
+type Service struct {
+	ctx     context.Context
+	node    *node.Node
+	history *History
+	replay  *replayCache
+	padding *paddingStore
+	mailbox *mailboxStore
+	onion   *onionStore
+	// onionDir holds the relays onion paths are picked from
+	onionDir *onion.Directory
+
+	sealedSender atomic.Bool
+	rotated      atomic.Bool
+
+	coverMu sync.Mutex
+	cover   *coverLoop
+
+	mu         sync.Mutex
+	rooms      map[string]*room
+	subs       map[chan Message]struct{}
+	acceptFile func(FileOffer) bool
+}
+
+// New starts messaging on n. History is kept under the identity's data
+// directory, or not at all if the identity is not persisted.
+func New(ctx context.Context, n *node.Node) (*Service, error) {
+	s := &Service{
+		ctx:      ctx,
+		node:     n,
+		rooms:    map[string]*room{},
+		subs:     map[chan Message]struct{}{},
+		onionDir: onion.NewDirectory(n.Relays.Relays()...),
+	}
+	var replayPath, paddingPath, mailboxPath, onionPath string
+	if dir := n.Identity.DataDir(); dir != "" {
+		h, err := OpenHistory(filepath.Join(dir, historyDir))
+		if err != nil {
+			return nil, err
+		}
+		s.history = h
+		replayPath = filepath.Join(dir, replayFile)
+		paddingPath = filepath.Join(dir, paddingFile)
+		mailboxPath = filepath.Join(dir, mailboxFile)
+		onionPath = filepath.Join(dir, onionFile)
+	}
+	var err error
+	if s.replay, err = openReplayCache(replayPath); err != nil {
+		return nil, err
+	}
+	if s.padding, err = openPaddingStore(paddingPath); err != nil {
+		return nil, err
+	}
+	if s.mailbox, err = openMailboxStore(mailboxPath); err != nil {
+		return nil, err
+	}
+	if s.onion, err = openOnionStore(onionPath); err != nil {
+		return nil, err
+	}
+	if len(n.Relays.Relays()) > 0 {
+		go s.runMailbox(ctx)
+	}
+	go s.runSuccession(ctx)
+	n.Host.SetStreamHandler(node.ChatProtocol, s.handleStream)
+	n.Host.SetStreamHandler(FileProtocol, s.handleFile)
+	n.Host.SetStreamHandler(onion.Protocol, s.handleOnion)
+	n.Host.SetStreamHandler(SuccessionProtocol, s.handleSuccession)
+	return s, nil
+}
+
+// Close stops receiving messages and leaves every room.
+func (s *Service) Close() {
+	s.node.Host.RemoveStreamHandler(node.ChatProtocol)
+	s.node.Host.RemoveStreamHandler(FileProtocol)
+	s.node.Host.RemoveStreamHandler(onion.Protocol)
+	s.node.Host.RemoveStreamHandler(SuccessionProtocol)
+	s.SetCover(Cover{Mode: CoverOff})
+	for _, r := range s.Rooms() {
+		s.LeaveRoom(r)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.subs {
+		delete(s.subs, ch)
+		close(ch)
+	}
+}
+
+// Node returns the node messages are sent through.
+func (s *Service) Node() *node.Node {
+	return s.node
+}
+
+// Subscribe returns a channel of incoming messages and a function that
+// cancels the subscription. Messages are dropped for slow subscribers.
+func (s *Service) Subscribe() (<-chan Message, func()) {
+	ch := make(chan Message, 64)
+	s.mu.Lock()
+	s.subs[ch] = struct{}{}
+	s.mu.Unlock()
+	return ch, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, ok := s.subs[ch]; ok {
+			delete(s.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// deliver records an incoming message and hands it to subscribers.
+func (s *Service) deliver(m Message) {
+	s.record(m)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.subs {
+		select {
+		case ch <- m:
+		default:
+			logging.Println("Dropping message for slow subscriber")
+		}
+	}
+}
+
+func (s *Service) record(m Message) {
+	if s.history == nil {
+		return
+	}
+	if err := s.history.Append(m.Conversation(s.node.Host.ID()), m); err != nil {
+		logging.Println("Failed to write history:", err)
+	}
+}
+
+// Send delivers text to peer to, looking up its addresses if needed.
+func (s *Service) Send(ctx context.Context, to peer.ID, text string) (Message, error) {
+	return s.SendAs(ctx, to, "", text)
+}
+
+// SendAs is Send on behalf of puppet, a remote user of a bridge. A peer
+// that rotated its key is sent to under the new one.
+func (s *Service) SendAs(ctx context.Context, to peer.ID, puppet, text string) (Message, error) {
+	to = s.current(to)
+	if to == s.node.Host.ID() {
+		return Message{}, fmt.Errorf("cannot message yourself")
+	}
+	pub, err := to.ExtractPublicKey()
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to get public key of %s: %w", to, err)
+	}
+	key, err := crypto.DeriveShared(s.node.Identity.PrivateKey(), pub)
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to derive shared key: %w", err)
+	}
+
+	m := Message{
+		ID:     newID(),
+		From:   s.node.Host.ID(),
+		Name:   s.node.Identity.Username(),
+		To:     to,
+		Text:   text,
+		Time:   time.Now().UTC(),
+		Puppet: puppet,
+	}
+	seq, err := s.replay.next(to, time.Now())
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to number message: %w", err)
+	}
+	p := payload{ID: m.ID, Seq: seq, Name: m.Name, Puppet: m.Puppet, Text: m.Text, Time: m.Time, Mailbox: s.mailbox.ownRoute(to)}
+	data, err := sealDirect(key, p, s.Padding(to).Policy)
+	if err != nil {
+		return Message{}, err
+	}
+	if len(data) > MaxMessageSize {
+		return Message{}, fmt.Errorf("message too large")
+	}
+
+	if l := s.activeCover(); l != nil {
+		err = s.sendCovered(ctx, l, to, data)
+		m.Onion = err == nil
+	} else if hops := s.OnionHops(to); hops > 0 {
+		// Never falls back to a route that would reveal the conversation
+		err = s.sendOnion(ctx, to, data, hops)
+		m.Onion = err == nil
+	} else if s.SealedSender() {
+		err = s.deposit(ctx, to, pub, data)
+		// Without a mailbox to use, the first message goes directly
+		if errors.Is(err, errNoMailbox) {
+			err = s.sendDirect(ctx, to, data)
+		} else {
+			m.Mailbox = err == nil
+		}
+	} else if err = s.sendDirect(ctx, to, data); err != nil {
+		// An unreachable recipient may still pick the message up later
+		if derr := s.deposit(ctx, to, pub, data); derr == nil {
+			m.Mailbox, err = true, nil
+		} else if !errors.Is(derr, errNoMailbox) {
+			err = fmt.Errorf("%w; mailbox: %v", err, derr)
+		}
+	}
+	if err != nil {
+		return Message{}, err
+	}
+	s.node.ProtectPeer(to)
+	s.record(m)
+	return m, nil
+}
+
+// sendDirect writes the envelope data on a stream to to, looking up its
+// addresses if needed.
+func (s *Service) sendDirect(ctx context.Context, to peer.ID, data []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+	if len(s.node.Host.Peerstore().Addrs(to)) == 0 {
+		if _, err := s.node.FindPeer(ctx, to); err != nil {
+			return fmt.Errorf("failed to find peer: %w", err)
+		}
+	}
+	st, err := s.node.OpenStream(ctx, to, node.ChatProtocol)
+	if err != nil {
+		return fmt.Errorf("failed to open stream to peer: %w", err)
+	}
+	defer st.Close()
+	if _, err := st.Write(data); err != nil {
+		st.Reset()
+		return fmt.Errorf("failed to send message: %w", err)
+	}
+	return nil
+}
+
+func (s *Service) handleStream(st network.Stream) {
+	defer st.Close()
+	from := st.Conn().RemotePeer()
+	st.SetReadDeadline(time.Now().Add(sendTimeout))
+	data, err := io.ReadAll(io.LimitReader(st, MaxMessageSize+1))
+	if err != nil || len(data) > MaxMessageSize {
+		st.Reset()
+		return
+	}
+	if err := s.receiveDirect(from, st.Conn().RemotePublicKey(), data, viaStream); err != nil {
+		logging.Println("Rejected message from", from, ":", err)
+	}
+}
+
+// delivery is how a direct message reached us.
+type delivery int
+
+const (
+	viaStream delivery = iota
+	viaMailbox
+	viaOnion
+)
+
+// receiveDirect opens the envelope data sent by from, whose public key is
+// pub, and delivers the message.
+func (s *Service) receiveDirect(from peer.ID, pub p2pcrypto.PubKey, data []byte, via delivery) error {
+	key, err := crypto.DeriveShared(s.node.Identity.PrivateKey(), pub)
+	if err != nil {
+		return fmt.Errorf("failed to derive shared key: %w", err)
+	}
+	p, err := openDirect(key, data)
+	if err != nil {
+		return err
+	}
+	maxAge := MaxClockSkew
+	if via == viaMailbox {
+		maxAge = maxMailboxAge
+	}
+	if err := s.replay.check(from, p.Seq, p.Time, time.Now(), maxAge); err != nil {
+		return err
+	}
+	s.node.RememberPeer(from)
+	if p.Name != "" {
+		s.node.SetPeerName(from, p.Name)
+	}
+	if p.Mailbox != nil {
+		s.mailbox.setRoute(from, *p.Mailbox)
+	}
+	s.deliver(Message{
+		ID:      p.ID,
+		From:    from,
+		Name:    p.Name,
+		To:      s.node.Host.ID(),
+		Text:    p.Text,
+		Time:    p.Time,
+		Mailbox: via == viaMailbox,
+		Onion:   via == viaOnion,
+		Puppet:  p.Puppet,
+	})
+	return nil
+}
+
+// History returns up to limit of the latest messages in a conversation
+// ("#room" or a peer ID), oldest first. limit <= 0 returns everything.
+func (s *Service) History(conversation string, limit int) ([]Message, error) {
+	if s.history == nil {
+		return nil, fmt.Errorf("history is not persisted for this identity")
+	}
+	return s.history.Query(conversation, limit)
+}
+
+// Conversations lists the conversations that have history.
+func (s *Service) Conversations() ([]string, error) {
+	if s.history == nil {
+		return []string{}, nil
+	}
+	return s.history.Conversations()
+}
+
+// Contacts lists the peers we exchanged messages with.
+func (s *Service) Contacts() []Contact {
+	out := []Contact{}
+	for _, p := range s.node.Contacts() {
+		out = append(out, Contact{ID: p, Zbase32: identity.PeerIDToZbase32(p), Name: s.node.PeerName(p), Verified: s.node.IsVerified(p)})
+	}
+	return out
+}
+
+// ResolvePeer parses a peer ID, a "z:"-prefixed zbase32 ID or "@name" of a
+// contact. Names are chosen by the contacts themselves, so a name more than
+// one contact goes by is refused rather than guessed.
+func (s *Service) ResolvePeer(ref string) (peer.ID, error) {
+	switch {
+	case strings.HasPrefix(ref, "@"):
+		name := ref[1:]
+		var found []peer.ID
+		for _, c := range s.Contacts() {
+			if c.Name == name {
+				found = append(found, c.ID)
+			}
+		}
+		switch len(found) {
+		case 0:
+			return "", fmt.Errorf("unknown contact: %s", name)
+		case 1:
+			return found[0], nil
+		}
+		return "", fmt.Errorf("%d contacts are named %s, use a peer ID", len(found), name)
+	case strings.HasPrefix(ref, "z:"):
+		return identity.Zbase32ToPeerID(ref[2:])
+	}
+	if p, err := peer.Decode(ref); err == nil {
+		return p, nil
+	}
+	if p, err := identity.Zbase32ToPeerID(ref); err == nil {
+		if _, err := peer.IDFromBytes([]byte(p)); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("invalid peer: %s", ref)
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
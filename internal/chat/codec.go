@@ -0,0 +1,71 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"shadow/internal/crypto"
+)
+
+// payload is the sealed part of a direct message. Sealing authenticates Seq
+// and Time, which the receiver checks against replays.
+type payload struct {
+	ID     string    `json:"id"`
+	Seq    uint64    `json:"seq"`
+	Name   string    `json:"name"`
+	Puppet string    `json:"puppet,omitempty"`
+	Text   string    `json:"text"`
+	Time   time.Time `json:"time"`
+	// Mailbox tells the recipient how to reach the sender's mailbox
+	Mailbox *mailboxRoute `json:"mailbox,omitempty"`
+}
+
+// envelope is written to a ChatProtocol stream. Box is the payload sealed
+// with the key both peers derive from their identity keys.
+type envelope struct {
+	Box []byte `json:"box"`
+}
+
+// sealDirect encodes p as the envelope of a direct message, padded under pad.
+func sealDirect(key []byte, p payload, pad crypto.PadPolicy) ([]byte, error) {
+	plain, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	box, err := crypto.Seal(key, crypto.Pad(plain, pad))
+	if err != nil {
+		return nil, fmt.Errorf("failed to seal message: %w", err)
+	}
+	return json.Marshal(envelope{Box: box})
+}
+
+// openDirect decodes the envelope of a direct message read from the wire.
+func openDirect(key, data []byte) (payload, error) {
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return payload{}, fmt.Errorf("invalid envelope: %w", err)
+	}
+	padded, err := crypto.Open(key, env.Box)
+	if err != nil {
+		return payload{}, fmt.Errorf("failed to open: %w", err)
+	}
+	plain, err := crypto.Unpad(padded)
+	if err != nil {
+		return payload{}, err
+	}
+	var p payload
+	if err := json.Unmarshal(plain, &p); err != nil {
+		return payload{}, fmt.Errorf("invalid payload: %w", err)
+	}
+	return p, nil
+}
+
+// decodeRoomMessage decodes a message published on a room topic.
+func decodeRoomMessage(data []byte) (roomMessage, error) {
+	var rm roomMessage
+	if err := json.Unmarshal(data, &rm); err != nil {
+		return roomMessage{}, err
+	}
+	return rm, nil
+}
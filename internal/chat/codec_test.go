@@ -0,0 +1,103 @@
+package chat
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"shadow/internal/crypto"
+)
+
+func newSecret(t testing.TB) []byte {
+	t.Helper()
+	key := make([]byte, chacha20poly1305.KeySize)
+	rand.Read(key)
+	return key
+}
+
+func TestDirectRoundTrip(t *testing.T) {
+	key := newSecret(t)
+	want := payload{ID: newID(), Seq: 42, Name: "alice", Puppet: "bob@irc", Text: "hello\nworld ✓", Time: time.Now().UTC().Round(0)}
+	for _, pad := range []crypto.PadPolicy{crypto.PadNone, crypto.PadPadme, crypto.PadBuckets} {
+		data, err := sealDirect(key, want, pad)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := openDirect(key, data)
+		if err != nil {
+			t.Fatalf("%s: %v", pad, err)
+		}
+		if got != want {
+			t.Fatalf("%s: round trip changed %+v to %+v", pad, want, got)
+		}
+	}
+}
+
+// Under buckets, short messages of any length have envelopes of one size.
+func TestDirectPaddingHidesLength(t *testing.T) {
+	key := newSecret(t)
+	size := -1
+	for _, text := range []string{"", "ok", "a somewhat longer message about nothing in particular"} {
+		data, _ := sealDirect(key, payload{ID: newID(), Seq: 1, Name: "alice", Text: text}, crypto.PadBuckets)
+		if size >= 0 && len(data) != size {
+			t.Fatalf("envelope of %q is %d bytes, others %d", text, len(data), size)
+		}
+		size = len(data)
+	}
+}
+
+func TestOpenDirectRejectsTampered(t *testing.T) {
+	key := newSecret(t)
+	data, _ := sealDirect(key, payload{ID: newID(), Name: "alice", Text: "hello"}, crypto.PadPadme)
+	var env envelope
+	json.Unmarshal(data, &env)
+	for i := range env.Box {
+		box := append([]byte(nil), env.Box...)
+		box[i] ^= 0x80
+		tampered, _ := json.Marshal(envelope{Box: box})
+		if _, err := openDirect(key, tampered); err == nil {
+			t.Fatalf("opened envelope with byte %d changed", i)
+		}
+	}
+	if _, err := openDirect(newSecret(t), data); err == nil {
+		t.Fatal("opened envelope with another key")
+	}
+}
+
+// FuzzOpenDirect feeds arbitrary stream contents to the direct message
+// decoder, and arbitrary plaintext sealed in a valid envelope to the payload
+// decoding. Neither may panic.
+func FuzzOpenDirect(f *testing.F) {
+	key := newSecret(f)
+	f.Fuzz(func(t *testing.T, data, plain []byte) {
+		openDirect(key, data)
+		for _, padded := range [][]byte{plain, crypto.Pad(plain, crypto.PadNone)} {
+			box, err := crypto.Seal(key, padded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sealed, _ := json.Marshal(envelope{Box: box})
+			openDirect(key, sealed)
+		}
+	})
+}
+
+func FuzzDecodeRoomMessage(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		rm, err := decodeRoomMessage(data)
+		if err != nil {
+			return
+		}
+		// What decodes must encode back to the same message
+		again, err := json.Marshal(rm)
+		if err != nil {
+			t.Fatalf("failed to re-encode %+v: %v", rm, err)
+		}
+		if rm2, err := decodeRoomMessage(again); err != nil || !rm2.Time.Equal(rm.Time) || rm2.Text != rm.Text {
+			t.Fatalf("re-encoding changed %+v to %+v (%v)", rm, rm2, err)
+		}
+	})
+}
@@ -0,0 +1,329 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"shadow/internal/crypto"
+	"shadow/internal/onion"
+)
+
+// Cover traffic: in a cover mode every direct message leaves as an onion
+// packet, all of the same size, and dummy packets that loop back through our
+// relays to us fill the gaps. Both kinds leave through one of our relays.
+// Someone watching our link then cannot tell when we write. Dummies carry an
+// empty payload and are dropped on arrival.
+// Rooms and file transfers are not covered.
+
+// CoverMode is how cover traffic is sent.
+type CoverMode string
+
+const (
+	// CoverOff sends no cover traffic.
+	CoverOff CoverMode = "off"
+	// CoverPoisson sends dummies at exponentially distributed intervals and
+	// real messages right away. Cheap, and real messages are not delayed,
+	// but bursts still show.
+	CoverPoisson CoverMode = "poisson"
+	// CoverConstant sends one packet every interval, a real message if one
+	// is waiting and a dummy otherwise. Timing says nothing; messages wait
+	// for the next slot.
+	CoverConstant CoverMode = "constant"
+)
+
+// maxCoverQueue bounds the real messages waiting for a slot.
+const maxCoverQueue = 64
+
+// ParseCoverMode parses the name of a mode.
+func ParseCoverMode(s string) (CoverMode, error) {
+	switch m := CoverMode(s); m {
+	case CoverOff, CoverPoisson, CoverConstant:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown cover mode: %q (off, poisson or constant)", s)
+}
+
+// Cover configures cover traffic.
+type Cover struct {
+	Mode CoverMode `json:"mode"`
+	// Interval is the time between packets in CoverConstant, the mean time
+	// between dummies in CoverPoisson.
+	Interval time.Duration `json:"interval"`
+	// Hops is the number of relays every packet goes through, at least.
+	Hops int `json:"hops"`
+	// Budget is the most bytes a day the mode may send, 0 for no limit. It
+	// stretches Interval as needed, and dummies stop for the rest of the day
+	// once it is used up.
+	Budget int64 `json:"budget"`
+}
+
+// DefaultCover returns the defaults of mode.
+func DefaultCover(mode CoverMode) Cover {
+	switch mode {
+	case CoverConstant:
+		return Cover{Mode: mode, Interval: 5 * time.Second, Hops: 1, Budget: 500 << 20}
+	case CoverPoisson:
+		return Cover{Mode: mode, Interval: 30 * time.Second, Hops: 1, Budget: 100 << 20}
+	}
+	return Cover{Mode: CoverOff}
+}
+
+// effectiveInterval is Interval, stretched to stay within Budget.
+func (c Cover) effectiveInterval() time.Duration {
+	if c.Budget <= 0 {
+		return c.Interval
+	}
+	perDay := c.Budget / crypto.OnionPacketSize
+	if perDay == 0 {
+		return 24 * time.Hour
+	}
+	return max(c.Interval, 24*time.Hour/time.Duration(perDay))
+}
+
+// CoverStats describes the cover traffic sent under the current mode.
+type CoverStats struct {
+	Cover
+	// Effective is the interval in use after the budget.
+	Effective time.Duration `json:"effective"`
+	Real      uint64        `json:"real"`
+	Dummies   uint64        `json:"dummies"`
+	// Today is what was sent in the current budget day, in bytes.
+	Today int64 `json:"today"`
+}
+
+// queuedPacket is a real message waiting for a slot.
+type queuedPacket struct {
+	first  peer.AddrInfo
+	packet []byte
+	sent   chan error
+}
+
+// coverLoop sends the traffic of one Cover until stopped.
+type coverLoop struct {
+	cfg    Cover
+	queue  chan *queuedPacket
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	real, dummies atomic.Uint64
+
+	mu       sync.Mutex
+	dayStart time.Time
+	today    int64
+}
+
+// spend accounts for one packet, reporting whether it fits the budget of
+// the day. Real messages are counted even when they do not fit.
+func (l *coverLoop) spend(real bool) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now := time.Now(); now.Sub(l.dayStart) >= 24*time.Hour {
+		l.dayStart, l.today = now, 0
+	}
+	if !real && l.cfg.Budget > 0 && l.today+crypto.OnionPacketSize > l.cfg.Budget {
+		return false
+	}
+	l.today += crypto.OnionPacketSize
+	return true
+}
+
+// SetCover switches to cover traffic c, stopping the previous mode. Messages
+// waiting for a slot of the previous mode fail.
+func (s *Service) SetCover(c Cover) error {
+	if _, err := ParseCoverMode(string(c.Mode)); err != nil {
+		return err
+	}
+	if c.Mode != CoverOff {
+		if c.Interval <= 0 {
+			return fmt.Errorf("cover interval must be positive")
+		}
+		if c.Hops < 1 || c.Hops > MaxOnionHops {
+			return fmt.Errorf("cover hops must be 1 to %d", MaxOnionHops)
+		}
+		if c.Budget < 0 {
+			return fmt.Errorf("cover budget must not be negative")
+		}
+	}
+
+	s.coverMu.Lock()
+	defer s.coverMu.Unlock()
+	if old := s.cover; old != nil {
+		old.cancel()
+		<-old.done
+		s.cover = nil
+	}
+	if c.Mode == CoverOff {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	l := &coverLoop{
+		cfg:      c,
+		queue:    make(chan *queuedPacket, maxCoverQueue),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		dayStart: time.Now(),
+	}
+	s.cover = l
+	go s.runCover(ctx, l)
+	return nil
+}
+
+// Cover returns the cover traffic settings.
+func (s *Service) Cover() Cover {
+	s.coverMu.Lock()
+	defer s.coverMu.Unlock()
+	if s.cover == nil {
+		return Cover{Mode: CoverOff}
+	}
+	return s.cover.cfg
+}
+
+// CoverStats returns what the current cover mode sent so far.
+func (s *Service) CoverStats() CoverStats {
+	s.coverMu.Lock()
+	l := s.cover
+	s.coverMu.Unlock()
+	if l == nil {
+		return CoverStats{Cover: Cover{Mode: CoverOff}}
+	}
+	l.mu.Lock()
+	today := l.today
+	l.mu.Unlock()
+	return CoverStats{
+		Cover:     l.cfg,
+		Effective: l.cfg.effectiveInterval(),
+		Real:      l.real.Load(),
+		Dummies:   l.dummies.Load(),
+		Today:     today,
+	}
+}
+
+func (s *Service) activeCover() *coverLoop {
+	s.coverMu.Lock()
+	defer s.coverMu.Unlock()
+	return s.cover
+}
+
+// sendCovered sends the direct message envelope data to to as cover mode l
+// does: as an onion packet through at least l.cfg.Hops relays, in the next
+// slot in CoverConstant.
+func (s *Service) sendCovered(ctx context.Context, l *coverLoop, to peer.ID, data []byte) error {
+	first, packet, err := s.onionPacket(to, data, max(s.OnionHops(to), l.cfg.Hops), s.entryRelays())
+	if err != nil {
+		return err
+	}
+	if l.cfg.Mode != CoverConstant {
+		l.spend(true)
+		if err := s.sendPacket(ctx, first, packet); err != nil {
+			return err
+		}
+		l.real.Add(1)
+		return nil
+	}
+	q := &queuedPacket{first: first, packet: packet, sent: make(chan error, 1)}
+	select {
+	case l.queue <- q:
+	default:
+		return fmt.Errorf("too many messages waiting to be sent")
+	}
+	select {
+	case err := <-q.sent:
+		return err
+	case <-l.done:
+		return fmt.Errorf("cover mode stopped")
+	case <-ctx.Done():
+		// Still goes out in its slot
+		return ctx.Err()
+	}
+}
+
+func (s *Service) runCover(ctx context.Context, l *coverLoop) {
+	defer close(l.done)
+	defer func() {
+		for {
+			select {
+			case q := <-l.queue:
+				q.sent <- fmt.Errorf("cover mode stopped")
+			default:
+				return
+			}
+		}
+	}()
+	interval := l.cfg.effectiveInterval()
+	next := func() time.Duration {
+		if l.cfg.Mode == CoverPoisson {
+			return time.Duration(rand.ExpFloat64() * float64(interval))
+		}
+		return interval
+	}
+	t := time.NewTimer(next())
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		t.Reset(next())
+		if l.cfg.Mode == CoverPoisson {
+			s.sendDummy(ctx, l)
+			continue
+		}
+		select {
+		case q := <-l.queue:
+			l.spend(true)
+			err := s.sendPacket(ctx, q.first, q.packet)
+			if err == nil {
+				l.real.Add(1)
+			}
+			q.sent <- err
+		default:
+			s.sendDummy(ctx, l)
+		}
+	}
+}
+
+// sendDummy sends a packet with an empty payload through our relays back to
+// us, if the budget allows.
+func (s *Service) sendDummy(ctx context.Context, l *coverLoop) {
+	if !l.spend(false) {
+		return
+	}
+	path, err := s.dummyPath(l.cfg.Hops)
+	if err != nil {
+		return
+	}
+	packet, err := onion.Seal(path, s.node.Host.ID(), nil)
+	if err != nil {
+		return
+	}
+	if err := s.sendPacket(ctx, path[0].Relay, packet); err == nil {
+		l.dummies.Add(1)
+	}
+}
+
+// dummyPath returns a path of hops relays from one of our relays back to us.
+func (s *Service) dummyPath(hops int) ([]onion.Hop, error) {
+	ours := s.entryRelays()
+	return s.onionDir.PathVia(ours, hops, ours)
+}
+
+// entryRelays returns the relays packets leave through in a cover mode: our
+// healthy relays, or all of them before they are probed.
+func (s *Service) entryRelays() []peer.ID {
+	relays := s.node.Relays.Ranked()
+	if len(relays) == 0 {
+		relays = s.node.Relays.Relays()
+	}
+	ids := []peer.ID{}
+	for _, ai := range relays {
+		ids = append(ids, ai.ID)
+	}
+	return ids
+}
@@ -0,0 +1,87 @@
+package chat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	ma "github.com/multiformats/go-multiaddr"
+
+	"shadow/internal/crypto"
+	"shadow/internal/onion"
+	"shadow/internal/relay"
+)
+
+func TestCoverBudgetStretchesInterval(t *testing.T) {
+	c := Cover{Mode: CoverConstant, Interval: time.Second}
+	if got := c.effectiveInterval(); got != time.Second {
+		t.Fatalf("unlimited interval is %s", got)
+	}
+	// One packet an hour
+	c.Budget = 24 * crypto.OnionPacketSize
+	if got := c.effectiveInterval(); got != time.Hour {
+		t.Fatalf("interval within budget is %s, want 1h", got)
+	}
+	c.Budget = 1
+	if got := c.effectiveInterval(); got != 24*time.Hour {
+		t.Fatalf("interval below one packet a day is %s", got)
+	}
+	for _, mode := range []CoverMode{CoverPoisson, CoverConstant} {
+		d := DefaultCover(mode)
+		if perDay := int64(24*time.Hour/d.effectiveInterval()) * crypto.OnionPacketSize; perDay > d.Budget {
+			t.Fatalf("%s default sends %d bytes a day, past its budget of %d", mode, perDay, d.Budget)
+		}
+	}
+}
+
+func TestCoverSpendKeepsBudget(t *testing.T) {
+	l := &coverLoop{cfg: Cover{Budget: 2 * crypto.OnionPacketSize}, dayStart: time.Now()}
+	if !l.spend(false) || !l.spend(false) {
+		t.Fatal("dummies within budget refused")
+	}
+	if l.spend(false) {
+		t.Fatal("dummy past budget allowed")
+	}
+	// Real messages always go
+	if !l.spend(true) {
+		t.Fatal("real message refused")
+	}
+	l.dayStart = time.Now().Add(-25 * time.Hour)
+	if !l.spend(false) {
+		t.Fatal("budget not renewed the next day")
+	}
+}
+
+func TestCoverLeavesThroughOwnRelays(t *testing.T) {
+	mn := mocknet.New()
+	defer mn.Close()
+	alice, bob := newTestService(t, mn, "alice"), newTestService(t, mn, "bob")
+	ours, theirs := newPeerID(t), newPeerID(t)
+	addr := ma.StringCast("/ip4/10.0.0.1/tcp/4001")
+	alice.node.Relays = relay.NewPool([]peer.AddrInfo{{ID: ours, Addrs: []ma.Multiaddr{addr}}}, 1)
+	alice.onionDir = onion.NewDirectory(
+		peer.AddrInfo{ID: ours, Addrs: []ma.Multiaddr{addr}},
+		peer.AddrInfo{ID: theirs, Addrs: []ma.Multiaddr{addr}},
+	)
+	// Bob is reachable through the other relay only
+	circuit := ma.StringCast("/ip4/10.0.0.1/tcp/4001/p2p/" + theirs.String() + "/p2p-circuit")
+	alice.node.Host.Peerstore().AddAddr(bob.node.Host.ID(), circuit, time.Hour)
+
+	for range 20 {
+		first, _, err := alice.onionPacket(bob.node.Host.ID(), []byte("{}"), 1, alice.entryRelays())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first.ID != ours {
+			t.Fatalf("real packet leaves for %s, not our relay", first.ID)
+		}
+		path, err := alice.dummyPath(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path[0].Relay.ID != ours {
+			t.Fatalf("dummy leaves for %s, not our relay", path[0].Relay.ID)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package chat
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"shadow/internal/logging"
+)
+
+// FileProtocol streams a file to a peer: a JSON header line, the bytes, then
+// as many zeros as the header's padding. Unlike direct messages the content is
+// not sealed separately; it relies on the connection's encryption, which is
+// end to end even through relays.
+const FileProtocol = "/shadow/file/1.0.0"
+
+const (
+	// MaxFileSize bounds a single file transfer.
+	MaxFileSize  = 256 << 20
+	downloadsDir = "downloads"
+	headerLimit  = 4096
+	fileTimeout  = 10 * time.Minute
+)
+
+// Attachment describes a transferred file.
+type Attachment struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	Path   string `json:"path,omitempty"` // local copy, on the receiving side
+}
+
+// FileOffer describes an incoming file before any of it is received.
+type FileOffer struct {
+	From peer.ID
+	Name string // base name the file will be stored under
+	Size int64
+}
+
+// SetFileFilter sets which incoming files are received; the others are
+// refused before their content is read. A nil accept, the default, receives
+// files from contacts only.
+func (s *Service) SetFileFilter(accept func(FileOffer) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acceptFile = accept
+}
+
+func (s *Service) fileAccepted(o FileOffer) bool {
+	s.mu.Lock()
+	accept := s.acceptFile
+	s.mu.Unlock()
+	if accept == nil {
+		return s.node.IsContact(o.From)
+	}
+	return accept(o)
+}
+
+type fileHeader struct {
+	ID     string    `json:"id"`
+	Sender string    `json:"sender"`
+	Name   string    `json:"name"`
+	Size   int64     `json:"size"`
+	SHA256 string    `json:"sha256"`
+	Time   time.Time `json:"time"`
+	// Padding is the number of zeros following the content.
+	Padding int64 `json:"padding,omitempty"`
+}
+
+// maxFilePadding bounds the padding of a file of size bytes. It is above what
+// any crypto.PadPolicy adds.
+func maxFilePadding(size int64) int64 {
+	return max(size/8, 64<<10)
+}
+
+// zeros reads as an endless run of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
+
+// SendFile transfers the file at path to peer to, under its latest key.
+func (s *Service) SendFile(ctx context.Context, to peer.ID, path string) (Message, error) {
+	to = s.current(to)
+	f, err := os.Open(path)
+	if err != nil {
+		return Message{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return Message{}, err
+	}
+	if fi.IsDir() || fi.Size() > MaxFileSize {
+		return Message{}, fmt.Errorf("%s is not a regular file of at most %d bytes", path, MaxFileSize)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return Message{}, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return Message{}, err
+	}
+
+	m := Message{
+		ID:   newID(),
+		From: s.node.Host.ID(),
+		Name: s.node.Identity.Username(),
+		To:   to,
+		Time: time.Now().UTC(),
+		File: &Attachment{Name: filepath.Base(path), Size: fi.Size(), SHA256: hex.EncodeToString(h.Sum(nil))},
+	}
+	var padding int64
+	if pad := s.Padding(to); pad.Files {
+		padding = int64(pad.Policy.PaddedLen(int(fi.Size()))) - fi.Size()
+	}
+	header, err := json.Marshal(fileHeader{
+		ID: m.ID, Sender: m.Name, Name: m.File.Name, Size: m.File.Size, SHA256: m.File.SHA256, Time: m.Time,
+		Padding: padding,
+	})
+	if err != nil {
+		return Message{}, err
+	}
+
+	if len(s.node.Host.Peerstore().Addrs(to)) == 0 {
+		if _, err := s.node.FindPeer(ctx, to); err != nil {
+			return Message{}, fmt.Errorf("failed to find peer: %w", err)
+		}
+	}
+	st, err := s.node.OpenDirectStream(ctx, to, FileProtocol)
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to open stream to peer: %w", err)
+	}
+	if _, err := st.Write(append(header, '\n')); err != nil {
+		st.Reset()
+		return Message{}, fmt.Errorf("failed to send file header: %w", err)
+	}
+	if _, err := io.Copy(st, io.MultiReader(f, io.LimitReader(zeros{}, padding))); err != nil {
+		st.Reset()
+		return Message{}, fmt.Errorf("failed to send file: %w", err)
+	}
+	if err := st.CloseWrite(); err != nil {
+		st.Reset()
+		return Message{}, err
+	}
+	// Wait for the receiver to verify and store the file
+	ack, err := io.ReadAll(io.LimitReader(st, headerLimit))
+	st.Close()
+	if err != nil {
+		return Message{}, fmt.Errorf("file transfer not acknowledged: %w", err)
+	}
+	if reply := strings.TrimSpace(string(ack)); reply != "OK" {
+		return Message{}, fmt.Errorf("file rejected: %s", strings.TrimPrefix(reply, "ERR "))
+	}
+	s.node.ProtectPeer(to)
+	s.record(m)
+	return m, nil
+}
+
+func (s *Service) handleFile(st network.Stream) {
+	defer st.Close()
+	from := st.Conn().RemotePeer()
+	st.SetDeadline(time.Now().Add(fileTimeout))
+	reject := func(format string, args ...any) {
+		msg := fmt.Sprintf(format, args...)
+		logging.Println("Rejected file from", from, ":", msg)
+		st.Write([]byte("ERR " + msg + "\n"))
+	}
+	if s.history == nil {
+		reject("not accepting files")
+		return
+	}
+
+	r := bufio.NewReader(io.LimitReader(st, headerLimit+MaxFileSize+maxFilePadding(MaxFileSize)+1))
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		st.Reset()
+		return
+	}
+	var hdr fileHeader
+	if err := json.Unmarshal(line, &hdr); err != nil {
+		reject("invalid header")
+		return
+	}
+	name := filepath.Base(filepath.Clean("/" + hdr.Name))
+	if name == "/" || strings.HasPrefix(name, ".") || hdr.Size < 0 || hdr.Size > MaxFileSize ||
+		hdr.Padding < 0 || hdr.Padding > maxFilePadding(hdr.Size) {
+		reject("invalid file")
+		return
+	}
+	if !s.fileAccepted(FileOffer{From: from, Name: name, Size: hdr.Size}) {
+		reject("not accepting files from this peer")
+		return
+	}
+
+	dir := filepath.Join(filepath.Dir(s.history.dir), downloadsDir)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		reject("cannot store file")
+		return
+	}
+	tmp, err := os.CreateTemp(dir, ".incoming-*")
+	if err != nil {
+		reject("cannot store file")
+		return
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(r, hdr.Size))
+	tmp.Close()
+	if err != nil || n != hdr.Size {
+		reject("size mismatch")
+		return
+	}
+	// Whatever follows must be the padding, and only the padding
+	if n, err := io.Copy(io.Discard, io.LimitReader(r, hdr.Padding+1)); err != nil || n != hdr.Padding {
+		reject("size mismatch")
+		return
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != hdr.SHA256 {
+		reject("checksum mismatch")
+		return
+	}
+	path := filepath.Join(dir, newID()+"-"+name)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		reject("cannot store file")
+		return
+	}
+	st.Write([]byte("OK\n"))
+
+	s.node.RememberPeer(from)
+	if hdr.Sender != "" {
+		s.node.SetPeerName(from, hdr.Sender)
+	}
+	s.deliver(Message{
+		ID:   hdr.ID,
+		From: from,
+		Name: hdr.Sender,
+		To:   s.node.Host.ID(),
+		Time: hdr.Time,
+		File: &Attachment{Name: name, Size: hdr.Size, SHA256: hdr.SHA256, Path: path},
+	})
+}
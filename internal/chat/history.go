@@ -0,0 +1,144 @@
+package chat
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const historyExt = ".jsonl"
+
+// History stores each conversation as a file of JSON lines.
+type History struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// OpenHistory opens or creates a history directory.
+func OpenHistory(dir string) (*History, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create history directory: %w", err)
+	}
+	return &History{dir: dir}, nil
+}
+
+func (h *History) path(conversation string) (string, error) {
+	if conversation == "" || strings.ContainsAny(conversation, `/\`) || strings.HasPrefix(conversation, ".") {
+		return "", fmt.Errorf("invalid conversation: %q", conversation)
+	}
+	return filepath.Join(h.dir, conversation+historyExt), nil
+}
+
+// Append adds m to a conversation.
+func (h *History) Append(conversation string, m Message) error {
+	path, err := h.path(conversation)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// Query returns the last limit messages of a conversation, oldest first.
+// limit <= 0 returns the whole conversation.
+func (h *History) Query(conversation string, limit int) ([]Message, error) {
+	path, err := h.path(conversation)
+	if err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return []Message{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	out := []Message{}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 4096), 2*MaxMessageSize)
+	for sc.Scan() {
+		var m Message
+		if err := json.Unmarshal(sc.Bytes(), &m); err != nil {
+			continue // skip a torn line from a crash
+		}
+		out = append(out, m)
+		if limit > 0 && len(out) > limit {
+			out = out[1:]
+		}
+	}
+	return out, sc.Err()
+}
+
+// Conversations lists every conversation with history.
+func (h *History) Conversations() ([]string, error) {
+	entries, err := os.ReadDir(h.dir)
+	if err != nil {
+		return nil, err
+	}
+	out := []string{}
+	for _, e := range entries {
+		if name, ok := strings.CutSuffix(e.Name(), historyExt); ok && !e.IsDir() {
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// Rename moves the messages of conversation from to the end of conversation
+// to, which is created if needed.
+func (h *History) Rename(from, to string) error {
+	src, err := h.path(from)
+	if err != nil {
+		return err
+	}
+	dst, err := h.path(to)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	data, err := os.ReadFile(src)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(dst); errors.Is(err, os.ErrNotExist) {
+		return os.Rename(src, dst)
+	}
+	f, err := os.OpenFile(dst, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
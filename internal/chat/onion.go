@@ -0,0 +1,219 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+
+	"shadow/internal/crypto"
+	"shadow/internal/logging"
+	"shadow/internal/onion"
+	"shadow/internal/relay"
+)
+
+// Onion routing: direct messages of a conversation can take a path of
+// relays, each peeling one layer, the last one being a relay the recipient is
+// reachable through. The first relay learns the sender, the last the
+// recipient, none both. Inside the onion is the same sealed envelope the
+// mailbox carries.
+
+const (
+	onionFile = "onion.json"
+	// MaxOnionHops bounds the relays of an onion path.
+	MaxOnionHops = crypto.OnionMaxHops - 1
+)
+
+// onionStore holds the onion path length of each conversation, saved to path
+// if set. 0 sends directly.
+type onionStore struct {
+	path string
+
+	mu sync.Mutex
+	// byConv is keyed by peer ID; "" holds the default
+	byConv map[string]int
+}
+
+func openOnionStore(path string) (*onionStore, error) {
+	st := &onionStore{path: path, byConv: map[string]int{}}
+	if path == "" {
+		return st, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read onion settings: %w", err)
+	}
+	if err := json.Unmarshal(data, &st.byConv); err != nil {
+		return nil, fmt.Errorf("invalid onion settings %s: %w", path, err)
+	}
+	return st, nil
+}
+
+func (o *onionStore) get(conversation string) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if hops, ok := o.byConv[conversation]; ok {
+		return hops
+	}
+	return o.byConv[""]
+}
+
+func (o *onionStore) set(conversation string, hops int) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.byConv[conversation] = hops
+	return o.save()
+}
+
+// save writes the settings; the caller holds mu.
+func (o *onionStore) save() error {
+	if o.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(o.byConv, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(o.path), "."+filepath.Base(o.path))
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, o.path)
+}
+
+// move hands the settings of conversation from, if it has its own, over to
+// conversation to.
+func (o *onionStore) move(from, to string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	v, ok := o.byConv[from]
+	if !ok {
+		return nil
+	}
+	o.byConv[to] = v
+	delete(o.byConv, from)
+	return o.save()
+}
+
+// OnionHops returns the number of relays direct messages to to are routed
+// through, 0 if they are sent directly.
+func (s *Service) OnionHops(to peer.ID) int {
+	return s.onion.get(to.String())
+}
+
+// SetOnionHops routes direct messages to to through hops relays, or directly
+// if hops is 0. An empty to sets the default of conversations without their
+// own. Onion-routed messages are never sent another way.
+func (s *Service) SetOnionHops(to peer.ID, hops int) error {
+	if hops < 0 || hops > MaxOnionHops {
+		return fmt.Errorf("onion hops must be 0 to %d", MaxOnionHops)
+	}
+	if err := s.onion.set(to.String(), hops); err != nil {
+		return fmt.Errorf("failed to save onion settings: %w", err)
+	}
+	return nil
+}
+
+// OnionDirectory returns the relays onion paths are picked from. It starts
+// with the node's relays; more can be added.
+func (s *Service) OnionDirectory() *onion.Directory {
+	return s.onionDir
+}
+
+// exitRelays returns the relays to is known to be reachable through: those
+// of its circuit addresses and of its mailbox.
+func (s *Service) exitRelays(to peer.ID) []peer.ID {
+	var exits []peer.ID
+	for _, a := range s.node.Host.Peerstore().Addrs(to) {
+		if _, err := a.ValueForProtocol(ma.P_CIRCUIT); err != nil {
+			continue
+		}
+		if v, err := a.ValueForProtocol(ma.P_P2P); err == nil {
+			if id, err := peer.Decode(v); err == nil {
+				exits = append(exits, id)
+			}
+		}
+	}
+	if route, ok := s.mailbox.route(to); ok {
+		if relays, err := relay.ParseAddrs(route.Relay); err == nil {
+			for _, ai := range relays {
+				exits = append(exits, ai.ID)
+			}
+		}
+	}
+	return exits
+}
+
+// sendOnion routes the direct message envelope data to to through hops relays.
+func (s *Service) sendOnion(ctx context.Context, to peer.ID, data []byte, hops int) error {
+	first, packet, err := s.onionPacket(to, data, hops, nil)
+	if err != nil {
+		return err
+	}
+	return s.sendPacket(ctx, first, packet)
+}
+
+// onionPacket seals the direct message envelope data for to into an onion
+// packet through hops relays, returning the first of them. With entries the
+// first is one of those.
+func (s *Service) onionPacket(to peer.ID, data []byte, hops int, entries []peer.ID) (peer.AddrInfo, []byte, error) {
+	inner, err := s.sealedEnvelope(data)
+	if err != nil {
+		return peer.AddrInfo{}, nil, err
+	}
+	if len(inner) > crypto.OnionMaxPayload {
+		return peer.AddrInfo{}, nil, fmt.Errorf("message too large for onion routing")
+	}
+	var path []onion.Hop
+	if entries != nil {
+		path, err = s.onionDir.PathVia(entries, hops, s.exitRelays(to))
+	} else {
+		path, err = s.onionDir.Path(hops, s.exitRelays(to))
+	}
+	if err != nil {
+		return peer.AddrInfo{}, nil, fmt.Errorf("no onion path to %s: %w", to, err)
+	}
+	packet, err := onion.Seal(path, to, inner)
+	if err != nil {
+		return peer.AddrInfo{}, nil, err
+	}
+	return path[0].Relay, packet, nil
+}
+
+func (s *Service) sendPacket(ctx context.Context, first peer.AddrInfo, packet []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+	return onion.Send(ctx, s.node.Host, first, packet)
+}
+
+// handleOnion takes an onion packet whose path ends here.
+func (s *Service) handleOnion(st network.Stream) {
+	packet, err := onion.ReadPacket(st)
+	if err != nil {
+		st.Reset()
+		return
+	}
+	st.Close()
+	inner, err := onion.Open(s.node.Identity.PrivateKey(), packet)
+	if err != nil {
+		logging.Println("Rejected onion message:", err)
+		return
+	}
+	if len(inner) == 0 {
+		// Cover traffic, dropped without a trace
+		return
+	}
+	if err := s.receiveSealed(inner, viaOnion); err != nil {
+		logging.Println("Rejected onion message:", err)
+	}
+}
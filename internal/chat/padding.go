@@ -0,0 +1,125 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"shadow/internal/crypto"
+)
+
+const paddingFile = "padding.json"
+
+// Padding is how the messages of a direct conversation are padded before
+// they leave, so their size says less about their content.
+type Padding struct {
+	Policy crypto.PadPolicy `json:"policy"`
+	// Files also pads file transfers to the policy's sizes.
+	Files bool `json:"files"`
+}
+
+// defaultPadding applies until a default is set with SetPadding.
+var defaultPadding = Padding{Policy: crypto.PadPadme}
+
+// paddingStore holds the padding of each conversation, saved to path if set.
+type paddingStore struct {
+	path string
+
+	mu sync.Mutex
+	// byConv is keyed by peer ID; "" holds the default
+	byConv map[string]Padding
+}
+
+func openPaddingStore(path string) (*paddingStore, error) {
+	ps := &paddingStore{path: path, byConv: map[string]Padding{}}
+	if path == "" {
+		return ps, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ps, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read padding settings: %w", err)
+	}
+	if err := json.Unmarshal(data, &ps.byConv); err != nil {
+		return nil, fmt.Errorf("invalid padding settings %s: %w", path, err)
+	}
+	return ps, nil
+}
+
+func (ps *paddingStore) get(conversation string) Padding {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if p, ok := ps.byConv[conversation]; ok {
+		return p
+	}
+	if p, ok := ps.byConv[""]; ok {
+		return p
+	}
+	return defaultPadding
+}
+
+func (ps *paddingStore) set(conversation string, p Padding) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.byConv[conversation] = p
+	return ps.save()
+}
+
+// save writes the settings; the caller holds mu.
+func (ps *paddingStore) save() error {
+	if ps.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(ps.byConv, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(ps.path), "."+filepath.Base(ps.path))
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ps.path)
+}
+
+// move hands the settings of conversation from, if it has its own, over to
+// conversation to.
+func (ps *paddingStore) move(from, to string) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	v, ok := ps.byConv[from]
+	if !ok {
+		return nil
+	}
+	ps.byConv[to] = v
+	delete(ps.byConv, from)
+	return ps.save()
+}
+
+// Padding returns the padding of direct messages and files sent to peer to.
+func (s *Service) Padding(to peer.ID) Padding {
+	return s.padding.get(to.String())
+}
+
+// DefaultPadding returns the padding of conversations without their own.
+func (s *Service) DefaultPadding() Padding {
+	return s.padding.get("")
+}
+
+// SetPadding sets the padding of direct messages and files sent to peer to.
+// An empty to sets the default of conversations without their own.
+func (s *Service) SetPadding(to peer.ID, p Padding) error {
+	if _, err := crypto.ParsePadPolicy(string(p.Policy)); err != nil {
+		return err
+	}
+	if err := s.padding.set(to.String(), p); err != nil {
+		return fmt.Errorf("failed to save padding settings: %w", err)
+	}
+	return nil
+}
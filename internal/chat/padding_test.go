@@ -0,0 +1,43 @@
+package chat
+
+import (
+	"path/filepath"
+	"testing"
+
+	"shadow/internal/crypto"
+)
+
+func TestPaddingStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), paddingFile)
+	ps, err := openPaddingStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ps.get("bob"); got != defaultPadding {
+		t.Fatalf("unset padding is %+v, want %+v", got, defaultPadding)
+	}
+	ps.set("", Padding{Policy: crypto.PadBuckets})
+	ps.set("carol", Padding{Policy: crypto.PadNone, Files: true})
+
+	ps, err = openPaddingStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ps.get("bob"); got.Policy != crypto.PadBuckets {
+		t.Fatalf("default after reload is %+v", got)
+	}
+	if got := ps.get("carol"); got.Policy != crypto.PadNone || !got.Files {
+		t.Fatalf("carol's padding after reload is %+v", got)
+	}
+}
+
+// Receivers must accept the file padding of every policy.
+func TestMaxFilePadding(t *testing.T) {
+	for _, policy := range []crypto.PadPolicy{crypto.PadNone, crypto.PadPadme, crypto.PadBuckets} {
+		for size := int64(0); size <= MaxFileSize; size = size*3 + 1 {
+			if pad := int64(policy.PaddedLen(int(size))) - size; pad > maxFilePadding(size) {
+				t.Fatalf("%s pads %d bytes by %d, above %d", policy, size, pad, maxFilePadding(size))
+			}
+		}
+	}
+}
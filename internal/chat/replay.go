@@ -0,0 +1,230 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"shadow/internal/logging"
+	"shadow/internal/mailbox"
+)
+
+const (
+	replayFile = "replay.json"
+	// MaxClockSkew is how far the sealed time of a direct message may be from
+	// the receiver's clock, except that one fetched from a mailbox may be up
+	// to maxMailboxAge old.
+	MaxClockSkew = 5 * time.Minute
+	// maxMailboxAge is how old the sealed time of a message fetched from a
+	// mailbox may be: it waited there for the recipient to come online.
+	maxMailboxAge = mailbox.BlobTTL
+	// windowSize is how many sequence numbers below the highest one seen from
+	// a sender are still accepted, for messages overtaking each other.
+	windowSize = 64
+	// counterExpiry is how long the sequence number of a recipient we stopped
+	// writing to is kept, well past when it forgot ours, at most
+	// maxMailboxAge+MaxClockSkew after our last message.
+	counterExpiry = maxMailboxAge + 24*time.Hour
+)
+
+var (
+	// ErrReplay is returned for a direct message that was already received.
+	ErrReplay = errors.New("replayed message")
+	// ErrStale is returned for a direct message whose time is off by more than
+	// it may be, or whose sequence number fell out of the replay window.
+	ErrStale = errors.New("stale message")
+)
+
+// replayCache numbers outgoing direct messages per recipient and rejects
+// incoming ones that were received before or are not fresh. With a path it
+// survives restarts, so a message captured before a restart cannot be
+// replayed after it.
+type replayCache struct {
+	path string
+
+	mu    sync.Mutex
+	state replayState
+}
+
+type replayState struct {
+	// Sent numbers our direct messages to each recipient, so that none
+	// learns how many we send to the others.
+	Sent  map[peer.ID]*seqCounter `json:"sent"`
+	Peers map[peer.ID]*seqWindow  `json:"peers"`
+	// Next is the single counter of a cache saved before Sent was kept. Until
+	// NextUntil new recipients start from it, above any number they may still
+	// remember from it.
+	Next      uint64    `json:"next,omitempty"`
+	NextUntil time.Time `json:"next_until"`
+}
+
+// seqCounter numbers the direct messages to one recipient.
+type seqCounter struct {
+	// Next is the sequence number of our next message.
+	Next uint64 `json:"next"`
+	// Last is when a number was last handed out.
+	Last time.Time `json:"last"`
+}
+
+// seqWindow tracks the sequence numbers received from one sender.
+type seqWindow struct {
+	// Max is the highest sequence number received.
+	Max uint64 `json:"max"`
+	// Seen has bit i set if Max-i was received.
+	Seen uint64 `json:"seen"`
+	// Last is when a message was last accepted.
+	Last time.Time `json:"last"`
+	// Until is when every message accepted so far is too old to pass the
+	// time check again, and the window can be forgotten.
+	Until time.Time `json:"until"`
+}
+
+// expiry returns when w can be forgotten.
+func (w *seqWindow) expiry() time.Time {
+	if w.Until.IsZero() {
+		// Saved before Until was kept, when messages were at most MaxClockSkew old
+		return w.Last.Add(2 * MaxClockSkew)
+	}
+	return w.Until
+}
+
+// openReplayCache loads the cache from path, or keeps it in memory if path
+// is empty.
+func openReplayCache(path string) (*replayCache, error) {
+	c := &replayCache{path: path, state: replayState{Sent: map[peer.ID]*seqCounter{}, Peers: map[peer.ID]*seqWindow{}}}
+	if path == "" {
+		return c, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read replay cache: %w", err)
+	}
+	c.state = replayState{}
+	if err := json.Unmarshal(data, &c.state); err != nil {
+		return nil, fmt.Errorf("invalid replay cache %s: %w", path, err)
+	}
+	if c.state.Sent == nil {
+		c.state.Sent = map[peer.ID]*seqCounter{}
+		if c.state.Next > 1 {
+			c.state.NextUntil = time.Now().Add(maxMailboxAge + MaxClockSkew)
+		}
+	}
+	if c.state.Peers == nil {
+		c.state.Peers = map[peer.ID]*seqWindow{}
+	}
+	return c, nil
+}
+
+// next returns the sequence number of a new outgoing message to to.
+func (c *replayCache) next(to peer.ID, now time.Time) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pruneSent(now)
+	ctr, ok := c.state.Sent[to]
+	if !ok {
+		ctr = &seqCounter{Next: 1}
+		if now.Before(c.state.NextUntil) {
+			ctr.Next = c.state.Next
+		}
+		c.state.Sent[to] = ctr
+	}
+	seq := ctr.Next
+	ctr.Next++
+	ctr.Last = now
+	// Saved before the message leaves, or a restart could reuse seq
+	if err := c.save(); err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+// check accepts the message seq sent by from at sent, at most maxAge ago,
+// or returns ErrReplay or ErrStale. An accepted message is remembered until
+// it is too old to pass again.
+func (c *replayCache) check(from peer.ID, seq uint64, sent, now time.Time, maxAge time.Duration) error {
+	if seq == 0 {
+		return fmt.Errorf("%w: no sequence number", ErrStale)
+	}
+	if age := now.Sub(sent); age > maxAge || age < -MaxClockSkew {
+		return fmt.Errorf("%w: sent at %s", ErrStale, sent.Format(time.RFC3339))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.prune(now)
+	w, ok := c.state.Peers[from]
+	switch {
+	case !ok:
+		w = &seqWindow{Max: seq, Seen: 1}
+		c.state.Peers[from] = w
+	case seq > w.Max:
+		if shift := seq - w.Max; shift < windowSize {
+			w.Seen = w.Seen<<shift | 1
+		} else {
+			w.Seen = 1
+		}
+		w.Max = seq
+	case w.Max-seq >= windowSize:
+		return fmt.Errorf("%w: sequence number %d is behind %d", ErrStale, seq, w.Max)
+	case w.Seen&(1<<(w.Max-seq)) != 0:
+		return fmt.Errorf("%w: sequence number %d", ErrReplay, seq)
+	default:
+		w.Seen |= 1 << (w.Max - seq)
+	}
+	w.Last = now
+	// A message sent up to MaxClockSkew ahead of our clock passes for longer
+	if until := now.Add(maxAge + MaxClockSkew); until.After(w.Until) {
+		w.Until = until
+	}
+	if err := c.save(); err != nil {
+		logging.Println("Failed to save replay cache:", err)
+	}
+	return nil
+}
+
+// prune forgets the windows of senders whose messages accepted so far are
+// all too old now, so replays of them fail the time check instead.
+func (c *replayCache) prune(now time.Time) {
+	for p, w := range c.state.Peers {
+		if now.After(w.expiry()) {
+			delete(c.state.Peers, p)
+		}
+	}
+}
+
+// pruneSent forgets the counters of recipients we stopped writing to; they
+// start over from 1, long after the recipient forgot our last number.
+func (c *replayCache) pruneSent(now time.Time) {
+	for p, ctr := range c.state.Sent {
+		if now.Sub(ctr.Last) > counterExpiry {
+			delete(c.state.Sent, p)
+		}
+	}
+	if !c.state.NextUntil.IsZero() && !now.Before(c.state.NextUntil) {
+		c.state.Next, c.state.NextUntil = 0, time.Time{}
+	}
+}
+
+func (c *replayCache) save() error {
+	if c.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(c.state)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(c.path), "."+filepath.Base(c.path))
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
@@ -0,0 +1,178 @@
+package chat
+
+import (
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func newPeerID(t *testing.T) peer.ID {
+	t.Helper()
+	_, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestReplayWindow(t *testing.T) {
+	alice := newPeerID(t)
+	c, _ := openReplayCache("")
+	now := time.Now()
+	steps := []struct {
+		seq  uint64
+		want error
+	}{
+		{10, nil},
+		{10, ErrReplay},
+		{12, nil},
+		{11, nil}, // overtaken
+		{11, ErrReplay},
+		{9, nil},
+		{12 + windowSize - 1, nil},
+		{12, ErrReplay},
+		{11, ErrStale}, // fell out of the window
+		{1000, nil},
+		{12 + windowSize - 1, ErrStale},
+		{0, ErrStale},
+	}
+	for _, s := range steps {
+		if err := c.check(alice, s.seq, now, now, MaxClockSkew); !errors.Is(err, s.want) {
+			t.Fatalf("seq %d: got %v, want %v", s.seq, err, s.want)
+		}
+	}
+	// Senders are tracked separately
+	if err := c.check(newPeerID(t), 10, now, now, MaxClockSkew); err != nil {
+		t.Fatalf("seq 10 from another sender: %v", err)
+	}
+}
+
+func TestReplayRejectsSkewedTime(t *testing.T) {
+	alice := newPeerID(t)
+	c, _ := openReplayCache("")
+	now := time.Now()
+	for i, sent := range []time.Time{now.Add(-MaxClockSkew - time.Second), now.Add(MaxClockSkew + time.Second)} {
+		if err := c.check(alice, uint64(i+1), sent, now, MaxClockSkew); !errors.Is(err, ErrStale) {
+			t.Fatalf("sent at %s: got %v, want ErrStale", sent, err)
+		}
+	}
+	if err := c.check(alice, 1, now.Add(-MaxClockSkew+time.Second), now, MaxClockSkew); err != nil {
+		t.Fatalf("within skew: %v", err)
+	}
+}
+
+func TestReplayPersists(t *testing.T) {
+	alice := newPeerID(t)
+	path := filepath.Join(t.TempDir(), replayFile)
+	c, err := openReplayCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if err := c.check(alice, 5, now, now, MaxClockSkew); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		c.next(alice, now)
+	}
+
+	c, err = openReplayCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.check(alice, 5, now, now, MaxClockSkew); !errors.Is(err, ErrReplay) {
+		t.Fatalf("replay after restart: got %v, want ErrReplay", err)
+	}
+	if seq, _ := c.next(alice, now); seq != 4 {
+		t.Fatalf("next sequence number after restart is %d, want 4", seq)
+	}
+}
+
+func TestReplayPrunesQuietSenders(t *testing.T) {
+	alice := newPeerID(t)
+	c, _ := openReplayCache("")
+	now := time.Now()
+	c.check(alice, 5, now, now, MaxClockSkew)
+	later := now.Add(2*MaxClockSkew + time.Second)
+	c.check(newPeerID(t), 1, later, later, MaxClockSkew)
+	if _, ok := c.state.Peers[alice]; ok {
+		t.Fatal("quiet sender was not pruned")
+	}
+	// The message itself is now too old to replay
+	if err := c.check(alice, 5, now, later, MaxClockSkew); !errors.Is(err, ErrStale) {
+		t.Fatalf("replay after pruning: got %v, want ErrStale", err)
+	}
+}
+
+func TestReplayKeepsMailboxSenders(t *testing.T) {
+	alice := newPeerID(t)
+	c, _ := openReplayCache("")
+	now := time.Now()
+	sent := now.Add(-time.Hour)
+	if err := c.check(alice, 5, sent, now, maxMailboxAge); err != nil {
+		t.Fatalf("message from the mailbox: %v", err)
+	}
+	if err := c.check(alice, 6, now.Add(MaxClockSkew+time.Second), now, maxMailboxAge); !errors.Is(err, ErrStale) {
+		t.Fatalf("message from the future: got %v, want ErrStale", err)
+	}
+	// The window outlives the quiet time of senders on streams
+	later := now.Add(2*MaxClockSkew + time.Second)
+	c.check(newPeerID(t), 1, later, later, MaxClockSkew)
+	if err := c.check(alice, 5, sent, later, maxMailboxAge); !errors.Is(err, ErrReplay) {
+		t.Fatalf("replay from the mailbox: got %v, want ErrReplay", err)
+	}
+	much := now.Add(maxMailboxAge + MaxClockSkew + time.Second)
+	c.check(newPeerID(t), 1, much, much, MaxClockSkew)
+	if _, ok := c.state.Peers[alice]; ok {
+		t.Fatal("sender kept past the age of its messages")
+	}
+}
+
+func TestReplayCountsPerRecipient(t *testing.T) {
+	alice, bob := newPeerID(t), newPeerID(t)
+	c, _ := openReplayCache("")
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		c.next(alice, now)
+	}
+	if seq, _ := c.next(bob, now); seq != 1 {
+		t.Fatalf("first sequence number to bob is %d, want 1", seq)
+	}
+	if seq, _ := c.next(alice, now); seq != 4 {
+		t.Fatalf("sequence number to alice is %d, want 4", seq)
+	}
+	// A recipient we stopped writing to starts over, long after it forgot us
+	later := now.Add(counterExpiry + time.Second)
+	if seq, _ := c.next(alice, later); seq != 1 {
+		t.Fatalf("sequence number to alice after a pause is %d, want 1", seq)
+	}
+}
+
+func TestReplayUpgradesGlobalCounter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), replayFile)
+	if err := os.WriteFile(path, []byte(`{"next":42,"peers":{}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := openReplayCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	// Recipients may still remember numbers of the old counter for a while
+	if seq, _ := c.next(newPeerID(t), now); seq != 42 {
+		t.Fatalf("first sequence number after upgrade is %d, want 42", seq)
+	}
+	if seq, _ := c.next(newPeerID(t), now.Add(maxMailboxAge+MaxClockSkew+time.Second)); seq != 1 {
+		t.Fatalf("first sequence number once forgotten is %d, want 1", seq)
+	}
+}
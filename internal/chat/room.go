@@ -0,0 +1,161 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"shadow/internal/logging"
+)
+
+const roomTopicPrefix = "shadow/room/"
+
+var roomName = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// roomMessage is published on a room topic. Pubsub signs it with the
+// sender's identity key, so the author is taken from the pubsub envelope.
+type roomMessage struct {
+	ID     string    `json:"id"`
+	Name   string    `json:"name"`
+	Puppet string    `json:"puppet,omitempty"`
+	Text   string    `json:"text"`
+	Time   time.Time `json:"time"`
+}
+
+type room struct {
+	topic  *pubsub.Topic
+	sub    *pubsub.Subscription
+	cancel context.CancelFunc
+}
+
+// JoinRoom subscribes to a room until LeaveRoom is called.
+func (s *Service) JoinRoom(name string) error {
+	if !roomName.MatchString(name) {
+		return fmt.Errorf("invalid room name: %q", name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.rooms[name]; ok {
+		return nil
+	}
+	topic, err := s.node.PubSub.Join(roomTopicPrefix + name)
+	if err != nil {
+		return fmt.Errorf("failed to join room: %w", err)
+	}
+	sub, err := topic.Subscribe()
+	if err != nil {
+		topic.Close()
+		return fmt.Errorf("failed to subscribe to room: %w", err)
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.rooms[name] = &room{topic: topic, sub: sub, cancel: cancel}
+	go s.readRoom(ctx, name, sub)
+	return nil
+}
+
+// LeaveRoom unsubscribes from a room.
+func (s *Service) LeaveRoom(name string) error {
+	s.mu.Lock()
+	r, ok := s.rooms[name]
+	delete(s.rooms, name)
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("not in room %s", name)
+	}
+	r.cancel()
+	r.sub.Cancel()
+	return r.topic.Close()
+}
+
+// Rooms lists the joined rooms.
+func (s *Service) Rooms() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]string, 0, len(s.rooms))
+	for name := range s.rooms {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// RoomPeers lists the peers we know to be subscribed to a joined room.
+func (s *Service) RoomPeers(name string) ([]peer.ID, error) {
+	s.mu.Lock()
+	r, ok := s.rooms[name]
+	s.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("not in room %s", name)
+	}
+	return r.topic.ListPeers(), nil
+}
+
+// SendRoom publishes text to a joined room.
+func (s *Service) SendRoom(ctx context.Context, name, text string) (Message, error) {
+	return s.SendRoomAs(ctx, name, "", text)
+}
+
+// SendRoomAs is SendRoom on behalf of puppet, a remote user of a bridge.
+func (s *Service) SendRoomAs(ctx context.Context, name, puppet, text string) (Message, error) {
+	s.mu.Lock()
+	r, ok := s.rooms[name]
+	s.mu.Unlock()
+	if !ok {
+		return Message{}, fmt.Errorf("not in room %s", name)
+	}
+	m := Message{
+		ID:     newID(),
+		From:   s.node.Host.ID(),
+		Name:   s.node.Identity.Username(),
+		Room:   name,
+		Text:   text,
+		Time:   time.Now().UTC(),
+		Puppet: puppet,
+	}
+	data, err := json.Marshal(roomMessage{ID: m.ID, Name: m.Name, Puppet: m.Puppet, Text: m.Text, Time: m.Time})
+	if err != nil {
+		return Message{}, err
+	}
+	if len(data) > MaxMessageSize {
+		return Message{}, fmt.Errorf("message too large")
+	}
+	if err := r.topic.Publish(ctx, data); err != nil {
+		return Message{}, fmt.Errorf("failed to publish: %w", err)
+	}
+	s.record(m)
+	return m, nil
+}
+
+func (s *Service) readRoom(ctx context.Context, name string, sub *pubsub.Subscription) {
+	self := s.node.Host.ID()
+	for {
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			return
+		}
+		from := msg.GetFrom()
+		if from == self {
+			continue
+		}
+		rm, err := decodeRoomMessage(msg.Data)
+		if err != nil {
+			logging.Println("Invalid room message from", from, ":", err)
+			continue
+		}
+		s.deliver(Message{
+			ID:     rm.ID,
+			From:   from,
+			Name:   rm.Name,
+			Room:   name,
+			Text:   rm.Text,
+			Time:   rm.Time,
+			Puppet: rm.Puppet,
+		})
+	}
+}
@@ -0,0 +1,433 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	p2pcrypto "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"shadow/internal/crypto"
+	"shadow/internal/logging"
+	"shadow/internal/mailbox"
+	"shadow/internal/relay"
+)
+
+// Sealed-sender delivery: a direct message envelope is wrapped with the
+// sender's public key in an anonymous box only the recipient can open, and
+// deposited in the recipient's mailbox on its relay from a throwaway host.
+// The relay learns the recipient and the size of the blob, not the sender.
+// Deposits are authorized by a delivery token the recipient hands out inside
+// its own direct messages, one per contact, so a contact can be cut off
+// without touching the others.
+
+const (
+	mailboxFile = "mailbox.json"
+	// tokenRefresh is how often the delivery tokens are registered again.
+	tokenRefresh = mailbox.TokenTTL / 2
+	// tokenRotation is how old a contact's token gets before the next message
+	// to it carries a new one. The previous token stays valid until the
+	// rotation after, for deposits made before the contact saw the new one.
+	tokenRotation  = 7 * 24 * time.Hour
+	mailboxRetry   = 10 * time.Second
+	depositTimeout = 30 * time.Second
+)
+
+// errNoMailbox is returned when a peer never told us where its mailbox is.
+var errNoMailbox = errors.New("no mailbox known for peer")
+
+// mailboxRoute is where and how to deposit into a peer's mailbox.
+type mailboxRoute struct {
+	Relay []string `json:"relay"` // p2p multiaddrs of the relay
+	Token []byte   `json:"token"`
+}
+
+// sealedEnvelope is what a sealed-sender blob opens to. Envelope is a direct
+// message envelope sealed with the key From and the recipient share, which
+// authenticates From to the recipient.
+type sealedEnvelope struct {
+	From     []byte `json:"from"` // marshalled public key
+	Envelope []byte `json:"envelope"`
+}
+
+// issuedToken authorizes one contact's deposits into our mailbox.
+type issuedToken struct {
+	Current  []byte    `json:"current"`
+	Previous []byte    `json:"previous,omitempty"`
+	Issued   time.Time `json:"issued"`
+}
+
+type mailboxState struct {
+	// Tokens are those we handed out, by contact
+	Tokens map[peer.ID]*issuedToken `json:"tokens"`
+	Routes map[peer.ID]mailboxRoute `json:"routes"`
+}
+
+// mailboxStore keeps our delivery tokens and the mailbox routes of peers,
+// saved to path if set.
+type mailboxStore struct {
+	path string
+
+	mu    sync.Mutex
+	state mailboxState
+	// own is the relay of our mailbox, nil until registered at one
+	own   []string
+	ownID peer.ID
+	// changed is set when tokens were issued or revoked since they were
+	// last registered, and wake is signalled
+	changed bool
+	wake    chan struct{}
+}
+
+func openMailboxStore(path string) (*mailboxStore, error) {
+	ms := &mailboxStore{path: path, state: mailboxState{Routes: map[peer.ID]mailboxRoute{}}, wake: make(chan struct{}, 1)}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		switch {
+		case err == nil:
+			if err := json.Unmarshal(data, &ms.state); err != nil {
+				return nil, fmt.Errorf("invalid mailbox state %s: %w", path, err)
+			}
+		case !errors.Is(err, os.ErrNotExist):
+			return nil, fmt.Errorf("failed to read mailbox state: %w", err)
+		}
+	}
+	if ms.state.Routes == nil {
+		ms.state.Routes = map[peer.ID]mailboxRoute{}
+	}
+	if ms.state.Tokens == nil {
+		ms.state.Tokens = map[peer.ID]*issuedToken{}
+	}
+	return ms, nil
+}
+
+// tokens returns every token to register, those of the contacts issued
+// most recently first if there are more than a mailbox takes, and clears
+// changed.
+func (ms *mailboxStore) tokens() [][]byte {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.changed = false
+	issued := slices.SortedFunc(maps.Values(ms.state.Tokens), func(a, b *issuedToken) int {
+		return b.Issued.Compare(a.Issued)
+	})
+	var out [][]byte
+	for _, t := range issued {
+		if len(out)+2 > mailbox.MaxTokens {
+			break
+		}
+		out = append(out, t.Current)
+		if t.Previous != nil {
+			out = append(out, t.Previous)
+		}
+	}
+	return out
+}
+
+// tokensChanged reports whether tokens must be registered again.
+func (ms *mailboxStore) tokensChanged() bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.changed
+}
+
+// changedLocked marks the tokens for registration.
+func (ms *mailboxStore) changedLocked() {
+	ms.changed = true
+	select {
+	case ms.wake <- struct{}{}:
+	default:
+	}
+}
+
+// tokenFor returns the token of p, issuing one if p has none or rotating it
+// if it is due.
+func (ms *mailboxStore) tokenFor(p peer.ID) []byte {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	t, ok := ms.state.Tokens[p]
+	if ok && time.Since(t.Issued) < tokenRotation {
+		return t.Current
+	}
+	next := &issuedToken{Current: make([]byte, mailbox.TokenSize), Issued: time.Now()}
+	rand.Read(next.Current)
+	if ok {
+		next.Previous = t.Current
+	}
+	ms.state.Tokens[p] = next
+	ms.changedLocked()
+	if err := ms.saveLocked(); err != nil {
+		logging.Println("Failed to save mailbox state:", err)
+	}
+	return next.Current
+}
+
+// revoke drops the tokens of p.
+func (ms *mailboxStore) revoke(p peer.ID) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, ok := ms.state.Tokens[p]; !ok {
+		return nil
+	}
+	delete(ms.state.Tokens, p)
+	ms.changedLocked()
+	return ms.saveLocked()
+}
+
+func (ms *mailboxStore) route(p peer.ID) (mailboxRoute, bool) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	r, ok := ms.state.Routes[p]
+	return r, ok
+}
+
+func (ms *mailboxStore) setRoute(p peer.ID, r mailboxRoute) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if old, ok := ms.state.Routes[p]; ok && bytes.Equal(old.Token, r.Token) && slices.Equal(old.Relay, r.Relay) {
+		return
+	}
+	ms.state.Routes[p] = r
+	if err := ms.saveLocked(); err != nil {
+		logging.Println("Failed to save mailbox state:", err)
+	}
+}
+
+// ownRoute returns the route to our mailbox to hand to p, nil until the
+// mailbox is registered at a relay.
+func (ms *mailboxStore) ownRoute(p peer.ID) *mailboxRoute {
+	ms.mu.Lock()
+	relay := ms.own
+	ms.mu.Unlock()
+	if relay == nil {
+		return nil
+	}
+	return &mailboxRoute{Relay: relay, Token: ms.tokenFor(p)}
+}
+
+func (ms *mailboxStore) setOwn(relay peer.AddrInfo) {
+	addrs, _ := peer.AddrInfoToP2pAddrs(&relay)
+	var own []string
+	for _, a := range addrs {
+		own = append(own, a.String())
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.own, ms.ownID = own, relay.ID
+}
+
+// ownRelay returns the relay our mailbox is registered at, "" if none.
+func (ms *mailboxStore) ownRelay() peer.ID {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.ownID
+}
+
+func (ms *mailboxStore) saveLocked() error {
+	if ms.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(ms.state)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(ms.path), "."+filepath.Base(ms.path))
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ms.path)
+}
+
+// SetSealedSender makes direct messages go through the recipient's mailbox
+// whenever its location is known, so relays do not see who talks to whom.
+// Otherwise the mailbox is only used when the recipient cannot be reached.
+func (s *Service) SetSealedSender(on bool) {
+	s.sealedSender.Store(on)
+}
+
+// RevokeMailbox stops accepting deposits into our mailbox from p, once the
+// tokens are registered again, within mailbox.MaxWait. A message to p
+// issues it a new token.
+func (s *Service) RevokeMailbox(p peer.ID) error {
+	if err := s.mailbox.revoke(p); err != nil {
+		return fmt.Errorf("failed to save mailbox state: %w", err)
+	}
+	return nil
+}
+
+// SealedSender reports whether SetSealedSender is on.
+func (s *Service) SealedSender() bool {
+	return s.sealedSender.Load()
+}
+
+// sealedEnvelope wraps the direct message envelope data with our public key.
+func (s *Service) sealedEnvelope(data []byte) ([]byte, error) {
+	from, err := p2pcrypto.MarshalPublicKey(s.node.Identity.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(sealedEnvelope{From: from, Envelope: data})
+}
+
+// deposit seals the direct message envelope data for to and leaves it in
+// to's mailbox, connecting to its relay under a throwaway identity.
+func (s *Service) deposit(ctx context.Context, to peer.ID, pub p2pcrypto.PubKey, data []byte) error {
+	route, ok := s.mailbox.route(to)
+	if !ok {
+		return errNoMailbox
+	}
+	inner, err := s.sealedEnvelope(data)
+	if err != nil {
+		return err
+	}
+	blob, err := crypto.SealAnonymous(pub, inner)
+	if err != nil {
+		return fmt.Errorf("failed to seal message: %w", err)
+	}
+	relays, err := relay.ParseAddrs(route.Relay)
+	if err != nil || len(relays) != 1 {
+		return fmt.Errorf("invalid mailbox relay of %s", to)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, depositTimeout)
+	defer cancel()
+	h, err := s.node.NewEphemeralHost()
+	if err != nil {
+		return fmt.Errorf("failed to start ephemeral host: %w", err)
+	}
+	defer h.Close()
+	if err := h.Connect(ctx, relays[0]); err != nil {
+		return fmt.Errorf("failed to reach mailbox relay: %w", err)
+	}
+	if err := mailbox.NewClient(h, relays[0].ID).Deposit(ctx, to, route.Token, blob); err != nil {
+		return err
+	}
+	return nil
+}
+
+// openSealed opens a blob from our mailbox and delivers the message in it.
+func (s *Service) openSealed(blob []byte) error {
+	inner, err := crypto.OpenAnonymous(s.node.Identity.PrivateKey(), blob)
+	if err != nil {
+		return fmt.Errorf("failed to open: %w", err)
+	}
+	return s.receiveSealed(inner, viaMailbox)
+}
+
+// receiveSealed delivers the message in a sealed envelope.
+func (s *Service) receiveSealed(inner []byte, via delivery) error {
+	var env sealedEnvelope
+	if err := json.Unmarshal(inner, &env); err != nil {
+		return fmt.Errorf("invalid sealed envelope: %w", err)
+	}
+	pub, err := p2pcrypto.UnmarshalPublicKey(env.From)
+	if err != nil {
+		return fmt.Errorf("invalid sender key: %w", err)
+	}
+	from, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		return err
+	}
+	return s.receiveDirect(from, pub, env.Envelope, via)
+}
+
+// runMailbox keeps our delivery tokens registered at the best relay and
+// fetches what is deposited there, until ctx is done.
+func (s *Service) runMailbox(ctx context.Context) {
+	var registered peer.ID
+	var registeredAt time.Time
+	var lastErr string
+	fail := func(err error) {
+		if err.Error() != lastErr {
+			logging.Println("Mailbox:", err)
+			lastErr = err.Error()
+		}
+		registered = ""
+		select {
+		case <-ctx.Done():
+		case <-time.After(mailboxRetry):
+		}
+	}
+	// New tokens are registered right away rather than after the fetch
+	// waiting below, on a stream of their own
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.mailbox.wake:
+			}
+			relay := s.mailbox.ownRelay()
+			if relay == "" {
+				continue
+			}
+			if err := mailbox.NewClient(s.node.Host, relay).SetTokens(ctx, s.mailbox.tokens()...); err != nil && ctx.Err() == nil {
+				// The loop below tries again after its fetch
+				logging.Println("Mailbox:", err)
+				s.mailbox.mu.Lock()
+				s.mailbox.changed = true
+				s.mailbox.mu.Unlock()
+			}
+		}
+	}()
+	for ctx.Err() == nil {
+		best, ok := s.node.Relays.Best()
+		if !ok {
+			fail(fmt.Errorf("no relay reachable"))
+			continue
+		}
+		c := mailbox.NewClient(s.node.Host, best.ID)
+		if best.ID != registered || time.Since(registeredAt) > tokenRefresh || s.mailbox.tokensChanged() {
+			if err := c.SetTokens(ctx, s.mailbox.tokens()...); err != nil {
+				fail(err)
+				continue
+			}
+			registered, registeredAt = best.ID, time.Now()
+			s.mailbox.setOwn(best)
+		}
+		fctx, cancel := context.WithTimeout(ctx, mailbox.MaxWait+10*time.Second)
+		blobs, err := c.Fetch(fctx, mailbox.MaxWait)
+		cancel()
+		if err != nil {
+			if ctx.Err() == nil {
+				fail(err)
+			}
+			continue
+		}
+		lastErr = ""
+		for _, b := range blobs {
+			if err := s.openSealed(b); err != nil {
+				logging.Println("Rejected mailbox message:", err)
+			}
+		}
+	}
+}
+
+// FetchMailbox takes what waits in our mailbox now and delivers it. Messages
+// are also fetched in the background.
+func (s *Service) FetchMailbox(ctx context.Context) error {
+	best, ok := s.node.Relays.Best()
+	if !ok {
+		return fmt.Errorf("no relay reachable")
+	}
+	blobs, err := mailbox.NewClient(s.node.Host, best.ID).Fetch(ctx, 0)
+	if err != nil {
+		return err
+	}
+	for _, b := range blobs {
+		if err := s.openSealed(b); err != nil {
+			logging.Println("Rejected mailbox message:", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package chat
+
+import (
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	p2pcrypto "github.com/libp2p/go-libp2p/core/crypto"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	ma "github.com/multiformats/go-multiaddr"
+
+	"shadow/internal/crypto"
+	"shadow/internal/identity"
+	"shadow/internal/node"
+)
+
+// newTestService returns a service on a mocknet host, without history or
+// background tasks.
+func newTestService(t *testing.T, mn mocknet.Mocknet, name string) *Service {
+	t.Helper()
+	priv, _, err := p2pcrypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := mn.AddPeer(priv, ma.StringCast("/ip4/127.0.0.1/tcp/4001"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := identity.New(priv, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{node: &node.Node{Host: h, Identity: id}, subs: map[chan Message]struct{}{}}
+	if s.replay, err = openReplayCache(""); err != nil {
+		t.Fatal(err)
+	}
+	if s.mailbox, err = openMailboxStore(""); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// mailboxBlob seals p from s for to the way deposit leaves it in to's mailbox.
+func mailboxBlob(t *testing.T, s, to *Service, p payload) []byte {
+	t.Helper()
+	key, err := crypto.DeriveShared(s.node.Identity.PrivateKey(), to.node.Identity.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := sealDirect(key, p, crypto.PadNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, err := s.sealedEnvelope(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := crypto.SealAnonymous(to.node.Identity.PublicKey(), inner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blob
+}
+
+func TestMailboxDeliversOldMessages(t *testing.T) {
+	mn := mocknet.New()
+	defer mn.Close()
+	alice, bob := newTestService(t, mn, "alice"), newTestService(t, mn, "bob")
+	msgs, unsub := bob.Subscribe()
+	defer unsub()
+
+	// Bob was offline for an hour
+	sent := time.Now().Add(-time.Hour).UTC()
+	blob := mailboxBlob(t, alice, bob, payload{ID: newID(), Seq: 1, Name: "alice", Text: "while you were away", Time: sent})
+	if err := bob.openSealed(blob); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-msgs:
+		if m.From != alice.node.Host.ID() || m.Text != "while you were away" || !m.Mailbox {
+			t.Fatalf("got %+v", m)
+		}
+	default:
+		t.Fatal("message from the mailbox not delivered")
+	}
+	if err := bob.openSealed(blob); !errors.Is(err, ErrReplay) {
+		t.Fatalf("replay: got %v, want ErrReplay", err)
+	}
+
+	// Only the mailbox may hold a message that long
+	key, err := crypto.DeriveShared(alice.node.Identity.PrivateKey(), bob.node.Identity.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := sealDirect(key, payload{ID: newID(), Seq: 2, Text: "late", Time: sent}, crypto.PadNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.receiveDirect(alice.node.Host.ID(), alice.node.Identity.PublicKey(), data, viaStream); !errors.Is(err, ErrStale) {
+		t.Fatalf("old message on a stream: got %v, want ErrStale", err)
+	}
+	old := mailboxBlob(t, alice, bob, payload{ID: newID(), Seq: 3, Text: "expired", Time: time.Now().Add(-maxMailboxAge - time.Hour)})
+	if err := bob.openSealed(old); !errors.Is(err, ErrStale) {
+		t.Fatalf("message older than the mailbox keeps: got %v, want ErrStale", err)
+	}
+}
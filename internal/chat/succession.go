@@ -0,0 +1,239 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	"shadow/internal/identity"
+	"shadow/internal/logging"
+)
+
+// Key rotation: a peer that replaces its key signs a succession record with
+// the old and the new one, publishes it in the DHT and pushes it to its
+// contacts. Whoever has the old key as a contact moves the conversation over
+// to the new one, and messages to the old key go to the new one from then on.
+// A verification of the old key does not carry over.
+
+// SuccessionProtocol pushes a succession record to a contact.
+const SuccessionProtocol = protocol.ID("/shadow/succession/1.0.0")
+
+const (
+	maxSuccessionSize = 4 << 10
+	// successionInterval is how often our records are republished in the DHT
+	// and those of contacts looked up.
+	successionInterval = 6 * time.Hour
+	// successionPushAge is how long after a rotation contacts are sent the
+	// record on every start, for those that were offline.
+	successionPushAge = 30 * 24 * time.Hour
+	// maxSuccessions bounds the successors followed from a key.
+	maxSuccessions = 16
+)
+
+// KeyChange is the notice that a contact rotated its key.
+type KeyChange struct {
+	Old peer.ID `json:"old"`
+	New peer.ID `json:"new"`
+	// Verified is set when the old key was verified; the new one is not.
+	Verified bool `json:"verified,omitempty"`
+}
+
+// Rotate replaces the key of our identity, which must be restarted with the
+// returned one to use it. The record of the succession is published in the
+// DHT and pushed to every contact, those offline get it on a later start. A
+// service rotates at most once.
+func (s *Service) Rotate(ctx context.Context) (*identity.Identity, *identity.Succession, error) {
+	if !s.rotated.CompareAndSwap(false, true) {
+		return nil, nil, fmt.Errorf("key already rotated, restart to use the new one")
+	}
+	next, rec, err := s.node.Identity.Rotate()
+	if err != nil {
+		s.rotated.Store(false)
+		return nil, nil, fmt.Errorf("failed to rotate key: %w", err)
+	}
+	if err := s.putSuccession(ctx, rec); err != nil {
+		logging.Println("Failed to publish succession record:", err)
+	}
+	s.pushSuccession(ctx, rec, s.node.Contacts())
+	return next, rec, nil
+}
+
+func (s *Service) putSuccession(ctx context.Context, rec *identity.Succession) error {
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+	return s.node.DHT.PutSuccession(ctx, rec)
+}
+
+// pushSuccession sends rec to each of to.
+func (s *Service) pushSuccession(ctx context.Context, rec *identity.Succession, to []peer.ID) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		logging.Println("Failed to encode succession record:", err)
+		return
+	}
+	var wg sync.WaitGroup
+	for _, p := range to {
+		if p == rec.New {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.sendSuccession(ctx, p, data); err != nil {
+				logging.Println("Failed to send succession record to", p, ":", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *Service) sendSuccession(ctx context.Context, to peer.ID, data []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+	if len(s.node.Host.Peerstore().Addrs(to)) == 0 {
+		if _, err := s.node.FindPeer(ctx, to); err != nil {
+			return fmt.Errorf("failed to find peer: %w", err)
+		}
+	}
+	st, err := s.node.OpenStream(ctx, to, SuccessionProtocol)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	if _, err := st.Write(data); err != nil {
+		st.Reset()
+		return err
+	}
+	return nil
+}
+
+func (s *Service) handleSuccession(st network.Stream) {
+	defer st.Close()
+	st.SetReadDeadline(time.Now().Add(sendTimeout))
+	data, err := io.ReadAll(io.LimitReader(st, maxSuccessionSize+1))
+	if err != nil || len(data) > maxSuccessionSize {
+		st.Reset()
+		return
+	}
+	rec, err := identity.ParseSuccession(data)
+	if err != nil {
+		logging.Println("Rejected succession record from", st.Conn().RemotePeer(), ":", err)
+		return
+	}
+	s.follow(rec)
+}
+
+// follow moves the contact rec.Old over to rec.New and delivers the notice.
+// Records of peers that are not contacts are ignored, as is any record of a
+// key that already has another successor.
+func (s *Service) follow(rec *identity.Succession) {
+	old, next := rec.Old, rec.New
+	if succ := s.node.Successor(old); succ != "" {
+		if succ != next {
+			logging.Println("Ignored conflicting succession record of", old)
+		}
+		return
+	}
+	if !s.node.IsContact(old) {
+		return
+	}
+	verified := s.node.MigrateContact(old, next)
+	if s.history != nil {
+		if err := s.history.Rename(old.String(), next.String()); err != nil {
+			logging.Println("Failed to move history:", err)
+		}
+	}
+	if err := s.padding.move(old.String(), next.String()); err != nil {
+		logging.Println("Failed to move padding settings:", err)
+	}
+	if err := s.onion.move(old.String(), next.String()); err != nil {
+		logging.Println("Failed to move onion settings:", err)
+	}
+	text := "changed their key"
+	if verified {
+		text += "; the new key is not verified"
+	}
+	s.deliver(Message{
+		ID:        newID(),
+		From:      next,
+		Name:      s.node.PeerName(next),
+		To:        s.node.Host.ID(),
+		Text:      text,
+		Time:      time.Now().UTC(),
+		KeyChange: &KeyChange{Old: old, New: next, Verified: verified},
+	})
+}
+
+// current follows the successors of p to its latest key.
+func (s *Service) current(p peer.ID) peer.ID {
+	for i := 0; i < maxSuccessions; i++ {
+		next := s.node.Successor(p)
+		if next == "" {
+			break
+		}
+		p = next
+	}
+	return p
+}
+
+// runSuccession keeps our succession records in the DHT, sends the latest to
+// contacts on every start for successionPushAge after the rotation, and
+// looks up those of contacts.
+func (s *Service) runSuccession(ctx context.Context) {
+	own, err := s.node.Identity.Successions()
+	if err != nil {
+		logging.Println("Failed to load succession records:", err)
+	}
+	if n := len(own); n > 0 {
+		if rec := own[n-1]; rec.New == s.node.Host.ID() && time.Since(rec.Time) < successionPushAge {
+			s.pushSuccession(ctx, rec, s.node.Contacts())
+		}
+	}
+	t := time.NewTicker(successionInterval)
+	defer t.Stop()
+	for {
+		// Records of earlier keys let contacts that missed a rotation follow
+		// the whole chain
+		for _, rec := range own {
+			if err := s.putSuccession(ctx, rec); err != nil && ctx.Err() == nil {
+				logging.Println("Failed to publish succession record:", err)
+			}
+		}
+		s.CheckSuccessions(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// CheckSuccessions looks up a succession record of every contact in the DHT
+// and follows those found.
+func (s *Service) CheckSuccessions(ctx context.Context) {
+	for _, p := range s.node.Contacts() {
+		lctx, cancel := context.WithTimeout(ctx, sendTimeout)
+		rec, err := s.node.DHT.GetSuccession(lctx, p)
+		cancel()
+		if err == nil {
+			s.follow(rec)
+		}
+	}
+}
+
+// SetVerified records whether the key of contact p was checked out of band.
+// A verified contact that rotates its key is reported with a warning.
+func (s *Service) SetVerified(p peer.ID, verified bool) error {
+	if !s.node.IsContact(p) {
+		return fmt.Errorf("not a contact: %s", p)
+	}
+	s.node.SetVerified(p, verified)
+	return nil
+}
@@ -0,0 +1,96 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// anonymousInfo separates keys of anonymous boxes from those of DeriveShared.
+const anonymousInfo = "shadow-sealed-sender-v1"
+
+// anonymousKey derives the AEAD key of an anonymous box from the DH output
+// and both public keys.
+func anonymousKey(dh, ephPub, recipient []byte) ([]byte, error) {
+	salt := append(append([]byte{}, ephPub...), recipient...)
+	h := hkdf.New(sha256.New, dh, salt, []byte(anonymousInfo))
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(h, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// SealAnonymous encrypts msg for the holder of to's private key under a fresh
+// ephemeral key, so the box says nothing about who sealed it. The result is
+// the ephemeral X25519 public key followed by a Seal envelope.
+func SealAnonymous(to crypto.PubKey, msg []byte) ([]byte, error) {
+	rawPub, err := to.Raw()
+	if err != nil {
+		return nil, err
+	}
+	xPub, err := ed25519PubKeyToX25519(rawPub)
+	if err != nil {
+		return nil, err
+	}
+	eph := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(eph); err != nil {
+		return nil, err
+	}
+	ephPub, err := curve25519.X25519(eph, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	dh, err := curve25519.X25519(eph, xPub)
+	if err != nil {
+		return nil, err
+	}
+	key, err := anonymousKey(dh, ephPub, xPub)
+	if err != nil {
+		return nil, err
+	}
+	env, err := seal(key, msg)
+	if err != nil {
+		return nil, err
+	}
+	return append(ephPub, env...), nil
+}
+
+// OpenAnonymous decrypts a box made by SealAnonymous for priv.
+func OpenAnonymous(priv crypto.PrivKey, box []byte) ([]byte, error) {
+	if len(box) < curve25519.PointSize {
+		return nil, fmt.Errorf("box too short")
+	}
+	rawPriv, err := priv.Raw()
+	if err != nil {
+		return nil, err
+	}
+	if len(rawPriv) < 32 {
+		return nil, fmt.Errorf("not an Ed25519 key")
+	}
+	xPriv, err := ed25519SeedToX25519Priv(rawPriv[:32])
+	if err != nil {
+		return nil, err
+	}
+	xPub, err := curve25519.X25519(xPriv, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	ephPub, env := box[:curve25519.PointSize], box[curve25519.PointSize:]
+	// Fails on low-order ephemeral keys, whose output would be all zeros
+	dh, err := curve25519.X25519(xPriv, ephPub)
+	if err != nil {
+		return nil, err
+	}
+	key, err := anonymousKey(dh, ephPub, xPub)
+	if err != nil {
+		return nil, err
+	}
+	return open(key, env)
+}
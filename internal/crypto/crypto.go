@@ -66,6 +66,10 @@ func ed25519PubKeyToX25519(ed25519Pub []byte) ([]byte, error) {
 	if _, err := A.SetBytes(ed25519Pub); err != nil {
 		return nil, err
 	}
+	// Low-order points give a DH output an attacker knows in advance
+	if new(edwards25519.Point).MultByCofactor(&A).Equal(edwards25519.NewIdentityPoint()) == 1 {
+		return nil, fmt.Errorf("invalid Ed25519 public key: low-order point")
+	}
 	montX := A.BytesMontgomery()
 	return montX[:], nil
 }
@@ -0,0 +1,261 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	mrand "math/rand/v2"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// lowOrderPoints are the encodings of the eight points of order dividing 8,
+// with the non-canonical sign variants of the order 1 and 4 points.
+var lowOrderPoints = []string{
+	"0100000000000000000000000000000000000000000000000000000000000000",
+	"0100000000000000000000000000000000000000000000000000000000000080",
+	"ecffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f",
+	"0000000000000000000000000000000000000000000000000000000000000000",
+	"0000000000000000000000000000000000000000000000000000000000000080",
+	"c7176a703d4dd84fba3c0b760d10670f2a2053fa2c39ccc64ec7fd7792ac037a",
+	"c7176a703d4dd84fba3c0b760d10670f2a2053fa2c39ccc64ec7fd7792ac03fa",
+	"26e8958fc2b227b045c3f489f2ef98f0d5dfac05d3c63339b13802886d53fc05",
+	"26e8958fc2b227b045c3f489f2ef98f0d5dfac05d3c63339b13802886d53fc85",
+}
+
+// notOnCurve are 32-byte strings that decode to no point.
+var notOnCurve = []string{
+	"0200000000000000000000000000000000000000000000000000000000000000",
+	"0700000000000000000000000000000000000000000000000000000000000000",
+	"1100000000000000000000000000000000000000000000000000000000000000",
+}
+
+func newKey(t testing.TB) crypto.PrivKey {
+	t.Helper()
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv
+}
+
+func newSecret(t testing.TB) []byte {
+	t.Helper()
+	key := make([]byte, chacha20poly1305.KeySize)
+	rand.Read(key)
+	return key
+}
+
+func TestDeriveSharedAgrees(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		a, b := newKey(t), newKey(t)
+		ab, err := DeriveShared(a, b.GetPublic())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ba, err := DeriveShared(b, a.GetPublic())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(ab, ba) {
+			t.Fatalf("keys differ: %x and %x", ab, ba)
+		}
+		c := newKey(t)
+		if ac, _ := DeriveShared(a, c.GetPublic()); bytes.Equal(ab, ac) {
+			t.Fatal("different peers derived the same key")
+		}
+	}
+}
+
+// The converted public key must be the X25519 public key of the converted seed.
+func TestConversionMatches(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		priv := newKey(t)
+		raw, _ := priv.Raw()
+		pub, _ := priv.GetPublic().Raw()
+		xPriv, err := ed25519SeedToX25519Priv(raw[:32])
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := curve25519.X25519(xPriv, curve25519.Basepoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ed25519PubKeyToX25519(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("converted %x to %x, want %x", pub, got, want)
+		}
+	}
+}
+
+func TestPubKeyRejectsLowOrder(t *testing.T) {
+	for _, h := range lowOrderPoints {
+		b, _ := hex.DecodeString(h)
+		if _, err := ed25519PubKeyToX25519(b); err == nil {
+			t.Errorf("accepted low-order point %s", h)
+		}
+	}
+}
+
+func TestPubKeyRejectsInvalid(t *testing.T) {
+	for _, h := range notOnCurve {
+		b, _ := hex.DecodeString(h)
+		if _, err := ed25519PubKeyToX25519(b); err == nil {
+			t.Errorf("accepted invalid point %s", h)
+		}
+	}
+	for _, n := range []int{0, 1, 31, 33, 64} {
+		if _, err := ed25519PubKeyToX25519(make([]byte, n)); err == nil {
+			t.Errorf("accepted %d-byte key", n)
+		}
+	}
+}
+
+func TestSealOpenRoundTrip(t *testing.T) {
+	key := newSecret(t)
+	rng := mrand.New(mrand.NewPCG(1, 2))
+	for _, n := range []int{0, 1, 15, 16, 17, 255, 4096, 64 << 10} {
+		msg := make([]byte, n)
+		for i := range msg {
+			msg[i] = byte(rng.Uint32())
+		}
+		env, err := Seal(key, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := chacha20poly1305.NonceSize + n + chacha20poly1305.Overhead; len(env) != want {
+			t.Fatalf("envelope of %d bytes is %d bytes, want %d", n, len(env), want)
+		}
+		got, err := Open(key, env)
+		if err != nil {
+			t.Fatalf("failed to open %d bytes: %v", n, err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("round trip of %d bytes changed the message", n)
+		}
+	}
+}
+
+func TestSealUsesFreshNonces(t *testing.T) {
+	key := newSecret(t)
+	a, _ := Seal(key, []byte("hello"))
+	b, _ := Seal(key, []byte("hello"))
+	if bytes.Equal(a[:chacha20poly1305.NonceSize], b[:chacha20poly1305.NonceSize]) {
+		t.Fatal("two envelopes share a nonce")
+	}
+}
+
+func TestOpenRejectsTruncated(t *testing.T) {
+	key := newSecret(t)
+	env, _ := Seal(key, []byte("attack at dawn"))
+	for n := 0; n < len(env); n++ {
+		if _, err := Open(key, env[:n]); err == nil {
+			t.Fatalf("opened envelope truncated to %d bytes", n)
+		}
+	}
+}
+
+func TestOpenRejectsBitFlips(t *testing.T) {
+	key := newSecret(t)
+	env, _ := Seal(key, []byte("attack at dawn"))
+	for i := 0; i < len(env)*8; i++ {
+		flipped := append([]byte(nil), env...)
+		flipped[i/8] ^= 1 << (i % 8)
+		if _, err := Open(key, flipped); err == nil {
+			t.Fatalf("opened envelope with bit %d flipped", i)
+		}
+	}
+}
+
+func TestOpenRejectsWrongKey(t *testing.T) {
+	env, _ := Seal(newSecret(t), []byte("attack at dawn"))
+	if _, err := Open(newSecret(t), env); err == nil {
+		t.Fatal("opened envelope with another key")
+	}
+	if _, err := Open([]byte("short"), env); err == nil {
+		t.Fatal("opened envelope with an invalid key")
+	}
+}
+
+func TestSealAnonymous(t *testing.T) {
+	priv := newKey(t)
+	msg := []byte("attack at dawn")
+	box, err := SealAnonymous(priv.GetPublic(), msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := OpenAnonymous(priv, box)
+	if err != nil || !bytes.Equal(got, msg) {
+		t.Fatalf("OpenAnonymous = %q, %v", got, err)
+	}
+	again, _ := SealAnonymous(priv.GetPublic(), msg)
+	if bytes.Equal(box[:curve25519.PointSize], again[:curve25519.PointSize]) {
+		t.Fatal("ephemeral key reused")
+	}
+	if _, err := OpenAnonymous(newKey(t), box); err == nil {
+		t.Fatal("opened box with another key")
+	}
+	for i := 0; i < len(box)*8; i++ {
+		flipped := append([]byte(nil), box...)
+		flipped[i/8] ^= 1 << (i % 8)
+		if _, err := OpenAnonymous(priv, flipped); err == nil {
+			t.Fatalf("opened box with bit %d flipped", i)
+		}
+	}
+	if _, err := OpenAnonymous(priv, box[:curve25519.PointSize-1]); err == nil {
+		t.Fatal("opened truncated box")
+	}
+}
+
+func FuzzSealOpen(f *testing.F) {
+	key := newSecret(f)
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		env, err := Seal(key, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := Open(key, env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("round trip changed %x to %x", msg, got)
+		}
+	})
+}
+
+// FuzzOpen feeds arbitrary envelopes to Open. Without the key nothing may
+// open, and nothing may panic.
+func FuzzOpen(f *testing.F) {
+	key := newSecret(f)
+	f.Fuzz(func(t *testing.T, env []byte) {
+		if _, err := Open(key, env); err == nil {
+			t.Fatalf("opened forged envelope %x", env)
+		}
+	})
+}
+
+// FuzzEd25519PubKeyToX25519 checks that every accepted key is usable: a
+// low-order point would make the X25519 output all zeros.
+func FuzzEd25519PubKeyToX25519(f *testing.F) {
+	scalar := make([]byte, curve25519.ScalarSize)
+	rand.Read(scalar)
+	f.Fuzz(func(t *testing.T, pub []byte) {
+		x, err := ed25519PubKeyToX25519(pub)
+		if err != nil {
+			return
+		}
+		if len(x) != curve25519.PointSize {
+			t.Fatalf("converted key is %d bytes", len(x))
+		}
+		if _, err := curve25519.X25519(scalar, x); err != nil {
+			t.Fatalf("accepted key %x is unusable: %v", pub, err)
+		}
+	})
+}
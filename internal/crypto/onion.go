@@ -0,0 +1,268 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Onion packets follow Sphinx: every hop finds its routing information and
+// the next hop's header under a key only it can derive, and every packet has
+// the same size whatever the path length and position on it. Unlike Sphinx
+// the sender draws a fresh ephemeral key per hop and passes it along in the
+// header instead of blinding one key, which keeps to X25519 as it is.
+//
+// A packet is version || alpha || gamma || beta || delta: alpha the ephemeral
+// key of the hop, gamma the MAC of beta, beta the encrypted routing slots and
+// delta the payload encrypted once per hop. The last hop opens the payload
+// with ChaCha20-Poly1305, which also catches a payload tampered with on the way.
+
+const (
+	// OnionMaxHops bounds the hops of a path, the final recipient included.
+	OnionMaxHops = 5
+	// OnionRoutingSize is the room for routing information of each hop.
+	OnionRoutingSize = 64
+	// OnionPayloadSize is the size of the encrypted payload of every packet.
+	OnionPayloadSize = 16 << 10
+	// OnionMaxPayload bounds what SealOnion carries.
+	OnionMaxPayload = OnionPayloadSize - 4 - chacha20poly1305.NonceSize - chacha20poly1305.Overhead
+	// OnionPacketSize is the size of every onion packet.
+	OnionPacketSize = 1 + curve25519.PointSize + onionMACSize + onionHeaderSize + OnionPayloadSize
+
+	onionVersion    = 1
+	onionInfo       = "shadow-onion-v1"
+	onionMACSize    = 16
+	onionSlotSize   = 1 + OnionRoutingSize + curve25519.PointSize + onionMACSize
+	onionHeaderSize = OnionMaxHops * onionSlotSize
+
+	slotForward = 0
+	slotDeliver = 1
+)
+
+// OnionHop is a hop of an onion path.
+type OnionHop struct {
+	Key crypto.PubKey
+	// Routing is what this hop is told, e.g. where to forward the packet.
+	// It is at most OnionRoutingSize bytes and comes back zero padded.
+	Routing []byte
+}
+
+// PeeledOnion is what a hop learns from a packet.
+type PeeledOnion struct {
+	Routing []byte
+	// Next is the packet for the next hop, nil at the last one.
+	Next []byte
+	// Payload is what the packet carried, at the last hop only.
+	Payload []byte
+	// Tag is the same for every copy of the packet and different for any
+	// other packet through this hop, for dropping replays.
+	Tag [32]byte
+}
+
+type onionKeys struct {
+	header, mac, payload, aead []byte
+	tag                        [32]byte
+}
+
+func deriveOnionKeys(dh, alpha []byte) (*onionKeys, error) {
+	h := hkdf.New(sha256.New, dh, alpha, []byte(onionInfo))
+	k := &onionKeys{
+		header:  make([]byte, chacha20.KeySize),
+		mac:     make([]byte, 32),
+		payload: make([]byte, chacha20.KeySize),
+		aead:    make([]byte, chacha20poly1305.KeySize),
+	}
+	for _, b := range [][]byte{k.header, k.mac, k.payload, k.aead, k.tag[:]} {
+		if _, err := io.ReadFull(h, b); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// xorStream XORs b with the ChaCha20 key stream of key. Keys are used for one
+// packet only, so the nonce is fixed.
+func xorStream(key, b []byte) {
+	c, err := chacha20.NewUnauthenticatedCipher(key, make([]byte, chacha20.NonceSize))
+	if err != nil {
+		panic(err) // keys are always chacha20.KeySize
+	}
+	c.XORKeyStream(b, b)
+}
+
+func onionMAC(key, beta []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write(beta)
+	return m.Sum(nil)[:onionMACSize]
+}
+
+// SealOnion wraps payload in a packet that reaches the last hop of path
+// through the others, each of which only learns its own routing information.
+func SealOnion(path []OnionHop, payload []byte) ([]byte, error) {
+	n := len(path)
+	if n == 0 || n > OnionMaxHops {
+		return nil, fmt.Errorf("onion path of %d hops (1 to %d)", n, OnionMaxHops)
+	}
+	if len(payload) > OnionMaxPayload {
+		return nil, fmt.Errorf("onion payload too large: %d > %d", len(payload), OnionMaxPayload)
+	}
+	alphas := make([][]byte, n)
+	keys := make([]*onionKeys, n)
+	for i, hop := range path {
+		if len(hop.Routing) > OnionRoutingSize {
+			return nil, fmt.Errorf("routing information of hop %d too large", i)
+		}
+		rawPub, err := hop.Key.Raw()
+		if err != nil {
+			return nil, err
+		}
+		xPub, err := ed25519PubKeyToX25519(rawPub)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key of hop %d: %w", i, err)
+		}
+		eph := make([]byte, curve25519.ScalarSize)
+		if _, err := rand.Read(eph); err != nil {
+			return nil, err
+		}
+		if alphas[i], err = curve25519.X25519(eph, curve25519.Basepoint); err != nil {
+			return nil, err
+		}
+		dh, err := curve25519.X25519(eph, xPub)
+		if err != nil {
+			return nil, err
+		}
+		if keys[i], err = deriveOnionKeys(dh, alphas[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	// The filler is what the hops before the last shift into the end of the
+	// header as they peel it, which the MACs must already cover
+	const h, s = onionHeaderSize, onionSlotSize
+	var filler []byte
+	for i := 0; i < n-1; i++ {
+		filler = append(filler, make([]byte, s)...)
+		stream := make([]byte, h+s)
+		xorStream(keys[i].header, stream)
+		for j := range filler {
+			filler[j] ^= stream[h+s-len(filler)+j]
+		}
+	}
+
+	beta := make([]byte, h)
+	slot := beta[:s]
+	slot[0] = slotDeliver
+	copy(slot[1:], path[n-1].Routing)
+	if _, err := rand.Read(beta[s : h-len(filler)]); err != nil {
+		return nil, err
+	}
+	xorStream(keys[n-1].header, beta[:h-len(filler)])
+	copy(beta[h-len(filler):], filler)
+	gamma := onionMAC(keys[n-1].mac, beta)
+
+	for i := n - 2; i >= 0; i-- {
+		next := make([]byte, h)
+		slot := next[:s]
+		slot[0] = slotForward
+		copy(slot[1:], path[i].Routing)
+		copy(slot[1+OnionRoutingSize:], alphas[i+1])
+		copy(slot[1+OnionRoutingSize+curve25519.PointSize:], gamma)
+		copy(next[s:], beta[:h-s])
+		xorStream(keys[i].header, next)
+		beta = next
+		gamma = onionMAC(keys[i].mac, beta)
+	}
+
+	sealed, err := seal(keys[n-1].aead, payload)
+	if err != nil {
+		return nil, err
+	}
+	delta := make([]byte, OnionPayloadSize)
+	binary.BigEndian.PutUint32(delta, uint32(len(sealed)))
+	copy(delta[4:], sealed)
+	for i := n - 1; i >= 0; i-- {
+		xorStream(keys[i].payload, delta)
+	}
+
+	packet := make([]byte, 0, OnionPacketSize)
+	packet = append(packet, onionVersion)
+	packet = append(packet, alphas[0]...)
+	packet = append(packet, gamma...)
+	packet = append(packet, beta...)
+	return append(packet, delta...), nil
+}
+
+// PeelOnion removes the layer of packet meant for priv.
+func PeelOnion(priv crypto.PrivKey, packet []byte) (*PeeledOnion, error) {
+	if len(packet) != OnionPacketSize {
+		return nil, fmt.Errorf("invalid onion packet size %d", len(packet))
+	}
+	if packet[0] != onionVersion {
+		return nil, fmt.Errorf("unknown onion packet version %d", packet[0])
+	}
+	rest := packet[1:]
+	alpha, rest := rest[:curve25519.PointSize], rest[curve25519.PointSize:]
+	gamma, rest := rest[:onionMACSize], rest[onionMACSize:]
+	beta, delta := rest[:onionHeaderSize], rest[onionHeaderSize:]
+
+	rawPriv, err := priv.Raw()
+	if err != nil {
+		return nil, err
+	}
+	if len(rawPriv) < 32 {
+		return nil, fmt.Errorf("not an Ed25519 key")
+	}
+	xPriv, err := ed25519SeedToX25519Priv(rawPriv[:32])
+	if err != nil {
+		return nil, err
+	}
+	dh, err := curve25519.X25519(xPriv, alpha)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := deriveOnionKeys(dh, alpha)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(onionMAC(keys.mac, beta), gamma) {
+		return nil, fmt.Errorf("invalid onion packet MAC")
+	}
+
+	const h, s = onionHeaderSize, onionSlotSize
+	b := make([]byte, h+s)
+	copy(b, beta)
+	xorStream(keys.header, b)
+	slot := b[:s]
+	d := append([]byte(nil), delta...)
+	xorStream(keys.payload, d)
+
+	peeled := &PeeledOnion{Routing: slot[1 : 1+OnionRoutingSize], Tag: keys.tag}
+	switch slot[0] {
+	case slotForward:
+		next := make([]byte, 0, OnionPacketSize)
+		next = append(next, onionVersion)
+		next = append(next, slot[1+OnionRoutingSize:]...) // alpha and gamma
+		next = append(next, b[s:]...)
+		peeled.Next = append(next, d...)
+	case slotDeliver:
+		size := binary.BigEndian.Uint32(d)
+		if size > OnionPayloadSize-4 {
+			return nil, fmt.Errorf("invalid onion payload size")
+		}
+		if peeled.Payload, err = open(keys.aead, d[4:4+size]); err != nil {
+			return nil, fmt.Errorf("failed to open onion payload: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("invalid onion routing slot")
+	}
+	return peeled, nil
+}
@@ -0,0 +1,128 @@
+package crypto
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+func newPath(t testing.TB, n int) ([]crypto.PrivKey, []OnionHop) {
+	t.Helper()
+	privs := make([]crypto.PrivKey, n)
+	path := make([]OnionHop, n)
+	for i := range path {
+		privs[i] = newKey(t)
+		path[i] = OnionHop{Key: privs[i].GetPublic(), Routing: []byte(fmt.Sprintf("hop %d", i))}
+	}
+	return privs, path
+}
+
+// routing strips the zero padding of peeled routing information.
+func routing(b []byte) []byte {
+	return bytes.TrimRight(b, "\x00")
+}
+
+func TestOnionRoundTrip(t *testing.T) {
+	for n := 1; n <= OnionMaxHops; n++ {
+		privs, path := newPath(t, n)
+		msg := []byte("attack at dawn")
+		packet, err := SealOnion(path, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, priv := range privs {
+			if len(packet) != OnionPacketSize {
+				t.Fatalf("%d hops: packet of %d bytes at hop %d", n, len(packet), i)
+			}
+			peeled, err := PeelOnion(priv, packet)
+			if err != nil {
+				t.Fatalf("%d hops: hop %d: %v", n, i, err)
+			}
+			if got := routing(peeled.Routing); !bytes.Equal(got, path[i].Routing) {
+				t.Fatalf("%d hops: hop %d routing = %q", n, i, got)
+			}
+			if i < n-1 {
+				if peeled.Next == nil || peeled.Payload != nil {
+					t.Fatalf("%d hops: hop %d is not forwarding", n, i)
+				}
+				packet = peeled.Next
+				continue
+			}
+			if peeled.Next != nil || !bytes.Equal(peeled.Payload, msg) {
+				t.Fatalf("%d hops: last hop got %q", n, peeled.Payload)
+			}
+		}
+	}
+}
+
+func TestOnionRejectsWrongHop(t *testing.T) {
+	privs, path := newPath(t, 3)
+	packet, _ := SealOnion(path, []byte("attack at dawn"))
+	if _, err := PeelOnion(privs[1], packet); err == nil {
+		t.Fatal("second hop peeled the first layer")
+	}
+	if _, err := PeelOnion(newKey(t), packet); err == nil {
+		t.Fatal("stranger peeled the packet")
+	}
+}
+
+func TestOnionRejectsTampering(t *testing.T) {
+	privs, path := newPath(t, 2)
+	packet, _ := SealOnion(path, []byte("attack at dawn"))
+	// Any change to the header fails the MAC of the first hop, a change to
+	// the sealed payload the AEAD of the last
+	for _, i := range []int{0, 1, 40, 60, 500, OnionPacketSize - OnionPayloadSize, OnionPacketSize - OnionPayloadSize + 20} {
+		flipped := append([]byte(nil), packet...)
+		flipped[i] ^= 1
+		peeled, err := PeelOnion(privs[0], flipped)
+		if err == nil {
+			_, err = PeelOnion(privs[1], peeled.Next)
+		}
+		if err == nil {
+			t.Fatalf("packet with byte %d flipped went through", i)
+		}
+	}
+}
+
+func TestOnionTagIdentifiesPacket(t *testing.T) {
+	privs, path := newPath(t, 2)
+	a, _ := SealOnion(path, []byte("attack at dawn"))
+	b, _ := SealOnion(path, []byte("attack at dawn"))
+	pa, _ := PeelOnion(privs[0], a)
+	again, _ := PeelOnion(privs[0], a)
+	pb, _ := PeelOnion(privs[0], b)
+	if pa.Tag != again.Tag {
+		t.Fatal("replayed packet has another tag")
+	}
+	if pa.Tag == pb.Tag {
+		t.Fatal("distinct packets share a tag")
+	}
+}
+
+func TestSealOnionLimits(t *testing.T) {
+	_, path := newPath(t, OnionMaxHops+1)
+	if _, err := SealOnion(path, nil); err == nil {
+		t.Fatal("sealed a path that is too long")
+	}
+	if _, err := SealOnion(path[:1], make([]byte, OnionMaxPayload+1)); err == nil {
+		t.Fatal("sealed a payload that is too large")
+	}
+	if _, err := SealOnion(path[:1], make([]byte, OnionMaxPayload)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func FuzzPeelOnion(f *testing.F) {
+	priv, _, _ := crypto.GenerateEd25519Key(bytes.NewReader(make([]byte, 64)))
+	packet, _ := SealOnion([]OnionHop{{Key: priv.GetPublic()}}, []byte("hello"))
+	f.Add(packet)
+	f.Add([]byte{onionVersion})
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		peeled, err := PeelOnion(priv, packet)
+		if err == nil && peeled.Next != nil && len(peeled.Next) != OnionPacketSize {
+			t.Fatalf("next packet of %d bytes", len(peeled.Next))
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package crypto
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// PadPolicy decides how far a plaintext is padded before sealing, so the
+// ciphertext length leaks less about the message.
+type PadPolicy string
+
+const (
+	// PadNone only adds the one-byte end marker.
+	PadNone PadPolicy = "none"
+	// PadPadme rounds lengths to Padmé sizes: at most 12% overhead, and a
+	// length leaks O(log log n) bits instead of O(log n).
+	PadPadme PadPolicy = "padme"
+	// PadBuckets rounds lengths up to 256 B, 1 KiB, 4 KiB, 16 KiB, 64 KiB,
+	// then to multiples of 64 KiB. Short messages all look alike.
+	PadBuckets PadPolicy = "buckets"
+)
+
+// padBuckets are the lengths PadBuckets rounds up to, the last one repeating.
+var padBuckets = []int{256, 1 << 10, 4 << 10, 16 << 10, 64 << 10}
+
+// padMarker ends the message within the padding, which is all zeros after it.
+const padMarker = 0x80
+
+// ParsePadPolicy parses the name of a policy.
+func ParsePadPolicy(s string) (PadPolicy, error) {
+	switch p := PadPolicy(s); p {
+	case PadNone, PadPadme, PadBuckets:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown padding policy: %q (none, padme or buckets)", s)
+}
+
+// PaddedLen returns the length n bytes are padded to under policy p.
+func (p PadPolicy) PaddedLen(n int) int {
+	switch p {
+	case PadPadme:
+		return padme(n)
+	case PadBuckets:
+		for _, b := range padBuckets {
+			if n <= b {
+				return b
+			}
+		}
+		last := padBuckets[len(padBuckets)-1]
+		return (n + last - 1) / last * last
+	}
+	return n
+}
+
+// padme returns the Padmé length of n: the low bits of n are rounded up so
+// that only about log2(log2(n)) of them remain significant.
+func padme(n int) int {
+	if n < 2 {
+		return n
+	}
+	e := bits.Len(uint(n)) - 1 // floor(log2 n)
+	s := bits.Len(uint(e))     // floor(log2 e) + 1
+	mask := 1<<(e-s) - 1
+	return (n + mask) &^ mask
+}
+
+// Pad appends an end marker and zeros to msg up to the length policy p
+// gives. Unpad strips them without knowing p.
+func Pad(msg []byte, p PadPolicy) []byte {
+	out := make([]byte, p.PaddedLen(len(msg)+1))
+	copy(out, msg)
+	out[len(msg)] = padMarker
+	return out
+}
+
+// Unpad returns the message Pad padded.
+func Unpad(padded []byte) ([]byte, error) {
+	i := len(padded) - 1
+	for i >= 0 && padded[i] == 0 {
+		i--
+	}
+	if i < 0 || padded[i] != padMarker {
+		return nil, fmt.Errorf("invalid padding")
+	}
+	return padded[:i], nil
+}
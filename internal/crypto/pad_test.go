@@ -0,0 +1,92 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPaddedLen(t *testing.T) {
+	tests := []struct {
+		policy PadPolicy
+		n      int
+		want   int
+	}{
+		{PadNone, 0, 0},
+		{PadNone, 1000, 1000},
+		{PadPadme, 1, 1},
+		{PadPadme, 9, 10},
+		{PadPadme, 100, 104},
+		{PadPadme, 1000, 1024},
+		{PadPadme, 1025, 1088},
+		{PadBuckets, 1, 256},
+		{PadBuckets, 256, 256},
+		{PadBuckets, 257, 1024},
+		{PadBuckets, 64 << 10, 64 << 10},
+		{PadBuckets, 64<<10 + 1, 128 << 10},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.PaddedLen(tt.n); got != tt.want {
+			t.Errorf("%s.PaddedLen(%d) = %d, want %d", tt.policy, tt.n, got, tt.want)
+		}
+	}
+}
+
+// Padmé never adds more than 12%, and never shrinks.
+func TestPadmeOverhead(t *testing.T) {
+	for n := 0; n < 1<<20; n += 1 + n/64 {
+		p := PadPadme.PaddedLen(n)
+		if p < n || float64(p-n) > 0.12*float64(n) {
+			t.Fatalf("padme(%d) = %d", n, p)
+		}
+	}
+}
+
+func TestPadUnpad(t *testing.T) {
+	for _, policy := range []PadPolicy{PadNone, PadPadme, PadBuckets} {
+		for _, msg := range [][]byte{nil, {0}, {0x80}, []byte("hello"), bytes.Repeat([]byte{0}, 300)} {
+			padded := Pad(msg, policy)
+			if len(padded) != policy.PaddedLen(len(msg)+1) {
+				t.Fatalf("%s: %d bytes padded to %d", policy, len(msg), len(padded))
+			}
+			got, err := Unpad(padded)
+			if err != nil {
+				t.Fatalf("%s: %v", policy, err)
+			}
+			if !bytes.Equal(got, msg) {
+				t.Fatalf("%s: unpadded %x to %x", policy, msg, got)
+			}
+		}
+	}
+}
+
+func TestUnpadRejectsMissingMarker(t *testing.T) {
+	for _, b := range [][]byte{nil, {0}, {0, 0}, {1}, {0x80, 1}, {0x81, 0}} {
+		if _, err := Unpad(b); err == nil {
+			t.Errorf("unpadded %x", b)
+		}
+	}
+}
+
+func TestParsePadPolicy(t *testing.T) {
+	for _, s := range []string{"none", "padme", "buckets"} {
+		if p, err := ParsePadPolicy(s); err != nil || string(p) != s {
+			t.Errorf("ParsePadPolicy(%q) = %q, %v", s, p, err)
+		}
+	}
+	if _, err := ParsePadPolicy("random"); err == nil {
+		t.Error("parsed an unknown policy")
+	}
+}
+
+func FuzzUnpad(f *testing.F) {
+	f.Fuzz(func(t *testing.T, padded []byte) {
+		msg, err := Unpad(padded)
+		if err != nil {
+			return
+		}
+		// What unpads must be the message Pad with no policy produces it from
+		if !bytes.HasPrefix(padded, Pad(msg, PadNone)) {
+			t.Fatalf("unpadded %x to %x", padded, msg)
+		}
+	})
+}
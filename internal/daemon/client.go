@@ -0,0 +1,298 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+
+	"shadow/internal/chat"
+	"shadow/internal/identity"
+	"shadow/internal/node"
+)
+
+// Client talks to a daemon over its Unix socket or WebSocket.
+type Client struct {
+	t      transport
+	wmu    sync.Mutex
+	nextID atomic.Int64
+
+	mu      sync.Mutex
+	pending map[string]chan message
+	err     error
+
+	notes chan Notification
+	done  chan struct{}
+}
+
+// Dial connects to the daemon at addr, a Unix socket path or a ws:// URL,
+// and authenticates with token.
+func Dial(ctx context.Context, addr, token string) (*Client, error) {
+	var t transport
+	if strings.HasPrefix(addr, "ws://") || strings.HasPrefix(addr, "wss://") {
+		ws, _, err := websocket.DefaultDialer.DialContext(ctx, addr, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to daemon: %w", err)
+		}
+		t = ws
+	} else {
+		var d net.Dialer
+		c, err := d.DialContext(ctx, "unix", addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to daemon: %w", err)
+		}
+		t = newStreamConn(c)
+	}
+
+	c := &Client{
+		t:       t,
+		pending: map[string]chan message{},
+		notes:   make(chan Notification, 64),
+		done:    make(chan struct{}),
+	}
+	go c.readLoop()
+	if err := c.Call(ctx, "auth", AuthParams{Token: token}, nil); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close disconnects from the daemon.
+func (c *Client) Close() error {
+	return c.t.Close()
+}
+
+// Done is closed when the connection to the daemon is lost.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Notifications returns the notifications pushed after Subscribe. It is
+// closed when the connection is lost.
+func (c *Client) Notifications() <-chan Notification {
+	return c.notes
+}
+
+func (c *Client) readLoop() {
+	defer close(c.notes)
+	defer close(c.done)
+	for {
+		var m message
+		if err := c.t.ReadJSON(&m); err != nil {
+			c.mu.Lock()
+			c.err = fmt.Errorf("daemon connection lost: %w", err)
+			for id, ch := range c.pending {
+				delete(c.pending, id)
+				close(ch)
+			}
+			c.mu.Unlock()
+			return
+		}
+		if m.Method != "" {
+			select {
+			case c.notes <- Notification{Method: m.Method, Params: m.Params}:
+			default:
+			}
+			continue
+		}
+		c.mu.Lock()
+		ch, ok := c.pending[string(m.ID)]
+		delete(c.pending, string(m.ID))
+		c.mu.Unlock()
+		if ok {
+			ch <- m
+		}
+	}
+}
+
+// Call invokes method with params and decodes the result into result, which may be nil.
+func (c *Client) Call(ctx context.Context, method string, params, result any) error {
+	id := strconv.FormatInt(c.nextID.Add(1), 10)
+	ch := make(chan message, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return c.err
+	}
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	req := request{JSONRPC: "2.0", ID: json.RawMessage(id), Method: method}
+	if params != nil {
+		raw, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		req.Params = raw
+	}
+	c.wmu.Lock()
+	err := c.t.WriteJSON(req)
+	c.wmu.Unlock()
+	if err != nil {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+
+	select {
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return ctx.Err()
+	case m, ok := <-ch:
+		if !ok {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return c.err
+		}
+		if m.Error != nil {
+			return m.Error
+		}
+		if result != nil {
+			return json.Unmarshal(m.Result, result)
+		}
+		return nil
+	}
+}
+
+func (c *Client) Info(ctx context.Context) (Info, error) {
+	var out Info
+	err := c.Call(ctx, "info", nil, &out)
+	return out, err
+}
+
+func (c *Client) Status(ctx context.Context) (Status, error) {
+	var out Status
+	err := c.Call(ctx, "status", nil, &out)
+	return out, err
+}
+
+func (c *Client) Peers(ctx context.Context) ([]Peer, error) {
+	var out []Peer
+	err := c.Call(ctx, "peers", nil, &out)
+	return out, err
+}
+
+func (c *Client) Whois(ctx context.Context, ref string) (Peer, error) {
+	var out Peer
+	err := c.Call(ctx, "whois", WhoisParams{Peer: ref}, &out)
+	return out, err
+}
+
+func (c *Client) Discover(ctx context.Context) ([]Peer, error) {
+	var out []Peer
+	err := c.Call(ctx, "discover", nil, &out)
+	return out, err
+}
+
+func (c *Client) Relays(ctx context.Context) ([]Relay, error) {
+	var out []Relay
+	err := c.Call(ctx, "relays", nil, &out)
+	return out, err
+}
+
+func (c *Client) Limits(ctx context.Context) (node.LimitsReport, error) {
+	var out node.LimitsReport
+	err := c.Call(ctx, "limits", nil, &out)
+	return out, err
+}
+
+// Send sends a direct message; to is a peer ID, z:<zbase32> or @contact.
+func (c *Client) Send(ctx context.Context, to, text string) (chat.Message, error) {
+	var out chat.Message
+	err := c.Call(ctx, "send", SendParams{To: to, Text: text}, &out)
+	return out, err
+}
+
+// SendRoom sends a message to a joined room.
+func (c *Client) SendRoom(ctx context.Context, room, text string) (chat.Message, error) {
+	var out chat.Message
+	err := c.Call(ctx, "send", SendParams{Room: room, Text: text}, &out)
+	return out, err
+}
+
+func (c *Client) Join(ctx context.Context, room string) error {
+	return c.Call(ctx, "join", RoomParams{Room: room}, nil)
+}
+
+func (c *Client) Leave(ctx context.Context, room string) error {
+	return c.Call(ctx, "leave", RoomParams{Room: room}, nil)
+}
+
+func (c *Client) Rooms(ctx context.Context) ([]string, error) {
+	var out []string
+	err := c.Call(ctx, "rooms", nil, &out)
+	return out, err
+}
+
+func (c *Client) Contacts(ctx context.Context) ([]chat.Contact, error) {
+	var out []chat.Contact
+	err := c.Call(ctx, "contacts", nil, &out)
+	return out, err
+}
+
+func (c *Client) Conversations(ctx context.Context) ([]string, error) {
+	var out []string
+	err := c.Call(ctx, "conversations", nil, &out)
+	return out, err
+}
+
+// History returns the last limit messages of a conversation: #room or a peer reference.
+func (c *Client) History(ctx context.Context, conversation string, limit int) ([]chat.Message, error) {
+	var out []chat.Message
+	err := c.Call(ctx, "history", HistoryParams{Conversation: conversation, Limit: limit}, &out)
+	return out, err
+}
+
+// SetPadding changes the padding of messages to peer, or the default if peer
+// is empty, and returns it. An empty policy or nil files is left unchanged.
+func (c *Client) SetPadding(ctx context.Context, peer, policy string, files *bool) (chat.Padding, error) {
+	var out chat.Padding
+	err := c.Call(ctx, "padding", PaddingParams{Peer: peer, Policy: policy, Files: files}, &out)
+	return out, err
+}
+
+// SetOnionHops routes messages to peer, or by default if peer is empty,
+// through hops relays and returns the setting. A nil hops is left unchanged.
+func (c *Client) SetOnionHops(ctx context.Context, peer string, hops *int) (int, error) {
+	var out int
+	err := c.Call(ctx, "onion", OnionParams{Peer: peer, Hops: hops}, &out)
+	return out, err
+}
+
+// SetVerified marks the key of contact peer as checked out of band, or not.
+func (c *Client) SetVerified(ctx context.Context, peer string, verified bool) error {
+	return c.Call(ctx, "verify", VerifyParams{Peer: peer, Verified: &verified}, nil)
+}
+
+// Rotate replaces the key of the daemon's identity, which takes effect when
+// the daemon restarts, and returns the record of the succession.
+func (c *Client) Rotate(ctx context.Context) (*identity.Succession, error) {
+	var out identity.Succession
+	if err := c.Call(ctx, "rotate", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Cover returns what the cover traffic mode sent so far, after applying p if
+// it sets anything.
+func (c *Client) Cover(ctx context.Context, p CoverParams) (chat.CoverStats, error) {
+	var out chat.CoverStats
+	err := c.Call(ctx, "cover", p, &out)
+	return out, err
+}
+
+// Subscribe asks the daemon to push notifications to Notifications.
+func (c *Client) Subscribe(ctx context.Context) error {
+	return c.Call(ctx, "subscribe", nil, nil)
+}
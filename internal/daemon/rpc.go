@@ -0,0 +1,224 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"shadow/internal/node"
+	"shadow/internal/relay"
+)
+
+// The daemon speaks JSON-RPC 2.0, one JSON object per message, over a Unix
+// socket or a WebSocket. A connection must call "auth" with the daemon token
+// before any other method. After "subscribe" the daemon pushes "message" and
+// "connectivity" notifications.
+//
+// Methods:
+//
+//	auth          {token}                  -> true
+//	info                                   -> Info
+//	status                                 -> Status
+//	peers                                  -> []Peer
+//	whois         {peer}                   -> Peer
+//	discover                               -> []Peer
+//	relays                                 -> []Relay
+//	limits                                 -> node.LimitsReport
+//	send          {to, text} | {room, text} -> chat.Message
+//	join, leave   {room}                   -> true
+//	rooms                                  -> []string
+//	contacts                               -> []chat.Contact
+//	conversations                          -> []string
+//	history       {conversation, limit}    -> []chat.Message
+//	padding       {peer, policy, files}    -> chat.Padding
+//	onion         {peer, hops}             -> int
+//	cover         {mode, interval, hops, budget} -> chat.CoverStats
+//	verify        {peer, verified}         -> bool
+//	rotate                                 -> identity.Succession
+//	subscribe                              -> true
+//
+// padding changes the given fields of a peer's padding and returns it; an
+// empty peer stands for the default. onion does the same for the number of
+// relays messages to the peer are routed through, 0 for none. cover switches
+// the cover traffic mode if one is given, starting from the mode's defaults
+// when it changes, and returns what the mode sent so far. verify marks a
+// contact's key as checked out of band, or not, and returns the mark.
+// rotate replaces the key of the identity and tells contacts; the daemon
+// keeps the old key until it is restarted.
+//
+// Methods taking a peer fail with CodeNotFound if it cannot be resolved;
+// send also when the peer cannot be found on the network.
+const (
+	NotifyMessage      = "message"
+	NotifyConnectivity = "connectivity"
+)
+
+// JSON-RPC error codes.
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeServerError    = -32000
+	CodeUnauthorized   = -32001
+	CodeNotFound       = -32002
+)
+
+type request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// message is any object read by the client: a response or a notification.
+type message struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+type notification struct {
+	JSONRPC string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  any    `json:"params"`
+}
+
+// Error is a JSON-RPC error.
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+// Notification is pushed by the daemon to subscribed clients.
+type Notification struct {
+	Method string
+	Params json.RawMessage
+}
+
+type AuthParams struct {
+	Token string `json:"token"`
+}
+
+type SendParams struct {
+	To   string `json:"to,omitempty"` // peer ID, z:<zbase32> or @contact
+	Room string `json:"room,omitempty"`
+	Text string `json:"text"`
+}
+
+type WhoisParams struct {
+	Peer string `json:"peer"` // peer ID, z:<zbase32> or @contact
+}
+
+type RoomParams struct {
+	Room string `json:"room"`
+}
+
+type HistoryParams struct {
+	Conversation string `json:"conversation"` // peer ID or #room
+	Limit        int    `json:"limit,omitempty"`
+}
+
+type PaddingParams struct {
+	Peer   string `json:"peer,omitempty"`   // peer ID, z:<zbase32> or @contact
+	Policy string `json:"policy,omitempty"` // none, padme or buckets
+	Files  *bool  `json:"files,omitempty"`
+}
+
+type OnionParams struct {
+	Peer string `json:"peer,omitempty"` // peer ID, z:<zbase32> or @contact
+	Hops *int   `json:"hops,omitempty"`
+}
+
+type VerifyParams struct {
+	Peer     string `json:"peer"` // peer ID, z:<zbase32> or @contact
+	Verified *bool  `json:"verified,omitempty"`
+}
+
+type CoverParams struct {
+	Mode     string `json:"mode,omitempty"`     // off, poisson or constant
+	Interval string `json:"interval,omitempty"` // e.g. 5s
+	Hops     int    `json:"hops,omitempty"`
+	Budget   int64  `json:"budget,omitempty"` // bytes a day
+}
+
+// Info describes the daemon's node.
+type Info struct {
+	PeerID  peer.ID  `json:"peer_id"`
+	Zbase32 string   `json:"zbase32"`
+	Name    string   `json:"name"`
+	Addrs   []string `json:"addrs"`
+}
+
+// Status is the node's connectivity.
+type Status struct {
+	State        string    `json:"state"`
+	Reachability string    `json:"reachability"`
+	Relays       int       `json:"relays"`
+	Reserved     int       `json:"reserved"`
+	Peers        int       `json:"peers"`
+	Time         time.Time `json:"time"`
+}
+
+func newStatus(ev node.ConnectivityEvent) Status {
+	return Status{
+		State:        string(ev.State),
+		Reachability: ev.Reachability.String(),
+		Relays:       ev.Relays,
+		Reserved:     ev.Reserved,
+		Peers:        ev.Peers,
+		Time:         ev.Time,
+	}
+}
+
+func (s Status) String() string {
+	return fmt.Sprintf("%s (reachability %s, %d relays, %d reserved, %d peers)",
+		s.State, s.Reachability, s.Relays, s.Reserved, s.Peers)
+}
+
+// Peer is a connected or discovered peer.
+type Peer struct {
+	ID       peer.ID  `json:"id"`
+	Zbase32  string   `json:"zbase32"`
+	Name     string   `json:"name,omitempty"`
+	ConnType string   `json:"conn_type"`
+	Contact  bool     `json:"contact"`
+	Addrs    []string `json:"addrs"`
+}
+
+// Relay is the health of a configured relay.
+type Relay struct {
+	ID        peer.ID       `json:"id"`
+	Healthy   bool          `json:"healthy"`
+	RTT       time.Duration `json:"rtt"`
+	Reserved  bool          `json:"reserved"`
+	LastProbe time.Time     `json:"last_probe"`
+	LastErr   string        `json:"last_error,omitempty"`
+}
+
+func newRelay(st relay.RelayStatus) Relay {
+	return Relay{
+		ID:        st.ID,
+		Healthy:   st.Healthy,
+		RTT:       st.RTT,
+		Reserved:  st.Reserved,
+		LastProbe: st.LastProbe,
+		LastErr:   st.LastErr,
+	}
+}
@@ -0,0 +1,546 @@
+package daemon
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"shadow/internal/chat"
+	"shadow/internal/crypto"
+	"shadow/internal/identity"
+	"shadow/internal/node"
+)
+
+const (
+	// lookupTimeout bounds the peer lookup of whois.
+	lookupTimeout = 10 * time.Second
+	// writeTimeout bounds a write to a client; one that cannot keep up is dropped.
+	writeTimeout = 10 * time.Second
+)
+
+// transport carries JSON-RPC objects; both *websocket.Conn and streamConn implement it.
+type transport interface {
+	ReadJSON(v any) error
+	WriteJSON(v any) error
+	SetWriteDeadline(t time.Time) error
+	Close() error
+}
+
+// streamConn frames JSON objects back to back on a stream connection.
+type streamConn struct {
+	net.Conn
+	dec *json.Decoder
+	enc *json.Encoder
+}
+
+func newStreamConn(c net.Conn) *streamConn {
+	return &streamConn{Conn: c, dec: json.NewDecoder(c), enc: json.NewEncoder(c)}
+}
+
+func (c *streamConn) ReadJSON(v any) error  { return c.dec.Decode(v) }
+func (c *streamConn) WriteJSON(v any) error { return c.enc.Encode(v) }
+
+// Server exposes a node and its messaging service to local clients.
+type Server struct {
+	chat  *chat.Service
+	node  *node.Node
+	token string
+
+	mu    sync.Mutex
+	conns map[*conn]struct{}
+}
+
+type conn struct {
+	t          transport
+	wmu        sync.Mutex
+	authed     atomic.Bool
+	subscribed atomic.Bool
+	unsub      func()
+}
+
+func (c *conn) write(v any) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.t.SetWriteDeadline(time.Now().Add(writeTimeout))
+	err := c.t.WriteJSON(v)
+	if err != nil {
+		// A partial write leaves the framing broken; the reader ends the connection
+		c.t.Close()
+	}
+	return err
+}
+
+// NewServer returns an API server for c that admits clients presenting token.
+func NewServer(ctx context.Context, c *chat.Service, token string) *Server {
+	s := &Server{
+		chat:  c,
+		node:  c.Node(),
+		token: token,
+		conns: map[*conn]struct{}{},
+	}
+	go s.forwardConnectivity(ctx)
+	return s
+}
+
+// forwardConnectivity relays node connectivity changes to subscribed clients.
+func (s *Server) forwardConnectivity(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-s.node.Connectivity():
+			s.broadcast(NotifyConnectivity, newStatus(ev))
+		}
+	}
+}
+
+// broadcast notifies subscribed clients. The writes happen outside mu, so
+// a slow client holds up neither the others nor the calls.
+func (s *Server) broadcast(method string, params any) {
+	s.mu.Lock()
+	var subs []*conn
+	for c := range s.conns {
+		if c.subscribed.Load() {
+			subs = append(subs, c)
+		}
+	}
+	s.mu.Unlock()
+	for _, c := range subs {
+		c.write(notification{JSONRPC: "2.0", Method: method, Params: params})
+	}
+}
+
+// ListenUnix listens on a Unix socket at path that only the owner can connect to.
+func ListenUnix(path string) (net.Listener, error) {
+	os.Remove(path) // stale socket of a daemon that did not shut down cleanly
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// ServeUnix serves the API on a Unix socket at path until ctx is cancelled.
+func (s *Server) ServeUnix(ctx context.Context, path string) error {
+	l, err := ListenUnix(path)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, l)
+}
+
+// Serve serves the API on stream connections accepted from l until ctx is cancelled.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go s.serve(ctx, newStreamConn(c))
+	}
+}
+
+var upgrader = websocket.Upgrader{}
+
+// ServeWebSocket serves the API as a WebSocket on addr until ctx is cancelled.
+// addr must be a loopback address; clients still need the token.
+func (s *Server) ServeWebSocket(ctx context.Context, addr string) error {
+	if err := CheckLoopback(addr); err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /", func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		s.serve(ctx, ws)
+	})
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// CheckLoopback refuses listen addresses reachable from other hosts.
+func CheckLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("%s is not a loopback address", addr)
+}
+
+func (s *Server) serve(ctx context.Context, t transport) {
+	c := &conn{t: t}
+	s.mu.Lock()
+	s.conns[c] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		if c.unsub != nil {
+			c.unsub()
+		}
+		t.Close()
+	}()
+
+	for {
+		var req request
+		if err := t.ReadJSON(&req); err != nil {
+			var syntaxErr *json.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				c.write(response{JSONRPC: "2.0", ID: json.RawMessage("null"),
+					Error: &Error{Code: CodeParseError, Message: err.Error()}})
+			}
+			return
+		}
+		// Authentication and subscription change connection state, so they are
+		// handled in order; everything else may block on the network
+		switch req.Method {
+		case "auth", "subscribe":
+			s.handle(ctx, c, req)
+		default:
+			go s.handle(ctx, c, req)
+		}
+	}
+}
+
+func (s *Server) handle(ctx context.Context, c *conn, req request) {
+	result, err := s.call(ctx, c, req)
+	if req.ID == nil {
+		return // notification, no reply
+	}
+	resp := response{JSONRPC: "2.0", ID: req.ID, Result: result}
+	if err != nil {
+		var rpcErr *Error
+		if !errors.As(err, &rpcErr) {
+			rpcErr = &Error{Code: CodeServerError, Message: err.Error()}
+		}
+		resp.Result, resp.Error = nil, rpcErr
+	}
+	c.write(resp)
+}
+
+func (s *Server) call(ctx context.Context, c *conn, req request) (any, error) {
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		return nil, &Error{Code: CodeInvalidRequest, Message: "invalid request"}
+	}
+	if req.Method == "auth" {
+		var p AuthParams
+		if err := decodeParams(req.Params, &p); err != nil {
+			return nil, err
+		}
+		if subtle.ConstantTimeCompare([]byte(p.Token), []byte(s.token)) != 1 {
+			return nil, &Error{Code: CodeUnauthorized, Message: "invalid token"}
+		}
+		c.authed.Store(true)
+		return true, nil
+	}
+	if !c.authed.Load() {
+		return nil, &Error{Code: CodeUnauthorized, Message: "call auth first"}
+	}
+
+	switch req.Method {
+	case "info":
+		return s.info(), nil
+	case "status":
+		return newStatus(s.node.ConnectivityState()), nil
+	case "peers":
+		return s.peers(s.node.Host.Network().Peers()), nil
+	case "whois":
+		var p WhoisParams
+		if err := decodeParams(req.Params, &p); err != nil {
+			return nil, err
+		}
+		id, err := s.chat.ResolvePeer(p.Peer)
+		if err != nil {
+			return nil, &Error{Code: CodeNotFound, Message: err.Error()}
+		}
+		// Look the peer up so its addresses are current; knowing none is not an error
+		if id != s.node.Host.ID() && s.node.Host.Network().Connectedness(id) != network.Connected {
+			lctx, cancel := context.WithTimeout(ctx, lookupTimeout)
+			s.node.FindPeer(lctx, id)
+			cancel()
+		}
+		return s.peer(id), nil
+	case "discover":
+		found, err := s.node.DiscoverPeers(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ids := make([]peer.ID, len(found))
+		for i, ai := range found {
+			ids[i] = ai.ID
+		}
+		return s.peers(ids), nil
+	case "relays":
+		out := []Relay{}
+		for _, st := range s.node.Relays.Status() {
+			out = append(out, newRelay(st))
+		}
+		return out, nil
+	case "limits":
+		return s.node.Limits(), nil
+	case "send":
+		var p SendParams
+		if err := decodeParams(req.Params, &p); err != nil {
+			return nil, err
+		}
+		switch {
+		case p.Text == "":
+			return nil, &Error{Code: CodeInvalidParams, Message: "text is required"}
+		case p.Room != "":
+			return s.chat.SendRoom(ctx, p.Room, p.Text)
+		case p.To != "":
+			to, err := s.chat.ResolvePeer(p.To)
+			if err != nil {
+				return nil, &Error{Code: CodeNotFound, Message: err.Error()}
+			}
+			m, err := s.chat.Send(ctx, to, p.Text)
+			if errors.Is(err, node.ErrPeerNotFound) {
+				return nil, &Error{Code: CodeNotFound, Message: err.Error()}
+			}
+			return m, err
+		}
+		return nil, &Error{Code: CodeInvalidParams, Message: "to or room is required"}
+	case "join", "leave":
+		var p RoomParams
+		if err := decodeParams(req.Params, &p); err != nil {
+			return nil, err
+		}
+		var err error
+		if req.Method == "join" {
+			err = s.chat.JoinRoom(p.Room)
+		} else {
+			err = s.chat.LeaveRoom(p.Room)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return true, nil
+	case "rooms":
+		return s.chat.Rooms(), nil
+	case "contacts":
+		return s.chat.Contacts(), nil
+	case "conversations":
+		return s.chat.Conversations()
+	case "history":
+		var p HistoryParams
+		if err := decodeParams(req.Params, &p); err != nil {
+			return nil, err
+		}
+		conv := p.Conversation
+		if conv != "" && conv[0] != '#' {
+			// Accept any peer reference, history is keyed by the canonical ID
+			id, err := s.chat.ResolvePeer(conv)
+			if err != nil {
+				return nil, &Error{Code: CodeNotFound, Message: err.Error()}
+			}
+			conv = id.String()
+		}
+		return s.chat.History(conv, p.Limit)
+	case "padding":
+		var p PaddingParams
+		if err := decodeParams(req.Params, &p); err != nil {
+			return nil, err
+		}
+		var to peer.ID
+		pad := s.chat.DefaultPadding()
+		if p.Peer != "" {
+			var err error
+			if to, err = s.chat.ResolvePeer(p.Peer); err != nil {
+				return nil, &Error{Code: CodeNotFound, Message: err.Error()}
+			}
+			pad = s.chat.Padding(to)
+		}
+		if p.Policy == "" && p.Files == nil {
+			return pad, nil
+		}
+		if p.Policy != "" {
+			policy, err := crypto.ParsePadPolicy(p.Policy)
+			if err != nil {
+				return nil, &Error{Code: CodeInvalidParams, Message: err.Error()}
+			}
+			pad.Policy = policy
+		}
+		if p.Files != nil {
+			pad.Files = *p.Files
+		}
+		if err := s.chat.SetPadding(to, pad); err != nil {
+			return nil, err
+		}
+		return pad, nil
+	case "onion":
+		var p OnionParams
+		if err := decodeParams(req.Params, &p); err != nil {
+			return nil, err
+		}
+		var to peer.ID
+		if p.Peer != "" {
+			var err error
+			if to, err = s.chat.ResolvePeer(p.Peer); err != nil {
+				return nil, &Error{Code: CodeNotFound, Message: err.Error()}
+			}
+		}
+		if p.Hops == nil {
+			return s.chat.OnionHops(to), nil
+		}
+		if *p.Hops < 0 || *p.Hops > chat.MaxOnionHops {
+			return nil, &Error{Code: CodeInvalidParams, Message: fmt.Sprintf("hops must be 0 to %d", chat.MaxOnionHops)}
+		}
+		if err := s.chat.SetOnionHops(to, *p.Hops); err != nil {
+			return nil, err
+		}
+		return *p.Hops, nil
+	case "cover":
+		var p CoverParams
+		if err := decodeParams(req.Params, &p); err != nil {
+			return nil, err
+		}
+		if p.Mode == "" && p.Interval == "" && p.Hops == 0 && p.Budget == 0 {
+			return s.chat.CoverStats(), nil
+		}
+		c := s.chat.Cover()
+		if p.Mode != "" {
+			mode, err := chat.ParseCoverMode(p.Mode)
+			if err != nil {
+				return nil, &Error{Code: CodeInvalidParams, Message: err.Error()}
+			}
+			if mode != c.Mode {
+				c = chat.DefaultCover(mode)
+			}
+		}
+		if p.Interval != "" {
+			d, err := time.ParseDuration(p.Interval)
+			if err != nil {
+				return nil, &Error{Code: CodeInvalidParams, Message: err.Error()}
+			}
+			c.Interval = d
+		}
+		if p.Hops != 0 {
+			c.Hops = p.Hops
+		}
+		if p.Budget != 0 {
+			c.Budget = p.Budget
+		}
+		if err := s.chat.SetCover(c); err != nil {
+			return nil, &Error{Code: CodeInvalidParams, Message: err.Error()}
+		}
+		return s.chat.CoverStats(), nil
+	case "verify":
+		var p VerifyParams
+		if err := decodeParams(req.Params, &p); err != nil {
+			return nil, err
+		}
+		to, err := s.chat.ResolvePeer(p.Peer)
+		if err != nil {
+			return nil, &Error{Code: CodeNotFound, Message: err.Error()}
+		}
+		if p.Verified == nil {
+			return s.node.IsVerified(to), nil
+		}
+		if err := s.chat.SetVerified(to, *p.Verified); err != nil {
+			return nil, &Error{Code: CodeNotFound, Message: err.Error()}
+		}
+		return *p.Verified, nil
+	case "rotate":
+		_, rec, err := s.chat.Rotate(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return rec, nil
+	case "subscribe":
+		if c.subscribed.CompareAndSwap(false, true) {
+			msgs, unsub := s.chat.Subscribe()
+			c.unsub = unsub
+			go func() {
+				for m := range msgs {
+					c.write(notification{JSONRPC: "2.0", Method: NotifyMessage, Params: m})
+				}
+			}()
+		}
+		return true, nil
+	}
+	return nil, &Error{Code: CodeMethodNotFound, Message: "unknown method: " + req.Method}
+}
+
+func decodeParams(raw json.RawMessage, v any) error {
+	if len(raw) == 0 {
+		return &Error{Code: CodeInvalidParams, Message: "missing params"}
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return &Error{Code: CodeInvalidParams, Message: err.Error()}
+	}
+	return nil
+}
+
+func (s *Server) info() Info {
+	id := s.node.Identity
+	info := Info{PeerID: id.PeerID(), Zbase32: id.Zbase32PeerID(), Name: id.Username(), Addrs: []string{}}
+	for _, a := range s.node.Host.Addrs() {
+		info.Addrs = append(info.Addrs, fmt.Sprintf("%s/p2p/%s", a, id.PeerID()))
+	}
+	return info
+}
+
+func (s *Server) peers(ids []peer.ID) []Peer {
+	out := []Peer{}
+	for _, p := range ids {
+		if p == s.node.Host.ID() {
+			continue
+		}
+		out = append(out, s.peer(p))
+	}
+	return out
+}
+
+func (s *Server) peer(p peer.ID) Peer {
+	info := Peer{
+		ID:       p,
+		Zbase32:  identity.PeerIDToZbase32(p),
+		Name:     s.node.PeerName(p),
+		ConnType: string(s.node.ConnType(p)),
+		Contact:  s.node.IsContact(p),
+		Addrs:    []string{},
+	}
+	for _, a := range s.node.Host.Peerstore().Addrs(p) {
+		info.Addrs = append(info.Addrs, a.String())
+	}
+	return info
+}
@@ -0,0 +1,28 @@
+package daemon
+
+import (
+	"path/filepath"
+
+	"shadow/internal/utils"
+)
+
+const (
+	tokenFile  = "daemon.token"
+	socketFile = "daemon.sock"
+)
+
+// SocketPath is the default Unix socket of the daemon for an identity directory.
+func SocketPath(dataDir string) string {
+	return filepath.Join(dataDir, socketFile)
+}
+
+// LoadOrCreateToken returns the API token stored in dataDir, creating one
+// readable only by the owner if there is none.
+func LoadOrCreateToken(dataDir string) (string, error) {
+	return utils.LoadOrCreateToken(filepath.Join(dataDir, tokenFile))
+}
+
+// LoadToken reads the API token stored in dataDir.
+func LoadToken(dataDir string) (string, error) {
+	return utils.LoadToken(filepath.Join(dataDir, tokenFile))
+}
@@ -6,14 +6,19 @@ import (
 	"fmt"
 
 	"github.com/ipfs/go-cid"
+	kaddht "github.com/libp2p/go-libp2p-kad-dht"
 	dual "github.com/libp2p/go-libp2p-kad-dht/dual"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multiaddr"
+
+	"shadow/internal/logging"
 )
 
 type DHT struct {
 	impl *dual.DHT
+	// records holds shadow's own records, such as key successions
+	records *dual.DHT
 }
 
 // DefaultBootstrapPeers are the default bootstrap peers for the DHT.
@@ -22,16 +27,31 @@ var DefaultBootstrapPeers = []string{
 	"/ip4/127.0.0.1/tcp/59848/p2p/12D3KooWCdnSstPmm2hb2DYLUgfYfbNpgucHRAzB52fo5q4hZn1A", // alice
 }
 
+// ProtocolPrefix is the protocol of the DHT for shadow's own records. The
+// public IPFS one accepts no records but public keys and IPNS names, so those
+// go to a second DHT among shadow peers only. Peer routing and providers stay
+// on the IPFS DHT, which peers of every version speak.
+const ProtocolPrefix = "/shadow"
+
 func NewDHT(ctx context.Context, h host.Host) (*DHT, error) {
 	dht, err := dual.New(ctx, h)
 	if err != nil {
 		return nil, err
 	}
-	if err := dht.Bootstrap(ctx); err != nil {
+	records, err := dual.New(ctx, h, dual.DHTOption(
+		kaddht.ProtocolPrefix(ProtocolPrefix),
+		kaddht.NamespacedValidator(SuccessionNamespace, successionValidator{}),
+	))
+	if err != nil {
+		dht.Close()
 		return nil, err
 	}
-
-	return &DHT{impl: dht}, nil
+	d := &DHT{impl: dht, records: records}
+	if err := d.Bootstrap(ctx); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
 }
 
 func (d *DHT) Bootstrap(ctx context.Context) error {
@@ -41,11 +61,14 @@ func (d *DHT) Bootstrap(ctx context.Context) error {
 	if err := d.impl.Bootstrap(ctx); err != nil {
 		return err
 	}
+	if d.records != nil {
+		return d.records.Bootstrap(ctx)
+	}
 	return nil
 }
 
 func (d *DHT) FindPeer(ctx context.Context, id peer.ID) (peerID peer.AddrInfo, err error) {
-	fmt.Println("Finding peer:", id)
+	logging.Println("Finding peer:", id)
 	if d.impl == nil {
 		return peer.AddrInfo{}, fmt.Errorf("DHT not initialized")
 	}
@@ -75,20 +98,17 @@ func (d *DHT) Provide(ctx context.Context, c cid.Cid, recursive bool) error {
 }
 
 func (d *DHT) Close() error {
-	return d.impl.Close()
-}
-
-func BootstrapPeers(relayId peer.ID) ([]peer.AddrInfo, error) {
-	// Add the relay ID to the list of bootstrap peers
-	relayCid := peer.ToCid(relayId)
-	relayAddr := fmt.Sprintf("/ip4/127.0.0.1/tcp/4001/p2p/%s", relayCid.String())
-	_, err := peer.AddrInfoFromString(relayAddr)
-	if err != nil {
-		return nil, err
+	err := d.impl.Close()
+	if d.records != nil {
+		if rerr := d.records.Close(); err == nil {
+			err = rerr
+		}
 	}
-	// Add the relay address to the list of bootstrap peers
-	DefaultBootstrapPeers = append(DefaultBootstrapPeers, relayAddr)
+	return err
+}
 
+// BootstrapPeers returns the default bootstrap peers followed by the relays.
+func BootstrapPeers(relays ...peer.AddrInfo) ([]peer.AddrInfo, error) {
 	var peers []peer.AddrInfo
 	for _, addr := range DefaultBootstrapPeers {
 		maddr, err := multiaddr.NewMultiaddr(addr)
@@ -101,5 +121,6 @@ func BootstrapPeers(relayId peer.ID) ([]peer.AddrInfo, error) {
 		}
 		peers = append(peers, *ai)
 	}
-	return peers, nil
+	// The relays double as bootstrap peers
+	return append(peers, relays...), nil
 }
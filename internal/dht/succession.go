@@ -0,0 +1,92 @@
+package dht
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	kaddht "github.com/libp2p/go-libp2p-kad-dht"
+	record "github.com/libp2p/go-libp2p-record"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"shadow/internal/identity"
+)
+
+// SuccessionNamespace holds the succession records of rotated keys, keyed by
+// the old peer ID.
+const SuccessionNamespace = "shadow-succession"
+
+// SuccessionKey is the DHT key of the succession record of old.
+func SuccessionKey(old peer.ID) string {
+	return "/" + SuccessionNamespace + "/" + string(old)
+}
+
+// successionValidator accepts records signed by the keys they name, stored
+// under the old key, and prefers the latest of several.
+type successionValidator struct{}
+
+func (successionValidator) Validate(key string, value []byte) error {
+	_, err := parseSuccession(key, value)
+	return err
+}
+
+func (successionValidator) Select(key string, values [][]byte) (int, error) {
+	best := -1
+	var bestRec *identity.Succession
+	for i, v := range values {
+		s, err := parseSuccession(key, v)
+		if err != nil {
+			continue
+		}
+		if bestRec == nil || s.Time.After(bestRec.Time) {
+			best, bestRec = i, s
+		}
+	}
+	if best < 0 {
+		return 0, fmt.Errorf("no valid succession record")
+	}
+	return best, nil
+}
+
+func parseSuccession(key string, value []byte) (*identity.Succession, error) {
+	ns, path, err := record.SplitKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if ns != SuccessionNamespace {
+		return nil, fmt.Errorf("not a succession key: %s", key)
+	}
+	s, err := identity.ParseSuccession(value)
+	if err != nil {
+		return nil, err
+	}
+	if string(s.Old) != path {
+		return nil, fmt.Errorf("succession record of %s stored under another key", s.Old)
+	}
+	return s, nil
+}
+
+// PutSuccession publishes s under the key of s.Old.
+func (d *DHT) PutSuccession(ctx context.Context, s *identity.Succession) error {
+	if d.records == nil {
+		return fmt.Errorf("DHT not initialized")
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return d.records.PutValue(ctx, SuccessionKey(s.Old), data)
+}
+
+// GetSuccession looks up the succession record of old.
+func (d *DHT) GetSuccession(ctx context.Context, old peer.ID) (*identity.Succession, error) {
+	if d.records == nil {
+		return nil, fmt.Errorf("DHT not initialized")
+	}
+	// Records are signed, so the first valid one will do
+	data, err := d.records.GetValue(ctx, SuccessionKey(old), kaddht.Quorum(1))
+	if err != nil {
+		return nil, err
+	}
+	return parseSuccession(SuccessionKey(old), data)
+}
@@ -6,6 +6,8 @@ import (
 	crypto "github.com/libp2p/go-libp2p/core/crypto"
 	peer "github.com/libp2p/go-libp2p/core/peer"
 	zbase32 "github.com/tv42/zbase32"
+
+	"shadow/internal/logging"
 )
 
 // Identity holds persistent identity info for a node
@@ -14,11 +16,12 @@ type Identity struct {
 	pubKey   crypto.PubKey
 	peerID   peer.ID
 	username string
+	dataDir  string
 }
 
 // New creates a new Identity from key and username
 func New(priv crypto.PrivKey, username string) (*Identity, error) {
-	fmt.Printf("Creating new identity for %s...\n", username)
+	logging.Printf("Creating new identity for %s...\n", username)
 	peerID, err := peer.IDFromPrivateKey(priv)
 	if err != nil {
 		return nil, err
@@ -35,6 +38,11 @@ func (id *Identity) Username() string {
 	return id.username
 }
 
+// DataDir is the directory the identity was loaded from, empty if it is not persisted.
+func (id *Identity) DataDir() string {
+	return id.dataDir
+}
+
 func (id *Identity) PeerID() peer.ID {
 	return id.peerID
 }
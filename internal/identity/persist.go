@@ -2,6 +2,7 @@ package identity
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
 
@@ -17,10 +18,21 @@ type diskIdentity struct {
 
 func LoadOrCreate(path, username string) (*Identity, error) {
 	filePath := filepath.Join(path, identityFile)
-	if _, err := os.Stat(filePath); err == nil {
-		return loadFromDisk(filePath)
+	var id *Identity
+	var err error
+	if _, statErr := os.Stat(filePath); statErr == nil {
+		id, err = loadFromDisk(filePath)
+	} else {
+		id, err = createNew(filePath, username)
 	}
-	return createNew(filePath, username)
+	if err != nil {
+		return nil, err
+	}
+	id.dataDir = path
+	if err := id.finishRotation(); err != nil {
+		return nil, fmt.Errorf("failed to finish rotation: %w", err)
+	}
+	return id, nil
 }
 
 func loadFromDisk(path string) (*Identity, error) {
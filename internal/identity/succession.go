@@ -0,0 +1,215 @@
+package identity
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	crypto "github.com/libp2p/go-libp2p/core/crypto"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	successionsFile = "successions.json"
+	// successionDomain separates succession signatures from any other use
+	// of the keys.
+	successionDomain = "shadow-succession-v1"
+)
+
+// Succession is a record by which the key of Old names New as its
+// successor. Both keys sign it: Old to hand over, New to accept, so nobody
+// can claim another key as theirs. Anyone holding Old's key can make one,
+// which is why it says nothing about a key that was already compromised.
+type Succession struct {
+	Old    peer.ID   `json:"old"`
+	New    peer.ID   `json:"new"`
+	Time   time.Time `json:"time"`
+	OldSig []byte    `json:"old_sig"`
+	NewSig []byte    `json:"new_sig"`
+}
+
+// NewSuccession signs a record handing old over to new.
+func NewSuccession(old, new crypto.PrivKey) (*Succession, error) {
+	oldID, err := peer.IDFromPrivateKey(old)
+	if err != nil {
+		return nil, err
+	}
+	newID, err := peer.IDFromPrivateKey(new)
+	if err != nil {
+		return nil, err
+	}
+	if oldID == newID {
+		return nil, fmt.Errorf("a key cannot succeed itself")
+	}
+	s := &Succession{Old: oldID, New: newID, Time: time.Now().UTC().Truncate(time.Second)}
+	msg := s.signed()
+	if s.OldSig, err = old.Sign(msg); err != nil {
+		return nil, err
+	}
+	if s.NewSig, err = new.Sign(msg); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// signed returns the bytes both keys sign.
+func (s *Succession) signed() []byte {
+	b := []byte(successionDomain)
+	for _, id := range []peer.ID{s.Old, s.New} {
+		b = binary.BigEndian.AppendUint16(b, uint16(len(id)))
+		b = append(b, id...)
+	}
+	return binary.BigEndian.AppendUint64(b, uint64(s.Time.Unix()))
+}
+
+// Verify checks both signatures against the keys in the peer IDs.
+func (s *Succession) Verify() error {
+	if s.Old == s.New {
+		return fmt.Errorf("a key cannot succeed itself")
+	}
+	msg := s.signed()
+	for _, c := range []struct {
+		id  peer.ID
+		sig []byte
+	}{{s.Old, s.OldSig}, {s.New, s.NewSig}} {
+		pub, err := c.id.ExtractPublicKey()
+		if err != nil {
+			return fmt.Errorf("no key in %s: %w", c.id, err)
+		}
+		ok, err := pub.Verify(msg, c.sig)
+		if err != nil || !ok {
+			return fmt.Errorf("invalid succession signature of %s", c.id)
+		}
+	}
+	return nil
+}
+
+// ParseSuccession decodes and verifies a record.
+func ParseSuccession(data []byte) (*Succession, error) {
+	var s Succession
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("invalid succession record: %w", err)
+	}
+	if err := s.Verify(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Rotate replaces the key of id with a fresh one and returns the new
+// identity with the record of the succession. A persisted identity is saved
+// with the new key, the old one overwritten, and the record is kept with
+// those of earlier rotations.
+func (id *Identity) Rotate() (*Identity, *Succession, error) {
+	priv, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	s, err := NewSuccession(id.privKey, priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	next, err := New(priv, id.username)
+	if err != nil {
+		return nil, nil, err
+	}
+	next.dataDir = id.dataDir
+	if id.dataDir == "" {
+		return next, s, nil
+	}
+
+	chain, err := id.Successions()
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := json.MarshalIndent(append(chain, s), "", "  ")
+	if err != nil {
+		return nil, nil, err
+	}
+	// The record is staged first but only put in place once the new key is
+	// saved, so it never names a successor whose key was lost
+	record := filepath.Join(id.dataDir, successionsFile)
+	staged, err := writeTemp(record, data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to save succession: %w", err)
+	}
+	serialized, err := crypto.MarshalPrivateKey(priv)
+	if err == nil {
+		data, err = json.Marshal(diskIdentity{PrivKey: serialized, Username: id.username})
+	}
+	if err == nil {
+		err = writeFile(filepath.Join(id.dataDir, identityFile), data)
+	}
+	if err != nil {
+		os.Remove(staged)
+		return nil, nil, fmt.Errorf("failed to save identity: %w", err)
+	}
+	// A staged record left here is put in place by finishRotation
+	if err := os.Rename(staged, record); err != nil {
+		return nil, nil, fmt.Errorf("failed to save succession: %w", err)
+	}
+	return next, s, nil
+}
+
+// Successions returns the records of every rotation of a persisted
+// identity, oldest first.
+func (id *Identity) Successions() ([]*Succession, error) {
+	if id.dataDir == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(filepath.Join(id.dataDir, successionsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read successions: %w", err)
+	}
+	var chain []*Succession
+	if err := json.Unmarshal(data, &chain); err != nil {
+		return nil, fmt.Errorf("invalid successions file: %w", err)
+	}
+	return chain, nil
+}
+
+// finishRotation puts in place a record staged by a rotation that saved
+// the new key but stopped before the record, and drops one whose key was
+// never saved.
+func (id *Identity) finishRotation() error {
+	record := filepath.Join(id.dataDir, successionsFile)
+	staged := tempPath(record)
+	data, err := os.ReadFile(staged)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var chain []*Succession
+	if json.Unmarshal(data, &chain) == nil && len(chain) > 0 && chain[len(chain)-1].New == id.PeerID() {
+		return os.Rename(staged, record)
+	}
+	return os.Remove(staged)
+}
+
+// writeFile replaces path with data, so a crash leaves either version.
+func writeFile(path string, data []byte) error {
+	tmp, err := writeTemp(path, data)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// writeTemp writes data next to path, to be renamed over it.
+func writeTemp(path string, data []byte) (string, error) {
+	tmp := tempPath(path)
+	return tmp, os.WriteFile(tmp, data, 0o600)
+}
+
+func tempPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path))
+}
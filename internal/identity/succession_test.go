@@ -0,0 +1,132 @@
+package identity
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	crypto "github.com/libp2p/go-libp2p/core/crypto"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestSuccession(t *testing.T) {
+	dir := t.TempDir()
+	id, err := LoadOrCreate(dir, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, rec, err := id.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Old != id.PeerID() || rec.New != next.PeerID() || next.Username() != "alice" {
+		t.Fatalf("record %+v does not hand %s over to %s", rec, id.PeerID(), next.PeerID())
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseSuccession(data); err != nil {
+		t.Fatal(err)
+	}
+
+	// The rotated key is the one loaded from now on, and the record is kept
+	loaded, err := LoadOrCreate(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.PeerID() != next.PeerID() {
+		t.Fatalf("loaded %s, want %s", loaded.PeerID(), next.PeerID())
+	}
+	if _, _, err := loaded.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	chain, err := loaded.Successions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 2 || chain[0].New != chain[1].Old {
+		t.Fatalf("chain %+v", chain)
+	}
+}
+
+func TestRotateKeepsRecordWithKey(t *testing.T) {
+	dir := t.TempDir()
+	id, err := LoadOrCreate(dir, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The new key cannot be saved: no record may name it
+	blocked := tempPath(filepath.Join(dir, identityFile))
+	if err := os.Mkdir(blocked, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := id.Rotate(); err == nil {
+		t.Fatal("rotated without saving the key")
+	}
+	if chain, err := id.Successions(); err != nil || len(chain) != 0 {
+		t.Fatalf("chain %+v, %v after a failed rotation", chain, err)
+	}
+	if err := os.Remove(blocked); err != nil {
+		t.Fatal(err)
+	}
+
+	// The key was saved but not the record: it is put in place on load
+	next, rec, err := id.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := filepath.Join(dir, successionsFile)
+	if err := os.Rename(record, tempPath(record)); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadOrCreate(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := loaded.Successions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.PeerID() != next.PeerID() || len(chain) != 1 || chain[0].New != rec.New {
+		t.Fatalf("loaded %s with chain %+v, want %s", loaded.PeerID(), chain, next.PeerID())
+	}
+}
+
+func TestSuccessionRejectsForgery(t *testing.T) {
+	old, _, _ := crypto.GenerateEd25519Key(nil)
+	new, _, _ := crypto.GenerateEd25519Key(nil)
+	other, _, _ := crypto.GenerateEd25519Key(nil)
+	rec, err := NewSuccession(old, new)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Someone else claiming the handover for their key
+	forged := *rec
+	if forged.New, err = peer.IDFromPrivateKey(other); err != nil {
+		t.Fatal(err)
+	}
+	if forged.Verify() == nil {
+		t.Fatal("accepted a successor that did not sign")
+	}
+	forged = *rec
+	forged.Time = rec.Time.AddDate(1, 0, 0)
+	if forged.Verify() == nil {
+		t.Fatal("accepted a changed time")
+	}
+	forged = *rec
+	forged.OldSig = append([]byte(nil), rec.OldSig...)
+	forged.OldSig[0] ^= 1
+	if forged.Verify() == nil {
+		t.Fatal("accepted a bad signature of the old key")
+	}
+	if _, err := NewSuccession(old, old); err == nil {
+		t.Fatal("a key succeeded itself")
+	}
+}
@@ -0,0 +1,520 @@
+package irc
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"shadow/pkg/shadow"
+)
+
+const (
+	readLimit    = 8192
+	writeTimeout = 10 * time.Second
+	sendTimeout  = 30 * time.Second
+)
+
+// IRC numeric replies.
+const (
+	rplWelcome        = "001"
+	rplYourHost       = "002"
+	rplCreated        = "003"
+	rplMyInfo         = "004"
+	rplUModeIs        = "221"
+	rplAway           = "301"
+	rplWhoisUser      = "311"
+	rplWhoisServer    = "312"
+	rplWhoisSpecial   = "320"
+	rplEndOfWho       = "315"
+	rplEndOfWhois     = "318"
+	rplListStart      = "321"
+	rplList           = "322"
+	rplListEnd        = "323"
+	rplChannelModeIs  = "324"
+	rplNoTopic        = "331"
+	rplWhoReply       = "352"
+	rplNamReply       = "353"
+	rplEndOfNames     = "366"
+	errNoSuchNick     = "401"
+	errNoSuchChannel  = "403"
+	errCannotSend     = "404"
+	errUnknownCmd     = "421"
+	errNoMotd         = "422"
+	errNoNickGiven    = "431"
+	errBadNick        = "432"
+	errNickInUse      = "433"
+	errNotOnChannel   = "442"
+	errNotRegistered  = "451"
+	errNeedMoreArgs   = "461"
+	errAlreadyReg     = "462"
+	errPasswdMismatch = "464"
+)
+
+// conn is one IRC client connection.
+type conn struct {
+	g  *Gateway
+	nc net.Conn
+
+	wmu sync.Mutex
+	w   *bufio.Writer
+
+	// Registration state, only touched by the read loop
+	pass       string
+	user       string
+	registered bool
+
+	mu       sync.Mutex
+	nick     string
+	channels map[string]struct{} // room names without '#'
+}
+
+func newConn(g *Gateway, nc net.Conn) *conn {
+	return &conn{g: g, nc: nc, w: bufio.NewWriter(nc), channels: map[string]struct{}{}}
+}
+
+func (c *conn) serve(ctx context.Context) {
+	defer c.nc.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.nc.Close()
+		case <-done:
+		}
+	}()
+	defer func() {
+		if c.registered {
+			c.g.unregister(c)
+		}
+	}()
+
+	sc := bufio.NewScanner(c.nc)
+	sc.Buffer(make([]byte, 0, maxLineLength), readLimit)
+	for sc.Scan() {
+		m, ok := parseMessage(sc.Text())
+		if !ok {
+			continue
+		}
+		if !c.handle(ctx, m) {
+			return
+		}
+	}
+}
+
+// send writes one line to the client.
+func (c *conn) send(m message) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.nc.SetWriteDeadline(time.Now().Add(writeTimeout))
+	c.w.WriteString(m.String() + "\r\n")
+	if err := c.w.Flush(); err != nil {
+		c.nc.Close()
+	}
+}
+
+// reply sends a numeric or command from the server to the client.
+func (c *conn) reply(command string, params ...string) {
+	target := c.currentNick()
+	if target == "" {
+		target = "*"
+	}
+	if len(command) == 3 && command[0] >= '0' && command[0] <= '9' {
+		params = append([]string{target}, params...)
+	}
+	c.send(message{Prefix: serverName, Command: command, Params: params})
+}
+
+func (c *conn) notice(text string) {
+	for _, line := range splitText(text, len(serverName)+len(c.currentNick())+12) {
+		c.send(message{Prefix: serverName, Command: "NOTICE", Params: []string{c.currentNick(), line}})
+	}
+}
+
+func (c *conn) selfmask() string {
+	return c.currentNick() + "!" + c.user + "@" + c.g.client.Zbase32()
+}
+
+func (c *conn) currentNick() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nick
+}
+
+func (c *conn) setNick(nick string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nick = nick
+}
+
+func (c *conn) inChannel(room string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.channels[room]
+	return ok
+}
+
+func (c *conn) channelList() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]string, 0, len(c.channels))
+	for room := range c.channels {
+		out = append(out, room)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// handle handles one message. It returns false when the connection should close.
+func (c *conn) handle(ctx context.Context, m message) bool {
+	switch m.Command {
+	case "PASS":
+		if c.registered {
+			c.reply(errAlreadyReg, "You may not reregister")
+			return true
+		}
+		c.pass = m.param(0)
+		return true
+	case "NICK":
+		return c.handleNick(m)
+	case "USER":
+		if c.registered {
+			c.reply(errAlreadyReg, "You may not reregister")
+			return true
+		}
+		if len(m.Params) < 4 {
+			c.reply(errNeedMoreArgs, "USER", "Not enough parameters")
+			return true
+		}
+		c.user = sanitizeNick(m.Params[0])
+		if c.user == "" {
+			c.user = "user"
+		}
+		return c.tryRegister()
+	case "CAP":
+		// No capabilities; answer LS so clients that negotiate go on to register
+		if strings.EqualFold(m.param(0), "LS") {
+			c.send(message{Prefix: serverName, Command: "CAP", Params: []string{"*", "LS", ""}})
+		} else if strings.EqualFold(m.param(0), "REQ") {
+			c.send(message{Prefix: serverName, Command: "CAP", Params: []string{"*", "NAK", m.param(1)}})
+		}
+		return true
+	case "PING":
+		c.send(message{Prefix: serverName, Command: "PONG", Params: []string{serverName, m.param(0)}})
+		return true
+	case "PONG":
+		return true
+	case "QUIT":
+		c.send(message{Command: "ERROR", Params: []string{"Closing link"}})
+		return false
+	}
+	if !c.registered {
+		c.reply(errNotRegistered, "You have not registered")
+		return true
+	}
+
+	switch m.Command {
+	case "JOIN":
+		c.handleJoin(m)
+	case "PART":
+		c.handlePart(m)
+	case "PRIVMSG", "NOTICE":
+		c.handlePrivmsg(ctx, m)
+	case "NAMES":
+		for _, ch := range strings.Split(m.param(0), ",") {
+			if ch != "" {
+				c.names(ch)
+			}
+		}
+	case "WHO":
+		c.handleWho(m)
+	case "WHOIS":
+		c.handleWhois(m)
+	case "LIST":
+		c.handleList()
+	case "TOPIC":
+		if len(m.Params) == 0 {
+			c.reply(errNeedMoreArgs, "TOPIC", "Not enough parameters")
+		} else {
+			c.reply(rplNoTopic, m.Params[0], "No topic is set")
+		}
+	case "MODE":
+		target := m.param(0)
+		switch {
+		case target == "":
+			c.reply(errNeedMoreArgs, "MODE", "Not enough parameters")
+		case strings.HasPrefix(target, "#"):
+			if len(m.Params) == 1 {
+				c.reply(rplChannelModeIs, target, "+n")
+			}
+		case strings.EqualFold(target, c.currentNick()):
+			if len(m.Params) == 1 {
+				c.reply(rplUModeIs, "+i")
+			}
+		default:
+			c.reply(errNoSuchNick, target, "No such nick/channel")
+		}
+	case "USERHOST", "ISON", "AWAY":
+		// Not supported, but clients send them on their own
+	default:
+		c.reply(errUnknownCmd, m.Command, "Unknown command")
+	}
+	return true
+}
+
+func (c *conn) handleNick(m message) bool {
+	nick := m.param(0)
+	if nick == "" {
+		c.reply(errNoNickGiven, "No nickname given")
+		return true
+	}
+	if !validNick(nick) {
+		c.reply(errBadNick, nick, "Erroneous nickname")
+		return true
+	}
+	if c.g.isPeerNick(nick) {
+		c.reply(errNickInUse, nick, "Nickname is already in use by a peer")
+		return true
+	}
+	if !c.registered {
+		c.setNick(nick)
+		return c.tryRegister()
+	}
+	c.send(message{Prefix: c.selfmask(), Command: "NICK", Params: []string{nick}})
+	c.setNick(nick)
+	return true
+}
+
+// tryRegister completes registration once NICK and USER are in.
+func (c *conn) tryRegister() bool {
+	if c.registered || c.currentNick() == "" || c.user == "" {
+		return true
+	}
+	if c.g.password != "" && subtle.ConstantTimeCompare([]byte(c.pass), []byte(c.g.password)) != 1 {
+		c.reply(errPasswdMismatch, "Password incorrect")
+		c.send(message{Command: "ERROR", Params: []string{"Bad password"}})
+		return false
+	}
+	c.registered = true
+	cl := c.g.client
+	c.reply(rplWelcome, fmt.Sprintf("Welcome to shadow, %s", c.selfmask()))
+	c.reply(rplYourHost, "Your host is "+serverName+", speaking for "+cl.Name()+"@"+cl.Zbase32())
+	c.reply(rplCreated, "This gateway relays to the shadow network")
+	c.reply(rplMyInfo, serverName, "shadow-irc", "i", "n")
+	c.reply(errNoMotd, "MOTD File is missing")
+	c.notice(fmt.Sprintf("You are %s (%s), connectivity: %s", cl.Name(), cl.ID(), cl.Connectivity().State))
+	c.notice("Message a nick to send an encrypted direct message; /join #room to join a room. " +
+		"Peers not in your contacts can be addressed by peer ID or z:<zbase32>.")
+	c.g.register(c)
+	return true
+}
+
+func (c *conn) handleJoin(m message) {
+	if len(m.Params) == 0 {
+		c.reply(errNeedMoreArgs, "JOIN", "Not enough parameters")
+		return
+	}
+	for _, ch := range strings.Split(m.Params[0], ",") {
+		room, ok := strings.CutPrefix(ch, "#")
+		if !ok || room == "" {
+			c.reply(errNoSuchChannel, ch, "No such channel")
+			continue
+		}
+		if c.inChannel(room) {
+			continue
+		}
+		if err := c.g.client.Join(context.Background(), room); err != nil {
+			c.reply(errNoSuchChannel, ch, err.Error())
+			continue
+		}
+		c.mu.Lock()
+		c.channels[room] = struct{}{}
+		c.mu.Unlock()
+		c.send(message{Prefix: c.selfmask(), Command: "JOIN", Params: []string{ch}})
+		c.reply(rplNoTopic, ch, "No topic is set")
+		c.names(ch)
+	}
+}
+
+func (c *conn) handlePart(m message) {
+	if len(m.Params) == 0 {
+		c.reply(errNeedMoreArgs, "PART", "Not enough parameters")
+		return
+	}
+	for _, ch := range strings.Split(m.Params[0], ",") {
+		room := strings.TrimPrefix(ch, "#")
+		if !c.inChannel(room) {
+			c.reply(errNotOnChannel, ch, "You're not on that channel")
+			continue
+		}
+		c.mu.Lock()
+		delete(c.channels, room)
+		c.mu.Unlock()
+		c.send(message{Prefix: c.selfmask(), Command: "PART", Params: []string{ch}})
+		if !c.g.inChannel(room) {
+			c.g.client.Leave(context.Background(), room)
+		}
+	}
+}
+
+func (c *conn) handlePrivmsg(ctx context.Context, m message) {
+	// NOTICE never produces error replies
+	notice := m.Command == "NOTICE"
+	if len(m.Params) < 2 {
+		if !notice {
+			c.reply(errNeedMoreArgs, m.Command, "Not enough parameters")
+		}
+		return
+	}
+	text := m.Params[1]
+	if action, ok := strings.CutPrefix(text, "\x01ACTION "); ok {
+		text = "* " + c.currentNick() + " " + strings.TrimSuffix(action, "\x01")
+	} else if strings.HasPrefix(text, "\x01") {
+		// Other CTCP requests are not forwarded
+		return
+	}
+	for _, target := range strings.Split(m.Params[0], ",") {
+		if room, ok := strings.CutPrefix(target, "#"); ok {
+			if !c.inChannel(room) {
+				if !notice {
+					c.reply(errCannotSend, target, "Cannot send to channel")
+				}
+				continue
+			}
+			sctx, cancel := context.WithTimeout(ctx, sendTimeout)
+			_, err := c.g.client.SendRoom(sctx, room, text)
+			cancel()
+			if err != nil && !notice {
+				c.reply(errCannotSend, target, err.Error())
+			}
+			continue
+		}
+		p, ok := c.g.peer(target)
+		if !ok {
+			if !notice {
+				c.reply(errNoSuchNick, target, "No such nick/channel")
+			}
+			continue
+		}
+		// Direct messages can take a while to reach a peer; don't block the connection
+		go func() {
+			sctx, cancel := context.WithTimeout(ctx, sendTimeout)
+			defer cancel()
+			if _, err := c.g.client.Send(sctx, p.String(), text); err != nil && !notice {
+				c.notice(fmt.Sprintf("Message to %s failed: %v", target, err))
+			}
+		}()
+	}
+}
+
+// names sends the NAMES reply for a channel.
+func (c *conn) names(ch string) {
+	room := strings.TrimPrefix(ch, "#")
+	nicks := []string{c.currentNick()}
+	if members, err := c.g.client.RoomMembers(room); err == nil {
+		for _, p := range members {
+			nicks = append(nicks, c.g.nick(p.ID, p.Name))
+		}
+	}
+	sort.Strings(nicks[1:])
+	// Keep each reply well under the line limit
+	for len(nicks) > 0 {
+		n := min(len(nicks), 20)
+		c.reply(rplNamReply, "=", ch, strings.Join(nicks[:n], " "))
+		nicks = nicks[n:]
+	}
+	c.reply(rplEndOfNames, ch, "End of /NAMES list")
+}
+
+func (c *conn) handleWho(m message) {
+	mask := m.param(0)
+	if room, ok := strings.CutPrefix(mask, "#"); ok {
+		cl := c.g.client
+		c.reply(rplWhoReply, mask, c.user, cl.Zbase32(), serverName, c.currentNick(), "H", "0 "+cl.Name())
+		if members, err := cl.RoomMembers(room); err == nil {
+			for _, p := range members {
+				nick := c.g.nick(p.ID, p.Name)
+				c.reply(rplWhoReply, mask, "shadow", p.Zbase32, serverName, nick, "H", "0 "+p.Name)
+			}
+		}
+	} else if p, ok := c.g.peer(mask); ok {
+		info := c.g.client.PeerInfo(p)
+		c.reply(rplWhoReply, "*", "shadow", info.Zbase32, serverName, c.g.nick(p, info.Name), "H", "0 "+info.Name)
+	}
+	c.reply(rplEndOfWho, mask, "End of /WHO list")
+}
+
+func (c *conn) handleWhois(m message) {
+	// WHOIS [server] nick
+	nick := m.param(len(m.Params) - 1)
+	if nick == "" {
+		c.reply(errNoNickGiven, "No nickname given")
+		return
+	}
+	p, ok := c.g.peer(nick)
+	if !ok {
+		c.reply(errNoSuchNick, nick, "No such nick/channel")
+		c.reply(rplEndOfWhois, nick, "End of /WHOIS list")
+		return
+	}
+	info := c.g.client.PeerInfo(p)
+	nick = c.g.nick(p, info.Name)
+	realname := info.Name
+	if realname == "" {
+		realname = "unknown"
+	}
+	c.reply(rplWhoisUser, nick, "shadow", info.Zbase32, "*", realname)
+	c.reply(rplWhoisServer, nick, serverName, "peer "+p.String())
+	presence := "connection: " + info.ConnType
+	if info.Contact {
+		presence += ", contact"
+	}
+	if info.ConnType == "none" {
+		c.reply(rplAway, nick, "Not connected")
+	}
+	c.reply(rplWhoisSpecial, nick, presence)
+	c.reply(rplEndOfWhois, nick, "End of /WHOIS list")
+}
+
+func (c *conn) handleList() {
+	c.reply(rplListStart, "Channel", "Users  Name")
+	for _, room := range c.g.client.Rooms() {
+		members, _ := c.g.client.RoomMembers(room)
+		c.reply(rplList, "#"+room, fmt.Sprint(len(members)+1), "")
+	}
+	c.reply(rplListEnd, "End of /LIST")
+}
+
+// event relays a shadow event to the client.
+func (c *conn) event(ev shadow.Event) {
+	switch ev := ev.(type) {
+	case shadow.MessageEvent:
+		from := c.g.hostmask(ev.From, ev.Name)
+		target := c.currentNick()
+		if ev.Room != "" {
+			target = "#" + ev.Room
+			if !c.inChannel(ev.Room) {
+				return
+			}
+		}
+		text := ev.Text
+		if ev.Puppet != "" {
+			text = "<" + ev.Puppet + "> " + text
+		}
+		if ev.File != nil {
+			text = fmt.Sprintf("sent file %s (%d bytes), saved to %s", ev.File.Name, ev.File.Size, ev.File.Path)
+		}
+		overhead := len(from) + len(target) + 12
+		for _, line := range splitText(text, overhead) {
+			c.send(message{Prefix: from, Command: "PRIVMSG", Params: []string{target, line}})
+		}
+	case shadow.ConnectivityEvent:
+		c.notice(fmt.Sprintf("Connectivity: %s (relays %d/%d, peers %d)", ev.State, ev.Reserved, ev.Relays, ev.Peers))
+	}
+}
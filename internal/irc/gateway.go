@@ -0,0 +1,250 @@
+// Package irc lets standard IRC clients use a shadow node.
+//
+// Nicks stand for peers: PRIVMSG to a nick is sent as an end-to-end
+// encrypted direct message, channels are rooms, and NAMES, WHO and WHOIS
+// answer from what the node knows about its peers.
+package irc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"shadow/pkg/shadow"
+)
+
+const (
+	serverName = "shadow"
+	maxNickLen = 30
+)
+
+// Gateway serves IRC connections for one shadow client. Every IRC
+// connection talks as the client's identity.
+type Gateway struct {
+	client   *shadow.Client
+	password string
+
+	mu     sync.Mutex
+	byNick map[string]peer.ID // lower-cased nick
+	byPeer map[peer.ID]string
+	// unnamed holds peers whose nick was made up before their name was known
+	unnamed map[peer.ID]bool
+	conns   map[*conn]struct{}
+}
+
+// New returns a gateway for client. If password is set, IRC clients must
+// send it with PASS before registering.
+func New(client *shadow.Client, password string) *Gateway {
+	g := &Gateway{
+		client:   client,
+		password: password,
+		byNick:   map[string]peer.ID{},
+		byPeer:   map[peer.ID]string{},
+		unnamed:  map[peer.ID]bool{},
+		conns:    map[*conn]struct{}{},
+	}
+	for _, c := range client.Contacts() {
+		g.nick(c.ID, c.Name)
+	}
+	return g
+}
+
+// ListenAndServe listens on addr and serves until ctx is cancelled.
+func (g *Gateway) ListenAndServe(ctx context.Context, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for IRC: %w", err)
+	}
+	return g.Serve(ctx, l)
+}
+
+// Serve accepts IRC connections on l until ctx is cancelled, then closes l
+// and all connections.
+func (g *Gateway) Serve(ctx context.Context, l net.Listener) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	go g.forwardEvents(ctx)
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("failed to accept IRC connection: %w", err)
+		}
+		c := newConn(g, nc)
+		go c.serve(ctx)
+	}
+}
+
+// forwardEvents hands incoming messages and connectivity changes to every
+// registered connection.
+func (g *Gateway) forwardEvents(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-g.client.Events():
+			if !ok {
+				return
+			}
+			if m, ok := ev.(shadow.MessageEvent); ok && m.From == g.client.ID() {
+				continue
+			}
+			g.mu.Lock()
+			conns := g.connList()
+			g.mu.Unlock()
+			for _, c := range conns {
+				c.event(ev)
+			}
+		}
+	}
+}
+
+// connList returns the registered connections; g.mu must be held.
+func (g *Gateway) connList() []*conn {
+	conns := make([]*conn, 0, len(g.conns))
+	for c := range g.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+func (g *Gateway) register(c *conn) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.conns[c] = struct{}{}
+}
+
+func (g *Gateway) unregister(c *conn) {
+	g.mu.Lock()
+	delete(g.conns, c)
+	g.mu.Unlock()
+	// Leave rooms no other connection is in
+	for _, room := range c.channelList() {
+		if !g.inChannel(room) {
+			g.client.Leave(context.Background(), room)
+		}
+	}
+}
+
+// inChannel reports whether any registered connection is in room.
+func (g *Gateway) inChannel(room string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for c := range g.conns {
+		if c.inChannel(room) {
+			return true
+		}
+	}
+	return false
+}
+
+// nick returns the nick of p, assigning one from its announced name on
+// first use. A name taken by another peer gets a zbase32 suffix. A peer
+// first seen without a name is renamed once its name is known.
+func (g *Gateway) nick(p peer.ID, name string) string {
+	info := g.client.PeerInfo(p)
+	if name == "" {
+		name = info.Name
+	}
+	g.mu.Lock()
+	old, ok := g.byPeer[p]
+	if ok && (name == "" || !g.unnamed[p]) {
+		g.mu.Unlock()
+		return old
+	}
+	// The tail of the zbase32 ID; the head is the same multihash prefix for every peer
+	tag := info.Zbase32[len(info.Zbase32)-8:]
+	n := sanitizeNick(name)
+	if n == "" {
+		n = "z" + tag
+		g.unnamed[p] = true
+	} else {
+		delete(g.unnamed, p)
+	}
+	if other, taken := g.byNick[strings.ToLower(n)]; taken && other != p {
+		n = truncate(n, maxNickLen-7) + "-" + tag[2:]
+	}
+	if ok {
+		delete(g.byNick, strings.ToLower(old))
+	}
+	g.byNick[strings.ToLower(n)] = p
+	g.byPeer[p] = n
+	conns := g.connList()
+	g.mu.Unlock()
+
+	if ok && old != n {
+		for _, c := range conns {
+			c.send(message{Prefix: old + "!shadow@" + info.Zbase32, Command: "NICK", Params: []string{n}})
+		}
+	}
+	return n
+}
+
+// peer resolves a nick, or anything shadow.Client.ResolvePeer accepts.
+func (g *Gateway) peer(nick string) (peer.ID, bool) {
+	g.mu.Lock()
+	p, ok := g.byNick[strings.ToLower(nick)]
+	g.mu.Unlock()
+	if ok {
+		return p, true
+	}
+	p, err := g.client.ResolvePeer(nick)
+	if err != nil {
+		return "", false
+	}
+	g.nick(p, "")
+	return p, true
+}
+
+// isPeerNick reports whether nick belongs to a remote peer.
+func (g *Gateway) isPeerNick(nick string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.byNick[strings.ToLower(nick)]
+	return ok
+}
+
+// hostmask is the nick!user@host prefix of a peer.
+func (g *Gateway) hostmask(p peer.ID, name string) string {
+	return g.nick(p, name) + "!shadow@" + g.client.PeerInfo(p).Zbase32
+}
+
+// sanitizeNick keeps the characters IRC allows in nicks.
+func sanitizeNick(name string) string {
+	var sb strings.Builder
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', strings.ContainsRune("_[]\\`^{}|", r):
+		case (r >= '0' && r <= '9') || r == '-':
+			if sb.Len() == 0 {
+				continue
+			}
+		default:
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return truncate(sb.String(), maxNickLen)
+}
+
+func validNick(nick string) bool {
+	return nick != "" && sanitizeNick(nick) == nick
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
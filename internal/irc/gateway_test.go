@@ -0,0 +1,146 @@
+package irc
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"shadow/pkg/shadow"
+)
+
+const testTimeout = 20 * time.Second
+
+func startClient(t *testing.T, name string) *shadow.Client {
+	t.Helper()
+	c, err := shadow.Start(context.Background(), shadow.Config{Name: name, DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// ircClient is a scripted IRC client on a loopback connection.
+type ircClient struct {
+	t  *testing.T
+	nc net.Conn
+	r  *bufio.Reader
+}
+
+func dial(t *testing.T, addr string) *ircClient {
+	t.Helper()
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { nc.Close() })
+	return &ircClient{t: t, nc: nc, r: bufio.NewReader(nc)}
+}
+
+func (c *ircClient) send(format string, args ...any) {
+	c.t.Helper()
+	if _, err := fmt.Fprintf(c.nc, format+"\r\n", args...); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// expect reads lines until one has command, failing on any line that came
+// from neither the gateway nor a user.
+func (c *ircClient) expect(command string) message {
+	c.t.Helper()
+	c.nc.SetReadDeadline(time.Now().Add(testTimeout))
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("waiting for %s: %v", command, err)
+		}
+		m, ok := parseMessage(line)
+		if !ok {
+			c.t.Fatalf("unparsable line %q", line)
+		}
+		if m.Prefix != serverName && !strings.Contains(m.Prefix, "!") {
+			c.t.Fatalf("line from %q injected: %q", m.Prefix, line)
+		}
+		if m.Command == command {
+			return m
+		}
+	}
+}
+
+func TestGateway(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	local := startClient(t, "alice")
+	remote := startClient(t, "mallory\r\n:evil PRIVMSG alice :pwned")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go New(local, "secret").Serve(ctx, l)
+
+	bad := dial(t, l.Addr().String())
+	bad.send("PASS wrong")
+	bad.send("NICK alice")
+	bad.send("USER alice 0 * :Alice")
+	bad.expect(errPasswdMismatch)
+
+	c := dial(t, l.Addr().String())
+	c.send("PASS secret")
+	c.send("NICK alice")
+	c.send("USER alice 0 * :Alice")
+	if m := c.expect(rplWelcome); m.param(0) != "alice" {
+		t.Fatalf("welcome for %q", m.param(0))
+	}
+	c.send("JOIN #lobby")
+	if m := c.expect("JOIN"); m.param(0) != "#lobby" {
+		t.Fatalf("joined %q", m.param(0))
+	}
+	c.expect(rplEndOfNames)
+
+	// A direct message from a peer with line breaks in its name
+	if err := remote.Connect(ctx, local.Addrs()[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remote.Send(ctx, local.ID().String(), "hello\r\n:evil QUIT"); err != nil {
+		t.Fatal(err)
+	}
+	m := c.expect("PRIVMSG")
+	nick, _, _ := strings.Cut(m.Prefix, "!")
+	if m.param(0) != "alice" || m.param(1) != "hello" {
+		t.Fatalf("got %+v", m)
+	}
+	c.send("WHOIS %s", nick)
+	if m := c.expect(rplWhoisUser); strings.ContainsAny(m.param(5), "\r\n") {
+		t.Fatalf("realname %q", m.param(5))
+	}
+	c.expect(rplEndOfWhois)
+	c.send("WHO %s", nick)
+	c.expect(rplEndOfWho)
+
+	// And one back to it
+	events := remote.Events()
+	c.send("PRIVMSG %s :hi mallory", nick)
+	deadline := time.After(testTimeout)
+	for {
+		select {
+		case ev := <-events:
+			if m, ok := ev.(shadow.MessageEvent); ok && m.Text == "hi mallory" {
+				return
+			}
+		case <-deadline:
+			t.Fatal("direct message from IRC not delivered")
+		}
+	}
+}
+
+func TestMessageStringDropsLineBreaks(t *testing.T) {
+	m := message{Prefix: serverName, Command: rplWhoisUser, Params: []string{"alice", "x\r\n:evil QUIT\x00"}}
+	if got, want := m.String(), ":shadow 311 alice :x:evil QUIT"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,97 @@
+package irc
+
+import "strings"
+
+// maxLineLength is the IRC line limit including CRLF.
+const maxLineLength = 512
+
+// message is one IRC protocol line.
+type message struct {
+	Prefix  string
+	Command string
+	Params  []string
+}
+
+// parseMessage parses a line without its CRLF. IRCv3 tags are ignored.
+func parseMessage(line string) (message, bool) {
+	var m message
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "@") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+	if strings.HasPrefix(line, ":") {
+		m.Prefix, line, _ = strings.Cut(line[1:], " ")
+	}
+	line = strings.TrimLeft(line, " ")
+	for line != "" {
+		if strings.HasPrefix(line, ":") {
+			m.Params = append(m.Params, line[1:])
+			break
+		}
+		var p string
+		p, line, _ = strings.Cut(line, " ")
+		if p != "" {
+			m.Params = append(m.Params, p)
+		}
+		line = strings.TrimLeft(line, " ")
+	}
+	if len(m.Params) == 0 {
+		return m, false
+	}
+	m.Command = strings.ToUpper(m.Params[0])
+	m.Params = m.Params[1:]
+	return m, true
+}
+
+// param returns the i-th parameter, or "" if there are fewer.
+func (m message) param(i int) string {
+	if i < len(m.Params) {
+		return m.Params[i]
+	}
+	return ""
+}
+
+// lineBreaks are dropped from everything written, since parameters carry
+// names and text of remote peers and would otherwise start new lines.
+var lineBreaks = strings.NewReplacer("\r", "", "\n", "", "\x00", "")
+
+// String formats m as a line without CRLF; the last parameter is always trailing.
+func (m message) String() string {
+	var sb strings.Builder
+	if m.Prefix != "" {
+		sb.WriteString(":" + m.Prefix + " ")
+	}
+	sb.WriteString(m.Command)
+	for i, p := range m.Params {
+		sb.WriteByte(' ')
+		if i == len(m.Params)-1 {
+			sb.WriteByte(':')
+		}
+		sb.WriteString(p)
+	}
+	return lineBreaks.Replace(sb.String())
+}
+
+// splitText splits text into lines that fit in a PRIVMSG after overhead bytes.
+func splitText(text string, overhead int) []string {
+	limit := maxLineLength - 2 - overhead
+	if limit < 64 {
+		limit = 64
+	}
+	var out []string
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r", ""), "\n") {
+		for len(line) > limit {
+			cut := limit
+			// Do not split inside a UTF-8 sequence
+			for cut > 0 && line[cut]&0xC0 == 0x80 {
+				cut--
+			}
+			out = append(out, line[:cut])
+			line = line[cut:]
+		}
+		if line != "" {
+			out = append(out, line)
+		}
+	}
+	return out
+}
@@ -0,0 +1,37 @@
+// Package logging carries the progress and error lines the node and the
+// libraries print. They go to stdout unless a program sends them elsewhere,
+// e.g. to stderr when stdout carries its own results.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+var (
+	mu  sync.Mutex
+	out io.Writer = os.Stdout
+)
+
+// SetOutput sends all further lines to w; io.Discard silences them.
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	out = w
+}
+
+// Println prints a line like fmt.Println.
+func Println(a ...any) {
+	mu.Lock()
+	defer mu.Unlock()
+	fmt.Fprintln(out, a...)
+}
+
+// Printf prints like fmt.Printf.
+func Printf(format string, a ...any) {
+	mu.Lock()
+	defer mu.Unlock()
+	fmt.Fprintf(out, format, a...)
+}
@@ -0,0 +1,82 @@
+package mailbox
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Client talks to the mailbox service of a single relay.
+type Client struct {
+	host  host.Host
+	relay peer.ID
+}
+
+// NewClient returns a client for the mailbox service on relay.
+func NewClient(h host.Host, relay peer.ID) *Client {
+	return &Client{host: h, relay: relay}
+}
+
+// Relay returns the peer ID of the relay.
+func (c *Client) Relay() peer.ID {
+	return c.relay
+}
+
+func (c *Client) roundTrip(ctx context.Context, req request) (*response, error) {
+	s, err := c.host.NewStream(ctx, c.relay, Protocol)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open mailbox stream: %w", err)
+	}
+	defer s.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		s.SetDeadline(dl)
+	} else {
+		s.SetDeadline(time.Now().Add(streamTimeout))
+	}
+	if err := json.NewEncoder(s).Encode(req); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	var resp response
+	if err := json.NewDecoder(s).Decode(&resp); err != nil {
+		s.Reset()
+		return nil, fmt.Errorf("failed to read mailbox response: %w", err)
+	}
+	if !resp.OK {
+		return nil, fmt.Errorf("mailbox %s failed: %s", req.Type, resp.Error)
+	}
+	return &resp, nil
+}
+
+// SetTokens makes tokens the only ones accepted for deposits into our
+// mailbox, for TokenTTL. Only their hashes are sent.
+func (c *Client) SetTokens(ctx context.Context, tokens ...[]byte) error {
+	req := request{Type: "tokens"}
+	for _, t := range tokens {
+		h := sha256.Sum256(t)
+		req.Hashes = append(req.Hashes, h[:])
+	}
+	_, err := c.roundTrip(ctx, req)
+	return err
+}
+
+// Deposit leaves blob in the mailbox of to, authorized by a token to issued.
+func (c *Client) Deposit(ctx context.Context, to peer.ID, token, blob []byte) error {
+	_, err := c.roundTrip(ctx, request{Type: "deposit", To: to.String(), Token: token, Blob: blob})
+	return err
+}
+
+// Fetch takes the blobs waiting in our mailbox. If there are none it waits
+// up to wait, at most MaxWait, for one to arrive.
+func (c *Client) Fetch(ctx context.Context, wait time.Duration) ([][]byte, error) {
+	resp, err := c.roundTrip(ctx, request{Type: "fetch", Wait: wait.Milliseconds()})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Blobs, nil
+}
@@ -0,0 +1,297 @@
+// Package mailbox stores blobs on a relay for peers to fetch later. A
+// mailbox belongs to the peer that registers delivery tokens for it; anyone
+// presenting one of those tokens may deposit, and the relay neither asks
+// nor records who deposited. Blobs are opaque to the relay.
+package mailbox
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Protocol is the stream protocol spoken between mailbox clients and the relay.
+const Protocol = "/shadow/mailbox/1.0.0"
+
+const (
+	// TokenSize is the length of a delivery token.
+	TokenSize = 32
+	// MaxBlobSize bounds a single deposit.
+	MaxBlobSize = 128 << 10
+	// MaxBlobs bounds the blobs waiting in one mailbox.
+	MaxBlobs = 256
+	// MaxWait bounds how long a fetch waits for a deposit.
+	MaxWait = 20 * time.Second
+	// BlobTTL is how long an unfetched blob is kept.
+	BlobTTL = 7 * 24 * time.Hour
+	// TokenTTL is how long registered tokens are honoured unless registered again.
+	TokenTTL = 24 * time.Hour
+	// MaxTokens bounds the tokens registered for one mailbox.
+	MaxTokens = 1024
+	// MaxBoxes bounds the mailboxes on a relay.
+	MaxBoxes = 4096
+	// MaxStored bounds the bytes of all blobs kept on a relay.
+	MaxStored = 1 << 30
+
+	// maxRequestSize bounds a request on the wire: a base64 blob of
+	// MaxBlobSize, or MaxTokens base64 hashes, and the JSON around them.
+	maxRequestSize = MaxBlobSize*4/3 + 64<<10
+	streamTimeout  = 30 * time.Second
+)
+
+type request struct {
+	Type   string   `json:"type"` // tokens, deposit, fetch
+	To     string   `json:"to,omitempty"`
+	Token  []byte   `json:"token,omitempty"`
+	Hashes [][]byte `json:"hashes,omitempty"` // SHA-256 of the accepted tokens
+	Blob   []byte   `json:"blob,omitempty"`
+	Wait   int64    `json:"wait,omitempty"` // milliseconds
+}
+
+type response struct {
+	OK    bool     `json:"ok"`
+	Error string   `json:"error,omitempty"`
+	Blobs [][]byte `json:"blobs,omitempty"`
+}
+
+type blob struct {
+	data    []byte
+	expires time.Time
+}
+
+type box struct {
+	tokens        map[[sha256.Size]byte]bool
+	tokensExpires time.Time
+	blobs         []blob
+	// arrived is closed and replaced when a blob is deposited
+	arrived chan struct{}
+}
+
+// Service is the mailbox server. Mailboxes live in memory.
+type Service struct {
+	host      host.Host
+	authorize func(peer.ID) bool
+
+	mu    sync.Mutex
+	boxes map[peer.ID]*box
+	// stored is the size of every blob in boxes
+	stored int64
+}
+
+// NewService registers the mailbox handler on h. If authorize is non-nil,
+// only peers it accepts may own a mailbox; deposits are open to any peer
+// holding a token.
+func NewService(h host.Host, authorize func(peer.ID) bool) *Service {
+	s := &Service{
+		host:      h,
+		authorize: authorize,
+		boxes:     map[peer.ID]*box{},
+	}
+	h.SetStreamHandler(Protocol, s.handleStream)
+	return s
+}
+
+// Close unregisters the handler.
+func (s *Service) Close() {
+	s.host.RemoveStreamHandler(Protocol)
+}
+
+// Stored returns the number of mailboxes and the bytes of blobs they hold.
+func (s *Service) Stored() (boxes int, bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gcLocked()
+	return len(s.boxes), s.stored
+}
+
+// Pending returns the number of blobs waiting for p.
+func (s *Service) Pending(p peer.ID) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gcLocked()
+	if b, ok := s.boxes[p]; ok {
+		return len(b.blobs)
+	}
+	return 0
+}
+
+func (s *Service) handleStream(str network.Stream) {
+	defer str.Close()
+	str.SetDeadline(time.Now().Add(streamTimeout))
+
+	// Each request gets maxRequestSize of the stream
+	limited := &io.LimitedReader{R: str}
+	dec := json.NewDecoder(limited)
+	enc := json.NewEncoder(str)
+	for {
+		limited.N = maxRequestSize
+		var req request
+		if err := dec.Decode(&req); err != nil {
+			if limited.N <= 0 {
+				str.Reset()
+			}
+			return
+		}
+		var resp response
+		switch req.Type {
+		case "tokens":
+			resp = s.setTokens(str.Conn().RemotePeer(), req)
+		case "deposit":
+			// Deliberately not looking at who is depositing
+			resp = s.deposit(req)
+		case "fetch":
+			resp = s.fetch(str.Conn().RemotePeer(), req)
+		default:
+			resp = response{Error: fmt.Sprintf("unknown request type %q", req.Type)}
+		}
+		if err := enc.Encode(resp); err != nil {
+			if len(resp.Blobs) > 0 {
+				s.putBack(str.Conn().RemotePeer(), resp.Blobs)
+			}
+			str.Reset()
+			return
+		}
+		str.SetDeadline(time.Now().Add(streamTimeout))
+	}
+}
+
+// boxLocked returns the mailbox of p, creating it.
+func (s *Service) boxLocked(p peer.ID) *box {
+	b, ok := s.boxes[p]
+	if !ok {
+		b = &box{tokens: map[[sha256.Size]byte]bool{}, arrived: make(chan struct{})}
+		s.boxes[p] = b
+	}
+	return b
+}
+
+func (s *Service) setTokens(p peer.ID, req request) response {
+	if s.authorize != nil && !s.authorize(p) {
+		return response{Error: "not authorized"}
+	}
+	if len(req.Hashes) > MaxTokens {
+		return response{Error: "too many tokens"}
+	}
+	tokens := map[[sha256.Size]byte]bool{}
+	for _, h := range req.Hashes {
+		if len(h) != sha256.Size {
+			return response{Error: "invalid token hash"}
+		}
+		tokens[[sha256.Size]byte(h)] = true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gcLocked()
+	if _, ok := s.boxes[p]; !ok && len(s.boxes) >= MaxBoxes {
+		return response{Error: "relay has no room for another mailbox"}
+	}
+	b := s.boxLocked(p)
+	b.tokens = tokens
+	b.tokensExpires = time.Now().Add(TokenTTL)
+	return response{OK: true}
+}
+
+func (s *Service) deposit(req request) response {
+	to, err := peer.Decode(req.To)
+	if err != nil {
+		return response{Error: "invalid recipient"}
+	}
+	if len(req.Blob) == 0 || len(req.Blob) > MaxBlobSize {
+		return response{Error: "invalid blob size"}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gcLocked()
+	b, ok := s.boxes[to]
+	// The same answer for unknown mailboxes and wrong tokens
+	if !ok || !b.tokens[sha256.Sum256(req.Token)] {
+		return response{Error: "not authorized"}
+	}
+	if len(b.blobs) >= MaxBlobs {
+		return response{Error: "mailbox full"}
+	}
+	if s.stored+int64(len(req.Blob)) > MaxStored {
+		return response{Error: "relay storage full"}
+	}
+	s.stored += int64(len(req.Blob))
+	b.blobs = append(b.blobs, blob{data: req.Blob, expires: time.Now().Add(BlobTTL)})
+	close(b.arrived)
+	b.arrived = make(chan struct{})
+	return response{OK: true}
+}
+
+// fetch hands p its blobs, waiting up to req.Wait for one if there are none.
+func (s *Service) fetch(p peer.ID, req request) response {
+	wait := min(time.Duration(req.Wait)*time.Millisecond, MaxWait)
+	deadline := time.After(wait)
+	for {
+		s.mu.Lock()
+		s.gcLocked()
+		b, ok := s.boxes[p]
+		if !ok {
+			// Without tokens nothing can arrive
+			s.mu.Unlock()
+			return response{OK: true}
+		}
+		if len(b.blobs) > 0 || wait <= 0 {
+			resp := response{OK: true}
+			for _, bl := range b.blobs {
+				resp.Blobs = append(resp.Blobs, bl.data)
+				s.stored -= int64(len(bl.data))
+			}
+			b.blobs = nil
+			s.mu.Unlock()
+			return resp
+		}
+		arrived := b.arrived
+		s.mu.Unlock()
+		select {
+		case <-arrived:
+		case <-deadline:
+			return response{OK: true}
+		}
+	}
+}
+
+// putBack returns blobs that could not be handed over.
+func (s *Service) putBack(p peer.ID, blobs [][]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.boxLocked(p)
+	expires := time.Now().Add(BlobTTL)
+	restored := make([]blob, 0, len(blobs)+len(b.blobs))
+	for _, data := range blobs {
+		restored = append(restored, blob{data: data, expires: expires})
+		s.stored += int64(len(data))
+	}
+	b.blobs = append(restored, b.blobs...)
+}
+
+func (s *Service) gcLocked() {
+	now := time.Now()
+	for p, b := range s.boxes {
+		if now.After(b.tokensExpires) {
+			b.tokens = map[[sha256.Size]byte]bool{}
+		}
+		kept := b.blobs[:0]
+		for _, bl := range b.blobs {
+			if now.Before(bl.expires) {
+				kept = append(kept, bl)
+			} else {
+				s.stored -= int64(len(bl.data))
+			}
+		}
+		b.blobs = kept
+		if len(b.tokens) == 0 && len(b.blobs) == 0 {
+			close(b.arrived)
+			delete(s.boxes, p)
+		}
+	}
+}
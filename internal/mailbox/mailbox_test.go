@@ -0,0 +1,55 @@
+package mailbox
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+func TestDepositLimits(t *testing.T) {
+	mn := mocknet.New()
+	defer mn.Close()
+	relay, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+	s := NewService(relay, nil)
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	token := make([]byte, TokenSize)
+	c := NewClient(owner, relay.ID())
+	if err := c.SetTokens(ctx, token); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Deposit(ctx, owner.ID(), token, make([]byte, MaxBlobSize)); err != nil {
+		t.Fatal(err)
+	}
+	// Cut off while still sending, not buffered whole
+	if err := c.Deposit(ctx, owner.ID(), token, make([]byte, 2*maxRequestSize)); err == nil {
+		t.Fatal("oversized request accepted")
+	}
+	if err := c.Deposit(ctx, owner.ID(), make([]byte, TokenSize-1), []byte("x")); err == nil {
+		t.Fatal("deposit without a registered token")
+	}
+	if boxes, stored := s.Stored(); boxes != 1 || stored != MaxBlobSize {
+		t.Fatalf("%d boxes holding %d bytes", boxes, stored)
+	}
+	blobs, err := c.Fetch(ctx, 0)
+	if err != nil || len(blobs) != 1 {
+		t.Fatalf("fetched %d blobs: %v", len(blobs), err)
+	}
+	if _, stored := s.Stored(); stored != 0 {
+		t.Fatalf("%d bytes left after fetch", stored)
+	}
+}
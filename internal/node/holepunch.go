@@ -0,0 +1,142 @@
+package node
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/protocol/holepunch"
+
+	"shadow/internal/logging"
+)
+
+// ConnType describes how the node is connected to a peer.
+type ConnType string
+
+const (
+	ConnNone        ConnType = "none"
+	ConnDirect      ConnType = "direct"
+	ConnRelayed     ConnType = "relayed"
+	ConnHolePunched ConnType = "hole-punched"
+)
+
+const (
+	// directWait is how long OpenDirectStream waits for DCUtR to upgrade a relayed connection.
+	directWait = 5 * time.Second
+	// punchRetryAfter is how long a failed hole punch suppresses further waiting.
+	punchRetryAfter = 10 * time.Minute
+)
+
+// holePunchTracer records the outcome of DCUtR attempts per remote peer.
+type holePunchTracer struct {
+	mu      sync.Mutex
+	punched map[peer.ID]bool
+	failed  map[peer.ID]time.Time
+}
+
+func newHolePunchTracer() *holePunchTracer {
+	return &holePunchTracer{
+		punched: map[peer.ID]bool{},
+		failed:  map[peer.ID]time.Time{},
+	}
+}
+
+// Trace implements holepunch.EventTracer.
+func (t *holePunchTracer) Trace(evt *holepunch.Event) {
+	var success bool
+	switch e := evt.Evt.(type) {
+	case *holepunch.EndHolePunchEvt:
+		success = e.Success
+		if !success {
+			logging.Println("Hole punch to", evt.Remote, "failed:", e.Error)
+		}
+	case *holepunch.DirectDialEvt:
+		// DCUtR dials directly before punching; a connection that needed no
+		// punch is plainly direct
+		if e.Success {
+			t.mu.Lock()
+			delete(t.failed, evt.Remote)
+			t.mu.Unlock()
+		}
+		return
+	default:
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if success {
+		if !t.punched[evt.Remote] {
+			logging.Println("Direct connection established with", evt.Remote)
+		}
+		t.punched[evt.Remote] = true
+		delete(t.failed, evt.Remote)
+	} else {
+		t.failed[evt.Remote] = time.Now()
+	}
+}
+
+func (t *holePunchTracer) wasPunched(p peer.ID) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.punched[p]
+}
+
+func (t *holePunchTracer) recentlyFailed(p peer.ID) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	at, ok := t.failed[p]
+	return ok && time.Since(at) < punchRetryAfter
+}
+
+func (t *holePunchTracer) forget(p peer.ID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.punched, p)
+}
+
+// ConnType reports whether the node talks to p directly, through a relay, or
+// over a connection obtained by hole punching.
+func (n *Node) ConnType(p peer.ID) ConnType {
+	conns := n.Host.Network().ConnsToPeer(p)
+	if len(conns) == 0 {
+		return ConnNone
+	}
+	for _, c := range conns {
+		if !c.Stat().Limited {
+			if n.holePunch != nil && n.holePunch.wasPunched(p) {
+				return ConnHolePunched
+			}
+			return ConnDirect
+		}
+	}
+	return ConnRelayed
+}
+
+// OpenStream opens a stream to p over the best connection there is,
+// relayed if need be. Hole punching upgrades a relayed connection in the
+// background, so later streams go direct.
+func (n *Node) OpenStream(ctx context.Context, p peer.ID, protos ...protocol.ID) (network.Stream, error) {
+	return n.Host.NewStream(network.WithAllowLimitedConn(ctx, "shadow"), p, protos...)
+}
+
+// OpenDirectStream opens a stream to p, preferring a direct connection. When
+// only a relayed connection exists it gives hole punching a moment to upgrade
+// it, then falls back to the relay. It is for transfers a relay would limit.
+func (n *Node) OpenDirectStream(ctx context.Context, p peer.ID, protos ...protocol.ID) (network.Stream, error) {
+	switch n.ConnType(p) {
+	case ConnDirect, ConnHolePunched:
+		return n.Host.NewStream(ctx, p, protos...)
+	}
+	if n.holePunch == nil || !n.holePunch.recentlyFailed(p) {
+		dctx, cancel := context.WithTimeout(ctx, directWait)
+		s, err := n.Host.NewStream(dctx, p, protos...)
+		cancel()
+		if err == nil {
+			return s, nil
+		}
+	}
+	return n.OpenStream(ctx, p, protos...)
+}
@@ -0,0 +1,28 @@
+package node
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/holepunch"
+)
+
+func TestHolePunchTracer(t *testing.T) {
+	tr := newHolePunchTracer()
+	direct, punched := peer.ID("direct"), peer.ID("punched")
+
+	tr.Trace(&holepunch.Event{Remote: punched, Evt: &holepunch.EndHolePunchEvt{Error: "timeout"}})
+	if !tr.recentlyFailed(punched) {
+		t.Fatal("failed punch not recorded")
+	}
+	tr.Trace(&holepunch.Event{Remote: punched, Evt: &holepunch.EndHolePunchEvt{Success: true}})
+	if !tr.wasPunched(punched) || tr.recentlyFailed(punched) {
+		t.Fatal("punch not recorded")
+	}
+
+	// A direct dial that worked is no punch
+	tr.Trace(&holepunch.Event{Remote: direct, Evt: &holepunch.DirectDialEvt{Success: true}})
+	if tr.wasPunched(direct) {
+		t.Fatal("direct dial reported as hole punched")
+	}
+}
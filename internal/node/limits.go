@@ -0,0 +1,126 @@
+package node
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+	"github.com/libp2p/go-libp2p/p2p/net/connmgr"
+)
+
+// ChatProtocol carries private messages between nodes.
+const ChatProtocol = "/chat/1.0.0"
+
+const (
+	defaultLowWater  = 100
+	defaultHighWater = 200
+	connGracePeriod  = time.Minute
+
+	// Connection manager tags; protected peers are never trimmed.
+	relayTag   = "shadow-relay"
+	contactTag = "shadow-contact"
+)
+
+// resourceLimits scales the libp2p defaults to this machine and caps what a
+// single peer may consume, in particular how many chat streams it can open.
+func resourceLimits() rcmgr.ConcreteLimitConfig {
+	scaling := rcmgr.DefaultLimits
+	libp2p.SetDefaultServiceLimits(&scaling)
+	partial := rcmgr.PartialLimitConfig{
+		PeerDefault: rcmgr.ResourceLimits{
+			Streams:         256,
+			StreamsInbound:  128,
+			StreamsOutbound: 128,
+			Conns:           8,
+			Memory:          64 << 20,
+		},
+		Protocol: map[protocol.ID]rcmgr.ResourceLimits{
+			ChatProtocol: {
+				StreamsInbound:  256,
+				StreamsOutbound: 256,
+				Memory:          16 << 20,
+			},
+		},
+		ProtocolPeer: map[protocol.ID]rcmgr.ResourceLimits{
+			ChatProtocol: {
+				Streams:         16,
+				StreamsInbound:  8,
+				StreamsOutbound: 8,
+				Memory:          1 << 20,
+			},
+		},
+	}
+	return partial.Build(scaling.AutoScale())
+}
+
+// limitOptions returns the connection and resource manager host options.
+func limitOptions(cfg config) ([]libp2p.Option, rcmgr.ConcreteLimitConfig, error) {
+	cm, err := connmgr.NewConnManager(cfg.lowWater, cfg.highWater, connmgr.WithGracePeriod(connGracePeriod))
+	if err != nil {
+		return nil, rcmgr.ConcreteLimitConfig{}, fmt.Errorf("failed to create connection manager: %w", err)
+	}
+	limits := resourceLimits()
+	rm, err := rcmgr.NewResourceManager(rcmgr.NewFixedLimiter(limits))
+	if err != nil {
+		return nil, rcmgr.ConcreteLimitConfig{}, fmt.Errorf("failed to create resource manager: %w", err)
+	}
+	return []libp2p.Option{libp2p.ConnectionManager(cm), libp2p.ResourceManager(rm)}, limits, nil
+}
+
+// ScopeUsage is the current usage of one resource manager scope next to its limits.
+type ScopeUsage struct {
+	Scope string
+	Stat  network.ScopeStat
+	Limit rcmgr.ResourceLimits
+}
+
+// LimitsReport describes connection manager watermarks and resource usage.
+type LimitsReport struct {
+	LowWater, HighWater int
+	Conns               int
+	Scopes              []ScopeUsage
+}
+
+// Limits reports current usage against the configured limits.
+func (n *Node) Limits() LimitsReport {
+	r := LimitsReport{Conns: len(n.Host.Network().Conns())}
+	if cm, ok := n.Host.ConnManager().(*connmgr.BasicConnMgr); ok {
+		info := cm.GetInfo()
+		r.LowWater, r.HighWater = info.LowWater, info.HighWater
+	}
+
+	rm := n.Host.Network().ResourceManager()
+	limits := n.limits.ToPartialLimitConfig()
+	add := func(name string, limit rcmgr.ResourceLimits, s network.ResourceScope) error {
+		r.Scopes = append(r.Scopes, ScopeUsage{Scope: name, Stat: s.Stat(), Limit: limit})
+		return nil
+	}
+	rm.ViewSystem(func(s network.ResourceScope) error { return add("system", limits.System, s) })
+	rm.ViewTransient(func(s network.ResourceScope) error { return add("transient", limits.Transient, s) })
+
+	if state, ok := rm.(rcmgr.ResourceManagerState); ok {
+		protos := state.ListProtocols()
+		sort.Slice(protos, func(i, j int) bool { return protos[i] < protos[j] })
+		for _, p := range protos {
+			limit, ok := limits.Protocol[p]
+			if !ok {
+				limit = limits.ProtocolDefault
+			}
+			rm.ViewProtocol(p, func(s network.ProtocolScope) error { return add("protocol "+string(p), limit, s) })
+		}
+	}
+	peers := n.Host.Network().Peers()
+	sort.Slice(peers, func(i, j int) bool { return peers[i] < peers[j] })
+	for _, p := range peers {
+		limit, ok := limits.Peer[p]
+		if !ok {
+			limit = limits.PeerDefault
+		}
+		rm.ViewPeer(p, func(s network.PeerScope) error { return add("peer "+p.String(), limit, s) })
+	}
+	return r
+}
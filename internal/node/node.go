@@ -3,50 +3,97 @@ package node
 
 import (
 	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
+	"io"
+	"sync"
 	"time"
 
+	leveldb "github.com/ipfs/go-ds-leveldb"
 	"github.com/libp2p/go-libp2p"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
-	dhtdisc "github.com/libp2p/go-libp2p/p2p/discovery/routing"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/libp2p/go-libp2p/p2p/host/autorelay"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+	"github.com/libp2p/go-libp2p/p2p/protocol/holepunch"
 	"github.com/libp2p/go-libp2p/p2p/protocol/identify"
 	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
 
 	"shadow/internal/dht"
 	"shadow/internal/identity"
+	"shadow/internal/logging"
+	"shadow/internal/relay"
+	"shadow/internal/rendezvous"
 )
 
+// RendezvousNamespace is the namespace every shadow node registers under.
+const RendezvousNamespace = "shadow"
+
 type Node struct {
 	Host     host.Host
 	DHT      *dht.DHT
 	Identity *identity.Identity
 	PubSub   *pubsub.PubSub
+	Relays   *relay.Pool
+
+	holePunch  *holePunchTracer
+	supervisor *supervisor
+	store      io.Closer
+	limits     rcmgr.ConcreteLimitConfig
+	newHost    HostFunc
+
+	mu         sync.RWMutex
+	rendezvous *rendezvous.Client
 }
 
-func NewNode(ctx context.Context, id *identity.Identity, relayAddr string) (*Node, error) {
-	if relayAddr == "" {
-		return nil, fmt.Errorf("relay address is required")
+// NewNode starts a node. relayAddrs may list multiaddrs of several relays;
+// with none the node runs relay-less and must be publicly reachable.
+func NewNode(ctx context.Context, id *identity.Identity, relayAddrs []string, opts ...Option) (*Node, error) {
+	cfg := config{
+		relayCount: defaultRelayCount,
+		lowWater:   defaultLowWater,
+		highWater:  defaultHighWater,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
 	}
 
-	ai, err := peer.AddrInfoFromString(relayAddr)
+	relays, err := relay.ParseAddrs(relayAddrs)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse relay address: %w", err)
+		return nil, err
+	}
+	pool := relay.NewPool(relays, cfg.relayCount)
+	if len(relays) == 0 {
+		logging.Println("No relay configured, running relay-less")
+	}
+	for _, ai := range relays {
+		logging.Println("Relay candidate:", ai.ID, "at", ai.Addrs)
 	}
 
-	fmt.Println("Connecting to relay:", ai.ID, "at", ai.Addrs)
-
-	h, err := libp2p.New(
-		libp2p.Identity(id.PrivateKey()),
-		libp2p.EnableAutoRelayWithStaticRelays([]peer.AddrInfo{*ai}),
-		libp2p.NATPortMap(),
-		libp2p.EnableNATService(),
-		libp2p.EnableRelay(),
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create host: %w", err)
+	hp := newHolePunchTracer()
+	var h host.Host
+	var store io.Closer
+	var limits rcmgr.ConcreteLimitConfig
+	if cfg.newHost != nil {
+		if h, err = cfg.newHost(id); err != nil {
+			return nil, fmt.Errorf("failed to create host: %w", err)
+		}
+	} else if h, store, limits, err = newHost(ctx, id, cfg, pool, hp); err != nil {
+		return nil, err
 	}
+	h.Network().Notify(&network.NotifyBundle{
+		DisconnectedF: func(net network.Network, c network.Conn) {
+			if net.Connectedness(c.RemotePeer()) != network.Connected {
+				hp.forget(c.RemotePeer())
+			}
+		},
+	})
 
 	dhtInstance, err := dht.NewDHT(ctx, h)
 	if err != nil {
@@ -56,23 +103,46 @@ func NewNode(ctx context.Context, id *identity.Identity, relayAddr string) (*Nod
 	identify.NewIDService(h)
 	_ = ping.NewPingService(h)
 
-	pubsubInstance, err := pubsub.NewPubSub(ctx, h, pubsub.DefaultGossipSubRouter(h), pubsub.WithMessageSigning(true))
+	psOpts := append([]pubsub.Option{pubsub.WithMessageSigning(true)}, cfg.pubsubOpts...)
+	pubsubInstance, err := pubsub.NewPubSub(ctx, h, pubsub.DefaultGossipSubRouter(h), psOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to init pubsub: %w", err)
 	}
 
-	if err := h.Connect(ctx, *ai); err != nil {
-		return nil, fmt.Errorf("failed to connect to relay: %w", err)
+	// Never trim relays or contacts we wrote to when the connection manager
+	// hits its high watermark
+	for _, ai := range relays {
+		h.ConnManager().Protect(ai.ID, relayTag)
+	}
+	ps := h.Peerstore()
+	for _, p := range ps.PeersWithAddrs() {
+		if v, err := ps.Get(p, protectedKey); err == nil && v == true {
+			h.ConnManager().Protect(p, contactTag)
+		}
+	}
+
+	// Connect to and rank the relays
+	pool.Start(ctx, h)
+	if _, ok := pool.Best(); len(relays) > 0 && !ok {
+		logging.Println("Warning: no relay reachable, will keep retrying")
+	}
+
+	if cfg.relayInvite != "" {
+		if err := redeemInvite(ctx, h, pool, cfg.relayInvite); err != nil {
+			return nil, err
+		}
 	}
 
 	// Connect to bootstrap peers
-	peers, err := dht.BootstrapPeers(*&ai.ID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get bootstrap peers: %w", err)
+	peers := append(append([]peer.AddrInfo{}, cfg.bootstrap...), relays...)
+	if !cfg.bootstrapSet {
+		if peers, err = dht.BootstrapPeers(relays...); err != nil {
+			return nil, fmt.Errorf("failed to get bootstrap peers: %w", err)
+		}
 	}
 	for _, peerInfo := range peers {
 		if err := h.Connect(ctx, peerInfo); err != nil {
-			fmt.Println("Failed to connect to bootstrap peer:", err)
+			logging.Println("Failed to connect to bootstrap peer:", err)
 		}
 	}
 
@@ -81,30 +151,184 @@ func NewNode(ctx context.Context, id *identity.Identity, relayAddr string) (*Nod
 		return nil, fmt.Errorf("DHT bootstrap failed: %w", err)
 	}
 
-	// Advertise the peer ID in the DHT, after a short delay
-	go func() {
-		time.Sleep(5 * time.Second) // Give DHT time to fill buckets
-		disc := dhtdisc.NewRoutingDiscovery(dhtInstance)
-		fmt.Println("Advertising peer ID " + id.PeerID().String() + " in DHT")
-		if _, err := disc.Advertise(ctx, id.PeerID().String()); err != nil {
-			fmt.Println("Failed to advertise:", err)
-		} else {
-			fmt.Println("Advertised peer ID in DHT:", id.PeerID())
+	n := &Node{
+		Host:      h,
+		DHT:       dhtInstance,
+		Identity:  id,
+		PubSub:    pubsubInstance,
+		Relays:    pool,
+		holePunch: hp,
+		store:     store,
+		limits:    limits,
+		newHost:   cfg.newHost,
+	}
+	go n.maintainPeerstore(ctx)
+
+	// The supervisor registers at the best relay's rendezvous point, advertises
+	// us in the DHT and keeps relays and bootstrap peers connected
+	n.supervisor = newSupervisor(n, peers)
+	go n.supervisor.run(ctx)
+
+	return n, nil
+}
+
+// newHost builds the libp2p host of a node, with its peerstore kept on disk
+// when the identity is persisted. The returned closer, if any, is the
+// datastore under the peerstore.
+func newHost(ctx context.Context, id *identity.Identity, cfg config, pool *relay.Pool, hp *holePunchTracer) (host.Host, io.Closer, rcmgr.ConcreteLimitConfig, error) {
+	// Keep the peerstore on disk next to the identity so known peers survive restarts
+	var store io.Closer
+	var ps peerstore.Peerstore
+	if dir := id.DataDir(); dir != "" {
+		var ds *leveldb.Datastore
+		var err error
+		if ps, ds, err = openPeerstore(ctx, dir); err != nil {
+			return nil, nil, rcmgr.ConcreteLimitConfig{}, err
+		}
+		store = ds
+		logging.Println("Loaded", len(ps.PeersWithAddrs()), "known peers from peerstore")
+	}
+
+	limitOpts, limits, err := limitOptions(cfg)
+	if err != nil {
+		if store != nil {
+			store.Close()
 		}
-	}()
-
-	return &Node{
-		Host:     h,
-		DHT:      dhtInstance,
-		Identity: id,
-		PubSub:   pubsubInstance,
-	}, nil
+		return nil, nil, rcmgr.ConcreteLimitConfig{}, err
+	}
+
+	hostOpts := []libp2p.Option{
+		libp2p.Identity(id.PrivateKey()),
+		libp2p.NATPortMap(),
+		libp2p.EnableNATService(),
+		libp2p.EnableRelay(),
+		// Upgrade relayed connections to direct ones with DCUtR
+		libp2p.EnableHolePunching(holepunch.WithTracer(hp)),
+	}
+	hostOpts = append(hostOpts, limitOpts...)
+	if ps != nil {
+		hostOpts = append(hostOpts, libp2p.Peerstore(ps))
+	}
+	if len(pool.Relays()) > 0 {
+		// Autorelay reserves slots on the best healthy relays once we are found to be
+		// behind NAT, and moves to the next ranked relay when one drops
+		hostOpts = append(hostOpts, libp2p.EnableAutoRelayWithPeerSource(pool.PeerSource,
+			autorelay.WithNumRelays(pool.Size()),
+			autorelay.WithMinCandidates(1),
+			autorelay.WithBootDelay(0),
+			autorelay.WithMinInterval(10*time.Second),
+			// A short backoff lets a reservation refused before the invite is redeemed be retried soon
+			autorelay.WithBackoff(time.Minute),
+		))
+	}
+	h, err := libp2p.New(hostOpts...)
+	if err != nil {
+		if store != nil {
+			store.Close()
+		}
+		return nil, nil, rcmgr.ConcreteLimitConfig{}, fmt.Errorf("failed to create host: %w", err)
+	}
+	return h, store, limits, nil
+}
+
+// NewEphemeralHost starts a host under a throwaway key that does not listen,
+// for talking to a peer without revealing who we are. The caller closes it.
+func (n *Node) NewEphemeralHost() (host.Host, error) {
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if n.newHost != nil {
+		id, err := identity.New(priv, "")
+		if err != nil {
+			return nil, err
+		}
+		return n.newHost(id)
+	}
+	return libp2p.New(libp2p.Identity(priv), libp2p.NoListenAddrs)
+}
+
+// Rendezvous returns the client for the current rendezvous point, or nil.
+func (n *Node) Rendezvous() *rendezvous.Client {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.rendezvous
+}
+
+func (n *Node) setRendezvous(rv *rendezvous.Client) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.rendezvous = rv
+}
+
+// redeemInvite presents the invite to every reachable relay; only the relay
+// that issued it accepts.
+func redeemInvite(ctx context.Context, h host.Host, pool *relay.Pool, token string) error {
+	var lastErr error = fmt.Errorf("no relay reachable to redeem invite")
+	for _, ai := range pool.Ranked() {
+		if err := relay.RedeemInvite(ctx, h, ai.ID, token); err != nil {
+			lastErr = err
+			continue
+		}
+		logging.Println("Relay invite accepted by", ai.ID)
+		return nil
+	}
+	return lastErr
+}
+
+// ErrPeerNotFound is returned by FindPeer when neither the rendezvous point
+// nor the DHT knows the peer.
+var ErrPeerNotFound = errors.New("peer not found on the network")
+
+// FindPeer resolves the addresses of pid, asking the rendezvous point first
+// and falling back to the DHT. Found addresses are added to the peerstore.
+func (n *Node) FindPeer(ctx context.Context, pid peer.ID) (peer.AddrInfo, error) {
+	if rv := n.Rendezvous(); rv != nil {
+		found, err := rv.Discover(ctx, pid.String(), 0)
+		if err == nil {
+			for _, ai := range found {
+				if ai.ID == pid {
+					n.Host.Peerstore().AddAddrs(pid, ai.Addrs, peerstore.TempAddrTTL)
+					return ai, nil
+				}
+			}
+		}
+	}
+	ai, err := n.DHT.FindPeer(ctx, pid)
+	if errors.Is(err, routing.ErrNotFound) {
+		return peer.AddrInfo{}, ErrPeerNotFound
+	} else if err != nil {
+		return peer.AddrInfo{}, err
+	}
+	n.Host.Peerstore().AddAddrs(pid, ai.Addrs, peerstore.TempAddrTTL)
+	return ai, nil
+}
+
+// DiscoverPeers lists the peers registered at the rendezvous point.
+func (n *Node) DiscoverPeers(ctx context.Context) ([]peer.AddrInfo, error) {
+	rv := n.Rendezvous()
+	if rv == nil {
+		return nil, fmt.Errorf("no rendezvous point available")
+	}
+	found, err := rv.Discover(ctx, RendezvousNamespace, 0)
+	if err != nil {
+		return nil, err
+	}
+	var out []peer.AddrInfo
+	for _, ai := range found {
+		if ai.ID == n.Host.ID() {
+			continue
+		}
+		n.Host.Peerstore().AddAddrs(ai.ID, ai.Addrs, peerstore.TempAddrTTL)
+		out = append(out, ai)
+	}
+	return out, nil
 }
 
 func (n *Node) PrintInfo() {
-	fmt.Println("Peer ID:", n.Identity.DisplayName())
+	logging.Println("Peer ID:", n.Identity.DisplayName())
 	for _, addr := range n.Host.Addrs() {
-		fmt.Printf("- %s/p2p/%s\n", addr, n.Host.ID())
+		logging.Printf("- %s/p2p/%s\n", addr, n.Host.ID())
 	}
 }
 
@@ -112,5 +336,12 @@ func (n *Node) Shutdown(ctx context.Context) error {
 	if err := n.DHT.Close(); err != nil {
 		return err
 	}
-	return n.Host.Close()
+	if err := n.Host.Close(); err != nil {
+		return err
+	}
+	// The host closes the peerstore; the datastore under it is ours to close
+	if n.store != nil {
+		return n.store.Close()
+	}
+	return nil
 }
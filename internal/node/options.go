@@ -0,0 +1,75 @@
+package node
+
+import (
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"shadow/internal/identity"
+)
+
+// Option configures optional NewNode behaviour.
+type Option func(*config)
+
+const defaultRelayCount = 2
+
+type config struct {
+	relayInvite string
+	relayCount  int
+	lowWater    int
+	highWater   int
+	newHost     HostFunc
+	bootstrap   []peer.AddrInfo
+	// bootstrapSet distinguishes an explicitly empty bootstrap list from the default
+	bootstrapSet bool
+	pubsubOpts   []pubsub.Option
+}
+
+// HostFunc builds the libp2p host of a node from its identity.
+type HostFunc func(id *identity.Identity) (host.Host, error)
+
+// WithRelayInvite redeems an invite token with the relay before reserving a slot.
+func WithRelayInvite(token string) Option {
+	return func(c *config) {
+		c.relayInvite = token
+	}
+}
+
+// WithRelayCount sets how many relays the node keeps reservations on.
+func WithRelayCount(n int) Option {
+	return func(c *config) {
+		c.relayCount = n
+	}
+}
+
+// WithConnLimits sets the connection manager watermarks: above high it trims
+// unprotected connections down to low.
+func WithConnLimits(low, high int) Option {
+	return func(c *config) {
+		c.lowWater, c.highWater = low, high
+	}
+}
+
+// WithHost builds the node's host with fn instead of libp2p.New, e.g. on a
+// mocknet in tests. The on-disk peerstore, resource limits, NAT traversal and
+// autorelay are then left to fn.
+func WithHost(fn HostFunc) Option {
+	return func(c *config) {
+		c.newHost = fn
+	}
+}
+
+// WithBootstrapPeers replaces dht.DefaultBootstrapPeers; the relays are still
+// used as bootstrap peers.
+func WithBootstrapPeers(peers []peer.AddrInfo) Option {
+	return func(c *config) {
+		c.bootstrap, c.bootstrapSet = peers, true
+	}
+}
+
+// WithPubSubOptions adds options to the node's gossipsub, e.g. a tracer.
+func WithPubSubOptions(opts ...pubsub.Option) Option {
+	return func(c *config) {
+		c.pubsubOpts = append(c.pubsubOpts, opts...)
+	}
+}
@@ -0,0 +1,278 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoreds"
+
+	"shadow/internal/logging"
+)
+
+const (
+	peerstoreDir = "peerstore"
+	// contactKey marks peers we exchanged messages with in the peerstore metadata.
+	contactKey = "shadow/contact"
+	// nameKey holds the name a peer announced in its messages.
+	nameKey = "shadow/name"
+	// verifiedKey marks contacts whose key the user checked out of band.
+	verifiedKey = "shadow/verified"
+	// successorKey holds the peer a contact rotated its key to.
+	successorKey = "shadow/successor"
+	// seenKey holds when we last exchanged a message with a contact, in Unix seconds.
+	seenKey = "shadow/seen"
+	// protectedKey marks contacts we wrote to, whose connections are kept.
+	protectedKey = "shadow/protected"
+	// contactAddrTTL keeps the addresses of contacts dialable across restarts,
+	// counted from when they were last seen.
+	contactAddrTTL = 7 * 24 * time.Hour
+	// contactTTL is how long a contact that is not verified is kept after it
+	// was last seen.
+	contactTTL = 90 * 24 * time.Hour
+	// contactRefresh is how often contact address TTLs are extended.
+	contactRefresh = time.Minute
+)
+
+// openPeerstore opens the on-disk peerstore under dataDir. Addresses, public
+// keys, protocols and metadata survive restarts; expired addresses are pruned.
+func openPeerstore(ctx context.Context, dataDir string) (peerstore.Peerstore, *leveldb.Datastore, error) {
+	store, err := leveldb.NewDatastore(filepath.Join(dataDir, peerstoreDir), nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open peerstore datastore: %w", err)
+	}
+	opts := pstoreds.DefaultOpts()
+	opts.GCPurgeInterval = time.Hour
+	ps, err := pstoreds.NewPeerstore(ctx, store, opts)
+	if err != nil {
+		store.Close()
+		return nil, nil, fmt.Errorf("failed to open peerstore: %w", err)
+	}
+	return retainingPeerstore{ps}, store, nil
+}
+
+type certifiedPeerstore interface {
+	peerstore.Peerstore
+	peerstore.CertifiedAddrBook
+}
+
+// retainingPeerstore keeps what libp2p would forget on disconnect. libp2p
+// removes a peer's keys, protocols and metadata a minute after it disconnects;
+// here they are kept for as long as the peer has unexpired addresses, and
+// prunePeers drops them afterwards.
+type retainingPeerstore struct {
+	certifiedPeerstore
+}
+
+func (ps retainingPeerstore) RemovePeer(p peer.ID) {
+	if len(ps.Addrs(p)) > 0 {
+		return
+	}
+	ps.certifiedPeerstore.RemovePeer(p)
+}
+
+// RememberPeer marks p as a contact seen now, so its addresses outlive the
+// connection. Its connections are not protected; see ProtectPeer.
+func (n *Node) RememberPeer(p peer.ID) {
+	ps := n.Host.Peerstore()
+	if err := ps.Put(p, contactKey, true); err != nil {
+		logging.Println("Failed to remember peer:", err)
+		return
+	}
+	if err := ps.Put(p, seenKey, time.Now().Unix()); err != nil {
+		logging.Println("Failed to store last seen time:", err)
+	}
+	ps.AddAddrs(p, ps.Addrs(p), contactAddrTTL)
+}
+
+// ProtectPeer remembers p and keeps its connections from being trimmed, for
+// contacts we wrote to rather than any peer that wrote to us.
+func (n *Node) ProtectPeer(p peer.ID) {
+	n.RememberPeer(p)
+	if err := n.Host.Peerstore().Put(p, protectedKey, true); err != nil {
+		logging.Println("Failed to protect peer:", err)
+	}
+	n.Host.ConnManager().Protect(p, contactTag)
+}
+
+// lastSeen returns when RememberPeer was last called for p, or the zero time.
+func (n *Node) lastSeen(p peer.ID) time.Time {
+	v, err := n.Host.Peerstore().Get(p, seenKey)
+	if err != nil {
+		return time.Time{}
+	}
+	// The datastore peerstore decodes numbers with gob, the memory one keeps them
+	switch t := v.(type) {
+	case int64:
+		return time.Unix(t, 0)
+	case int:
+		return time.Unix(int64(t), 0)
+	}
+	return time.Time{}
+}
+
+func (n *Node) isProtected(p peer.ID) bool {
+	v, err := n.Host.Peerstore().Get(p, protectedKey)
+	return err == nil && v == true
+}
+
+// forget drops p from the contacts.
+func (n *Node) forget(p peer.ID) {
+	ps := n.Host.Peerstore()
+	if err := ps.Put(p, contactKey, false); err != nil {
+		logging.Println("Failed to forget peer:", err)
+	}
+	if err := ps.Put(p, protectedKey, false); err != nil {
+		logging.Println("Failed to forget peer:", err)
+	}
+	n.Host.ConnManager().Unprotect(p, contactTag)
+}
+
+// IsContact reports whether RememberPeer was called for p, in this or an
+// earlier run, and the contact has not expired since.
+func (n *Node) IsContact(p peer.ID) bool {
+	v, err := n.Host.Peerstore().Get(p, contactKey)
+	return err == nil && v == true
+}
+
+// Contacts lists every peer marked with RememberPeer.
+func (n *Node) Contacts() []peer.ID {
+	var out []peer.ID
+	for _, p := range n.Host.Peerstore().Peers() {
+		if n.IsContact(p) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// SetPeerName records the name p announced for itself, without control
+// characters, which could do anything to a terminal or a line protocol.
+func (n *Node) SetPeerName(p peer.ID, name string) {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	if err := n.Host.Peerstore().Put(p, nameKey, name); err != nil {
+		logging.Println("Failed to store peer name:", err)
+	}
+}
+
+// PeerName returns the name p last announced, or "" if unknown.
+func (n *Node) PeerName(p peer.ID) string {
+	v, err := n.Host.Peerstore().Get(p, nameKey)
+	if err != nil {
+		return ""
+	}
+	name, _ := v.(string)
+	return name
+}
+
+// SetVerified records whether the user checked the key of p out of band.
+func (n *Node) SetVerified(p peer.ID, verified bool) {
+	if err := n.Host.Peerstore().Put(p, verifiedKey, verified); err != nil {
+		logging.Println("Failed to store verification:", err)
+	}
+}
+
+// IsVerified reports whether the key of p was marked as checked.
+func (n *Node) IsVerified(p peer.ID) bool {
+	v, err := n.Host.Peerstore().Get(p, verifiedKey)
+	return err == nil && v == true
+}
+
+// Successor returns the peer p rotated its key to, or "" if none is known.
+func (n *Node) Successor(p peer.ID) peer.ID {
+	v, err := n.Host.Peerstore().Get(p, successorKey)
+	if err != nil {
+		return ""
+	}
+	s, _ := v.(string)
+	return peer.ID(s)
+}
+
+// MigrateContact moves the contact old to new, its successor: new becomes a
+// contact under the name of old, and old is no longer one. The verification
+// of old does not carry over, since nothing was checked about the new key;
+// MigrateContact reports whether old was verified.
+func (n *Node) MigrateContact(old, new peer.ID) (verified bool) {
+	ps := n.Host.Peerstore()
+	if err := ps.Put(old, successorKey, string(new)); err != nil {
+		logging.Println("Failed to store successor:", err)
+	}
+	if n.PeerName(new) == "" {
+		if name := n.PeerName(old); name != "" {
+			n.SetPeerName(new, name)
+		}
+	}
+	// Peers are only listed with a key or addresses, and new may have neither yet
+	if pub, err := new.ExtractPublicKey(); err == nil {
+		if err := ps.AddPubKey(new, pub); err != nil {
+			logging.Println("Failed to store public key:", err)
+		}
+	}
+	if n.isProtected(old) {
+		n.ProtectPeer(new)
+	} else {
+		n.RememberPeer(new)
+	}
+	verified = n.IsVerified(old)
+	n.forget(old)
+	return verified
+}
+
+// maintainPeerstore periodically extends the address TTL of contacts, since
+// addresses drop to a short TTL when a connection closes, forgets contacts
+// not seen for contactTTL unless they are verified, and prunes peers whose
+// addresses all expired.
+func (n *Node) maintainPeerstore(ctx context.Context) {
+	t := time.NewTicker(contactRefresh)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			n.refreshContacts(time.Now())
+		}
+	}
+}
+
+func (n *Node) refreshContacts(now time.Time) {
+	ps := n.Host.Peerstore()
+	for _, p := range ps.Peers() {
+		addrs := ps.Addrs(p)
+		if n.IsContact(p) {
+			seen := n.lastSeen(p)
+			if seen.IsZero() {
+				// Remembered before last seen times were kept
+				seen = now
+				if err := ps.Put(p, seenKey, now.Unix()); err != nil {
+					logging.Println("Failed to store last seen time:", err)
+				}
+			}
+			if now.Sub(seen) > contactTTL && !n.IsVerified(p) {
+				n.forget(p)
+				continue
+			}
+			// Addresses are kept for contactAddrTTL from when the contact was
+			// last seen, not from now
+			if ttl := seen.Add(contactAddrTTL).Sub(now); ttl > 0 {
+				ps.AddAddrs(p, addrs, ttl)
+			}
+			continue
+		}
+		if len(addrs) == 0 && n.Host.Network().Connectedness(p) != network.Connected {
+			ps.RemovePeer(p)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package node
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+func TestContactExpiry(t *testing.T) {
+	mn := mocknet.New()
+	defer mn.Close()
+	h, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &Node{Host: h}
+	var peers []peer.ID
+	for range 3 {
+		other, err := mn.GenPeer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.Peerstore().AddAddrs(other.ID(), other.Addrs(), peerstore.TempAddrTTL)
+		peers = append(peers, other.ID())
+	}
+	wrote, wroteUs, verified := peers[0], peers[1], peers[2]
+	n.ProtectPeer(wrote)
+	n.RememberPeer(wroteUs)
+	n.RememberPeer(verified)
+	n.SetVerified(verified, true)
+
+	// Only contacts we wrote to are kept connected
+	if !n.isProtected(wrote) || n.isProtected(wroteUs) {
+		t.Fatal("wrong contacts protected")
+	}
+
+	n.refreshContacts(time.Now().Add(contactTTL - time.Hour))
+	if !n.IsContact(wrote) || !n.IsContact(wroteUs) {
+		t.Fatal("contacts expired early")
+	}
+
+	// Contacts not seen for long are forgotten, unless verified
+	n.refreshContacts(time.Now().Add(contactTTL + time.Hour))
+	if n.IsContact(wrote) || n.IsContact(wroteUs) || !n.IsContact(verified) {
+		t.Fatal("contacts not expired")
+	}
+	if n.isProtected(wrote) {
+		t.Fatal("expired contact still protected")
+	}
+
+	// Seeing one again makes it a contact again
+	n.RememberPeer(wroteUs)
+	n.refreshContacts(time.Now())
+	if !n.IsContact(wroteUs) {
+		t.Fatal("contact seen again not remembered")
+	}
+}
+
+func TestPeerstoreReopen(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	priv, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	self, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// open runs a node on the peerstore in dir, stopped with the test or stop
+	open := func() (n *Node, stop func()) {
+		mn := mocknet.New()
+		ps, store, err := openPeerstore(ctx, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ps.AddPrivKey(self, priv); err != nil {
+			t.Fatal(err)
+		}
+		h, err := mn.AddPeerWithPeerstore(self, ps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stopped bool
+		stop = func() {
+			if !stopped {
+				stopped = true
+				mn.Close()
+				store.Close()
+			}
+		}
+		t.Cleanup(stop)
+		return &Node{Host: h}, stop
+	}
+
+	n, stop := open()
+	mn := mocknet.New()
+	defer mn.Close()
+	contact, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := n.Host.Peerstore()
+	ps.AddAddrs(contact.ID(), contact.Addrs(), peerstore.TempAddrTTL)
+	n.ProtectPeer(contact.ID())
+	n.SetPeerName(contact.ID(), "bob")
+	// What libp2p does a minute after the peer disconnects
+	ps.RemovePeer(contact.ID())
+	stop()
+
+	n, _ = open()
+	if contacts := n.Contacts(); len(contacts) != 1 || contacts[0] != contact.ID() {
+		t.Fatalf("contacts %v after reopening, want %s", contacts, contact.ID())
+	}
+	if addrs := n.Host.Peerstore().Addrs(contact.ID()); len(addrs) != len(contact.Addrs()) {
+		t.Fatalf("addresses %v after reopening, want %v", addrs, contact.Addrs())
+	}
+	if n.PeerName(contact.ID()) != "bob" || !n.isProtected(contact.ID()) || n.lastSeen(contact.ID()).IsZero() {
+		t.Fatal("contact metadata lost on reopening")
+	}
+}
@@ -0,0 +1,353 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	dhtdisc "github.com/libp2p/go-libp2p/p2p/discovery/routing"
+	ma "github.com/multiformats/go-multiaddr"
+
+	"shadow/internal/logging"
+	"shadow/internal/rendezvous"
+)
+
+// ConnState summarises the node's connectivity.
+type ConnState string
+
+const (
+	StateOffline    ConnState = "offline"    // no connections at all
+	StateConnecting ConnState = "connecting" // connected, but not yet reachable by others
+	StateRelayed    ConnState = "relayed"    // reachable through at least one relay reservation
+	StatePublic     ConnState = "public"     // publicly reachable without relays
+)
+
+// ConnectivityEvent is published whenever the node's connectivity changes.
+type ConnectivityEvent struct {
+	State        ConnState
+	Reachability network.Reachability
+	Relays       int // connected relays
+	Reserved     int // relays holding a reservation for us
+	Peers        int
+	Time         time.Time
+}
+
+func (e ConnectivityEvent) String() string {
+	return fmt.Sprintf("%s (reachability %s, %d relays, %d reserved, %d peers)",
+		e.State, e.Reachability, e.Relays, e.Reserved, e.Peers)
+}
+
+const (
+	minBackoff       = time.Second
+	maxBackoff       = 5 * time.Minute
+	checkInterval    = 30 * time.Second
+	dialTimeout      = 10 * time.Second
+	advertiseDelay   = 5 * time.Second // give the DHT time to fill buckets
+	eventsBufferSize = 16
+)
+
+// supervisor keeps the node connected: it reconnects relays and bootstrap
+// peers with jittered exponential backoff, re-advertises the node after
+// connectivity changes and publishes ConnectivityEvents.
+type supervisor struct {
+	n       *Node
+	targets map[peer.ID]peer.AddrInfo
+	events  chan ConnectivityEvent
+	poke    chan struct{}
+
+	mu           sync.Mutex
+	reconnecting map[peer.ID]bool
+	reach        network.Reachability
+	last         ConnectivityEvent
+	rvCancel     context.CancelFunc
+	advertising  atomic.Bool
+}
+
+func newSupervisor(n *Node, bootstrap []peer.AddrInfo) *supervisor {
+	s := &supervisor{
+		n:            n,
+		targets:      map[peer.ID]peer.AddrInfo{},
+		events:       make(chan ConnectivityEvent, eventsBufferSize),
+		poke:         make(chan struct{}, 1),
+		reconnecting: map[peer.ID]bool{},
+		reach:        network.ReachabilityUnknown,
+	}
+	for _, ai := range bootstrap {
+		s.targets[ai.ID] = ai
+	}
+	for _, ai := range n.Relays.Relays() {
+		s.targets[ai.ID] = ai
+	}
+	return s
+}
+
+func (s *supervisor) run(ctx context.Context) {
+	h := s.n.Host
+	sub, err := h.EventBus().Subscribe([]interface{}{
+		new(event.EvtLocalReachabilityChanged),
+		new(event.EvtLocalAddressesUpdated),
+	})
+	if err != nil {
+		logging.Println("Supervisor failed to subscribe to events:", err)
+		return
+	}
+	defer sub.Close()
+
+	notifee := &network.NotifyBundle{
+		ConnectedF: func(network.Network, network.Conn) { s.wake() },
+		DisconnectedF: func(net network.Network, c network.Conn) {
+			p := c.RemotePeer()
+			if net.Connectedness(p) != network.Connected {
+				if ai, ok := s.targets[p]; ok {
+					go s.reconnect(ctx, ai)
+				}
+			}
+			s.wake()
+		},
+	}
+	h.Network().Notify(notifee)
+	defer h.Network().StopNotify(notifee)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-time.After(advertiseDelay):
+			s.readvertise(ctx)
+		}
+	}()
+	s.ensureConnected(ctx)
+	s.update()
+
+	t := time.NewTicker(checkInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-sub.Out():
+			if !ok {
+				return
+			}
+			switch evt := e.(type) {
+			case event.EvtLocalReachabilityChanged:
+				s.mu.Lock()
+				s.reach = evt.Reachability
+				s.mu.Unlock()
+				go s.readvertise(ctx)
+			case event.EvtLocalAddressesUpdated:
+				if evt.Diffs {
+					go s.readvertise(ctx)
+				}
+			}
+			s.update()
+		case <-s.poke:
+			s.update()
+		case <-t.C:
+			s.ensureConnected(ctx)
+			s.update()
+		}
+	}
+}
+
+func (s *supervisor) wake() {
+	select {
+	case s.poke <- struct{}{}:
+	default:
+	}
+}
+
+// ensureConnected starts a reconnect loop for every disconnected target.
+func (s *supervisor) ensureConnected(ctx context.Context) {
+	for _, ai := range s.targets {
+		if s.n.Host.Network().Connectedness(ai.ID) != network.Connected {
+			go s.reconnect(ctx, ai)
+		}
+	}
+}
+
+// reconnect dials ai until it succeeds, backing off exponentially with jitter.
+func (s *supervisor) reconnect(ctx context.Context, ai peer.AddrInfo) {
+	s.mu.Lock()
+	if s.reconnecting[ai.ID] {
+		s.mu.Unlock()
+		return
+	}
+	s.reconnecting[ai.ID] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.reconnecting, ai.ID)
+		s.mu.Unlock()
+	}()
+
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff(attempt)):
+		}
+		if s.n.Host.Network().Connectedness(ai.ID) == network.Connected {
+			return
+		}
+		dctx, cancel := context.WithTimeout(ctx, dialTimeout)
+		err := s.n.Host.Connect(dctx, ai)
+		cancel()
+		if err == nil {
+			logging.Println("Reconnected to", ai.ID)
+			if s.isRelay(ai.ID) {
+				s.n.Relays.ProbeAll(ctx)
+			}
+			s.readvertise(ctx)
+			s.wake()
+			return
+		}
+	}
+}
+
+// backoff returns the delay before reconnect attempt n: exponential, capped,
+// with half of it randomised so peers do not retry in lockstep.
+func backoff(attempt int) time.Duration {
+	d := maxBackoff
+	if attempt < 20 {
+		if exp := minBackoff << attempt; exp < maxBackoff {
+			d = exp
+		}
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+func (s *supervisor) isRelay(p peer.ID) bool {
+	for _, ai := range s.n.Relays.Relays() {
+		if ai.ID == p {
+			return true
+		}
+	}
+	return false
+}
+
+// readvertise re-registers at the best rendezvous point and re-advertises in the DHT.
+func (s *supervisor) readvertise(ctx context.Context) {
+	if !s.advertising.CompareAndSwap(false, true) {
+		return
+	}
+	defer s.advertising.Store(false)
+
+	if best, ok := s.n.Relays.Best(); ok {
+		namespaces := []string{RendezvousNamespace, s.n.Identity.PeerID().String()}
+		if cur := s.n.Rendezvous(); cur != nil && cur.Point() == best.ID {
+			// Same point: refresh now, the server may have restarted and lost us
+			for _, ns := range namespaces {
+				if _, err := cur.Register(ctx, ns, rendezvous.DefaultTTL); err != nil {
+					logging.Println("Rendezvous register failed:", err)
+				}
+			}
+		} else {
+			rv := rendezvous.NewClient(s.n.Host, best.ID)
+			rctx, cancel := context.WithCancel(ctx)
+			s.mu.Lock()
+			if s.rvCancel != nil {
+				s.rvCancel() // unregisters from the previous point
+			}
+			s.rvCancel = cancel
+			s.mu.Unlock()
+			s.n.setRendezvous(rv)
+			go rv.KeepRegistered(rctx, rendezvous.DefaultTTL, namespaces...)
+		}
+	}
+
+	disc := dhtdisc.NewRoutingDiscovery(s.n.DHT)
+	logging.Println("Advertising peer ID " + s.n.Identity.PeerID().String() + " in DHT")
+	if _, err := disc.Advertise(ctx, s.n.Identity.PeerID().String()); err != nil {
+		logging.Println("Failed to advertise:", err)
+	} else {
+		logging.Println("Advertised peer ID in DHT:", s.n.Identity.PeerID())
+	}
+}
+
+// update computes the current connectivity and publishes it if it changed.
+func (s *supervisor) update() {
+	h := s.n.Host
+	s.mu.Lock()
+	ev := ConnectivityEvent{
+		Reachability: s.reach,
+		Peers:        len(h.Network().Peers()),
+		Time:         time.Now(),
+	}
+	s.mu.Unlock()
+
+	reserved := map[string]bool{}
+	for _, a := range h.Addrs() {
+		if _, err := a.ValueForProtocol(ma.P_CIRCUIT); err != nil {
+			continue
+		}
+		if id, err := a.ValueForProtocol(ma.P_P2P); err == nil {
+			reserved[id] = true
+		}
+	}
+	for _, ai := range s.n.Relays.Relays() {
+		if h.Network().Connectedness(ai.ID) == network.Connected {
+			ev.Relays++
+			if reserved[ai.ID.String()] {
+				ev.Reserved++
+			}
+		}
+	}
+
+	switch {
+	case ev.Peers == 0:
+		ev.State = StateOffline
+	case ev.Reachability == network.ReachabilityPublic:
+		ev.State = StatePublic
+	case ev.Reserved > 0:
+		ev.State = StateRelayed
+	default:
+		ev.State = StateConnecting
+	}
+
+	s.mu.Lock()
+	last := s.last
+	changed := ev.State != last.State || ev.Reachability != last.Reachability ||
+		ev.Relays != last.Relays || ev.Reserved != last.Reserved
+	if changed {
+		s.last = ev
+	}
+	s.mu.Unlock()
+	if !changed {
+		return
+	}
+	select {
+	case s.events <- ev:
+	default:
+		// Drop the oldest event so a slow reader always sees the latest state
+		select {
+		case <-s.events:
+		default:
+		}
+		select {
+		case s.events <- ev:
+		default:
+		}
+	}
+}
+
+func (s *supervisor) current() ConnectivityEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+// Connectivity returns a channel of connectivity changes.
+func (n *Node) Connectivity() <-chan ConnectivityEvent {
+	return n.supervisor.events
+}
+
+// ConnectivityState returns the last published connectivity.
+func (n *Node) ConnectivityState() ConnectivityEvent {
+	return n.supervisor.current()
+}
@@ -0,0 +1,165 @@
+package onion
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"shadow/internal/relay"
+)
+
+// Directory is the set of relays onion paths are picked from. Relays use it
+// too, to find the addresses of the next relay of a path.
+type Directory struct {
+	mu     sync.RWMutex
+	relays map[peer.ID]peer.AddrInfo
+}
+
+// NewDirectory returns a directory of relays.
+func NewDirectory(relays ...peer.AddrInfo) *Directory {
+	d := &Directory{relays: map[peer.ID]peer.AddrInfo{}}
+	d.Add(relays...)
+	return d
+}
+
+// LoadDirectory reads a directory file: one relay multiaddr with its /p2p
+// component per line, blank lines and lines starting with # ignored.
+func LoadDirectory(path string) (*Directory, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read relay directory: %w", err)
+	}
+	defer f.Close()
+	var addrs []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		addrs = append(addrs, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read relay directory: %w", err)
+	}
+	relays, err := relay.ParseAddrs(addrs)
+	if err != nil {
+		return nil, err
+	}
+	return NewDirectory(relays...), nil
+}
+
+// Add adds relays, merging the addresses of those already known.
+func (d *Directory) Add(relays ...peer.AddrInfo) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, r := range relays {
+		known := d.relays[r.ID]
+		known.ID = r.ID
+		for _, a := range r.Addrs {
+			if !slices.ContainsFunc(known.Addrs, a.Equal) {
+				known.Addrs = append(known.Addrs, a)
+			}
+		}
+		d.relays[r.ID] = known
+	}
+}
+
+// Lookup returns the relay p, if in the directory.
+func (d *Directory) Lookup(p peer.ID) (peer.AddrInfo, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	ai, ok := d.relays[p]
+	return ai, ok
+}
+
+// Relays returns every relay of the directory.
+func (d *Directory) Relays() []peer.AddrInfo {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	out := make([]peer.AddrInfo, 0, len(d.relays))
+	for _, ai := range d.relays {
+		out = append(out, ai)
+	}
+	return out
+}
+
+// Path picks n distinct relays at random, the last one among exits: the
+// relays the recipient can be reached through. Each hop gets a RandomDelay.
+func (d *Directory) Path(n int, exits []peer.ID) ([]Hop, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("onion path of %d relays", n)
+	}
+	candidates := d.lookupAll(exits)
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no relay of the recipient is in the directory")
+	}
+	exit := candidates[rand.IntN(len(candidates))]
+
+	others := slices.DeleteFunc(d.Relays(), func(ai peer.AddrInfo) bool { return ai.ID == exit.ID })
+	if len(others) < n-1 {
+		return nil, fmt.Errorf("onion path of %d relays needs %d relays in the directory, have %d", n, n, len(others)+1)
+	}
+	rand.Shuffle(len(others), func(i, j int) { others[i], others[j] = others[j], others[i] })
+	path := make([]Hop, 0, n)
+	for _, ai := range append(others[:n-1], exit) {
+		path = append(path, Hop{Relay: ai, Delay: RandomDelay()})
+	}
+	return path, nil
+}
+
+// PathVia is Path with the first relay picked among entries, so that every
+// packet leaves towards the same relays wherever it goes. The path is one
+// relay longer than n where it needs to be to start at an entry and end at
+// an exit; with no exit but the entry it leaves the entry and comes back.
+func (d *Directory) PathVia(entries []peer.ID, n int, exits []peer.ID) ([]Hop, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("onion path of %d relays", n)
+	}
+	starts := d.lookupAll(entries)
+	if len(starts) == 0 {
+		return nil, fmt.Errorf("no entry relay is in the directory")
+	}
+	ends := d.lookupAll(exits)
+	if len(ends) == 0 {
+		return nil, fmt.Errorf("no relay of the recipient is in the directory")
+	}
+	entry := starts[rand.IntN(len(starts))]
+	isEntry := func(ai peer.AddrInfo) bool { return ai.ID == entry.ID }
+	if n == 1 && slices.ContainsFunc(ends, isEntry) {
+		return []Hop{{Relay: entry, Delay: RandomDelay()}}, nil
+	}
+
+	exit, middle := entry, max(n-1, 1)
+	if ends = slices.DeleteFunc(ends, isEntry); len(ends) > 0 {
+		exit, middle = ends[rand.IntN(len(ends))], max(n-2, 0)
+	}
+	others := slices.DeleteFunc(d.Relays(), func(ai peer.AddrInfo) bool { return ai.ID == entry.ID || ai.ID == exit.ID })
+	if len(others) < middle {
+		return nil, fmt.Errorf("onion path needs %d more relays in the directory, have %d", middle, len(others))
+	}
+	rand.Shuffle(len(others), func(i, j int) { others[i], others[j] = others[j], others[i] })
+	relays := append(append([]peer.AddrInfo{entry}, others[:middle]...), exit)
+	path := make([]Hop, 0, len(relays))
+	for _, ai := range relays {
+		path = append(path, Hop{Relay: ai, Delay: RandomDelay()})
+	}
+	return path, nil
+}
+
+// lookupAll returns the relays of ids that are in the directory.
+func (d *Directory) lookupAll(ids []peer.ID) []peer.AddrInfo {
+	var out []peer.AddrInfo
+	for _, id := range ids {
+		if ai, ok := d.Lookup(id); ok {
+			out = append(out, ai)
+		}
+	}
+	return out
+}
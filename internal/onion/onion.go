@@ -0,0 +1,153 @@
+// Package onion routes packets through a path of relays, each of which peels
+// one layer of encryption and learns only the hop before and after it. The
+// packet format is in internal/crypto; this package picks paths from a relay
+// directory, forwards packets on relays after a mixing delay, and hands
+// packets to the first hop.
+package onion
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"time"
+
+	p2pcrypto "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"shadow/internal/crypto"
+)
+
+// Protocol is the stream protocol carrying one onion packet to the next hop.
+const Protocol = "/shadow/onion/1.0.0"
+
+const (
+	// MeanDelay is the mean of the delay a sender asks of each relay.
+	MeanDelay = 500 * time.Millisecond
+	// MaxDelay bounds the delay a relay holds a packet for.
+	MaxDelay = 5 * time.Second
+
+	streamTimeout = 30 * time.Second
+)
+
+// Hop is a relay of a path and how long it holds the packet before
+// forwarding it.
+type Hop struct {
+	Relay peer.AddrInfo
+	Delay time.Duration
+}
+
+// routing is what a relay is told: the next hop and the delay.
+type routing struct {
+	Next  peer.ID
+	Delay time.Duration
+}
+
+func (r routing) marshal() ([]byte, error) {
+	id := []byte(r.Next)
+	if 1+len(id)+4 > crypto.OnionRoutingSize {
+		return nil, fmt.Errorf("peer ID too long for onion routing: %s", r.Next)
+	}
+	b := append([]byte{byte(len(id))}, id...)
+	return binary.BigEndian.AppendUint32(b, uint32(r.Delay.Milliseconds())), nil
+}
+
+func unmarshalRouting(b []byte) (routing, error) {
+	n := int(b[0])
+	if n == 0 || 1+n+4 > len(b) {
+		return routing{}, fmt.Errorf("invalid onion routing")
+	}
+	next, err := peer.IDFromBytes(b[1 : 1+n])
+	if err != nil {
+		return routing{}, fmt.Errorf("invalid onion next hop: %w", err)
+	}
+	delay := time.Duration(binary.BigEndian.Uint32(b[1+n:])) * time.Millisecond
+	return routing{Next: next, Delay: delay}, nil
+}
+
+// RandomDelay draws a mixing delay from an exponential distribution with
+// mean MeanDelay, capped at MaxDelay. Exponential delays make the order
+// packets leave a relay independent of the order they arrived in.
+func RandomDelay() time.Duration {
+	return min(time.Duration(rand.ExpFloat64()*float64(MeanDelay)), MaxDelay)
+}
+
+// Seal wraps payload in a packet for to, routed through the relays of path
+// in order. The last relay must be able to reach to.
+func Seal(path []Hop, to peer.ID, payload []byte) ([]byte, error) {
+	if len(path)+1 > crypto.OnionMaxHops {
+		return nil, fmt.Errorf("onion path of %d relays, at most %d", len(path), crypto.OnionMaxHops-1)
+	}
+	hops := make([]crypto.OnionHop, 0, len(path)+1)
+	for i, h := range path {
+		next := to
+		if i+1 < len(path) {
+			next = path[i+1].Relay.ID
+		}
+		key, err := h.Relay.ID.ExtractPublicKey()
+		if err != nil {
+			return nil, fmt.Errorf("no key in relay ID %s: %w", h.Relay.ID, err)
+		}
+		r, err := routing{Next: next, Delay: min(max(h.Delay, 0), MaxDelay)}.marshal()
+		if err != nil {
+			return nil, err
+		}
+		hops = append(hops, crypto.OnionHop{Key: key, Routing: r})
+	}
+	key, err := to.ExtractPublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("no key in peer ID %s: %w", to, err)
+	}
+	hops = append(hops, crypto.OnionHop{Key: key})
+	return crypto.SealOnion(hops, payload)
+}
+
+// Send hands packet to the first relay of its path.
+func Send(ctx context.Context, h host.Host, first peer.AddrInfo, packet []byte) error {
+	if len(first.Addrs) > 0 {
+		if err := h.Connect(ctx, first); err != nil {
+			return fmt.Errorf("failed to reach onion relay: %w", err)
+		}
+	}
+	return write(ctx, h, first.ID, packet)
+}
+
+func write(ctx context.Context, h host.Host, to peer.ID, packet []byte) error {
+	s, err := h.NewStream(ctx, to, Protocol)
+	if err != nil {
+		return fmt.Errorf("failed to open onion stream: %w", err)
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		s.SetDeadline(dl)
+	} else {
+		s.SetDeadline(time.Now().Add(streamTimeout))
+	}
+	if _, err := s.Write(packet); err != nil {
+		s.Reset()
+		return fmt.Errorf("failed to send onion packet: %w", err)
+	}
+	return s.Close()
+}
+
+// ReadPacket reads the one packet on an onion stream.
+func ReadPacket(r io.Reader) ([]byte, error) {
+	packet := make([]byte, crypto.OnionPacketSize)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return nil, fmt.Errorf("failed to read onion packet: %w", err)
+	}
+	return packet, nil
+}
+
+// Open peels the last layer of a packet sent to priv and returns the payload.
+func Open(priv p2pcrypto.PrivKey, packet []byte) ([]byte, error) {
+	peeled, err := crypto.PeelOnion(priv, packet)
+	if err != nil {
+		return nil, err
+	}
+	if peeled.Next == nil {
+		return peeled.Payload, nil
+	}
+	return nil, fmt.Errorf("onion packet does not end here")
+}
@@ -0,0 +1,238 @@
+package onion
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const testTimeout = 20 * time.Second
+
+// localhost starts a host listening on a loopback TCP port.
+func localhost(t *testing.T) host.Host {
+	t.Helper()
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+// setup starts n onion relays on localhost sharing a directory, and a
+// recipient holding a connection to the last relay, as it would for its
+// reservation. Packets the recipient opens come out of received.
+func setup(t *testing.T, n int) (relays []*Service, dir *Directory, to host.Host, received chan []byte) {
+	t.Helper()
+	dir = NewDirectory()
+	for i := 0; i < n; i++ {
+		h := localhost(t)
+		dir.Add(peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()})
+		s, err := NewService(h, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(s.Close)
+		relays = append(relays, s)
+	}
+
+	to = localhost(t)
+	received = make(chan []byte, 16)
+	priv := to.Peerstore().PrivKey(to.ID())
+	to.SetStreamHandler(Protocol, func(s network.Stream) {
+		defer s.Close()
+		packet, err := ReadPacket(s)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		payload, err := Open(priv, packet)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		received <- payload
+	})
+	exit := relays[n-1].host
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := to.Connect(ctx, peer.AddrInfo{ID: exit.ID(), Addrs: exit.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	return relays, dir, to, received
+}
+
+func expect(t *testing.T, received chan []byte, want string) {
+	t.Helper()
+	select {
+	case got := <-received:
+		if string(got) != want {
+			t.Fatalf("received %q, want %q", got, want)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("nothing received")
+	}
+}
+
+// eventually polls cond until it holds.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRouteThroughRelays(t *testing.T) {
+	for _, n := range []int{1, 2, 3} {
+		relays, dir, to, received := setup(t, n)
+		exit := relays[n-1].host.ID()
+		path, err := dir.Path(n, []peer.ID{exit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(path) != n || path[n-1].Relay.ID != exit {
+			t.Fatalf("path %v does not end at %s", path, exit)
+		}
+		for i := range path {
+			path[i].Delay = 10 * time.Millisecond
+		}
+		packet, err := Seal(path, to.ID(), []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		from := localhost(t)
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+		if err := Send(ctx, from, path[0].Relay, packet); err != nil {
+			t.Fatal(err)
+		}
+		expect(t, received, "hello")
+		for _, r := range relays {
+			eventually(t, "forwarding", func() bool {
+				fwd, dropped := r.Stats()
+				return fwd == 1 && dropped == 0
+			})
+		}
+	}
+}
+
+func TestRelayDropsReplays(t *testing.T) {
+	relays, dir, to, received := setup(t, 2)
+	path, err := dir.Path(2, []peer.ID{relays[1].host.ID()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, err := Seal(path, to.ID(), []byte("once"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := localhost(t)
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		if err := Send(ctx, from, path[0].Relay, packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect(t, received, "once")
+	eventually(t, "replay drop", func() bool {
+		_, dropped := relays[0].Stats()
+		return dropped == 1
+	})
+	select {
+	case got := <-received:
+		t.Fatalf("replay delivered: %q", got)
+	case <-time.After(2 * MaxDelay / 5):
+	}
+}
+
+func TestPathNeedsExitInDirectory(t *testing.T) {
+	_, dir, to, _ := setup(t, 2)
+	if _, err := dir.Path(2, []peer.ID{to.ID()}); err == nil {
+		t.Fatal("path through a relay missing from the directory")
+	}
+	if _, err := dir.Path(3, []peer.ID{dir.Relays()[0].ID}); err == nil {
+		t.Fatal("path longer than the directory")
+	}
+}
+
+func TestReplayCacheBounded(t *testing.T) {
+	c := newReplayCache(2, time.Hour)
+	now := time.Now()
+	tag := func(b byte) [32]byte { return [32]byte{b} }
+	if !c.add(tag(1), now) || c.add(tag(1), now) {
+		t.Fatal("replay not detected")
+	}
+	// Filling the current generation moves it aside; its tags still count
+	c.add(tag(2), now)
+	c.add(tag(3), now)
+	if c.add(tag(1), now) || c.add(tag(2), now) {
+		t.Fatal("tag of the previous generation forgotten")
+	}
+	c.add(tag(4), now)
+	c.add(tag(5), now)
+	if len(c.cur)+len(c.old) > 4 {
+		t.Fatalf("cache holds %d tags", len(c.cur)+len(c.old))
+	}
+	if !c.add(tag(1), now) {
+		t.Fatal("tag two generations old still remembered")
+	}
+
+	// Time turns the generations over too
+	c = newReplayCache(2, time.Hour)
+	now = c.started
+	c.add(tag(1), now)
+	c.add(tag(2), now.Add(time.Hour))
+	if c.add(tag(1), now.Add(time.Hour)) {
+		t.Fatal("tag forgotten after one lifetime")
+	}
+	c.add(tag(3), now.Add(2*time.Hour))
+	if !c.add(tag(1), now.Add(2*time.Hour)) {
+		t.Fatal("tag remembered after two lifetimes")
+	}
+}
+
+func TestPathViaEntry(t *testing.T) {
+	relays, dir, to, received := setup(t, 3)
+	entry, exit := relays[0].host.ID(), relays[2].host.ID()
+	path, err := dir.PathVia([]peer.ID{entry}, 1, []peer.ID{exit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(path) != 2 || path[0].Relay.ID != entry || path[1].Relay.ID != exit {
+		t.Fatalf("path %v, want %s then %s", path, entry, exit)
+	}
+	packet, err := Seal(path, to.ID(), []byte("via entry"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := Send(ctx, localhost(t), path[0].Relay, packet); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, received, "via entry")
+
+	// An entry the recipient is reachable through is the whole path
+	if path, err := dir.PathVia([]peer.ID{exit}, 1, []peer.ID{exit}); err != nil || len(path) != 1 {
+		t.Fatalf("path %v: %v", path, err)
+	}
+	// With the entry as the only exit the packet comes back to it
+	path, err = dir.PathVia([]peer.ID{entry}, 2, []peer.ID{entry})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(path) != 3 || path[0].Relay.ID != entry || path[2].Relay.ID != entry {
+		t.Fatalf("path %v", path)
+	}
+}
@@ -0,0 +1,177 @@
+package onion
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	p2pcrypto "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"shadow/internal/crypto"
+)
+
+const (
+	// replayTTL is how long the tags of forwarded packets are remembered at
+	// most, and at least half of it unless a flood fills the cache sooner.
+	replayTTL = 24 * time.Hour
+	// maxReplayTags bounds the tags of one generation of the replay cache.
+	maxReplayTags = 1 << 17
+	// maxPending bounds the packets held for their mixing delay.
+	maxPending = 1024
+)
+
+// Service forwards onion packets on a relay: it peels its layer, holds the
+// packet for the delay the sender asked for and passes it to the next hop.
+// Replayed packets are dropped, so a packet cannot be sent through again to
+// see where it goes.
+type Service struct {
+	host host.Host
+	priv p2pcrypto.PrivKey
+	dir  *Directory
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	seen    *replayCache
+	pending int
+
+	forwarded, dropped atomic.Uint64
+}
+
+// NewService registers the onion handler on h, finding the addresses of next
+// relays in dir. Recipients are reached over the connections they hold.
+func NewService(h host.Host, dir *Directory) (*Service, error) {
+	priv := h.Peerstore().PrivKey(h.ID())
+	if priv == nil {
+		return nil, fmt.Errorf("no private key for %s", h.ID())
+	}
+	if dir == nil {
+		dir = NewDirectory()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Service{
+		host:   h,
+		priv:   priv,
+		dir:    dir,
+		ctx:    ctx,
+		cancel: cancel,
+		seen:   newReplayCache(maxReplayTags, replayTTL/2),
+	}
+	h.SetStreamHandler(Protocol, s.handleStream)
+	return s, nil
+}
+
+// Close unregisters the handler and drops the packets held.
+func (s *Service) Close() {
+	s.host.RemoveStreamHandler(Protocol)
+	s.cancel()
+}
+
+// Stats returns the number of packets forwarded and dropped so far.
+func (s *Service) Stats() (forwarded, dropped uint64) {
+	return s.forwarded.Load(), s.dropped.Load()
+}
+
+func (s *Service) handleStream(str network.Stream) {
+	str.SetDeadline(time.Now().Add(streamTimeout))
+	packet, err := ReadPacket(str)
+	if err != nil {
+		str.Reset()
+		s.dropped.Add(1)
+		return
+	}
+	str.Close()
+	if err := s.accept(packet); err != nil {
+		s.dropped.Add(1)
+	}
+}
+
+// accept peels packet and schedules it for forwarding.
+func (s *Service) accept(packet []byte) error {
+	peeled, err := crypto.PeelOnion(s.priv, packet)
+	if err != nil {
+		return err
+	}
+	if peeled.Next == nil {
+		return fmt.Errorf("onion packet ends at a relay")
+	}
+	r, err := unmarshalRouting(peeled.Routing)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.pending >= maxPending {
+		s.mu.Unlock()
+		return fmt.Errorf("too many onion packets pending")
+	}
+	if !s.seen.add(peeled.Tag, time.Now()) {
+		s.mu.Unlock()
+		return fmt.Errorf("replayed onion packet")
+	}
+	s.pending++
+	s.mu.Unlock()
+
+	go func() {
+		err := s.forward(r.Next, min(r.Delay, MaxDelay), peeled.Next)
+		s.mu.Lock()
+		s.pending--
+		s.mu.Unlock()
+		if err != nil {
+			s.dropped.Add(1)
+		} else {
+			s.forwarded.Add(1)
+		}
+	}()
+	return nil
+}
+
+func (s *Service) forward(next peer.ID, delay time.Duration, packet []byte) error {
+	select {
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	case <-time.After(delay):
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, streamTimeout)
+	defer cancel()
+	if ai, ok := s.dir.Lookup(next); ok {
+		return Send(ctx, s.host, ai, packet)
+	}
+	return write(ctx, s.host, next, packet)
+}
+
+// replayCache remembers tags in two generations: a new one starts when the
+// current one is full or older than lifetime, and the oldest is dropped
+// whole. It never holds more than 2*max tags, and a tag is remembered for
+// lifetime to twice that unless the cache fills up sooner.
+type replayCache struct {
+	max      int
+	lifetime time.Duration
+	cur, old map[[32]byte]struct{}
+	started  time.Time
+}
+
+func newReplayCache(max int, lifetime time.Duration) *replayCache {
+	return &replayCache{max: max, lifetime: lifetime, cur: map[[32]byte]struct{}{}, started: time.Now()}
+}
+
+// add remembers tag and reports whether it is new.
+func (c *replayCache) add(tag [32]byte, now time.Time) bool {
+	if _, ok := c.cur[tag]; ok {
+		return false
+	}
+	if _, ok := c.old[tag]; ok {
+		return false
+	}
+	if len(c.cur) >= c.max || now.Sub(c.started) >= c.lifetime {
+		c.old, c.cur, c.started = c.cur, make(map[[32]byte]struct{}, len(c.cur)), now
+	}
+	c.cur[tag] = struct{}{}
+	return true
+}
@@ -0,0 +1,527 @@
+package relay
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/metrics"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+
+	"shadow/internal/logging"
+)
+
+const (
+	aclFileName     = "relay.acl.json"
+	invitedFileName = "relay.invited"
+	// redeemedFileName lists the nonces of redeemed invites, so that each
+	// invite admits one peer only.
+	redeemedFileName = "relay.redeemed"
+
+	defaultQuotaWindow = 24 * time.Hour
+	enforceInterval    = 10 * time.Second
+)
+
+// Policy is the on-disk relay access policy. A relay without a policy file is open.
+type Policy struct {
+	// Open allows any non-denied peer to reserve a slot. When false only
+	// peers in Allow, or peers that redeemed an invite, may reserve.
+	Open bool `json:"open"`
+	// Allow lists peer IDs that may always reserve.
+	Allow []string `json:"allow"`
+	// Deny lists peer IDs that are refused any connection.
+	Deny []string `json:"deny"`
+	// MaxConnsPerPeer caps simultaneous connections from one peer (0 for unlimited).
+	MaxConnsPerPeer int `json:"max_conns_per_peer"`
+	// MaxBytesPerPeer caps bytes relayed for one peer per quota window (0 for unlimited).
+	MaxBytesPerPeer int64 `json:"max_bytes_per_peer"`
+	// MaxRatePerPeer caps the bytes/second one peer may sustain (0 for unlimited).
+	MaxRatePerPeer float64 `json:"max_rate_per_peer"`
+	// QuotaWindow is how often byte quotas reset, as a Go duration (default 24h).
+	QuotaWindow string `json:"quota_window"`
+}
+
+// ACL enforces a Policy. It is both a libp2p connection gater and a circuit
+// relay ACL filter, and can be reloaded at runtime.
+type ACL struct {
+	dataDir string
+	bw      *metrics.BandwidthCounter
+
+	// fileMu serializes reading and writing the policy and invite files
+	// with updating the state from them. It is taken before mu.
+	fileMu sync.Mutex
+
+	mu          sync.RWMutex
+	policy      Policy
+	allow       map[peer.ID]bool
+	deny        map[peer.ID]bool
+	invited     map[peer.ID]time.Time // zero for no expiry
+	redeemed    map[string]redemption
+	window      time.Duration
+	windowStart time.Time
+	base        map[peer.ID]int64
+	circuits    map[[2]peer.ID]time.Time
+	host        host.Host
+}
+
+// redemption is the peer that redeemed an invite and when the invite expires.
+type redemption struct {
+	peer    peer.ID
+	expires time.Time
+}
+
+// Circuit is a relayed connection admitted by the ACL.
+type Circuit struct {
+	Src    peer.ID   `json:"src"`
+	Dest   peer.ID   `json:"dest"`
+	Opened time.Time `json:"opened"`
+}
+
+// NewACL loads the access policy and redeemed invites from dataDir.
+func NewACL(dataDir string) (*ACL, error) {
+	a := &ACL{
+		dataDir:  dataDir,
+		bw:       metrics.NewBandwidthCounter(),
+		invited:  map[peer.ID]time.Time{},
+		redeemed: map[string]redemption{},
+		circuits: map[[2]peer.ID]time.Time{},
+	}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload re-reads the policy and invite files, then disconnects peers that
+// are no longer permitted.
+func (a *ACL) Reload() error {
+	a.fileMu.Lock()
+	defer a.fileMu.Unlock()
+	return a.reloadLocked()
+}
+
+// reloadLocked is Reload with fileMu held.
+func (a *ACL) reloadLocked() error {
+	p := Policy{Open: true}
+	b, err := os.ReadFile(filepath.Join(a.dataDir, aclFileName))
+	if err == nil {
+		p = Policy{}
+		if err := json.Unmarshal(b, &p); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", aclFileName, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	allow, err := decodePeers(p.Allow)
+	if err != nil {
+		return fmt.Errorf("invalid allow entry: %w", err)
+	}
+	deny, err := decodePeers(p.Deny)
+	if err != nil {
+		return fmt.Errorf("invalid deny entry: %w", err)
+	}
+	window := defaultQuotaWindow
+	if p.QuotaWindow != "" {
+		if window, err = time.ParseDuration(p.QuotaWindow); err != nil {
+			return fmt.Errorf("invalid quota_window: %w", err)
+		}
+	}
+
+	// Lines are "<peer> [<expires>]"; peers invited before expiries were
+	// kept have none
+	invited := map[peer.ID]time.Time{}
+	for _, f := range readFields(filepath.Join(a.dataDir, invitedFileName)) {
+		id, err := peer.Decode(f[0])
+		if err != nil {
+			continue
+		}
+		var expires time.Time
+		if len(f) > 1 {
+			if expires, err = parseUnix(f[1]); err != nil {
+				continue
+			}
+		}
+		invited[id] = expires
+	}
+	// Lines are "<nonce> <peer> <expires>"
+	redeemed := map[string]redemption{}
+	for _, f := range readFields(filepath.Join(a.dataDir, redeemedFileName)) {
+		if len(f) < 3 {
+			continue
+		}
+		id, err := peer.Decode(f[1])
+		if err != nil {
+			continue
+		}
+		expires, err := parseUnix(f[2])
+		if err != nil {
+			continue
+		}
+		redeemed[f[0]] = redemption{peer: id, expires: expires}
+	}
+
+	a.mu.Lock()
+	a.policy = p
+	a.allow = allow
+	a.deny = deny
+	a.invited = invited
+	a.redeemed = redeemed
+	if window != a.window {
+		a.window = window
+		a.resetWindowLocked()
+	}
+	a.mu.Unlock()
+
+	a.enforce()
+	return nil
+}
+
+func decodePeers(ids []string) (map[peer.ID]bool, error) {
+	m := make(map[peer.ID]bool, len(ids))
+	for _, s := range ids {
+		id, err := peer.Decode(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", s, err)
+		}
+		m[id] = true
+	}
+	return m, nil
+}
+
+// Attach binds the ACL to the relay host and starts quota enforcement.
+func (a *ACL) Attach(ctx context.Context, h host.Host) {
+	a.mu.Lock()
+	a.host = h
+	a.mu.Unlock()
+	go func() {
+		t := time.NewTicker(enforceInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				a.enforce()
+			}
+		}
+	}()
+}
+
+// Policy returns the currently active policy.
+func (a *ACL) Policy() Policy {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.policy
+}
+
+// BandwidthCounter returns the per-peer byte counter used for quotas.
+func (a *ACL) BandwidthCounter() *metrics.BandwidthCounter {
+	return a.bw
+}
+
+// Invite records that p redeemed inv, which lets p reserve until the invite
+// expires. An invite admits the first peer that redeems it; that peer may
+// present it again.
+func (a *ACL) Invite(p peer.ID, inv *Invite) error {
+	if len(inv.Nonce) == 0 {
+		return fmt.Errorf("invite has no nonce")
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(inv.Nonce)
+	expires := time.Unix(inv.Expires, 0)
+	a.fileMu.Lock()
+	defer a.fileMu.Unlock()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if r, ok := a.redeemed[nonce]; ok {
+		if r.peer != p {
+			return fmt.Errorf("invite already redeemed")
+		}
+		return nil
+	}
+	a.redeemed[nonce] = redemption{peer: p, expires: expires}
+	if cur, ok := a.invited[p]; !ok || (!cur.IsZero() && cur.Before(expires)) {
+		a.invited[p] = expires
+	}
+	return a.saveInvitesLocked()
+}
+
+// saveInvitesLocked drops expired invites and rewrites both invite files.
+func (a *ACL) saveInvitesLocked() error {
+	now := time.Now()
+	var invited, redeemed []string
+	for p, expires := range a.invited {
+		if expires.IsZero() {
+			invited = append(invited, p.String())
+			continue
+		}
+		if now.After(expires) {
+			delete(a.invited, p)
+			continue
+		}
+		invited = append(invited, fmt.Sprintf("%s %d", p, expires.Unix()))
+	}
+	for nonce, r := range a.redeemed {
+		if now.After(r.expires) {
+			delete(a.redeemed, nonce)
+			continue
+		}
+		redeemed = append(redeemed, fmt.Sprintf("%s %s %d", nonce, r.peer, r.expires.Unix()))
+	}
+	if err := os.MkdirAll(a.dataDir, 0700); err != nil {
+		return err
+	}
+	// The nonce goes first: a redeemer without it could be admitted twice
+	if err := writeLines(filepath.Join(a.dataDir, redeemedFileName), redeemed); err != nil {
+		return err
+	}
+	return writeLines(filepath.Join(a.dataDir, invitedFileName), invited)
+}
+
+// readFields returns the fields of each non-empty line of path.
+func readFields(path string) [][]string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var out [][]string
+	for _, line := range strings.Split(string(b), "\n") {
+		if f := strings.Fields(line); len(f) > 0 {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+func parseUnix(s string) (time.Time, error) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(n, 0), nil
+}
+
+// writeLines replaces path with lines, so a crash leaves either version.
+func writeLines(path string, lines []string) error {
+	sort.Strings(lines)
+	var b strings.Builder
+	for _, l := range lines {
+		b.WriteString(l + "\n")
+	}
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path))
+	if err := os.WriteFile(tmp, []byte(b.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Denied reports whether p is on the denylist.
+func (a *ACL) Denied(p peer.ID) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.deny[p]
+}
+
+// Allowed reports whether p may hold a reservation.
+func (a *ACL) Allowed(p peer.ID) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.deny[p] {
+		return false
+	}
+	if a.policy.Open || a.allow[p] {
+		return true
+	}
+	expires, ok := a.invited[p]
+	return ok && (expires.IsZero() || time.Now().Before(expires))
+}
+
+// Usage returns the bytes p has used in the current quota window.
+func (a *ACL) Usage(p peer.ID) int64 {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.usageLocked(p)
+}
+
+func (a *ACL) usageLocked(p peer.ID) int64 {
+	s := a.bw.GetBandwidthForPeer(p)
+	return s.TotalIn + s.TotalOut - a.base[p]
+}
+
+func (a *ACL) resetWindowLocked() {
+	a.windowStart = time.Now()
+	a.base = map[peer.ID]int64{}
+	for p, s := range a.bw.GetBandwidthByPeer() {
+		a.base[p] = s.TotalIn + s.TotalOut
+	}
+}
+
+// overQuota reports whether p exceeded its byte or rate quota.
+func (a *ACL) overQuota(p peer.ID) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.overQuotaLocked(p)
+}
+
+func (a *ACL) overQuotaLocked(p peer.ID) bool {
+	if a.policy.MaxBytesPerPeer > 0 && a.usageLocked(p) > a.policy.MaxBytesPerPeer {
+		return true
+	}
+	if a.policy.MaxRatePerPeer > 0 {
+		s := a.bw.GetBandwidthForPeer(p)
+		if s.RateIn+s.RateOut > a.policy.MaxRatePerPeer {
+			return true
+		}
+	}
+	return false
+}
+
+// enforce rolls the quota window and disconnects denied or over-quota peers.
+func (a *ACL) enforce() {
+	a.mu.Lock()
+	if a.window > 0 && time.Since(a.windowStart) > a.window {
+		a.resetWindowLocked()
+	}
+	h := a.host
+	var drop []peer.ID
+	if h != nil {
+		for _, p := range h.Network().Peers() {
+			if a.deny[p] || a.overQuotaLocked(p) {
+				drop = append(drop, p)
+			}
+		}
+	}
+	a.mu.Unlock()
+
+	for _, p := range drop {
+		logging.Println("Disconnecting peer (denied or over quota):", p)
+		h.Network().ClosePeer(p)
+	}
+}
+
+// AllowReserve implements the circuit relay ACLFilter.
+func (a *ACL) AllowReserve(p peer.ID, addr ma.Multiaddr) bool {
+	return a.Allowed(p) && !a.overQuota(p)
+}
+
+// AllowConnect implements the circuit relay ACLFilter.
+func (a *ACL) AllowConnect(src peer.ID, srcAddr ma.Multiaddr, dest peer.ID) bool {
+	if a.Denied(src) || a.Denied(dest) {
+		return false
+	}
+	if a.overQuota(src) || a.overQuota(dest) {
+		return false
+	}
+	a.mu.Lock()
+	a.circuits[[2]peer.ID{src, dest}] = time.Now()
+	a.mu.Unlock()
+	return true
+}
+
+// Circuits returns the admitted circuits for which active reports both ends
+// are still relaying. Finished circuits are forgotten.
+func (a *ACL) Circuits(active func(peer.ID) bool) []Circuit {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := []Circuit{}
+	for k, opened := range a.circuits {
+		if !active(k[0]) || !active(k[1]) {
+			delete(a.circuits, k)
+			continue
+		}
+		out = append(out, Circuit{Src: k[0], Dest: k[1], Opened: opened})
+	}
+	return out
+}
+
+// Ban adds p to the denylist, persists the policy and disconnects p.
+func (a *ACL) Ban(p peer.ID) error {
+	return a.updateDeny(p, true)
+}
+
+// Unban removes p from the denylist and persists the policy.
+func (a *ACL) Unban(p peer.ID) error {
+	return a.updateDeny(p, false)
+}
+
+func (a *ACL) updateDeny(p peer.ID, deny bool) error {
+	// Held until the new policy is loaded, so concurrent updates each start
+	// from the last one
+	a.fileMu.Lock()
+	defer a.fileMu.Unlock()
+	a.mu.RLock()
+	if a.deny[p] == deny {
+		a.mu.RUnlock()
+		return nil
+	}
+	policy := a.policy
+	a.mu.RUnlock()
+
+	denied := policy.Deny
+	policy.Deny = nil
+	for _, s := range denied {
+		if id, err := peer.Decode(s); err == nil && id != p {
+			policy.Deny = append(policy.Deny, s)
+		}
+	}
+	if deny {
+		policy.Deny = append(policy.Deny, p.String())
+	}
+	b, err := json.MarshalIndent(policy, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(a.dataDir, 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(a.dataDir, aclFileName), b, 0600); err != nil {
+		return err
+	}
+	return a.reloadLocked()
+}
+
+// InterceptPeerDial implements connmgr.ConnectionGater.
+func (a *ACL) InterceptPeerDial(p peer.ID) bool {
+	return !a.Denied(p)
+}
+
+// InterceptAddrDial implements connmgr.ConnectionGater.
+func (a *ACL) InterceptAddrDial(p peer.ID, addr ma.Multiaddr) bool {
+	return true
+}
+
+// InterceptAccept implements connmgr.ConnectionGater.
+func (a *ACL) InterceptAccept(cm network.ConnMultiaddrs) bool {
+	return true
+}
+
+// InterceptSecured implements connmgr.ConnectionGater.
+func (a *ACL) InterceptSecured(dir network.Direction, p peer.ID, cm network.ConnMultiaddrs) bool {
+	if a.Denied(p) {
+		return false
+	}
+	a.mu.RLock()
+	max, h := a.policy.MaxConnsPerPeer, a.host
+	a.mu.RUnlock()
+	if max > 0 && h != nil && dir == network.DirInbound && len(h.Network().ConnsToPeer(p)) >= max {
+		return false
+	}
+	return true
+}
+
+// InterceptUpgraded implements connmgr.ConnectionGater.
+func (a *ACL) InterceptUpgraded(c network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
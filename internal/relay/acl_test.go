@@ -0,0 +1,58 @@
+package relay
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestConcurrentBans(t *testing.T) {
+	dir := t.TempDir()
+	acl, err := NewACL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers := make([]peer.ID, 32)
+	for i := range peers {
+		peers[i] = newPeer(t)
+	}
+	if err := acl.Ban(peers[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bans racing each other and an unban must all end up in the policy
+	var wg sync.WaitGroup
+	for _, p := range peers[1:] {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := acl.Ban(p); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := acl.Unban(peers[0]); err != nil {
+			t.Error(err)
+		}
+	}()
+	wg.Wait()
+
+	reloaded, err := NewACL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range []*ACL{acl, reloaded} {
+		if a.Denied(peers[0]) {
+			t.Fatal("unbanned peer denied")
+		}
+		for _, p := range peers[1:] {
+			if !a.Denied(p) {
+				t.Fatalf("ban of %s lost", p)
+			}
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package relay
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"shadow/internal/utils"
+)
+
+const (
+	reservationTag = "relay-reservation" // set by the circuit v2 relay service
+	circuitTag     = "relay-v2-hop"
+
+	adminTokenFile = "relay.admin-token"
+)
+
+// Admin serves the relay's admin HTTP API and Prometheus metrics. Every route
+// but /metrics requires the admin token as a bearer token.
+type Admin struct {
+	host    host.Host
+	acl     *ACL
+	token   string
+	metrics *prometheus.Registry
+}
+
+// Reservation is an active relay slot.
+type Reservation struct {
+	Peer  peer.ID   `json:"peer"`
+	Since time.Time `json:"since"`
+}
+
+// PeerStats describes a connected peer.
+type PeerStats struct {
+	Peer        peer.ID  `json:"peer"`
+	Addrs       []string `json:"addrs"`
+	Conns       int      `json:"conns"`
+	Reservation bool     `json:"reservation"`
+	Denied      bool     `json:"denied"`
+	BytesIn     int64    `json:"bytes_in"`
+	BytesOut    int64    `json:"bytes_out"`
+	RateIn      float64  `json:"rate_in"`
+	RateOut     float64  `json:"rate_out"`
+	QuotaUsed   int64    `json:"quota_used"`
+}
+
+// NewAdmin returns an admin API for the relay host h gated by acl, admitting
+// requests that present token.
+func NewAdmin(h host.Host, acl *ACL, token string) *Admin {
+	a := &Admin{host: h, acl: acl, token: token, metrics: prometheus.NewRegistry()}
+	a.metrics.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "shadow", Subsystem: "relay", Name: "reservations",
+			Help: "Number of active relay reservations.",
+		}, func() float64 { return float64(len(a.Reservations())) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "shadow", Subsystem: "relay", Name: "circuits",
+			Help: "Number of active relayed circuits.",
+		}, func() float64 { return float64(len(a.Circuits())) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "shadow", Subsystem: "relay", Name: "connected_peers",
+			Help: "Number of connected peers.",
+		}, func() float64 { return float64(len(h.Network().Peers())) }),
+	)
+	return a
+}
+
+func (a *Admin) tagged(p peer.ID, tag string) bool {
+	info := a.host.ConnManager().GetTagInfo(p)
+	if info == nil {
+		return false
+	}
+	_, ok := info.Tags[tag]
+	return ok
+}
+
+// Reservations lists peers currently holding a relay slot.
+func (a *Admin) Reservations() []Reservation {
+	out := []Reservation{}
+	for _, p := range a.host.Network().Peers() {
+		if info := a.host.ConnManager().GetTagInfo(p); info != nil {
+			if _, ok := info.Tags[reservationTag]; ok {
+				out = append(out, Reservation{Peer: p, Since: info.FirstSeen})
+			}
+		}
+	}
+	return out
+}
+
+// Circuits lists active relayed connections.
+func (a *Admin) Circuits() []Circuit {
+	return a.acl.Circuits(func(p peer.ID) bool { return a.tagged(p, circuitTag) })
+}
+
+// Peers lists connected peers with their traffic counters.
+func (a *Admin) Peers() []PeerStats {
+	out := []PeerStats{}
+	for _, p := range a.host.Network().Peers() {
+		conns := a.host.Network().ConnsToPeer(p)
+		st := PeerStats{
+			Peer:        p,
+			Conns:       len(conns),
+			Reservation: a.tagged(p, reservationTag),
+			Denied:      a.acl.Denied(p),
+			QuotaUsed:   a.acl.Usage(p),
+		}
+		for _, c := range conns {
+			st.Addrs = append(st.Addrs, c.RemoteMultiaddr().String())
+		}
+		bw := a.acl.BandwidthCounter().GetBandwidthForPeer(p)
+		st.BytesIn, st.BytesOut = bw.TotalIn, bw.TotalOut
+		st.RateIn, st.RateOut = bw.RateIn, bw.RateOut
+		out = append(out, st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Peer < out[j].Peer })
+	return out
+}
+
+// Handler returns the admin HTTP routes.
+func (a *Admin) Handler() http.Handler {
+	mux := http.NewServeMux()
+	api := http.NewServeMux()
+	api.HandleFunc("GET /reservations", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, a.Reservations())
+	})
+	api.HandleFunc("GET /circuits", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, a.Circuits())
+	})
+	api.HandleFunc("GET /peers", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, a.Peers())
+	})
+	api.HandleFunc("GET /policy", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, a.acl.Policy())
+	})
+	api.HandleFunc("POST /peers/{id}/kick", a.peerAction(func(p peer.ID) error {
+		return a.host.Network().ClosePeer(p)
+	}))
+	api.HandleFunc("POST /peers/{id}/ban", a.peerAction(a.acl.Ban))
+	api.HandleFunc("DELETE /peers/{id}/ban", a.peerAction(a.acl.Unban))
+	api.HandleFunc("POST /reload", func(w http.ResponseWriter, r *http.Request) {
+		if err := a.acl.Reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.Handle("/", a.authorized(api))
+	mux.Handle("GET /metrics", promhttp.HandlerFor(a.metrics, promhttp.HandlerOpts{}))
+	return mux
+}
+
+// authorized passes on requests that carry the admin token.
+func (a *Admin) authorized(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || a.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *Admin) peerAction(fn func(peer.ID) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := peer.Decode(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid peer ID: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := fn(p); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ListenAndServe serves the admin API on addr until ctx is cancelled.
+func (a *Admin) ListenAndServe(ctx context.Context, addr string) error {
+	srv := &http.Server{Addr: addr, Handler: a.Handler()}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// LoadOrCreateAdminToken returns the admin API token stored in dataDir,
+// creating one readable only by the owner if there is none.
+func LoadOrCreateAdminToken(dataDir string) (string, error) {
+	return utils.LoadOrCreateToken(AdminTokenPath(dataDir))
+}
+
+// AdminTokenPath is the file holding the admin API token of a relay.
+func AdminTokenPath(dataDir string) string {
+	return filepath.Join(dataDir, adminTokenFile)
+}
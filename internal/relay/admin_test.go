@@ -0,0 +1,63 @@
+package relay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+func TestAdminToken(t *testing.T) {
+	mn := mocknet.New()
+	defer mn.Close()
+	h, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	acl, err := NewACL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := LoadOrCreateAdminToken(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := LoadOrCreateAdminToken(dir); err != nil || again != token {
+		t.Fatalf("token not kept: %v", err)
+	}
+	srv := httptest.NewServer(NewAdmin(h, acl, token).Handler())
+	defer srv.Close()
+	// Each admin keeps its own metrics
+	NewAdmin(h, acl, token)
+
+	for _, c := range []struct {
+		method, path, token string
+		want                int
+	}{
+		{"POST", "/reload", "", http.StatusUnauthorized},
+		{"POST", "/reload", "wrong", http.StatusUnauthorized},
+		{"POST", "/peers/" + h.ID().String() + "/ban", "", http.StatusUnauthorized},
+		{"GET", "/peers", "", http.StatusUnauthorized},
+		{"GET", "/metrics", "", http.StatusOK},
+		{"GET", "/peers", token, http.StatusOK},
+		{"POST", "/reload", token, http.StatusNoContent},
+	} {
+		req, err := http.NewRequest(c.method, srv.URL+c.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.want {
+			t.Errorf("%s %s with token %q: got %d, want %d", c.method, c.path, c.token, resp.StatusCode, c.want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"shadow/internal/logging"
+)
+
+// InviteProtocol is the stream protocol used to redeem an invite token.
+const InviteProtocol = "/shadow/relay/invite/1.0.0"
+
+// Invite is the signed content of an invite token.
+type Invite struct {
+	Relay   peer.ID `json:"relay"`
+	Peer    peer.ID `json:"peer,omitempty"` // optional: only this peer may redeem
+	Expires int64   `json:"expires"`
+	Nonce   []byte  `json:"nonce"`
+}
+
+// IssueInvite creates a token signed by the relay key, valid for ttl. The first
+// peer to redeem it may reserve until it expires; if bound is non-empty only
+// that peer can redeem it.
+func IssueInvite(priv crypto.PrivKey, bound peer.ID, ttl time.Duration) (string, error) {
+	relayID, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(Invite{
+		Relay:   relayID,
+		Peer:    bound,
+		Expires: time.Now().Add(ttl).Unix(),
+		Nonce:   nonce,
+	})
+	if err != nil {
+		return "", err
+	}
+	sig, err := priv.Sign(payload)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(sig), nil
+}
+
+// VerifyInvite checks the token signature against the relay public key and
+// that redeemer is permitted to use it.
+func VerifyInvite(pub crypto.PubKey, token string, redeemer peer.ID) (*Invite, error) {
+	parts := strings.SplitN(strings.TrimSpace(token), ".", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("malformed invite")
+	}
+	enc := base64.RawURLEncoding
+	payload, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed invite: %w", err)
+	}
+	sig, err := enc.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed invite: %w", err)
+	}
+	ok, err := pub.Verify(payload, sig)
+	if err != nil || !ok {
+		return nil, fmt.Errorf("invalid invite signature")
+	}
+	var inv Invite
+	if err := json.Unmarshal(payload, &inv); err != nil {
+		return nil, fmt.Errorf("malformed invite: %w", err)
+	}
+	if relayID, err := peer.IDFromPublicKey(pub); err != nil || inv.Relay != relayID {
+		return nil, fmt.Errorf("invite issued for another relay")
+	}
+	if time.Now().Unix() > inv.Expires {
+		return nil, fmt.Errorf("invite expired")
+	}
+	if inv.Peer != "" && inv.Peer != redeemer {
+		return nil, fmt.Errorf("invite bound to another peer")
+	}
+	return &inv, nil
+}
+
+// ServeInvites registers the invite redemption handler on the relay host.
+func ServeInvites(h host.Host, acl *ACL) {
+	h.SetStreamHandler(InviteProtocol, func(s network.Stream) {
+		defer s.Close()
+		s.SetDeadline(time.Now().Add(10 * time.Second))
+		token, err := bufio.NewReader(s).ReadString('\n')
+		if err != nil {
+			s.Reset()
+			return
+		}
+		remote := s.Conn().RemotePeer()
+		inv, err := VerifyInvite(h.Peerstore().PubKey(h.ID()), token, remote)
+		if err != nil {
+			fmt.Fprintf(s, "ERR %s\n", err)
+			return
+		}
+		if err := acl.Invite(remote, inv); err != nil {
+			fmt.Fprintf(s, "ERR %s\n", err)
+			return
+		}
+		logging.Println("Peer redeemed invite:", remote)
+		fmt.Fprintln(s, "OK")
+	})
+}
+
+// RedeemInvite presents token to the relay so this host may reserve a slot.
+func RedeemInvite(ctx context.Context, h host.Host, relayID peer.ID, token string) error {
+	s, err := h.NewStream(ctx, relayID, InviteProtocol)
+	if err != nil {
+		return fmt.Errorf("failed to open invite stream: %w", err)
+	}
+	defer s.Close()
+	if _, err := fmt.Fprintln(s, strings.TrimSpace(token)); err != nil {
+		return err
+	}
+	resp, err := bufio.NewReader(s).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read invite response: %w", err)
+	}
+	resp = strings.TrimSpace(resp)
+	if resp != "OK" {
+		return fmt.Errorf("relay rejected invite: %s", strings.TrimPrefix(resp, "ERR "))
+	}
+	return nil
+}
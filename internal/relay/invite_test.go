@@ -0,0 +1,84 @@
+package relay
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func newPeer(t *testing.T) peer.ID {
+	t.Helper()
+	_, pub, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestInviteSingleUse(t *testing.T) {
+	dir := t.TempDir()
+	priv, err := LoadOrCreateKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, aclFileName), []byte(`{"open": false}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	acl, err := NewACL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := IssueInvite(priv, "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, bob := newPeer(t), newPeer(t)
+	redeem := func(acl *ACL, p peer.ID) error {
+		inv, err := VerifyInvite(priv.GetPublic(), token, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return acl.Invite(p, inv)
+	}
+	if err := redeem(acl, alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := redeem(acl, alice); err != nil {
+		t.Fatalf("redeemer presenting the invite again: %v", err)
+	}
+	if err := redeem(acl, bob); err == nil {
+		t.Fatal("invite redeemed by a second peer")
+	}
+	if !acl.Allowed(alice) || acl.Allowed(bob) {
+		t.Fatal("wrong peers allowed")
+	}
+
+	// Redemptions survive a restart
+	acl, err = NewACL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := redeem(acl, bob); err == nil {
+		t.Fatal("invite redeemed by a second peer after restart")
+	}
+	if !acl.Allowed(alice) {
+		t.Fatal("invited peer forgotten after restart")
+	}
+
+	// And the admission ends with the invite
+	acl.mu.Lock()
+	acl.invited[alice] = time.Now().Add(-time.Second)
+	acl.mu.Unlock()
+	if acl.Allowed(alice) {
+		t.Fatal("peer allowed after its invite expired")
+	}
+}
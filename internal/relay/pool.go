@@ -0,0 +1,228 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+	ma "github.com/multiformats/go-multiaddr"
+
+	"shadow/internal/logging"
+)
+
+const (
+	probeInterval = 30 * time.Second
+	probeTimeout  = 10 * time.Second
+)
+
+// RelayStatus is the last known health of a relay in a Pool.
+type RelayStatus struct {
+	ID        peer.ID
+	Addrs     []ma.Multiaddr
+	Healthy   bool
+	RTT       time.Duration
+	Reserved  bool
+	LastProbe time.Time
+	LastErr   string
+}
+
+// Pool health checks a set of relays and hands the fastest healthy ones to
+// libp2p autorelay, which keeps reservations on them and fails over when one drops.
+type Pool struct {
+	relays []peer.AddrInfo
+	size   int
+
+	mu     sync.RWMutex
+	host   host.Host
+	status map[peer.ID]*RelayStatus
+}
+
+// ParseAddrs groups relay multiaddrs by peer ID.
+func ParseAddrs(addrs []string) ([]peer.AddrInfo, error) {
+	var maddrs []ma.Multiaddr
+	for _, a := range addrs {
+		maddr, err := ma.NewMultiaddr(a)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse relay address %q: %w", a, err)
+		}
+		maddrs = append(maddrs, maddr)
+	}
+	return peer.AddrInfosFromP2pAddrs(maddrs...)
+}
+
+// NewPool returns a pool over relays that keeps reservations on the best size of them.
+func NewPool(relays []peer.AddrInfo, size int) *Pool {
+	if size <= 0 {
+		size = 1
+	}
+	p := &Pool{
+		relays: relays,
+		size:   size,
+		status: map[peer.ID]*RelayStatus{},
+	}
+	for _, r := range relays {
+		p.status[r.ID] = &RelayStatus{ID: r.ID, Addrs: r.Addrs}
+	}
+	return p
+}
+
+// Size is the number of relays the pool tries to keep reservations on.
+func (p *Pool) Size() int {
+	return p.size
+}
+
+// Relays returns every configured relay.
+func (p *Pool) Relays() []peer.AddrInfo {
+	return p.relays
+}
+
+// Start probes the relays once, then keeps probing in the background until ctx is done.
+func (p *Pool) Start(ctx context.Context, h host.Host) {
+	p.mu.Lock()
+	p.host = h
+	p.mu.Unlock()
+	p.ProbeAll(ctx)
+	go func() {
+		t := time.NewTicker(probeInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				p.ProbeAll(ctx)
+			}
+		}
+	}()
+}
+
+// ProbeAll connects to and pings every relay concurrently.
+func (p *Pool) ProbeAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, r := range p.relays {
+		wg.Add(1)
+		go func(ai peer.AddrInfo) {
+			defer wg.Done()
+			p.probe(ctx, ai)
+		}(r)
+	}
+	wg.Wait()
+}
+
+func (p *Pool) probe(ctx context.Context, ai peer.AddrInfo) {
+	p.mu.RLock()
+	h := p.host
+	p.mu.RUnlock()
+	if h == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	var rtt time.Duration
+	err := h.Connect(ctx, ai)
+	if err == nil {
+		res := <-ping.Ping(ctx, h, ai.ID)
+		rtt, err = res.RTT, res.Error
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st := p.status[ai.ID]
+	wasHealthy := st.Healthy
+	st.LastProbe = time.Now()
+	st.Healthy = err == nil
+	st.Reserved = isReserved(h, ai.ID)
+	if err != nil {
+		st.LastErr = err.Error()
+		if wasHealthy {
+			logging.Println("Relay", ai.ID, "is down:", err)
+		}
+		return
+	}
+	st.LastErr = ""
+	st.RTT = rtt
+	if !wasHealthy {
+		logging.Println("Relay", ai.ID, "is up, rtt", rtt)
+	}
+}
+
+// isReserved reports whether h advertises a circuit address through relay.
+func isReserved(h host.Host, relay peer.ID) bool {
+	for _, a := range h.Addrs() {
+		if _, err := a.ValueForProtocol(ma.P_CIRCUIT); err != nil {
+			continue
+		}
+		if id, err := a.ValueForProtocol(ma.P_P2P); err == nil && id == relay.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// Ranked returns the healthy relays, fastest first.
+func (p *Pool) Ranked() []peer.AddrInfo {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var healthy []*RelayStatus
+	for _, st := range p.status {
+		if st.Healthy {
+			healthy = append(healthy, st)
+		}
+	}
+	sort.Slice(healthy, func(i, j int) bool { return healthy[i].RTT < healthy[j].RTT })
+	out := make([]peer.AddrInfo, len(healthy))
+	for i, st := range healthy {
+		out[i] = peer.AddrInfo{ID: st.ID, Addrs: st.Addrs}
+	}
+	return out
+}
+
+// Best returns the fastest healthy relay.
+func (p *Pool) Best() (peer.AddrInfo, bool) {
+	ranked := p.Ranked()
+	if len(ranked) == 0 {
+		return peer.AddrInfo{}, false
+	}
+	return ranked[0], true
+}
+
+// Status returns a snapshot of every relay, fastest healthy relays first.
+func (p *Pool) Status() []RelayStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	out := make([]RelayStatus, 0, len(p.status))
+	for _, st := range p.status {
+		s := *st
+		if p.host != nil {
+			s.Reserved = isReserved(p.host, st.ID)
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Healthy != out[j].Healthy {
+			return out[i].Healthy
+		}
+		return out[i].RTT < out[j].RTT
+	})
+	return out
+}
+
+// PeerSource implements autorelay.PeerSource, yielding healthy relays by RTT.
+func (p *Pool) PeerSource(ctx context.Context, num int) <-chan peer.AddrInfo {
+	ranked := p.Ranked()
+	if len(ranked) > num {
+		ranked = ranked[:num]
+	}
+	ch := make(chan peer.AddrInfo, len(ranked))
+	for _, ai := range ranked {
+		ch <- ai
+	}
+	close(ch)
+	return ch
+}
@@ -7,64 +7,113 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
 )
 
-const keyFileName = "relay.key"
+const (
+	keyFileName  = "relay.key"
+	addrFileName = "relay.addr"
+)
+
+// Config describes how a relay host is built.
+type Config struct {
+	// DataDir holds relay.key and relay.addr.
+	DataDir string
+	// ListenAddrs are the multiaddrs the relay listens on (TCP, QUIC, WebSocket...).
+	ListenAddrs []string
+	// Resources are the limits applied to the circuit relay service.
+	Resources relayv2.Resources
+	// ACL, if set, gates connections and reservations.
+	ACL *ACL
+}
+
+// DefaultListenAddrs listens on TCP, QUIC and WebSocket on all interfaces.
+var DefaultListenAddrs = []string{
+	"/ip4/0.0.0.0/tcp/4001",
+	"/ip4/0.0.0.0/udp/4001/quic-v1",
+	"/ip4/0.0.0.0/tcp/4002/ws",
+}
+
+// DefaultConfig returns a Config using dataDir, the default listen addresses and
+// the libp2p default relay resources.
+func DefaultConfig(dataDir string) Config {
+	return Config{
+		DataDir:     dataDir,
+		ListenAddrs: DefaultListenAddrs,
+		Resources:   relayv2.DefaultResources(),
+	}
+}
 
 // LoadOrCreateRelayHost loads a persisted private key or creates a new one, returning a libp2p host.
-func LoadOrCreateRelayHost(ctx context.Context, dataDir string, listenAddr string) (host.Host, error) {
-	keyPath := filepath.Join(dataDir, keyFileName)
-	var priv crypto.PrivKey
-	if b, err := os.ReadFile(keyPath); err == nil {
-		// decode base64
-		keyBytes, err := base64.StdEncoding.DecodeString(string(b))
-		if err != nil {
-			return nil, fmt.Errorf("failed to decode relay key: %w", err)
-		}
-		priv, err = crypto.UnmarshalPrivateKey(keyBytes)
-		if err != nil {
-			return nil, fmt.Errorf("failed to unmarshal relay key: %w", err)
-		}
-	} else {
-		// generate new key and persist
-		var err error
-		priv, _, err = crypto.GenerateEd25519Key(rand.Reader)
-		if err != nil {
-			return nil, fmt.Errorf("failed to generate relay key: %w", err)
-		}
-		keyBytes, err := crypto.MarshalPrivateKey(priv)
-		if err != nil {
-			return nil, fmt.Errorf("failed to marshal relay key: %w", err)
-		}
-		if err := os.MkdirAll(dataDir, 0700); err != nil {
-			return nil, err
-		}
-		if err := os.WriteFile(keyPath, []byte(base64.StdEncoding.EncodeToString(keyBytes)), 0600); err != nil {
-			return nil, fmt.Errorf("failed to write relay key: %w", err)
-		}
+func LoadOrCreateRelayHost(ctx context.Context, cfg Config) (host.Host, error) {
+	priv, err := LoadOrCreateKey(cfg.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	return newHost(ctx, priv, cfg)
+}
+
+// LoadRelayHost loads a persisted private key and returns a libp2p host. Fails if the key does not exist.
+func LoadRelayHost(ctx context.Context, cfg Config) (host.Host, error) {
+	priv, err := loadKey(cfg.DataDir)
+	if err != nil {
+		return nil, err
 	}
+	return newHost(ctx, priv, cfg)
+}
+
+// LoadOrCreateKey returns the relay private key persisted in dataDir, creating it if needed.
+func LoadOrCreateKey(dataDir string) (crypto.PrivKey, error) {
+	priv, err := loadKey(dataDir)
+	if os.IsNotExist(err) {
+		return createKey(dataDir)
+	}
+	return priv, err
+}
 
-	h, err := libp2p.New(
+func newHost(ctx context.Context, priv crypto.PrivKey, cfg Config) (host.Host, error) {
+	relayOpts := []relayv2.Option{relayv2.WithResources(cfg.Resources)}
+	opts := []libp2p.Option{
 		libp2p.Identity(priv),
-		libp2p.ListenAddrStrings(listenAddr),
+		libp2p.ListenAddrStrings(cfg.ListenAddrs...),
+		libp2p.EnableNATService(),
+		libp2p.NATPortMap(),
 		libp2p.EnableRelay(),
-	)
+		// A dedicated relay serves reservations without waiting for AutoNAT
+		libp2p.ForceReachabilityPublic(),
+	}
+	if cfg.ACL != nil {
+		relayOpts = append(relayOpts, relayv2.WithACL(cfg.ACL))
+		opts = append(opts,
+			libp2p.ConnectionGater(cfg.ACL),
+			libp2p.BandwidthReporter(cfg.ACL.BandwidthCounter()),
+		)
+	}
+	opts = append(opts, libp2p.EnableRelayService(relayOpts...))
+
+	h, err := libp2p.New(opts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create relay host: %w", err)
 	}
+	if cfg.ACL != nil {
+		cfg.ACL.Attach(ctx, h)
+		ServeInvites(h, cfg.ACL)
+	}
 	return h, nil
 }
 
-// LoadRelayHost loads a persisted private key and returns a libp2p host. Fails if the key does not exist.
-func LoadRelayHost(ctx context.Context, dataDir string, listenAddr string) (host.Host, error) {
+func loadKey(dataDir string) (crypto.PrivKey, error) {
 	keyPath := filepath.Join(dataDir, keyFileName)
 	b, err := os.ReadFile(keyPath)
 	if err != nil {
-		return nil, fmt.Errorf("relay key not found at %s: %w", keyPath, err)
+		return nil, err
 	}
 	// decode base64
 	keyBytes, err := base64.StdEncoding.DecodeString(string(b))
@@ -75,14 +124,74 @@ func LoadRelayHost(ctx context.Context, dataDir string, listenAddr string) (host
 	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal relay key: %w", err)
 	}
+	return priv, nil
+}
 
-	h, err := libp2p.New(
-		libp2p.Identity(priv),
-		libp2p.ListenAddrStrings(listenAddr),
-		libp2p.EnableRelay(),
-	)
+func createKey(dataDir string) (crypto.PrivKey, error) {
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create relay host: %w", err)
+		return nil, fmt.Errorf("failed to generate relay key: %w", err)
 	}
-	return h, nil
+	keyBytes, err := crypto.MarshalPrivateKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal relay key: %w", err)
+	}
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return nil, err
+	}
+	keyPath := filepath.Join(dataDir, keyFileName)
+	if err := os.WriteFile(keyPath, []byte(base64.StdEncoding.EncodeToString(keyBytes)), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write relay key: %w", err)
+	}
+	return priv, nil
+}
+
+// FullAddrs returns the host's addresses with the /p2p component appended,
+// public addresses first.
+func FullAddrs(h host.Host) []ma.Multiaddr {
+	p2p := ma.StringCast("/p2p/" + h.ID().String())
+	var public, private []ma.Multiaddr
+	for _, addr := range h.Addrs() {
+		if manet.IsPublicAddr(addr) {
+			public = append(public, addr.Encapsulate(p2p))
+		} else {
+			private = append(private, addr.Encapsulate(p2p))
+		}
+	}
+	return append(public, private...)
+}
+
+// WriteAddrs persists every address of h to relay.addr in dataDir, one per line.
+func WriteAddrs(h host.Host, dataDir string) (string, error) {
+	addrs := FullAddrs(h)
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("no addresses found for host")
+	}
+	lines := make([]string, len(addrs))
+	for i, a := range addrs {
+		lines[i] = a.String()
+	}
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dataDir, addrFileName)
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return "", fmt.Errorf("failed to write relay address: %w", err)
+	}
+	return path, nil
+}
+
+// ReadAddrs reads the relay addresses persisted by WriteAddrs.
+func ReadAddrs(dataDir string) ([]string, error) {
+	b, err := os.ReadFile(filepath.Join(dataDir, addrFileName))
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			addrs = append(addrs, line)
+		}
+	}
+	return addrs, nil
 }
@@ -0,0 +1,127 @@
+package rendezvous
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+
+	"shadow/internal/logging"
+)
+
+// Client talks to a single rendezvous point.
+type Client struct {
+	host host.Host
+	rp   peer.ID
+}
+
+// NewClient returns a client for the rendezvous server rp.
+func NewClient(h host.Host, rp peer.ID) *Client {
+	return &Client{host: h, rp: rp}
+}
+
+// Point returns the peer ID of the rendezvous server.
+func (c *Client) Point() peer.ID {
+	return c.rp
+}
+
+func (c *Client) roundTrip(ctx context.Context, req request) (*response, error) {
+	s, err := c.host.NewStream(ctx, c.rp, Protocol)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open rendezvous stream: %w", err)
+	}
+	defer s.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		s.SetDeadline(dl)
+	} else {
+		s.SetDeadline(time.Now().Add(streamTimeout))
+	}
+	if err := json.NewEncoder(s).Encode(req); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	var resp response
+	if err := json.NewDecoder(s).Decode(&resp); err != nil {
+		s.Reset()
+		return nil, fmt.Errorf("failed to read rendezvous response: %w", err)
+	}
+	if !resp.OK {
+		return nil, fmt.Errorf("rendezvous %s failed: %s", req.Type, resp.Error)
+	}
+	return &resp, nil
+}
+
+// Register advertises this host under ns for ttl and returns the TTL granted by the server.
+func (c *Client) Register(ctx context.Context, ns string, ttl time.Duration) (time.Duration, error) {
+	req := request{Type: "register", Namespace: ns, TTL: int64(ttl / time.Second)}
+	for _, a := range c.host.Addrs() {
+		req.Addrs = append(req.Addrs, a.String())
+	}
+	resp, err := c.roundTrip(ctx, req)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(resp.TTL) * time.Second, nil
+}
+
+// Unregister removes this host from ns.
+func (c *Client) Unregister(ctx context.Context, ns string) error {
+	_, err := c.roundTrip(ctx, request{Type: "unregister", Namespace: ns})
+	return err
+}
+
+// Discover returns up to limit peers registered under ns (0 for the server maximum).
+func (c *Client) Discover(ctx context.Context, ns string, limit int) ([]peer.AddrInfo, error) {
+	resp, err := c.roundTrip(ctx, request{Type: "discover", Namespace: ns, Limit: limit})
+	if err != nil {
+		return nil, err
+	}
+	var out []peer.AddrInfo
+	for _, r := range resp.Registrations {
+		id, err := peer.Decode(r.Peer)
+		if err != nil {
+			continue
+		}
+		ai := peer.AddrInfo{ID: id}
+		for _, a := range r.Addrs {
+			if maddr, err := ma.NewMultiaddr(a); err == nil {
+				ai.Addrs = append(ai.Addrs, maddr)
+			}
+		}
+		out = append(out, ai)
+	}
+	return out, nil
+}
+
+// KeepRegistered registers under each namespace and refreshes the
+// registrations before they expire, until ctx is cancelled.
+func (c *Client) KeepRegistered(ctx context.Context, ttl time.Duration, namespaces ...string) {
+	for {
+		next := ttl
+		for _, ns := range namespaces {
+			granted, err := c.Register(ctx, ns, ttl)
+			if err != nil {
+				logging.Println("Rendezvous register failed:", err)
+				next = time.Minute
+				continue
+			}
+			if granted < next {
+				next = granted
+			}
+		}
+		select {
+		case <-ctx.Done():
+			unregCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			for _, ns := range namespaces {
+				c.Unregister(unregCtx, ns)
+			}
+			cancel()
+			return
+		case <-time.After(next * 3 / 4):
+		}
+	}
+}
@@ -0,0 +1,228 @@
+// rendezvous.go
+package rendezvous
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// Protocol is the stream protocol spoken between rendezvous clients and the server.
+const Protocol = "/shadow/rendezvous/1.0.0"
+
+const (
+	DefaultTTL    = 2 * time.Hour
+	MaxTTL        = 72 * time.Hour
+	MaxNamespace  = 256
+	MaxDiscover   = 1000
+	maxPerPeer    = 64
+	streamTimeout = 30 * time.Second
+)
+
+type request struct {
+	Type      string   `json:"type"` // register, unregister, discover
+	Namespace string   `json:"ns"`
+	TTL       int64    `json:"ttl,omitempty"` // seconds
+	Addrs     []string `json:"addrs,omitempty"`
+	Limit     int      `json:"limit,omitempty"`
+}
+
+type response struct {
+	OK            bool           `json:"ok"`
+	Error         string         `json:"error,omitempty"`
+	TTL           int64          `json:"ttl,omitempty"`
+	Registrations []registration `json:"registrations,omitempty"`
+}
+
+type registration struct {
+	Peer  string   `json:"peer"`
+	Addrs []string `json:"addrs"`
+	TTL   int64    `json:"ttl"`
+}
+
+type entry struct {
+	addrs   []ma.Multiaddr
+	expires time.Time
+}
+
+// Service is the rendezvous server. Registrations live in memory and expire after their TTL.
+type Service struct {
+	host      host.Host
+	authorize func(peer.ID) bool
+
+	mu  sync.Mutex
+	nss map[string]map[peer.ID]entry
+}
+
+// NewService registers the rendezvous handler on h. If authorize is non-nil,
+// only peers it accepts may register.
+func NewService(h host.Host, authorize func(peer.ID) bool) *Service {
+	s := &Service{
+		host:      h,
+		authorize: authorize,
+		nss:       map[string]map[peer.ID]entry{},
+	}
+	h.SetStreamHandler(Protocol, s.handleStream)
+	return s
+}
+
+// Close unregisters the handler.
+func (s *Service) Close() {
+	s.host.RemoveStreamHandler(Protocol)
+}
+
+// Namespaces returns the number of live registrations per namespace.
+func (s *Service) Namespaces() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gcLocked()
+	out := make(map[string]int, len(s.nss))
+	for ns, regs := range s.nss {
+		out[ns] = len(regs)
+	}
+	return out
+}
+
+func (s *Service) handleStream(str network.Stream) {
+	defer str.Close()
+	str.SetDeadline(time.Now().Add(streamTimeout))
+	remote := str.Conn().RemotePeer()
+
+	dec := json.NewDecoder(str)
+	enc := json.NewEncoder(str)
+	for {
+		var req request
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		var resp response
+		switch req.Type {
+		case "register":
+			resp = s.register(remote, req)
+		case "unregister":
+			resp = s.unregister(remote, req)
+		case "discover":
+			resp = s.discover(req)
+		default:
+			resp = response{Error: fmt.Sprintf("unknown request type %q", req.Type)}
+		}
+		if err := enc.Encode(resp); err != nil {
+			str.Reset()
+			return
+		}
+	}
+}
+
+func validNamespace(ns string) error {
+	if ns == "" || len(ns) > MaxNamespace {
+		return fmt.Errorf("invalid namespace")
+	}
+	return nil
+}
+
+func (s *Service) register(p peer.ID, req request) response {
+	if err := validNamespace(req.Namespace); err != nil {
+		return response{Error: err.Error()}
+	}
+	if s.authorize != nil && !s.authorize(p) {
+		return response{Error: "not authorized"}
+	}
+	// A namespace named after a peer belongs to that peer
+	if id, err := peer.Decode(req.Namespace); err == nil && id != p {
+		return response{Error: "namespace of another peer"}
+	}
+	ttl := time.Duration(req.TTL) * time.Second
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	if ttl > MaxTTL {
+		ttl = MaxTTL
+	}
+
+	var addrs []ma.Multiaddr
+	for _, a := range req.Addrs {
+		if maddr, err := ma.NewMultiaddr(a); err == nil {
+			addrs = append(addrs, maddr)
+		}
+	}
+	// The registrant is reachable through us even without public addresses
+	addrs = append(addrs, ma.StringCast("/p2p/"+s.host.ID().String()+"/p2p-circuit"))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gcLocked()
+	count := 0
+	for _, regs := range s.nss {
+		if _, ok := regs[p]; ok {
+			count++
+		}
+	}
+	regs, ok := s.nss[req.Namespace]
+	if !ok {
+		regs = map[peer.ID]entry{}
+		s.nss[req.Namespace] = regs
+	}
+	if _, exists := regs[p]; !exists && count >= maxPerPeer {
+		return response{Error: "too many registrations"}
+	}
+	regs[p] = entry{addrs: addrs, expires: time.Now().Add(ttl)}
+	return response{OK: true, TTL: int64(ttl / time.Second)}
+}
+
+func (s *Service) unregister(p peer.ID, req request) response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if regs, ok := s.nss[req.Namespace]; ok {
+		delete(regs, p)
+		if len(regs) == 0 {
+			delete(s.nss, req.Namespace)
+		}
+	}
+	return response{OK: true}
+}
+
+func (s *Service) discover(req request) response {
+	if err := validNamespace(req.Namespace); err != nil {
+		return response{Error: err.Error()}
+	}
+	limit := req.Limit
+	if limit <= 0 || limit > MaxDiscover {
+		limit = MaxDiscover
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gcLocked()
+	resp := response{OK: true}
+	now := time.Now()
+	for p, e := range s.nss[req.Namespace] {
+		if len(resp.Registrations) >= limit {
+			break
+		}
+		r := registration{Peer: p.String(), TTL: int64(e.expires.Sub(now) / time.Second)}
+		for _, a := range e.addrs {
+			r.Addrs = append(r.Addrs, a.String())
+		}
+		resp.Registrations = append(resp.Registrations, r)
+	}
+	return resp
+}
+
+func (s *Service) gcLocked() {
+	now := time.Now()
+	for ns, regs := range s.nss {
+		for p, e := range regs {
+			if now.After(e.expires) {
+				delete(regs, p)
+			}
+		}
+		if len(regs) == 0 {
+			delete(s.nss, ns)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package rendezvous
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+func TestPeerNamespace(t *testing.T) {
+	mn := mocknet.New()
+	defer mn.Close()
+	rp, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mallory, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+	s := NewService(rp, nil)
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ns := alice.ID().String()
+	if _, err := NewClient(mallory, rp.ID()).Register(ctx, ns, time.Minute); err == nil {
+		t.Fatal("registered in the namespace of another peer")
+	}
+	if _, err := NewClient(mallory, rp.ID()).Register(ctx, "lobby", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(alice, rp.ID())
+	if _, err := c.Register(ctx, ns, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	found, err := c.Discover(ctx, ns, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].ID != alice.ID() {
+		t.Fatalf("found %v", found)
+	}
+}
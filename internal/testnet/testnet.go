@@ -0,0 +1,353 @@
+// Package testnet runs shadow nodes in process on a libp2p mocknet: a relay
+// with its rendezvous point, mailboxes and onion forwarding, and any number of nodes forming a DHT, with
+// configurable link latency and partitions. Nothing touches the real network.
+//
+// Mocknet has no transports, so circuit relaying, hole punching and AutoNAT do
+// not happen: every node is linked to every other and declared publicly
+// reachable, which puts its DHT in server mode.
+package testnet
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+	ma "github.com/multiformats/go-multiaddr"
+
+	"shadow/internal/chat"
+	"shadow/internal/identity"
+	"shadow/internal/mailbox"
+	"shadow/internal/node"
+	"shadow/internal/onion"
+	"shadow/internal/rendezvous"
+)
+
+// bootstrapCount is how many of the first nodes later nodes bootstrap from,
+// standing in for dht.DefaultBootstrapPeers.
+const bootstrapCount = 3
+
+// Option configures a Network.
+type Option func(*config)
+
+type config struct {
+	latency  time.Duration
+	noRelay  bool
+	nodeOpts []node.Option
+}
+
+// WithLatency delays every message on every link by d.
+func WithLatency(d time.Duration) Option {
+	return func(c *config) {
+		c.latency = d
+	}
+}
+
+// WithoutRelay starts the nodes relay-less, without a rendezvous point or mailboxes.
+func WithoutRelay() Option {
+	return func(c *config) {
+		c.noRelay = true
+	}
+}
+
+// WithNodeOptions passes opts to every node started on the network.
+func WithNodeOptions(opts ...node.Option) Option {
+	return func(c *config) {
+		c.nodeOpts = append(c.nodeOpts, opts...)
+	}
+}
+
+// Network is a set of in-process nodes on one mocknet.
+type Network struct {
+	Mocknet mocknet.Mocknet
+	// Relay is the relay host every node uses, nil WithoutRelay. It serves the
+	// rendezvous point, the mailboxes and onion forwarding.
+	Relay      host.Host
+	Rendezvous *rendezvous.Service
+	Mailbox    *mailbox.Service
+	Onion      *onion.Service
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	nodeOpts []node.Option
+
+	mu    sync.Mutex
+	peers []*Peer
+	addrs int
+	cut   map[[2]peer.ID]bool
+}
+
+// Peer is a node of the network with its messaging service.
+type Peer struct {
+	Name string
+	Node *node.Node
+	Chat *chat.Service
+
+	cancel context.CancelFunc
+}
+
+// ID returns the peer ID of p.
+func (p *Peer) ID() peer.ID {
+	return p.Node.Host.ID()
+}
+
+// AddrInfo returns the mocknet address of p.
+func (p *Peer) AddrInfo() peer.AddrInfo {
+	return peer.AddrInfo{ID: p.ID(), Addrs: p.Node.Host.Addrs()}
+}
+
+// New starts a relay and n nodes named node1 to nodeN. Close stops them.
+func New(ctx context.Context, n int, opts ...Option) (*Network, error) {
+	var cfg config
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	mn := mocknet.New()
+	mn.SetLinkDefaults(mocknet.LinkOptions{Latency: cfg.latency})
+	net := &Network{
+		Mocknet:  mn,
+		ctx:      ctx,
+		cancel:   cancel,
+		nodeOpts: cfg.nodeOpts,
+		cut:      map[[2]peer.ID]bool{},
+	}
+
+	if !cfg.noRelay {
+		priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+		if err != nil {
+			net.Close()
+			return nil, err
+		}
+		if net.Relay, err = net.addHost(priv); err != nil {
+			net.Close()
+			return nil, fmt.Errorf("failed to create relay host: %w", err)
+		}
+		// Nodes ping relays to rank them
+		ping.NewPingService(net.Relay)
+		net.Rendezvous = rendezvous.NewService(net.Relay, nil)
+		net.Mailbox = mailbox.NewService(net.Relay, nil)
+		if net.Onion, err = onion.NewService(net.Relay, nil); err != nil {
+			net.Close()
+			return nil, err
+		}
+	}
+
+	for i := 1; i <= n; i++ {
+		if _, err := net.AddPeer(ctx, fmt.Sprintf("node%d", i)); err != nil {
+			net.Close()
+			return nil, err
+		}
+	}
+	return net, nil
+}
+
+// addHost adds a host with the next private address, linked to every host
+// already on the mocknet.
+func (net *Network) addHost(priv crypto.PrivKey) (host.Host, error) {
+	net.mu.Lock()
+	net.addrs++
+	i := net.addrs
+	net.mu.Unlock()
+	addr, err := ma.NewMultiaddr(fmt.Sprintf("/ip4/10.%d.%d.%d/tcp/4001", i>>16&0xff, i>>8&0xff, i&0xff))
+	if err != nil {
+		return nil, err
+	}
+	h, err := net.Mocknet.AddPeer(priv, addr)
+	if err != nil {
+		return nil, err
+	}
+	for _, other := range net.Mocknet.Peers() {
+		if other == h.ID() {
+			continue
+		}
+		if _, err := net.Mocknet.LinkPeers(h.ID(), other); err != nil {
+			return nil, err
+		}
+	}
+	// Stands in for AutoNAT, which needs real transports; the emitter is
+	// stateful so the DHT started later still sees it
+	em, err := h.EventBus().Emitter(new(event.EvtLocalReachabilityChanged), eventbus.Stateful)
+	if err != nil {
+		return nil, err
+	}
+	defer em.Close()
+	if err := em.Emit(event.EvtLocalReachabilityChanged{Reachability: network.ReachabilityPublic}); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// AddPeer starts a node announcing name, bootstrapping from the relay and the
+// first nodes of the network.
+func (net *Network) AddPeer(ctx context.Context, name string) (*Peer, error) {
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	id, err := identity.New(priv, name)
+	if err != nil {
+		return nil, err
+	}
+	return net.AddIdentity(ctx, id)
+}
+
+// AddIdentity is AddPeer with an existing identity, such as one returned by
+// a key rotation.
+func (net *Network) AddIdentity(ctx context.Context, id *identity.Identity) (*Peer, error) {
+	name := id.Username()
+	var relays []string
+	if net.Relay != nil {
+		for _, a := range net.Relay.Addrs() {
+			relays = append(relays, fmt.Sprintf("%s/p2p/%s", a, net.Relay.ID()))
+		}
+	}
+	var bootstrap []peer.AddrInfo
+	for _, p := range net.Peers() {
+		if len(bootstrap) == bootstrapCount {
+			break
+		}
+		bootstrap = append(bootstrap, p.AddrInfo())
+	}
+
+	pctx, cancel := context.WithCancel(net.ctx)
+	opts := append([]node.Option{
+		node.WithHost(func(id *identity.Identity) (host.Host, error) {
+			return net.addHost(id.PrivateKey())
+		}),
+		node.WithBootstrapPeers(bootstrap),
+	}, net.nodeOpts...)
+	n, err := node.NewNode(pctx, id, relays, opts...)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to start %s: %w", name, err)
+	}
+	c, err := chat.New(pctx, n)
+	if err != nil {
+		cancel()
+		n.Shutdown(ctx)
+		return nil, fmt.Errorf("failed to start messaging on %s: %w", name, err)
+	}
+	p := &Peer{Name: name, Node: n, Chat: c, cancel: cancel}
+	net.mu.Lock()
+	net.peers = append(net.peers, p)
+	net.mu.Unlock()
+	return p, nil
+}
+
+// Peers returns the nodes in the order they were added.
+func (net *Network) Peers() []*Peer {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	return append([]*Peer(nil), net.peers...)
+}
+
+// Peer returns the node announcing name, or nil.
+func (net *Network) Peer(name string) *Peer {
+	for _, p := range net.Peers() {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// RemovePeer shuts p down, as a node going offline would.
+func (net *Network) RemovePeer(p *Peer) error {
+	net.mu.Lock()
+	for i, q := range net.peers {
+		if q == p {
+			net.peers = append(net.peers[:i], net.peers[i+1:]...)
+			break
+		}
+	}
+	net.mu.Unlock()
+	p.Chat.Close()
+	p.cancel()
+	return p.Node.Shutdown(context.Background())
+}
+
+// SetLatency changes the latency of the link between a and b.
+func (net *Network) SetLatency(a, b peer.ID, d time.Duration) error {
+	links := net.Mocknet.LinksBetweenPeers(a, b)
+	if len(links) == 0 {
+		return fmt.Errorf("%s and %s are not linked", a, b)
+	}
+	for _, l := range links {
+		l.SetOptions(mocknet.LinkOptions{Latency: d})
+	}
+	return nil
+}
+
+// Partition splits the network: peers in different groups are disconnected
+// and can no longer dial each other. Peers in no group, the relay included
+// unless listed, stay reachable from every group.
+func (net *Network) Partition(groups ...[]peer.ID) error {
+	for i, g := range groups {
+		for _, other := range groups[i+1:] {
+			for _, a := range g {
+				for _, b := range other {
+					if err := net.unlink(a, b); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (net *Network) unlink(a, b peer.ID) error {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	if net.cut[[2]peer.ID{a, b}] || net.cut[[2]peer.ID{b, a}] {
+		return nil
+	}
+	if err := net.Mocknet.UnlinkPeers(a, b); err != nil {
+		return fmt.Errorf("failed to unlink %s and %s: %w", a, b, err)
+	}
+	// Unlinking only prevents new connections
+	net.Mocknet.DisconnectPeers(a, b)
+	net.cut[[2]peer.ID{a, b}] = true
+	return nil
+}
+
+// Heal relinks every pair of peers split by Partition. The nodes reconnect on
+// their own.
+func (net *Network) Heal() error {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	for pair := range net.cut {
+		if _, err := net.Mocknet.LinkPeers(pair[0], pair[1]); err != nil {
+			return fmt.Errorf("failed to link %s and %s: %w", pair[0], pair[1], err)
+		}
+		delete(net.cut, pair)
+	}
+	return nil
+}
+
+// Connect dials b from a, e.g. to give a node a neighbour after a Heal.
+func (net *Network) Connect(ctx context.Context, a, b *Peer) error {
+	return a.Node.Host.Connect(ctx, b.AddrInfo())
+}
+
+// Close stops every node, the relay and the mocknet.
+func (net *Network) Close() error {
+	for _, p := range net.Peers() {
+		net.RemovePeer(p)
+	}
+	if net.Onion != nil {
+		net.Onion.Close()
+	}
+	net.cancel()
+	return net.Mocknet.Close()
+}
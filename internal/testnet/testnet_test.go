@@ -0,0 +1,453 @@
+package testnet
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"shadow/internal/chat"
+	"shadow/internal/identity"
+	"shadow/internal/node"
+)
+
+const testTimeout = 20 * time.Second
+
+func start(t *testing.T, n int, opts ...Option) *Network {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	net, err := New(ctx, n, opts...)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		net.Close()
+		cancel()
+	})
+	return net
+}
+
+// receive subscribes to p's messages; next returns the next one matching keep.
+func receive(t *testing.T, p *Peer) (next func(keep func(chat.Message) bool) chat.Message) {
+	t.Helper()
+	msgs, unsub := p.Chat.Subscribe()
+	t.Cleanup(unsub)
+	return func(keep func(chat.Message) bool) chat.Message {
+		t.Helper()
+		timeout := time.After(testTimeout)
+		for {
+			select {
+			case m := <-msgs:
+				if keep(m) {
+					return m
+				}
+			case <-timeout:
+				t.Fatalf("%s received no message", p.Name)
+				return chat.Message{}
+			}
+		}
+	}
+}
+
+// eventually polls cond until it holds.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestDirectMessage(t *testing.T) {
+	net := start(t, 3, WithLatency(5*time.Millisecond))
+	alice, carol := net.Peer("node1"), net.Peer("node3")
+	next := receive(t, carol)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	sent, err := alice.Chat.Send(ctx, carol.ID(), "hello carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := next(func(m chat.Message) bool { return m.Room == "" })
+	if got.ID != sent.ID || got.Text != "hello carol" || got.From != alice.ID() || got.Name != "node1" {
+		t.Fatalf("got %+v, want %+v", got, sent)
+	}
+
+	// The reply goes back over the same connection
+	next = receive(t, alice)
+	if _, err := carol.Chat.Send(ctx, alice.ID(), "hi"); err != nil {
+		t.Fatal(err)
+	}
+	if got := next(func(m chat.Message) bool { return m.Room == "" }); got.Text != "hi" || got.From != carol.ID() {
+		t.Fatalf("got %+v", got)
+	}
+}
+
+func TestRoom(t *testing.T) {
+	net := start(t, 4)
+	peers := net.Peers()
+	for _, p := range peers {
+		if err := p.Chat.JoinRoom("lobby"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eventually(t, "room mesh", func() bool {
+		for _, p := range peers {
+			if members, _ := p.Chat.RoomPeers("lobby"); len(members) < len(peers)-1 {
+				return false
+			}
+		}
+		return true
+	})
+	// Peers are listed once their subscriptions arrive; give gossipsub a few
+	// heartbeats to set up the mesh before publishing
+	time.Sleep(3 * pubsub.GossipSubHeartbeatInterval)
+
+	var nexts []func(func(chat.Message) bool) chat.Message
+	for _, p := range peers[1:] {
+		nexts = append(nexts, receive(t, p))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if _, err := peers[0].Chat.SendRoom(ctx, "lobby", "hello room"); err != nil {
+		t.Fatal(err)
+	}
+	for i, next := range nexts {
+		got := next(func(m chat.Message) bool { return m.Room == "lobby" && m.From == peers[0].ID() })
+		if got.Text != "hello room" || got.Name != "node1" {
+			t.Fatalf("%s got %+v", peers[i+1].Name, got)
+		}
+	}
+
+	// Leaving stops delivery to that peer only
+	if err := peers[1].Chat.LeaveRoom("lobby"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peers[1].Chat.SendRoom(ctx, "lobby", "gone"); err == nil {
+		t.Fatal("sent to a room that was left")
+	}
+}
+
+func TestNameResolution(t *testing.T) {
+	net := start(t, 5, WithoutRelay())
+	alice, bob, eve := net.Peer("node1"), net.Peer("node2"), net.Peer("node5")
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	// Peer IDs and zbase32 IDs resolve without the network
+	for _, ref := range []string{alice.ID().String(), "z:" + identity.PeerIDToZbase32(alice.ID())} {
+		if p, err := bob.Chat.ResolvePeer(ref); err != nil || p != alice.ID() {
+			t.Fatalf("ResolvePeer(%q) = %s, %v", ref, p, err)
+		}
+	}
+
+	// @name resolves once the peer announced its name in a message
+	if _, err := bob.Chat.ResolvePeer("@node1"); err == nil {
+		t.Fatal("resolved a name never announced")
+	}
+	next := receive(t, bob)
+	if _, err := alice.Chat.Send(ctx, bob.ID(), "hi"); err != nil {
+		t.Fatal(err)
+	}
+	next(func(m chat.Message) bool { return m.From == alice.ID() })
+	if p, err := bob.Chat.ResolvePeer("@node1"); err != nil || p != alice.ID() {
+		t.Fatalf("ResolvePeer(@node1) = %s, %v", p, err)
+	}
+
+	// A name two contacts go by is not guessed
+	bob.Node.RememberPeer(eve.ID())
+	bob.Node.SetPeerName(eve.ID(), "node1")
+	if p, err := bob.Chat.ResolvePeer("@node1"); err == nil {
+		t.Fatalf("ambiguous name resolved to %s", p)
+	}
+
+	// Addresses of a peer we forgot come from the DHT, once the routing
+	// tables have filled
+	eve.Node.Host.Network().ClosePeer(alice.ID())
+	eve.Node.Host.Peerstore().ClearAddrs(alice.ID())
+	eventually(t, "DHT lookup", func() bool {
+		ai, err := eve.Node.FindPeer(ctx, alice.ID())
+		return err == nil && len(ai.Addrs) > 0
+	})
+	if _, err := eve.Chat.Send(ctx, alice.ID(), "found you"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRendezvous(t *testing.T) {
+	net := start(t, 3)
+	alice := net.Peer("node1")
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	eventually(t, "rendezvous registrations", func() bool {
+		found, err := alice.Node.DiscoverPeers(ctx)
+		return err == nil && len(found) == 2
+	})
+}
+
+func TestUnknownPeer(t *testing.T) {
+	net := start(t, 3)
+	alice := net.Peer("node1")
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stranger, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.Chat.Send(ctx, stranger, "anyone there?"); !errors.Is(err, node.ErrPeerNotFound) {
+		t.Fatalf("got %v, want %v", err, node.ErrPeerNotFound)
+	}
+}
+
+func TestPartition(t *testing.T) {
+	net := start(t, 2, WithoutRelay())
+	alice, bob := net.Peer("node1"), net.Peer("node2")
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	if err := net.Partition([]peer.ID{alice.ID()}, []peer.ID{bob.ID()}); err != nil {
+		t.Fatal(err)
+	}
+	if alice.Node.Host.Network().Connectedness(bob.ID()) == network.Connected {
+		t.Fatal("still connected across the partition")
+	}
+	sctx, scancel := context.WithTimeout(ctx, 2*time.Second)
+	_, err := alice.Chat.Send(sctx, bob.ID(), "lost")
+	scancel()
+	if err == nil {
+		t.Fatal("message crossed the partition")
+	}
+
+	if err := net.Heal(); err != nil {
+		t.Fatal(err)
+	}
+	// Bob keeps redialling alice, his bootstrap peer
+	eventually(t, "reconnection", func() bool {
+		return alice.Node.Host.Network().Connectedness(bob.ID()) == network.Connected
+	})
+	next := receive(t, bob)
+	if _, err := alice.Chat.Send(ctx, bob.ID(), "back"); err != nil {
+		t.Fatal(err)
+	}
+	if got := next(func(m chat.Message) bool { return true }); got.Text != "back" {
+		t.Fatalf("got %+v", got)
+	}
+}
+
+func TestOfflineMailbox(t *testing.T) {
+	net := start(t, 2)
+	alice, bob := net.Peer("node1"), net.Peer("node2")
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	next := receive(t, bob)
+
+	// Bob tells alice where his mailbox is in his messages, once it is
+	// registered at the relay. Until then sealed-sender messages go directly.
+	alice.Chat.SetSealedSender(true)
+	eventually(t, "mailbox route", func() bool {
+		if _, err := bob.Chat.Send(ctx, alice.ID(), "hi"); err != nil {
+			t.Fatal(err)
+		}
+		m, err := alice.Chat.Send(ctx, bob.ID(), "sealed")
+		return err == nil && m.Mailbox
+	})
+	got := next(func(m chat.Message) bool { return m.Mailbox })
+	if got.From != alice.ID() || got.Text != "sealed" {
+		t.Fatalf("got %+v", got)
+	}
+	if net.Mailbox.Pending(bob.ID()) != 0 {
+		t.Fatal("fetched message left in the mailbox")
+	}
+
+	// Both still reach the relay, not each other
+	alice.Chat.SetSealedSender(false)
+	if err := net.Partition([]peer.ID{alice.ID()}, []peer.ID{bob.ID()}); err != nil {
+		t.Fatal(err)
+	}
+	sctx, scancel := context.WithTimeout(ctx, 5*time.Second)
+	m, err := alice.Chat.Send(sctx, bob.ID(), "are you there?")
+	scancel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Mailbox {
+		t.Fatal("message crossed the partition")
+	}
+	got = next(func(m chat.Message) bool { return m.Text == "are you there?" })
+	if got.From != alice.ID() || !got.Mailbox {
+		t.Fatalf("got %+v", got)
+	}
+
+	// Bob cuts alice off his mailbox; her token is hers alone
+	if err := bob.Chat.RevokeMailbox(alice.ID()); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "revocation", func() bool {
+		sctx, scancel := context.WithTimeout(ctx, 5*time.Second)
+		defer scancel()
+		_, err := alice.Chat.Send(sctx, bob.ID(), "let me in")
+		return err != nil
+	})
+}
+
+func TestOnionMessage(t *testing.T) {
+	net := start(t, 2)
+	alice, bob := net.Peer("node1"), net.Peer("node2")
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	next := receive(t, bob)
+
+	// The only relay is bob's, which alice learns from his messages
+	if err := alice.Chat.SetOnionHops(bob.ID(), 1); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "onion path", func() bool {
+		if _, err := bob.Chat.Send(ctx, alice.ID(), "hi"); err != nil {
+			t.Fatal(err)
+		}
+		m, err := alice.Chat.Send(ctx, bob.ID(), "through the relay")
+		return err == nil && m.Onion
+	})
+	got := next(func(m chat.Message) bool { return true })
+	if got.From != alice.ID() || got.Text != "through the relay" || !got.Onion {
+		t.Fatalf("got %+v", got)
+	}
+	// Counted once the relay closed its stream to bob, maybe after he read it
+	eventually(t, "relay stats", func() bool {
+		fwd, _ := net.Onion.Stats()
+		return fwd > 0
+	})
+}
+
+func TestCoverTraffic(t *testing.T) {
+	net := start(t, 2)
+	alice, bob := net.Peer("node1"), net.Peer("node2")
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	next := receive(t, bob)
+	atAlice, unsub := alice.Chat.Subscribe()
+	defer unsub()
+
+	err := alice.Chat.SetCover(chat.Cover{Mode: chat.CoverConstant, Interval: 20 * time.Millisecond, Hops: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "covered message", func() bool {
+		if _, err := bob.Chat.Send(ctx, alice.ID(), "hi"); err != nil {
+			t.Fatal(err)
+		}
+		m, err := alice.Chat.Send(ctx, bob.ID(), "covered")
+		return err == nil && m.Onion
+	})
+	if got := next(func(m chat.Message) bool { return true }); got.Text != "covered" || !got.Onion {
+		t.Fatalf("got %+v", got)
+	}
+
+	// Dummies loop back to alice and vanish
+	eventually(t, "dummies", func() bool { return alice.Chat.CoverStats().Dummies >= 5 })
+	for {
+		select {
+		case m := <-atAlice:
+			if m.From != bob.ID() || m.Text != "hi" {
+				t.Fatalf("alice got %+v", m)
+			}
+			continue
+		default:
+		}
+		break
+	}
+	if err := alice.Chat.SetCover(chat.Cover{Mode: chat.CoverOff}); err != nil {
+		t.Fatal(err)
+	}
+	if st := alice.Chat.CoverStats(); st.Mode != chat.CoverOff {
+		t.Fatalf("cover still %s", st.Mode)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	net := start(t, 3)
+	alice, bob, carol := net.Peer("node1"), net.Peer("node2"), net.Peer("node3")
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	next := receive(t, alice)
+	for _, p := range []*Peer{alice, carol} {
+		if _, err := bob.Chat.Send(ctx, p.ID(), "hi"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	next(func(m chat.Message) bool { return m.Text == "hi" })
+	eventually(t, "carol's message", func() bool { return carol.Node.IsContact(bob.ID()) })
+	if err := alice.Chat.SetVerified(bob.ID(), true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Carol misses the push and has to find the record in the DHT
+	if err := net.Partition([]peer.ID{carol.ID()}, []peer.ID{bob.ID()}); err != nil {
+		t.Fatal(err)
+	}
+	id, rec, err := bob.Chat.Rotate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Old != bob.ID() || rec.New != id.PeerID() {
+		t.Fatalf("record %+v", rec)
+	}
+	if _, _, err := bob.Chat.Rotate(ctx); err == nil {
+		t.Fatal("rotated twice without a restart")
+	}
+
+	got := next(func(m chat.Message) bool { return m.KeyChange != nil })
+	if kc := got.KeyChange; kc.Old != bob.ID() || kc.New != id.PeerID() || !kc.Verified {
+		t.Fatalf("key change %+v", kc)
+	}
+	if got.Name != "node2" {
+		t.Fatalf("key change from %q", got.Name)
+	}
+	an := alice.Node
+	if an.IsContact(bob.ID()) || !an.IsContact(id.PeerID()) || an.IsVerified(id.PeerID()) {
+		t.Fatal("contact not moved to the new key, or verified without a check")
+	}
+
+	eventually(t, "succession lookup", func() bool {
+		carol.Chat.CheckSuccessions(ctx)
+		return carol.Node.Successor(bob.ID()) == id.PeerID()
+	})
+	if !carol.Node.IsContact(id.PeerID()) {
+		t.Fatal("carol did not move bob to the new key")
+	}
+
+	// Messages to the old key reach bob under the new one
+	if err := net.RemovePeer(bob); err != nil {
+		t.Fatal(err)
+	}
+	bob, err = net.AddIdentity(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextBob := receive(t, bob)
+	m, err := alice.Chat.Send(ctx, rec.Old, "new key?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.To != id.PeerID() {
+		t.Fatalf("sent to %s, want %s", m.To, id.PeerID())
+	}
+	if got := nextBob(func(m chat.Message) bool { return true }); got.From != alice.ID() || got.Text != "new key?" {
+		t.Fatalf("got %+v", got)
+	}
+}
@@ -0,0 +1,255 @@
+// Package bot runs command bots on the shadow network.
+//
+// A bot answers messages that start with its prefix ("!" by default) in
+// direct messages and joined rooms:
+//
+//	b := bot.New(client)
+//	b.Handle("deploy", "deploy <service>: start a deploy", func(ctx context.Context, m *bot.Context) error {
+//		return m.Replyf("deploying %s", m.Arg(0))
+//	})
+//	b.Run(ctx)
+//
+// Replies go through the same end-to-end encrypted messaging as any other
+// direct message; they are rate limited per conversation.
+package bot
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"shadow/internal/logging"
+	"shadow/pkg/shadow"
+)
+
+const (
+	defaultPrefix = "!"
+	// Default output rate per conversation: a burst of 5, then one reply a second.
+	defaultRate  = rate.Limit(1)
+	defaultBurst = 5
+	queueSize    = 32
+	workerIdle   = 5 * time.Minute
+	// maxConversations bounds the conversations whose state is kept; the
+	// least recently active are dropped first.
+	maxConversations = 1024
+)
+
+// Handler handles one command or message.
+type Handler func(ctx context.Context, m *Context) error
+
+type command struct {
+	help    string
+	handler Handler
+}
+
+// Bot dispatches incoming messages to handlers.
+type Bot struct {
+	client   *shadow.Client
+	prefix   string
+	limit    rate.Limit
+	burst    int
+	commands map[string]command
+	fallback Handler
+
+	mu      sync.Mutex
+	workers map[string]chan shadow.Message
+	convs   map[string]*conversation
+}
+
+// conversation is the per-DM or per-room state of the bot.
+type conversation struct {
+	state   *State
+	limiter *rate.Limiter
+	active  time.Time
+}
+
+// Option configures a Bot.
+type Option func(*Bot)
+
+// WithPrefix sets the command prefix, "!" by default.
+func WithPrefix(prefix string) Option {
+	return func(b *Bot) {
+		b.prefix = prefix
+	}
+}
+
+// WithRateLimit limits replies in each conversation to r per second with bursts of burst.
+func WithRateLimit(r float64, burst int) Option {
+	return func(b *Bot) {
+		b.limit, b.burst = rate.Limit(r), burst
+	}
+}
+
+// New returns a bot answering on client. It has a built-in "help" command.
+func New(client *shadow.Client, opts ...Option) *Bot {
+	b := &Bot{
+		client:   client,
+		prefix:   defaultPrefix,
+		limit:    defaultRate,
+		burst:    defaultBurst,
+		commands: map[string]command{},
+		workers:  map[string]chan shadow.Message{},
+		convs:    map[string]*conversation{},
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	b.Handle("help", "help: list commands", b.help)
+	return b
+}
+
+// Client returns the shadow client the bot runs on.
+func (b *Bot) Client() *shadow.Client {
+	return b.client
+}
+
+// Handle registers h for prefix+name. help is shown by the help command.
+func (b *Bot) Handle(name, help string, h Handler) {
+	b.commands[strings.ToLower(name)] = command{help: help, handler: h}
+}
+
+// HandleDefault registers h for messages that are not commands. Without it
+// such messages are ignored.
+func (b *Bot) HandleDefault(h Handler) {
+	b.fallback = h
+}
+
+// Run handles messages until ctx is cancelled or the client is closed.
+// Messages of one conversation are handled in order; conversations are
+// handled concurrently.
+func (b *Bot) Run(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ev, ok := <-b.client.Events():
+			if !ok {
+				return nil
+			}
+			if m, ok := ev.(shadow.MessageEvent); ok && m.From != b.client.ID() {
+				b.dispatch(ctx, m.Message)
+			}
+		}
+	}
+}
+
+func conversationKey(m shadow.Message) string {
+	if m.Room != "" {
+		return "#" + m.Room
+	}
+	return m.From.String()
+}
+
+// dispatch queues m on the worker of its conversation, starting one if needed.
+func (b *Bot) dispatch(ctx context.Context, m shadow.Message) {
+	key := conversationKey(m)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.workers[key]
+	if !ok {
+		q = make(chan shadow.Message, queueSize)
+		b.workers[key] = q
+		go b.work(ctx, key, q)
+	}
+	select {
+	case q <- m:
+	default:
+		logging.Println("Bot is overloaded, dropping message in", key)
+	}
+}
+
+func (b *Bot) work(ctx context.Context, key string, q chan shadow.Message) {
+	idle := time.NewTimer(workerIdle)
+	defer idle.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case m := <-q:
+			b.handle(ctx, key, m)
+			idle.Reset(workerIdle)
+		case <-idle.C:
+			b.mu.Lock()
+			if len(q) == 0 {
+				delete(b.workers, key)
+				b.mu.Unlock()
+				return
+			}
+			b.mu.Unlock()
+			idle.Reset(workerIdle)
+		}
+	}
+}
+
+func (b *Bot) conversation(key string) *conversation {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.convs[key]
+	if !ok {
+		if len(b.convs) >= maxConversations {
+			b.dropOldestLocked()
+		}
+		c = &conversation{state: newState(), limiter: rate.NewLimiter(b.limit, b.burst)}
+		b.convs[key] = c
+	}
+	c.active = time.Now()
+	return c
+}
+
+// dropOldestLocked forgets the least recently active conversation.
+func (b *Bot) dropOldestLocked() {
+	var oldest string
+	var at time.Time
+	for key, c := range b.convs {
+		if oldest == "" || c.active.Before(at) {
+			oldest, at = key, c.active
+		}
+	}
+	delete(b.convs, oldest)
+}
+
+func (b *Bot) handle(ctx context.Context, key string, m shadow.Message) {
+	conv := b.conversation(key)
+	c := &Context{Message: m, State: conv.state, bot: b, limiter: conv.limiter, ctx: ctx}
+
+	h := b.fallback
+	if text, ok := strings.CutPrefix(m.Text, b.prefix); ok && b.prefix != "" {
+		fields := strings.Fields(text)
+		if len(fields) > 0 {
+			c.Command = strings.ToLower(fields[0])
+			c.Args = fields[1:]
+			if cmd, ok := b.commands[c.Command]; ok {
+				h = cmd.handler
+			} else {
+				h = func(ctx context.Context, c *Context) error {
+					return c.Replyf("unknown command %s%s, try %shelp", b.prefix, c.Command, b.prefix)
+				}
+			}
+		}
+	}
+	if h == nil {
+		return
+	}
+	if err := h(ctx, c); err != nil {
+		logging.Println("Bot handler failed in", key, ":", err)
+		c.Reply("error: " + err.Error())
+	}
+}
+
+func (b *Bot) help(ctx context.Context, c *Context) error {
+	names := make([]string, 0, len(b.commands))
+	for name := range b.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	sb.WriteString("Commands:")
+	for _, name := range names {
+		sb.WriteString("\n  " + b.prefix + b.commands[name].help)
+	}
+	return c.Reply(sb.String())
+}
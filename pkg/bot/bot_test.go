@@ -0,0 +1,202 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"shadow/pkg/shadow"
+)
+
+const testTimeout = 20 * time.Second
+
+func start(t *testing.T, name string) *shadow.Client {
+	t.Helper()
+	c, err := shadow.Start(context.Background(), shadow.Config{Name: name, DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// tcpAddr returns a TCP address of c.
+func tcpAddr(t *testing.T, c *shadow.Client) string {
+	t.Helper()
+	for _, a := range c.Addrs() {
+		if strings.Contains(a, "/tcp/") && !strings.Contains(a, "/ws") {
+			return a
+		}
+	}
+	t.Fatal("no TCP address")
+	return ""
+}
+
+// runBot starts a bot set up by setup and a user client connected to it.
+// Only two clients: more would start AutoNAT dial-backs over QUIC, which the
+// pinned quic-go cannot do with newer Go releases.
+func runBot(t *testing.T, setup func(*Bot), opts ...Option) (*Bot, *shadow.Client) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	b := New(start(t, "bot"), opts...)
+	setup(b)
+	go b.Run(ctx)
+
+	user := start(t, "alice")
+	cctx, ccancel := context.WithTimeout(ctx, testTimeout)
+	defer ccancel()
+	if err := user.Connect(cctx, tcpAddr(t, b.Client())); err != nil {
+		t.Fatal(err)
+	}
+	return b, user
+}
+
+// ask sends text to the bot and returns its reply.
+func ask(t *testing.T, user *shadow.Client, b *Bot, text string) string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if _, err := user.Send(ctx, b.Client().ID().String(), text); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("no reply to %q", text)
+		case ev := <-user.Events():
+			if m, ok := ev.(shadow.MessageEvent); ok && m.From == b.Client().ID() {
+				return m.Text
+			}
+		}
+	}
+}
+
+func TestCommands(t *testing.T) {
+	b, user := runBot(t, func(b *Bot) {
+		b.Handle("Echo", "echo <text>: repeat text", func(ctx context.Context, m *Context) error {
+			return m.Reply(m.Rest())
+		})
+		b.Handle("fail", "fail: always fail", func(ctx context.Context, m *Context) error {
+			return fmt.Errorf("on purpose")
+		})
+	})
+
+	if got := ask(t, user, b, "!ECHO hello  there"); got != "hello there" {
+		t.Fatalf("echo replied %q", got)
+	}
+	if got := ask(t, user, b, "!deploy web"); got != "unknown command !deploy, try !help" {
+		t.Fatalf("unknown command replied %q", got)
+	}
+	if got := ask(t, user, b, "!fail"); got != "error: on purpose" {
+		t.Fatalf("failing handler replied %q", got)
+	}
+	if got := ask(t, user, b, "!help"); !strings.Contains(got, "!echo <text>") || !strings.Contains(got, "!help: list commands") {
+		t.Fatalf("help replied %q", got)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	elapsed := make(chan time.Duration, 1)
+	b, user := runBot(t, func(b *Bot) {
+		b.Handle("three", "three: reply three times", func(ctx context.Context, m *Context) error {
+			start := time.Now()
+			for i := range 3 {
+				if err := m.Replyf("%d", i); err != nil {
+					return err
+				}
+			}
+			elapsed <- time.Since(start)
+			return nil
+		})
+	}, WithRateLimit(10, 1))
+
+	if got := ask(t, user, b, "!three"); got != "0" {
+		t.Fatalf("first reply %q", got)
+	}
+	select {
+	case d := <-elapsed:
+		// A burst of one at ten a second makes the third reply wait 200ms
+		if d < 150*time.Millisecond {
+			t.Fatalf("three replies in %v", d)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("handler did not finish")
+	}
+}
+
+func TestConversationOrder(t *testing.T) {
+	b := New(nil)
+	var (
+		mu   sync.Mutex
+		seen = map[string][]string{}
+		done = make(chan struct{}, 64)
+	)
+	b.Handle("n", "n <i>: record i", func(ctx context.Context, m *Context) error {
+		// Later messages of a conversation would overtake a slow handler if
+		// they were not queued behind it
+		if m.Arg(0) == "0" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		mu.Lock()
+		seen[m.Room] = append(seen[m.Room], m.Arg(0))
+		mu.Unlock()
+		done <- struct{}{}
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	const n = 10
+	for i := range n {
+		for _, room := range []string{"a", "b"} {
+			b.dispatch(ctx, shadow.Message{Room: room, Text: fmt.Sprintf("!n %d", i)})
+		}
+	}
+	for range 2 * n {
+		select {
+		case <-done:
+		case <-time.After(testTimeout):
+			t.Fatal("messages not handled")
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, room := range []string{"a", "b"} {
+		for i, got := range seen[room] {
+			if got != fmt.Sprint(i) {
+				t.Fatalf("room %s handled in order %v", room, seen[room])
+			}
+		}
+	}
+	if b.conversation("#a") == b.conversation("#b") {
+		t.Fatal("rooms share a conversation")
+	}
+	if got := b.conversation("#a").limiter.Burst(); got != defaultBurst {
+		t.Fatalf("burst %d, want %d", got, defaultBurst)
+	}
+}
+
+func TestConversationsBounded(t *testing.T) {
+	b := New(nil)
+	now := time.Now()
+	for i := range maxConversations {
+		b.convs[fmt.Sprint(i)] = &conversation{state: newState(), active: now.Add(time.Duration(i) * time.Second)}
+	}
+	b.convs["0"].active = now.Add(time.Hour)
+
+	b.conversation("new")
+	if len(b.convs) != maxConversations {
+		t.Fatalf("%d conversations kept, want %d", len(b.convs), maxConversations)
+	}
+	if _, ok := b.convs["1"]; ok {
+		t.Fatal("least recently active conversation kept")
+	}
+	if _, ok := b.convs["0"]; !ok {
+		t.Fatal("recently active conversation dropped")
+	}
+}
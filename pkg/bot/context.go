@@ -0,0 +1,115 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/time/rate"
+
+	"shadow/pkg/shadow"
+)
+
+// Context is passed to a handler for one incoming message.
+type Context struct {
+	shadow.Message
+	// Command is the lower-cased command name without prefix, empty for plain messages.
+	Command string
+	// Args are the whitespace-separated words after the command.
+	Args []string
+	// State is kept per conversation (direct chat or room) while the bot
+	// runs, except for the least recently active beyond a thousand or so.
+	State *State
+
+	bot     *Bot
+	limiter *rate.Limiter
+	ctx     context.Context
+}
+
+// Arg returns the i-th argument, or "" if there are fewer.
+func (c *Context) Arg(i int) string {
+	if i < len(c.Args) {
+		return c.Args[i]
+	}
+	return ""
+}
+
+// Rest returns all arguments joined by spaces.
+func (c *Context) Rest() string {
+	return strings.Join(c.Args, " ")
+}
+
+// IsRoom reports whether the message was sent to a room.
+func (c *Context) IsRoom() bool {
+	return c.Room != ""
+}
+
+// Reply answers in the conversation the message came from: the room, or
+// a direct message to the sender. It waits for the conversation's rate limit.
+func (c *Context) Reply(text string) error {
+	return c.send(c.Room, text)
+}
+
+// Replyf formats and sends a reply.
+func (c *Context) Replyf(format string, args ...any) error {
+	return c.Reply(fmt.Sprintf(format, args...))
+}
+
+// ReplyDirect answers the sender in a direct message, even for room messages.
+func (c *Context) ReplyDirect(text string) error {
+	return c.send("", text)
+}
+
+func (c *Context) send(room, text string) error {
+	if err := c.limiter.Wait(c.ctx); err != nil {
+		return err
+	}
+	var err error
+	if room != "" {
+		_, err = c.bot.client.SendRoom(c.ctx, room, text)
+	} else {
+		_, err = c.bot.client.Send(c.ctx, c.From.String(), text)
+	}
+	return err
+}
+
+// State is a conversation's key-value store, safe for concurrent use.
+type State struct {
+	mu     sync.Mutex
+	values map[string]any
+}
+
+func newState() *State {
+	return &State{values: map[string]any{}}
+}
+
+// Get returns the value stored under key, or nil.
+func (s *State) Get(key string) any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.values[key]
+}
+
+// Set stores value under key.
+func (s *State) Set(key string, value any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = value
+}
+
+// Delete removes key.
+func (s *State) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+}
+
+// Update atomically replaces the value under key with fn(old).
+func (s *State) Update(key string, fn func(old any) any) any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v := fn(s.values[key])
+	s.values[key] = v
+	return v
+}
@@ -0,0 +1,270 @@
+// Package bridge connects a shadow client to another chat network.
+//
+// An Adapter speaks the other network's protocol; the Bridge maps its
+// channels to shadow rooms and relays messages both ways:
+//
+//	b := bridge.New(client, webhook.New(cfg), bridge.WithRoom("general", "lobby"))
+//	b.Run(ctx)
+//
+// Remote users are puppeted: their messages are sent by the bridge's
+// identity and carry the remote user as shadow.Message.Puppet. Shadow peers
+// appear on the remote side as Outbound.From, for the adapter to present
+// the way its network shows other users.
+//
+// Direct messages work both ways. A remote user addresses a shadow peer
+// with Inbound.To; a shadow peer answers by messaging the bridge, either
+// "@user text" or plain text to the remote user it last heard from.
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"shadow/internal/logging"
+	"shadow/pkg/shadow"
+)
+
+const (
+	inboundQueueSize  = 64
+	outboundQueueSize = 64
+)
+
+// User is a user of the remote network.
+type User struct {
+	ID   string // stable ID on the remote network
+	Name string // display name, may be empty
+}
+
+// Inbound is a message from the remote network. Either Channel or To is set.
+type Inbound struct {
+	From    User
+	Channel string // remote channel of a room message
+	To      string // shadow peer of a direct message, anything shadow.Client.ResolvePeer accepts
+	Text    string
+}
+
+// Sender is a shadow user as shown on the remote network.
+type Sender struct {
+	ID      peer.ID
+	Zbase32 string
+	Name    string
+	// Puppet is set when the sender is itself a bridge speaking for a remote user.
+	Puppet string
+}
+
+// Outbound is a message for the remote network. Either Channel or To is set.
+type Outbound struct {
+	From    Sender
+	Channel string // remote channel of a room message
+	To      string // remote user ID of a direct message
+	Text    string
+	Time    time.Time
+}
+
+// Adapter connects the bridge to one remote network.
+type Adapter interface {
+	// Name identifies the network, e.g. "webhook"; it is appended to puppet names.
+	Name() string
+	// Run receives messages from the remote network and passes them to in
+	// until ctx is cancelled.
+	Run(ctx context.Context, in chan<- Inbound) error
+	// Send delivers a message to the remote network.
+	Send(ctx context.Context, m Outbound) error
+}
+
+// Bridge relays messages between a shadow client and an adapter.
+type Bridge struct {
+	client  *shadow.Client
+	adapter Adapter
+	rooms   map[string]string // remote channel -> room
+	// channels is the reverse of rooms
+	channels map[string]string
+
+	mu      sync.Mutex
+	replyTo map[peer.ID]string // remote user a shadow peer last heard from
+	hinted  map[peer.ID]bool   // peers told how to address remote users
+}
+
+// Option configures a Bridge.
+type Option func(*Bridge)
+
+// WithRoom bridges a remote channel to a shadow room. Messages in channels
+// and rooms without a mapping are not relayed.
+func WithRoom(channel, room string) Option {
+	return func(b *Bridge) {
+		b.rooms[channel] = room
+		b.channels[room] = channel
+	}
+}
+
+// New returns a bridge between client and adapter.
+func New(client *shadow.Client, adapter Adapter, opts ...Option) *Bridge {
+	b := &Bridge{
+		client:   client,
+		adapter:  adapter,
+		rooms:    map[string]string{},
+		channels: map[string]string{},
+		replyTo:  map[peer.ID]string{},
+		hinted:   map[peer.ID]bool{},
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// Run joins the mapped rooms and relays messages until ctx is cancelled,
+// the client is closed or the adapter fails.
+func (b *Bridge) Run(ctx context.Context) error {
+	for _, room := range b.rooms {
+		if err := b.client.Join(ctx, room); err != nil {
+			return fmt.Errorf("failed to join room %s: %w", room, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	in := make(chan Inbound, inboundQueueSize)
+	out := make(chan shadow.Message, outboundQueueSize)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- b.adapter.Run(ctx, in)
+	}()
+	// Relay each direction on its own so a slow peer lookup or a slow remote
+	// network does not hold up the other, nor the client's events
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case m := <-in:
+				if err := b.inbound(ctx, m); err != nil {
+					logging.Println("Failed to relay message from", b.adapter.Name(), ":", err)
+				}
+			}
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case m := <-out:
+				if err := b.outbound(ctx, m); err != nil {
+					logging.Println("Failed to relay message to", b.adapter.Name(), ":", err)
+				}
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errc:
+			if err == nil {
+				return nil
+			}
+			return fmt.Errorf("%s adapter failed: %w", b.adapter.Name(), err)
+		case ev, ok := <-b.client.Events():
+			if !ok {
+				return nil
+			}
+			if m, ok := ev.(shadow.MessageEvent); ok && m.From != b.client.ID() {
+				select {
+				case out <- m.Message:
+				default:
+					logging.Println("Bridge is overloaded, dropping message to", b.adapter.Name())
+				}
+			}
+		}
+	}
+}
+
+// puppet is the name a remote user is shown under on shadow.
+func (b *Bridge) puppet(u User) string {
+	name := u.Name
+	if name == "" {
+		name = u.ID
+	}
+	return name + "@" + b.adapter.Name()
+}
+
+// inbound relays a remote message to shadow.
+func (b *Bridge) inbound(ctx context.Context, m Inbound) error {
+	if m.From.ID == "" {
+		return fmt.Errorf("message without sender")
+	}
+	switch {
+	case m.Channel != "":
+		room, ok := b.rooms[m.Channel]
+		if !ok {
+			return fmt.Errorf("channel %s is not bridged", m.Channel)
+		}
+		_, err := b.client.SendRoomAs(ctx, room, b.puppet(m.From), m.Text)
+		return err
+	case m.To != "":
+		p, err := b.client.ResolvePeer(m.To)
+		if err != nil {
+			return err
+		}
+		if _, err := b.client.SendAs(ctx, p.String(), b.puppet(m.From), m.Text); err != nil {
+			return err
+		}
+		b.mu.Lock()
+		b.replyTo[p] = m.From.ID
+		b.mu.Unlock()
+		return nil
+	}
+	return fmt.Errorf("message has neither channel nor recipient")
+}
+
+// outbound relays a shadow message to the remote network.
+func (b *Bridge) outbound(ctx context.Context, m shadow.Message) error {
+	out := Outbound{
+		From: Sender{ID: m.From, Zbase32: b.client.PeerInfo(m.From).Zbase32, Name: m.Name, Puppet: m.Puppet},
+		Text: m.Text,
+		Time: m.Time,
+	}
+	if m.File != nil {
+		out.Text = fmt.Sprintf("sent file %s (%d bytes)", m.File.Name, m.File.Size)
+	}
+
+	if m.Room != "" {
+		channel, ok := b.channels[m.Room]
+		if !ok {
+			return nil
+		}
+		out.Channel = channel
+		return b.adapter.Send(ctx, out)
+	}
+
+	// A direct message to the bridge: "@user text" or a reply to the last remote sender
+	if to, text, ok := strings.Cut(m.Text, " "); ok && strings.HasPrefix(to, "@") && len(to) > 1 {
+		out.To, out.Text = to[1:], text
+	}
+	b.mu.Lock()
+	if out.To == "" {
+		out.To = b.replyTo[m.From]
+	}
+	if out.To == "" {
+		// Tell the peer once; answering every message could loop with another bot
+		hint := !b.hinted[m.From]
+		b.hinted[m.From] = true
+		b.mu.Unlock()
+		if !hint {
+			return nil
+		}
+		_, err := b.client.Send(ctx, m.From.String(),
+			fmt.Sprintf("This is a bridge to %s. Start a message with @user to reach someone there.", b.adapter.Name()))
+		return err
+	}
+	b.replyTo[m.From] = out.To
+	b.mu.Unlock()
+	return b.adapter.Send(ctx, out)
+}
@@ -0,0 +1,118 @@
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"shadow/pkg/shadow"
+)
+
+const testTimeout = 20 * time.Second
+
+// fakeAdapter hands the bridge's inbound channel to the test and collects
+// what the bridge sends. Send blocks while hold is open.
+type fakeAdapter struct {
+	in   chan chan<- Inbound
+	sent chan Outbound
+	hold chan struct{}
+}
+
+func newFakeAdapter() *fakeAdapter {
+	return &fakeAdapter{in: make(chan chan<- Inbound, 1), sent: make(chan Outbound, 16), hold: make(chan struct{})}
+}
+
+func (a *fakeAdapter) Name() string { return "fake" }
+
+func (a *fakeAdapter) Run(ctx context.Context, in chan<- Inbound) error {
+	a.in <- in
+	<-ctx.Done()
+	return nil
+}
+
+func (a *fakeAdapter) Send(ctx context.Context, m Outbound) error {
+	select {
+	case <-a.hold:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	a.sent <- m
+	return nil
+}
+
+func start(t *testing.T, name string) *shadow.Client {
+	t.Helper()
+	c, err := shadow.Start(context.Background(), shadow.Config{Name: name, DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// tcpAddr returns a TCP address of c.
+func tcpAddr(t *testing.T, c *shadow.Client) string {
+	t.Helper()
+	for _, a := range c.Addrs() {
+		if strings.Contains(a, "/tcp/") && !strings.Contains(a, "/ws") {
+			return a
+		}
+	}
+	t.Fatal("no TCP address")
+	return ""
+}
+
+// receive waits for the message with text on c.
+func receive(ctx context.Context, t *testing.T, c *shadow.Client, text string) shadow.Message {
+	t.Helper()
+	for {
+		select {
+		case ev := <-c.Events():
+			if m, ok := ev.(shadow.MessageEvent); ok && m.Text == text {
+				return m.Message
+			}
+		case <-ctx.Done():
+			t.Fatalf("%s received no %q", c.Name(), text)
+			return shadow.Message{}
+		}
+	}
+}
+
+func TestDirectMessages(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	alice, client := start(t, "alice"), start(t, "bridge")
+	if err := alice.Connect(ctx, tcpAddr(t, client)); err != nil {
+		t.Fatal(err)
+	}
+	adapter := newFakeAdapter()
+	go New(client, adapter).Run(ctx)
+	in := <-adapter.in
+
+	// Remote to shadow, as a puppet of the remote user
+	in <- Inbound{From: User{ID: "u1", Name: "bob"}, To: alice.ID().String(), Text: "hi alice"}
+	if m := receive(ctx, t, alice, "hi alice"); m.Puppet != "bob@fake" {
+		t.Fatalf("puppet %q", m.Puppet)
+	}
+
+	// Shadow to remote, while the remote network is slow: messages queue up
+	// and go out in order once it is back
+	for i := range 3 {
+		if _, err := alice.Send(ctx, client.ID().String(), fmt.Sprintf("reply %d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(adapter.hold)
+	for i := range 3 {
+		select {
+		case m := <-adapter.sent:
+			if m.To != "u1" || m.Text != fmt.Sprintf("reply %d", i) || m.From.ID != alice.ID() {
+				t.Fatalf("sent %+v", m)
+			}
+		case <-ctx.Done():
+			t.Fatal("message to the remote network not relayed")
+		}
+	}
+}
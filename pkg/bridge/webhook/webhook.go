@@ -0,0 +1,202 @@
+// Package webhook is a reference bridge adapter speaking JSON over HTTP.
+//
+// Outgoing messages are POSTed to a URL; the remote side POSTs incoming
+// messages to /messages on the adapter's listen address. Both directions
+// carry the shared secret, if set, in the X-Shadow-Secret header. A chat
+// system with webhook support, or a small script standing in for one, is
+// all it takes to bridge it.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"shadow/pkg/bridge"
+)
+
+const (
+	// SecretHeader carries the shared secret on both directions.
+	SecretHeader = "X-Shadow-Secret"
+	// MessagesPath is where the remote side POSTs incoming messages.
+	MessagesPath = "/messages"
+
+	maxBodySize = 64 << 10
+	httpTimeout = 10 * time.Second
+)
+
+// Config configures the adapter.
+type Config struct {
+	// Listen is the address to accept incoming messages on, e.g. "127.0.0.1:8088".
+	// If empty, mount the Adapter on your own server instead.
+	Listen string
+	// URL receives outgoing messages.
+	URL string
+	// Secret, if set, must be sent by the remote side and is sent to it.
+	Secret string
+}
+
+// Incoming is the JSON body the remote side POSTs to MessagesPath. Either
+// Channel or To is set.
+type Incoming struct {
+	User    string `json:"user"`
+	Name    string `json:"name,omitempty"`
+	Channel string `json:"channel,omitempty"`
+	To      string `json:"to,omitempty"` // shadow peer: peer ID, z:<zbase32> or @contact
+	Text    string `json:"text"`
+}
+
+// Outgoing is the JSON body POSTed to Config.URL.
+type Outgoing struct {
+	From struct {
+		ID      string `json:"id"`
+		Zbase32 string `json:"zbase32"`
+		Name    string `json:"name"`
+		Puppet  string `json:"puppet,omitempty"`
+	} `json:"from"`
+	Channel string    `json:"channel,omitempty"`
+	To      string    `json:"to,omitempty"`
+	Text    string    `json:"text"`
+	Time    time.Time `json:"time"`
+}
+
+// Adapter is a bridge.Adapter over HTTP webhooks. It is also an
+// http.Handler for MessagesPath, so it can be mounted on another server.
+type Adapter struct {
+	cfg    Config
+	client *http.Client
+
+	mu   sync.Mutex
+	sink chan<- bridge.Inbound // set while running
+}
+
+// New returns an adapter for cfg.
+func New(cfg Config) *Adapter {
+	return &Adapter{cfg: cfg, client: &http.Client{Timeout: httpTimeout}}
+}
+
+// Name implements bridge.Adapter.
+func (a *Adapter) Name() string {
+	return "webhook"
+}
+
+// Run serves MessagesPath on cfg.Listen until ctx is cancelled. Without
+// cfg.Listen it only accepts messages through ServeHTTP, for an adapter
+// mounted on another server.
+func (a *Adapter) Run(ctx context.Context, in chan<- bridge.Inbound) error {
+	a.mu.Lock()
+	a.sink = in
+	a.mu.Unlock()
+	defer func() {
+		a.mu.Lock()
+		a.sink = nil
+		a.mu.Unlock()
+	}()
+	if a.cfg.Listen == "" {
+		<-ctx.Done()
+		return nil
+	}
+
+	l, err := net.Listen("tcp", a.cfg.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen for webhooks: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(MessagesPath, a)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: httpTimeout}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (a *Adapter) authorized(r *http.Request) bool {
+	if a.cfg.Secret == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get(SecretHeader)), []byte(a.cfg.Secret)) == 1
+}
+
+// ServeHTTP accepts one Incoming message.
+func (a *Adapter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	a.mu.Lock()
+	sink := a.sink
+	a.mu.Unlock()
+	if sink == nil {
+		http.Error(w, "bridge not running", http.StatusServiceUnavailable)
+		return
+	}
+	var m Incoming
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxBodySize)).Decode(&m); err != nil {
+		http.Error(w, "invalid message: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if m.User == "" || m.Text == "" || (m.Channel == "") == (m.To == "") {
+		http.Error(w, "message needs user, text and one of channel or to", http.StatusBadRequest)
+		return
+	}
+	select {
+	case sink <- bridge.Inbound{
+		From:    bridge.User{ID: m.User, Name: m.Name},
+		Channel: m.Channel,
+		To:      m.To,
+		Text:    m.Text,
+	}:
+		w.WriteHeader(http.StatusAccepted)
+	case <-r.Context().Done():
+	default:
+		http.Error(w, "bridge is busy", http.StatusServiceUnavailable)
+	}
+}
+
+// Send implements bridge.Adapter by POSTing m to cfg.URL.
+func (a *Adapter) Send(ctx context.Context, m bridge.Outbound) error {
+	var out Outgoing
+	out.From.ID = m.From.ID.String()
+	out.From.Zbase32 = m.From.Zbase32
+	out.From.Name = m.From.Name
+	out.From.Puppet = m.From.Puppet
+	out.Channel, out.To, out.Text, out.Time = m.Channel, m.To, m.Text, m.Time
+	body, err := json.Marshal(out)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("invalid webhook URL: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.cfg.Secret != "" {
+		req.Header.Set(SecretHeader, a.cfg.Secret)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxBodySize))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"shadow/pkg/bridge"
+)
+
+func TestRoundTrip(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The remote side, receiving outgoing messages
+	got := make(chan Outgoing, 1)
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(SecretHeader) != "s3cret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var m Outgoing
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		got <- m
+	}))
+	defer remote.Close()
+
+	a := New(Config{URL: remote.URL, Secret: "s3cret"})
+	in := make(chan bridge.Inbound, 1)
+	go a.Run(ctx, in)
+	for running := false; !running; time.Sleep(10 * time.Millisecond) {
+		a.mu.Lock()
+		running = a.sink != nil
+		a.mu.Unlock()
+	}
+	srv := httptest.NewServer(a)
+	defer srv.Close()
+
+	if err := a.Send(ctx, bridge.Outbound{From: bridge.Sender{Name: "alice"}, Channel: "general", Text: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	if m := <-got; m.From.Name != "alice" || m.Channel != "general" || m.Text != "hi" {
+		t.Fatalf("remote got %+v", m)
+	}
+	if err := New(Config{URL: remote.URL}).Send(ctx, bridge.Outbound{Text: "hi"}); err == nil {
+		t.Fatal("rejected webhook reported as sent")
+	}
+
+	for _, c := range []struct {
+		secret, body string
+		want         int
+	}{
+		{"wrong", `{"user":"u1","channel":"general","text":"hi"}`, http.StatusUnauthorized},
+		{"s3cret", `{"user":"u1","text":"hi"}`, http.StatusBadRequest},
+		{"s3cret", `not json`, http.StatusBadRequest},
+		{"s3cret", `{"user":"u1","name":"bob","channel":"general","text":"hi"}`, http.StatusAccepted},
+	} {
+		req, err := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(SecretHeader, c.secret)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.want {
+			t.Errorf("%s with secret %q: got %d, want %d", c.body, c.secret, resp.StatusCode, c.want)
+		}
+	}
+	select {
+	case m := <-in:
+		if m.From.ID != "u1" || m.From.Name != "bob" || m.Channel != "general" || m.Text != "hi" {
+			t.Fatalf("bridge got %+v", m)
+		}
+	case <-ctx.Done():
+		t.Fatal("incoming message not handed to the bridge")
+	}
+}
@@ -0,0 +1,76 @@
+package shadow
+
+import (
+	"context"
+	"time"
+
+	"shadow/internal/node"
+)
+
+const eventsBufferSize = 64
+
+// Event is delivered on Client.Events: a MessageEvent or a ConnectivityEvent.
+type Event interface {
+	isEvent()
+}
+
+// MessageEvent is an incoming direct message, file or room message.
+type MessageEvent struct {
+	Message
+}
+
+// ConnectivityEvent reports a change in how the node is connected.
+type ConnectivityEvent struct {
+	// State is "offline", "connecting", "relayed" or "public".
+	State        string
+	Reachability string
+	Relays       int // connected relays
+	Reserved     int // relays holding a reservation for us
+	Peers        int
+	Time         time.Time
+}
+
+func (MessageEvent) isEvent()      {}
+func (ConnectivityEvent) isEvent() {}
+
+func newConnectivityEvent(ev node.ConnectivityEvent) ConnectivityEvent {
+	return ConnectivityEvent{
+		State:        string(ev.State),
+		Reachability: ev.Reachability.String(),
+		Relays:       ev.Relays,
+		Reserved:     ev.Reserved,
+		Peers:        ev.Peers,
+		Time:         ev.Time,
+	}
+}
+
+// Events returns incoming messages and connectivity changes. Read it
+// continuously; events are dropped while the buffer is full. It is closed
+// when the client is closed.
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+func (c *Client) forwardEvents(ctx context.Context) {
+	defer close(c.events)
+	msgs, unsub := c.chat.Subscribe()
+	defer unsub()
+	for {
+		var ev Event
+		select {
+		case <-ctx.Done():
+			return
+		case m, ok := <-msgs:
+			if !ok {
+				return
+			}
+			ev = MessageEvent{newMessage(m)}
+		case ce := <-c.node.Connectivity():
+			ev = newConnectivityEvent(ce)
+		}
+		select {
+		case c.events <- ev:
+		default:
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package shadow
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"shadow/internal/chat"
+	"shadow/internal/identity"
+)
+
+// Message is a direct message, file or room message.
+type Message struct {
+	ID   string
+	From peer.ID
+	Name string  // name the sender announced
+	To   peer.ID // set on direct messages and files
+	Room string  // set on room messages
+	Text string
+	File *File // set on file transfers
+	Time time.Time
+	// Puppet is the remote user a bridge sent the message for; From and
+	// Name are then the bridge's identity.
+	Puppet string
+}
+
+// FileOffer describes an incoming file before it is received.
+type FileOffer struct {
+	From peer.ID
+	Name string
+	Size int64
+}
+
+// File describes a transferred file.
+type File struct {
+	Name   string
+	Size   int64
+	SHA256 string
+	Path   string // where a received file was stored
+}
+
+// Peer describes a peer and how the node is connected to it.
+type Peer struct {
+	ID       peer.ID
+	Zbase32  string
+	Name     string
+	ConnType string // "none", "direct", "relayed" or "hole-punched"
+	Contact  bool
+}
+
+// Contact is a peer the node exchanged messages with.
+type Contact struct {
+	ID      peer.ID
+	Zbase32 string
+	Name    string
+}
+
+func newMessage(m chat.Message) Message {
+	out := Message{
+		ID:     m.ID,
+		From:   m.From,
+		Name:   m.Name,
+		To:     m.To,
+		Room:   m.Room,
+		Text:   m.Text,
+		Time:   m.Time,
+		Puppet: m.Puppet,
+	}
+	if m.File != nil {
+		out.File = &File{Name: m.File.Name, Size: m.File.Size, SHA256: m.File.SHA256, Path: m.File.Path}
+	}
+	return out
+}
+
+func newMessages(ms []chat.Message) []Message {
+	out := make([]Message, len(ms))
+	for i, m := range ms {
+		out[i] = newMessage(m)
+	}
+	return out
+}
+
+// ResolvePeer parses a peer ID, a "z:"-prefixed zbase32 ID or "@name" of a
+// contact. A name more than one contact goes by is an error.
+func (c *Client) ResolvePeer(ref string) (peer.ID, error) {
+	return c.chat.ResolvePeer(ref)
+}
+
+// Send sends an end-to-end encrypted direct message. to is anything ResolvePeer accepts.
+func (c *Client) Send(ctx context.Context, to, text string) (Message, error) {
+	p, err := c.chat.ResolvePeer(to)
+	if err != nil {
+		return Message{}, err
+	}
+	m, err := c.chat.Send(ctx, p, text)
+	if err != nil {
+		return Message{}, err
+	}
+	return newMessage(m), nil
+}
+
+// SendAs sends a direct message on behalf of puppet, a user on another
+// network. Receivers see the message from this client, marked with puppet.
+func (c *Client) SendAs(ctx context.Context, to, puppet, text string) (Message, error) {
+	p, err := c.chat.ResolvePeer(to)
+	if err != nil {
+		return Message{}, err
+	}
+	m, err := c.chat.SendAs(ctx, p, puppet, text)
+	if err != nil {
+		return Message{}, err
+	}
+	return newMessage(m), nil
+}
+
+// SendFile transfers the file at path to a peer. The receiver stores it in
+// the downloads directory under its DataDir, if its Config.AcceptFile takes
+// it; by default only files from contacts are.
+func (c *Client) SendFile(ctx context.Context, to, path string) (Message, error) {
+	p, err := c.chat.ResolvePeer(to)
+	if err != nil {
+		return Message{}, err
+	}
+	m, err := c.chat.SendFile(ctx, p, path)
+	if err != nil {
+		return Message{}, err
+	}
+	return newMessage(m), nil
+}
+
+// Join subscribes to a room. Room messages arrive on Events.
+func (c *Client) Join(ctx context.Context, room string) error {
+	return c.chat.JoinRoom(room)
+}
+
+// Leave unsubscribes from a room.
+func (c *Client) Leave(ctx context.Context, room string) error {
+	return c.chat.LeaveRoom(room)
+}
+
+// Rooms lists the joined rooms.
+func (c *Client) Rooms() []string {
+	return c.chat.Rooms()
+}
+
+// RoomMembers lists the peers currently known to be in a joined room, not
+// including this node.
+func (c *Client) RoomMembers(room string) ([]Peer, error) {
+	ids, err := c.chat.RoomPeers(room)
+	if err != nil {
+		return nil, err
+	}
+	var out []Peer
+	for _, p := range ids {
+		out = append(out, c.peer(p))
+	}
+	return out, nil
+}
+
+// PeerInfo describes any peer, connected or not.
+func (c *Client) PeerInfo(p peer.ID) Peer {
+	return c.peer(p)
+}
+
+func (c *Client) peer(p peer.ID) Peer {
+	n := c.node
+	return Peer{
+		ID:       p,
+		Zbase32:  identity.PeerIDToZbase32(p),
+		Name:     n.PeerName(p),
+		ConnType: string(n.ConnType(p)),
+		Contact:  n.IsContact(p),
+	}
+}
+
+// SendRoom publishes a message to a joined room.
+func (c *Client) SendRoom(ctx context.Context, room, text string) (Message, error) {
+	m, err := c.chat.SendRoom(ctx, room, text)
+	if err != nil {
+		return Message{}, err
+	}
+	return newMessage(m), nil
+}
+
+// SendRoomAs publishes a room message on behalf of puppet, a user on
+// another network.
+func (c *Client) SendRoomAs(ctx context.Context, room, puppet, text string) (Message, error) {
+	m, err := c.chat.SendRoomAs(ctx, room, puppet, text)
+	if err != nil {
+		return Message{}, err
+	}
+	return newMessage(m), nil
+}
+
+// History returns up to limit of the latest messages with a peer (anything
+// ResolvePeer accepts) or in a room ("#room"), oldest first. limit <= 0
+// returns the whole conversation.
+func (c *Client) History(ctx context.Context, conversation string, limit int) ([]Message, error) {
+	if conversation == "" {
+		return nil, fmt.Errorf("shadow: empty conversation")
+	}
+	if conversation[0] != '#' {
+		p, err := c.chat.ResolvePeer(conversation)
+		if err != nil {
+			return nil, err
+		}
+		conversation = p.String()
+	}
+	ms, err := c.chat.History(conversation, limit)
+	if err != nil {
+		return nil, err
+	}
+	return newMessages(ms), nil
+}
+
+// Contacts lists the peers the node exchanged messages with.
+func (c *Client) Contacts() []Contact {
+	var out []Contact
+	for _, ct := range c.chat.Contacts() {
+		out = append(out, Contact{ID: ct.ID, Zbase32: ct.Zbase32, Name: ct.Name})
+	}
+	return out
+}
+
+// Peers lists connected peers.
+func (c *Client) Peers() []Peer {
+	var out []Peer
+	for _, p := range c.node.Host.Network().Peers() {
+		out = append(out, c.peer(p))
+	}
+	return out
+}
+
+// Discover lists peers registered at the node's rendezvous point.
+func (c *Client) Discover(ctx context.Context) ([]Peer, error) {
+	found, err := c.node.DiscoverPeers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var out []Peer
+	for _, ai := range found {
+		out = append(out, c.peer(ai.ID))
+	}
+	return out, nil
+}
+
+// Connect dials a peer by full multiaddr ("/ip4/.../p2p/<id>").
+func (c *Client) Connect(ctx context.Context, addr string) error {
+	ai, err := peer.AddrInfoFromString(addr)
+	if err != nil {
+		return fmt.Errorf("shadow: invalid address: %w", err)
+	}
+	return c.node.Host.Connect(ctx, *ai)
+}
@@ -0,0 +1,168 @@
+// Package shadow embeds a shadow node in a Go program.
+//
+// Start a node with Start, send direct messages, files and room messages
+// through the returned Client and read incoming traffic from Events:
+//
+//	c, err := shadow.Start(ctx, shadow.Config{Name: "deploybot", DataDir: "data/deploybot"})
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//	for ev := range c.Events() {
+//		if m, ok := ev.(shadow.MessageEvent); ok {
+//			c.Send(ctx, m.From.String(), "got it")
+//		}
+//	}
+//
+// The types in this package are stable; they do not change with the internal
+// packages they are built on.
+package shadow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"shadow/internal/chat"
+	"shadow/internal/identity"
+	"shadow/internal/logging"
+	"shadow/internal/node"
+)
+
+// Config configures a node started with Start.
+type Config struct {
+	// Name is announced to peers and used for a new identity.
+	Name string
+	// DataDir holds the identity key, peerstore, history and received files.
+	// It is required: a node without it would get a new peer ID on every start.
+	DataDir string
+	// Relays lists relay multiaddrs. Without relays the node must be publicly reachable.
+	Relays []string
+	// RelayCount is how many relays to keep reservations on; 0 means the default of 2.
+	RelayCount int
+	// RelayInvite is redeemed with the relay that issued it before reserving a slot.
+	RelayInvite string
+	// ConnLow and ConnHigh are the connection manager watermarks; 0 keeps the defaults.
+	ConnLow, ConnHigh int
+	// SealedSender delivers direct messages through the recipient's relay
+	// mailbox without revealing the sender to the relay, once the recipient
+	// has told us where its mailbox is.
+	SealedSender bool
+	// AcceptFile decides which incoming files are received. Nil receives
+	// files from contacts only: peers we exchanged messages with.
+	AcceptFile func(FileOffer) bool
+}
+
+// SetLogOutput sends the progress and error lines printed by the nodes of
+// this process to w instead of stdout; io.Discard silences them.
+func SetLogOutput(w io.Writer) {
+	logging.SetOutput(w)
+}
+
+// Client is a running shadow node.
+type Client struct {
+	node   *node.Node
+	chat   *chat.Service
+	cancel context.CancelFunc
+	events chan Event
+
+	closeOnce sync.Once
+}
+
+// Start starts a node and connects it to the network. The node runs until
+// Close is called or ctx is cancelled.
+func Start(ctx context.Context, cfg Config) (*Client, error) {
+	if cfg.DataDir == "" {
+		return nil, errors.New("shadow: DataDir is required")
+	}
+	if cfg.Name == "" {
+		cfg.Name = "anon"
+	}
+	id, err := identity.LoadOrCreate(cfg.DataDir, cfg.Name)
+	if err != nil {
+		return nil, fmt.Errorf("shadow: failed to load identity: %w", err)
+	}
+
+	var opts []node.Option
+	if cfg.RelayCount > 0 {
+		opts = append(opts, node.WithRelayCount(cfg.RelayCount))
+	}
+	if cfg.RelayInvite != "" {
+		opts = append(opts, node.WithRelayInvite(cfg.RelayInvite))
+	}
+	if cfg.ConnLow > 0 || cfg.ConnHigh > 0 {
+		opts = append(opts, node.WithConnLimits(cfg.ConnLow, cfg.ConnHigh))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	n, err := node.NewNode(ctx, id, cfg.Relays, opts...)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("shadow: failed to start node: %w", err)
+	}
+	svc, err := chat.New(ctx, n)
+	if err != nil {
+		cancel()
+		n.Shutdown(ctx)
+		return nil, fmt.Errorf("shadow: failed to start messaging: %w", err)
+	}
+	svc.SetSealedSender(cfg.SealedSender)
+	if accept := cfg.AcceptFile; accept != nil {
+		svc.SetFileFilter(func(o chat.FileOffer) bool {
+			return accept(FileOffer{From: o.From, Name: o.Name, Size: o.Size})
+		})
+	}
+
+	c := &Client{
+		node:   n,
+		chat:   svc,
+		cancel: cancel,
+		events: make(chan Event, eventsBufferSize),
+	}
+	go c.forwardEvents(ctx)
+	return c, nil
+}
+
+// Close shuts the node down and closes the Events channel.
+func (c *Client) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.cancel()
+		c.chat.Close()
+		err = c.node.Shutdown(context.Background())
+	})
+	return err
+}
+
+// ID returns the node's peer ID.
+func (c *Client) ID() peer.ID {
+	return c.node.Host.ID()
+}
+
+// Name returns the name the node announces.
+func (c *Client) Name() string {
+	return c.node.Identity.Username()
+}
+
+// Zbase32 returns the node's peer ID in the zbase32 form shown to users.
+func (c *Client) Zbase32() string {
+	return c.node.Identity.Zbase32PeerID()
+}
+
+// Addrs returns the node's full multiaddrs, including relayed ones.
+func (c *Client) Addrs() []string {
+	out := []string{}
+	for _, a := range c.node.Host.Addrs() {
+		out = append(out, fmt.Sprintf("%s/p2p/%s", a, c.ID()))
+	}
+	return out
+}
+
+// Connectivity returns the node's current connectivity.
+func (c *Client) Connectivity() ConnectivityEvent {
+	return newConnectivityEvent(c.node.ConnectivityState())
+}
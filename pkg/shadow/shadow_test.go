@@ -0,0 +1,103 @@
+package shadow
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testTimeout = 20 * time.Second
+
+func start(t *testing.T, cfg Config) *Client {
+	t.Helper()
+	cfg.DataDir = t.TempDir()
+	c, err := Start(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// tcpAddr returns a TCP address of c.
+func tcpAddr(t *testing.T, c *Client) string {
+	t.Helper()
+	for _, a := range c.Addrs() {
+		if strings.Contains(a, "/tcp/") && !strings.Contains(a, "/ws") {
+			return a
+		}
+	}
+	t.Fatal("no TCP address")
+	return ""
+}
+
+// pair starts two clients, the first connected to the second. More would
+// start AutoNAT dial-backs over QUIC, which the pinned quic-go cannot do with
+// newer Go releases.
+func pair(t *testing.T, a, b Config) (*Client, *Client) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	ca, cb := start(t, a), start(t, b)
+	if err := ca.Connect(ctx, tcpAddr(t, cb)); err != nil {
+		t.Fatal(err)
+	}
+	return ca, cb
+}
+
+func writeFile(t *testing.T, name string, size int) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, make([]byte, size), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFileFromContactsOnly(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	alice, bob := pair(t, Config{Name: "alice"}, Config{Name: "bob"})
+	path := writeFile(t, "notes.txt", 2)
+
+	if _, err := alice.SendFile(ctx, bob.ID().String(), path); err == nil {
+		t.Fatal("file from a stranger accepted")
+	}
+	if _, err := bob.Send(ctx, alice.ID().String(), "send it"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.SendFile(ctx, bob.ID().String(), path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileFilter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	var (
+		mu     sync.Mutex
+		offers []FileOffer
+	)
+	alice, bob := pair(t, Config{Name: "alice"}, Config{Name: "bob", AcceptFile: func(o FileOffer) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		offers = append(offers, o)
+		return o.Size < 16
+	}})
+
+	if _, err := alice.SendFile(ctx, bob.ID().String(), writeFile(t, "small.txt", 2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.SendFile(ctx, bob.ID().String(), writeFile(t, "big.txt", 64)); err == nil {
+		t.Fatal("file refused by the filter accepted")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(offers) != 2 || offers[0].From != alice.ID() || offers[0].Name != "small.txt" || offers[1].Size != 64 {
+		t.Fatalf("offers %+v", offers)
+	}
+}
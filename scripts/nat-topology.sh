@@ -0,0 +1,115 @@
+#!/usr/bin/env bash
+# nat-topology.sh - simulated NAT topology for testing hole punching (DCUtR).
+#
+# Builds, with network namespaces:
+#
+#   shadow-relay (10.10.0.1) ----+
+#                                |  br-shadow (10.10.0.0/24, the "internet")
+#   shadow-nat-a (10.10.0.2) ----+---- shadow-nat-b (10.10.0.3)
+#        | 192.168.1.1                      | 192.168.2.1
+#   shadow-alice (192.168.1.2)         shadow-bob (192.168.2.2)
+#
+# Both NAT routers masquerade their LAN. With "cone" (default) mappings are
+# port-preserving and hole punching should succeed; "symmetric" randomises
+# ports so connections must stay relayed.
+#
+# Usage (as root, from the repo root):
+#   scripts/nat-topology.sh up [cone|symmetric]
+#   scripts/nat-topology.sh run        # starts relay, alice and bob in tmux panes
+#   scripts/nat-topology.sh down
+set -euo pipefail
+
+NS_RELAY=shadow-relay
+NS_NAT_A=shadow-nat-a
+NS_NAT_B=shadow-nat-b
+NS_ALICE=shadow-alice
+NS_BOB=shadow-bob
+BRIDGE=br-shadow
+BIN=${BIN:-./bin}
+
+in_ns() { ip netns exec "$1" "${@:2}"; }
+
+link_to_bridge() { # ns ifname addr
+	ip link add "$2" type veth peer name "$2-br"
+	ip link set "$2" netns "$1"
+	ip link set "$2-br" master "$BRIDGE" up
+	in_ns "$1" ip addr add "$3/24" dev "$2"
+	in_ns "$1" ip link set "$2" up
+	in_ns "$1" ip link set lo up
+}
+
+nat_router() { # nat-ns host-ns wan-addr lan-net mode
+	local nat=$1 lan=$2 wan=$3 net=$4 mode=$5
+	link_to_bridge "$nat" "${nat#shadow-}-wan" "$wan"
+	ip link add "${nat#shadow-}-lan" type veth peer name "${lan#shadow-}-eth"
+	ip link set "${nat#shadow-}-lan" netns "$nat"
+	ip link set "${lan#shadow-}-eth" netns "$lan"
+	in_ns "$nat" ip addr add "$net.1/24" dev "${nat#shadow-}-lan"
+	in_ns "$nat" ip link set "${nat#shadow-}-lan" up
+	in_ns "$nat" sysctl -qw net.ipv4.ip_forward=1
+	in_ns "$lan" ip addr add "$net.2/24" dev "${lan#shadow-}-eth"
+	in_ns "$lan" ip link set "${lan#shadow-}-eth" up
+	in_ns "$lan" ip link set lo up
+	in_ns "$lan" ip route add default via "$net.1"
+	if [ "$mode" = symmetric ]; then
+		in_ns "$nat" iptables -t nat -A POSTROUTING -o "${nat#shadow-}-wan" -j MASQUERADE --random-fully
+	else
+		in_ns "$nat" iptables -t nat -A POSTROUTING -o "${nat#shadow-}-wan" -j MASQUERADE
+	fi
+	# Drop unsolicited inbound traffic like a home router would
+	in_ns "$nat" iptables -A FORWARD -i "${nat#shadow-}-wan" -m state --state ESTABLISHED,RELATED -j ACCEPT
+	in_ns "$nat" iptables -A FORWARD -i "${nat#shadow-}-wan" -j DROP
+}
+
+up() {
+	local mode=${1:-cone}
+	for ns in $NS_RELAY $NS_NAT_A $NS_NAT_B $NS_ALICE $NS_BOB; do
+		ip netns add "$ns"
+	done
+	ip link add "$BRIDGE" type bridge
+	ip link set "$BRIDGE" up
+	link_to_bridge $NS_RELAY relay-eth 10.10.0.1
+	nat_router $NS_NAT_A $NS_ALICE 10.10.0.2 192.168.1 "$mode"
+	nat_router $NS_NAT_B $NS_BOB 10.10.0.3 192.168.2 "$mode"
+	echo "Topology up ($mode NAT)."
+}
+
+down() {
+	for ns in $NS_RELAY $NS_NAT_A $NS_NAT_B $NS_ALICE $NS_BOB; do
+		ip netns del "$ns" 2>/dev/null || true
+	done
+	ip link del "$BRIDGE" 2>/dev/null || true
+	echo "Topology down."
+}
+
+run() {
+	mkdir -p "$BIN"
+	go build -o "$BIN/relay" ./cmd/relay
+	go build -o "$BIN/cli" ./cmd/cli
+	local workdir
+	workdir=$(mktemp -d)
+	mkdir -p "$workdir/relay" "$workdir/alice" "$workdir/bob"
+	local relay cli
+	relay=$(realpath "$BIN/relay")
+	cli=$(realpath "$BIN/cli")
+	tmux new-session -d -s shadow-nat \
+		"cd $workdir/relay && ip netns exec $NS_RELAY $relay -tcp /ip4/10.10.0.1/tcp/4001 -quic /ip4/10.10.0.1/udp/4001/quic-v1 -ws ''"
+	sleep 2
+	local addr
+	addr=$(grep /tcp/ "$workdir/relay/data/relay.addr" | head -n1)
+	tmux split-window -t shadow-nat "cd $workdir/alice && ip netns exec $NS_ALICE $cli -name alice -relay $addr"
+	tmux split-window -t shadow-nat "cd $workdir/bob && ip netns exec $NS_BOB $cli -name bob -relay $addr"
+	tmux select-layout -t shadow-nat even-vertical
+	echo "Relay at $addr; use /discover, /msg and /peers to watch the connection type change."
+	tmux attach -t shadow-nat
+}
+
+case "${1:-}" in
+up) up "${2:-}" ;;
+down) down ;;
+run) run ;;
+*)
+	echo "usage: $0 up [cone|symmetric] | run | down" >&2
+	exit 1
+	;;
+esac
@@ -0,0 +1,63 @@
+#!/usr/bin/env bash
+# onion-relays.sh - several relays on localhost for trying onion routing.
+#
+# Starts COUNT relays (default 3) on 127.0.0.1, writes their addresses to a
+# shared directory file, makes every relay load it with SIGHUP, then starts
+# alice and bob in tmux panes, both using the directory for their paths.
+# Bob keeps his reservation on the last relay, alice on the first.
+#
+# Usage (from the repo root):
+#   scripts/onion-relays.sh [count]
+#
+# In alice's pane, after bob wrote to her once (so she knows his relay):
+#   /onion @bob 3
+#   /msg @bob hello
+set -euo pipefail
+
+COUNT=${1:-3}
+BASE_PORT=${BASE_PORT:-4101}
+BIN=${BIN:-./bin}
+
+mkdir -p "$BIN"
+go build -o "$BIN/relay" ./cmd/relay
+go build -o "$BIN/cli" ./cmd/cli
+relay=$(realpath "$BIN/relay")
+cli=$(realpath "$BIN/cli")
+
+workdir=$(mktemp -d)
+directory=$workdir/directory
+: >"$directory"
+
+pids=()
+cleanup() {
+	kill "${pids[@]}" 2>/dev/null || true
+}
+trap cleanup EXIT
+
+for i in $(seq 1 "$COUNT"); do
+	mkdir -p "$workdir/relay$i"
+	(cd "$workdir/relay$i" && exec "$relay" -tcp "/ip4/127.0.0.1/tcp/$((BASE_PORT + i - 1))" -quic '' -ws '' \
+		-onion-dir "$directory" >relay.log 2>&1) &
+	pids+=($!)
+done
+
+addrs=()
+for i in $(seq 1 "$COUNT"); do
+	addrfile=$workdir/relay$i/data/relay.addr
+	for _ in $(seq 1 50); do
+		[ -s "$addrfile" ] && break
+		sleep 0.1
+	done
+	addrs+=("$(grep /tcp/ "$addrfile" | head -n1)")
+done
+printf '%s\n' "${addrs[@]}" >"$directory"
+kill -HUP "${pids[@]}"
+
+mkdir -p "$workdir/alice" "$workdir/bob"
+tmux new-session -d -s shadow-onion \
+	"cd $workdir/alice && $cli -name alice -relays 1 -relay ${addrs[0]} -onion-dir $directory"
+tmux split-window -t shadow-onion \
+	"cd $workdir/bob && $cli -name bob -relays 1 -relay ${addrs[$((COUNT - 1))]} -onion-dir $directory"
+tmux select-layout -t shadow-onion even-vertical
+echo "$COUNT relays up, directory in $directory, logs in $workdir/relay*/relay.log."
+tmux attach -t shadow-onion